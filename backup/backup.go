@@ -0,0 +1,199 @@
+// Package backup takes snapshots of a live SQLite database and restores them.
+//
+// the database runs in WAL mode, so copying the file while gonic is running can give a broken copy.
+// snapshots are made with VACUUM INTO instead, which writes a consistent copy from inside a read transaction
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+var (
+	ErrInvalidBasePath = errors.New("invalid base path")
+	ErrNotSQLite       = errors.New("only sqlite databases can be backed up, use pg_dump for postgres")
+	ErrNotSnapshot     = errors.New("not an sqlite database")
+)
+
+const (
+	snapshotPrefix     = "gonic-"
+	snapshotExt        = ".db"
+	snapshotTimeFormat = "20060102T150405.000"
+)
+
+type Snapshot struct {
+	Name string
+	Path string
+	Time time.Time
+	Size int64
+}
+
+type Backups struct {
+	db       *db.DB
+	basePath string
+	keep     int
+	mu       sync.Mutex
+}
+
+// New returns Backups which writes snapshots of dbc to basePath. only the newest keep snapshots are kept,
+// or all of them if keep is 0
+func New(dbc *db.DB, basePath string, keep int) (*Backups, error) {
+	if basePath == "" {
+		return nil, ErrInvalidBasePath
+	}
+	if err := os.MkdirAll(basePath, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create base path: %w", err)
+	}
+	return &Backups{
+		db:       dbc,
+		basePath: basePath,
+		keep:     keep,
+	}, nil
+}
+
+func (b *Backups) BasePath() string {
+	return b.basePath
+}
+
+// Snapshot writes a new snapshot of the database and removes the old ones
+func (b *Backups) Snapshot() (*Snapshot, error) {
+	if !b.db.IsSQLite() {
+		return nil, ErrNotSQLite
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().UTC()
+	path := filepath.Join(b.basePath, snapshotPrefix+now.Format(snapshotTimeFormat)+snapshotExt)
+	// write to a temporary name first, so that an unfinished snapshot is never listed
+	tmpPath := path + ".tmp"
+	_ = os.Remove(tmpPath)
+	if err := b.db.Exec(`VACUUM INTO ?`, tmpPath).Error; err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, fmt.Errorf("vacuum into: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("rename snapshot: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat snapshot: %w", err)
+	}
+
+	if err := b.prune(); err != nil {
+		return nil, fmt.Errorf("prune: %w", err)
+	}
+	return &Snapshot{Name: filepath.Base(path), Path: path, Time: now, Size: info.Size()}, nil
+}
+
+// List returns the snapshots in the base path, newest first
+func (b *Backups) List() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(b.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("read base path: %w", err)
+	}
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		t, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotExt))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat %q: %w", name, err)
+		}
+		snapshots = append(snapshots, &Snapshot{
+			Name: name,
+			Path: filepath.Join(b.basePath, name),
+			Time: t,
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+func (b *Backups) prune() error {
+	if b.keep <= 0 {
+		return nil
+	}
+	snapshots, err := b.List()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) <= b.keep {
+		return nil
+	}
+	for _, s := range snapshots[b.keep:] {
+		if err := os.Remove(s.Path); err != nil {
+			return fmt.Errorf("remove %q: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Restore replaces the SQLite database at dbPath with the snapshot at snapshotPath. gonic must not be running.
+// the caller should migrate the restored database, since the snapshot may be from an older version
+func Restore(snapshotPath, dbPath string) error {
+	src, err := os.Open(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer src.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(src, header); err != nil || !bytes.Equal(header, sqliteHeader) {
+		return ErrNotSnapshot
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek snapshot: %w", err)
+	}
+
+	// copy next to the database then rename, so that a failed copy leaves the old database in place
+	tmpPath := dbPath + ".restore"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("create temp database: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("copy snapshot: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("close temp database: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("replace database: %w", err)
+	}
+	// the old write ahead log belongs to the old database. it's only removed once that's gone, so a failed rename
+	// leaves the old database whole
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", suffix, err)
+		}
+	}
+	return nil
+}
+
+var sqliteHeader = []byte("SQLite format 3\x00")
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/deps"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "gonic.db")
+
+	dbc, err := db.New(dbPath, deps.DBDriverOptions(), false)
+	require.NoError(t, err)
+	t.Cleanup(func() { dbc.Close() })
+	require.NoError(t, dbc.Migrate(db.MigrationContext{}))
+	require.NoError(t, dbc.Create(&db.User{Name: "first", Password: "password"}).Error)
+
+	backups, err := New(dbc, filepath.Join(dir, "backups"), 2)
+	require.NoError(t, err)
+
+	first, err := backups.Snapshot()
+	require.NoError(t, err)
+	require.NoError(t, dbc.Create(&db.User{Name: "second", Password: "password"}).Error)
+	second, err := backups.Snapshot()
+	require.NoError(t, err)
+	third, err := backups.Snapshot()
+	require.NoError(t, err)
+
+	snapshots, err := backups.List()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	require.Equal(t, third.Path, snapshots[0].Path)
+	require.Equal(t, second.Path, snapshots[1].Path)
+	require.NoFileExists(t, first.Path)
+
+	restorePath := filepath.Join(dir, "restored.db")
+	require.NoError(t, Restore(second.Path, restorePath))
+
+	restored, err := db.New(restorePath, deps.DBDriverOptions(), false)
+	require.NoError(t, err)
+	t.Cleanup(func() { restored.Close() })
+	require.NoError(t, restored.Migrate(db.MigrationContext{}))
+
+	var names []string
+	require.NoError(t, restored.Model(db.User{}).Order("id").Pluck("name", &names).Error)
+	require.Equal(t, []string{"admin", "first", "second"}, names)
+}
+
+func TestRestoreNotSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	notSnapshot := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(notSnapshot, []byte("hello"), 0o600))
+
+	dbPath := filepath.Join(dir, "gonic.db")
+	require.NoError(t, os.WriteFile(dbPath, []byte("existing"), 0o600))
+
+	require.ErrorIs(t, Restore(notSnapshot, dbPath), ErrNotSnapshot)
+
+	existing, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	require.Equal(t, "existing", string(existing))
+}
+
+func TestRestoreFailedKeepsWAL(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "snapshot.db")
+	require.NoError(t, os.WriteFile(snapshot, append([]byte("SQLite format 3\x00"), "pages"...), 0o600))
+
+	// a directory in the way, so the rename fails
+	dbPath := filepath.Join(dir, "gonic.db")
+	require.NoError(t, os.MkdirAll(filepath.Join(dbPath, "in-the-way"), 0o700))
+	require.NoError(t, os.WriteFile(dbPath+"-wal", []byte("wal"), 0o600))
+
+	require.Error(t, Restore(snapshot, dbPath))
+	require.FileExists(t, dbPath+"-wal")
+	require.NoFileExists(t, dbPath+".restore")
+}
@@ -0,0 +1,240 @@
+// Package cachewarm transcodes a user's starred music or a playlist ahead of time, so that it's already in the
+// transcode cache when a client asks for it. for example before syncing for offline use.
+//
+// warming runs in the background one track at a time, and with low priority so live streams go first. priority only
+// matters with a transcode concurrency limit. without one, warming is at most one transcode alongside the live ones
+package cachewarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/transcode"
+)
+
+var (
+	ErrNoProfile      = errors.New("no transcode profile for this user and client")
+	ErrNotYours       = errors.New("playlist belongs to another user")
+	ErrAlreadyWarming = errors.New("already warming")
+)
+
+// keepFinished is how many finished jobs are kept to show
+const keepFinished = 10
+
+type Warmer struct {
+	dbc           *db.DB
+	playlistStore *playlist.Store
+	transcoder    transcode.Transcoder
+
+	mu     sync.Mutex
+	nextID int
+	jobs   []*job // newest first
+}
+
+func New(dbc *db.DB, playlistStore *playlist.Store, transcoder transcode.Transcoder) *Warmer {
+	return &Warmer{
+		dbc:           dbc,
+		playlistStore: playlistStore,
+		transcoder:    transcoder,
+	}
+}
+
+// Job is a snapshot of the progress of warming
+type Job struct {
+	ID        int
+	UserID    int
+	User      string
+	Client    string
+	Name      string // what's being warmed, "starred" or the playlist's name
+	Profile   string
+	Total     int
+	Done      int // transcoded, or already in the cache
+	Failed    int
+	Running   bool
+	Started   time.Time
+	Finished  time.Time // zero while running
+	Cancelled bool
+}
+
+type job struct {
+	Job
+	cancel context.CancelFunc
+}
+
+// WarmStarred transcodes the tracks of the user's starred albums, then their starred tracks
+func (w *Warmer) WarmStarred(user *db.User, client string) (Job, error) {
+	var tracks []*db.Track
+	err := w.dbc.
+		Preload("Album").
+		Joins("JOIN album_stars ON album_stars.album_id=tracks.album_id").
+		Where("album_stars.user_id=?", user.ID).
+		Order("album_stars.star_date, tracks.album_id, tracks.tag_disc_number, tracks.tag_track_number").
+		Find(&tracks).
+		Error
+	if err != nil {
+		return Job{}, fmt.Errorf("find tracks of starred albums: %w", err)
+	}
+	var starredTracks []*db.Track
+	err = w.dbc.
+		Preload("Album").
+		Joins("JOIN track_stars ON track_stars.track_id=tracks.id").
+		Where("track_stars.user_id=?", user.ID).
+		Order("track_stars.star_date").
+		Find(&starredTracks).
+		Error
+	if err != nil {
+		return Job{}, fmt.Errorf("find starred tracks: %w", err)
+	}
+
+	var paths []string
+	for _, track := range append(tracks, starredTracks...) {
+		if path := track.AbsPath(); !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return w.start(user, client, "starred", paths)
+}
+
+// WarmPlaylist transcodes the items of a playlist, which must be the user's own or public
+func (w *Warmer) WarmPlaylist(user *db.User, client string, playlistPath string) (Job, error) {
+	pl, err := w.playlistStore.Read(playlistPath)
+	if err != nil {
+		return Job{}, fmt.Errorf("read playlist: %w", err)
+	}
+	if pl.UserID != user.ID && !pl.IsPublic {
+		return Job{}, ErrNotYours
+	}
+	return w.start(user, client, pl.Name, pl.Items)
+}
+
+func (w *Warmer) start(user *db.User, client string, name string, paths []string) (Job, error) {
+	// warming isn't for any one address, so only rules for any network apply
+	pref, err := w.dbc.GetTranscodePreference(user.ID, client, netip.Addr{})
+	if err != nil {
+		return Job{}, err
+	}
+	if pref == nil || pref.Profile == db.TranscodeRuleRaw {
+		return Job{}, ErrNoProfile
+	}
+	profile, ok := transcode.LookupProfile(pref.Profile)
+	if !ok {
+		return Job{}, fmt.Errorf("unknown transcode user profile %q", pref.Profile)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		Job: Job{
+			UserID:  user.ID,
+			User:    user.Name,
+			Client:  client,
+			Name:    name,
+			Profile: pref.Profile,
+			Total:   len(paths),
+			Running: true,
+			Started: time.Now(),
+		},
+		cancel: cancel,
+	}
+
+	w.mu.Lock()
+	for _, o := range w.jobs {
+		if o.Running && o.UserID == j.UserID && o.Name == j.Name && o.Profile == j.Profile {
+			w.mu.Unlock()
+			cancel()
+			return Job{}, ErrAlreadyWarming
+		}
+	}
+	w.nextID++
+	j.ID = w.nextID
+	w.jobs = append([]*job{j}, w.jobs...)
+	snapshot := j.Job
+	w.mu.Unlock()
+
+	go w.run(ctx, j, profile, paths)
+	return snapshot, nil
+}
+
+func (w *Warmer) run(ctx context.Context, j *job, profile transcode.Profile, paths []string) {
+	defer j.cancel()
+
+	ctx = transcode.WithLowPriority(transcode.WithUser(ctx, j.User))
+	cacher, _ := w.transcoder.(transcode.CacheOpener)
+
+	for _, path := range paths {
+		err := w.warm(ctx, cacher, profile, path)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			log.Printf("error warming transcode cache with %q: %v", path, err)
+		}
+
+		w.mu.Lock()
+		if err != nil {
+			j.Failed++
+		} else {
+			j.Done++
+		}
+		w.mu.Unlock()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	j.Running = false
+	j.Finished = time.Now()
+	j.Cancelled = ctx.Err() != nil
+	w.pruneLocked()
+}
+
+func (w *Warmer) warm(ctx context.Context, cacher transcode.CacheOpener, profile transcode.Profile, path string) error {
+	if cacher != nil {
+		if cf, err := cacher.OpenCached(profile, path); err == nil {
+			return cf.Close()
+		}
+	}
+	return w.transcoder.Transcode(ctx, profile, path, io.Discard)
+}
+
+// Cancel stops a running job, returning false if there's no such job or it's finished
+func (w *Warmer) Cancel(id int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, j := range w.jobs {
+		if j.ID == id && j.Running {
+			j.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// Jobs lists the running and recently finished jobs, newest first
+func (w *Warmer) Jobs() []Job {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	jobs := make([]Job, 0, len(w.jobs))
+	for _, j := range w.jobs {
+		jobs = append(jobs, j.Job)
+	}
+	return jobs
+}
+
+func (w *Warmer) pruneLocked() {
+	var finished int
+	w.jobs = slices.DeleteFunc(w.jobs, func(j *job) bool {
+		if j.Running {
+			return false
+		}
+		finished++
+		return finished > keepFinished
+	})
+}
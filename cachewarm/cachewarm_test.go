@@ -0,0 +1,165 @@
+package cachewarm
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func TestWarmStarred(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	user := m.DB().GetUserByName("admin")
+	require.NotNil(t, user)
+
+	var album db.Album
+	require.NoError(t, m.DB().Where("tag_title IS NOT NULL").Preload("Tracks").First(&album).Error)
+	require.NotEmpty(t, album.Tracks)
+	require.NoError(t, m.DB().Create(&db.AlbumStar{UserID: user.ID, AlbumID: album.ID, StarDate: time.Now()}).Error)
+
+	transcoder := &recordTranscoder{}
+	warmer := New(m.DB(), nil, transcoder)
+
+	// no profile for the client, so nothing to warm
+	_, err := warmer.WarmStarred(user, "client")
+	require.ErrorIs(t, err, ErrNoProfile)
+
+	require.NoError(t, m.DB().Create(&db.TranscodePreference{UserID: user.ID, Client: "client", Profile: "mp3"}).Error)
+	job, err := warmer.WarmStarred(user, "client")
+	require.NoError(t, err)
+	require.Equal(t, len(album.Tracks), job.Total)
+	require.Equal(t, "starred", job.Name)
+	require.Equal(t, "mp3", job.Profile)
+
+	job = waitFinished(t, warmer, job.ID)
+	require.Equal(t, len(album.Tracks), job.Done)
+	require.Zero(t, job.Failed)
+	require.False(t, job.Cancelled)
+	require.Len(t, transcoder.paths(), len(album.Tracks))
+}
+
+func TestWarmPlaylist(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	user := m.DB().GetUserByName("admin")
+	require.NotNil(t, user)
+	require.NoError(t, m.DB().Create(&db.TranscodePreference{UserID: user.ID, Client: "*", Profile: "opus"}).Error)
+
+	var tracks []*db.Track
+	require.NoError(t, m.DB().Preload("Album").Limit(3).Find(&tracks).Error)
+	var items []string
+	for _, track := range tracks {
+		items = append(items, track.AbsPath())
+	}
+
+	store, err := playlist.NewStore(t.TempDir())
+	require.NoError(t, err)
+	path := playlist.NewPath(user.ID, "flight")
+	require.NoError(t, store.Write(path, &playlist.Playlist{UserID: user.ID, Name: "flight", Items: items}))
+
+	other := &db.User{Name: "other", Password: "password"}
+	require.NoError(t, m.DB().Create(other).Error)
+
+	transcoder := &recordTranscoder{}
+	warmer := New(m.DB(), store, transcoder)
+
+	_, err = warmer.WarmPlaylist(other, "client", path)
+	require.ErrorIs(t, err, ErrNotYours)
+
+	job, err := warmer.WarmPlaylist(user, "client", path)
+	require.NoError(t, err)
+	require.Equal(t, "flight", job.Name)
+
+	job = waitFinished(t, warmer, job.ID)
+	require.Equal(t, 3, job.Done)
+	require.Equal(t, items, transcoder.paths())
+}
+
+func TestWarmCancel(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	user := m.DB().GetUserByName("admin")
+	require.NotNil(t, user)
+	require.NoError(t, m.DB().Create(&db.TranscodePreference{UserID: user.ID, Client: "*", Profile: "mp3"}).Error)
+	require.NoError(t, m.DB().Exec("INSERT INTO album_stars (user_id, album_id, star_date) SELECT ?, id, ? FROM albums", user.ID, time.Now()).Error)
+
+	transcoder := &recordTranscoder{block: true}
+	warmer := New(m.DB(), nil, transcoder)
+
+	job, err := warmer.WarmStarred(user, "client")
+	require.NoError(t, err)
+	require.Greater(t, job.Total, 1)
+
+	_, err = warmer.WarmStarred(user, "client")
+	require.ErrorIs(t, err, ErrAlreadyWarming)
+
+	require.Eventually(t, func() bool { return len(transcoder.paths()) == 1 }, time.Second, time.Millisecond)
+	require.True(t, warmer.Cancel(job.ID))
+
+	job = waitFinished(t, warmer, job.ID)
+	require.True(t, job.Cancelled)
+	require.Zero(t, job.Done)
+	require.Zero(t, job.Failed)
+	require.False(t, warmer.Cancel(job.ID))
+	require.Len(t, transcoder.paths(), 1)
+}
+
+func waitFinished(t *testing.T, warmer *Warmer, id int) Job {
+	t.Helper()
+	var job Job
+	require.Eventually(t, func() bool {
+		for _, j := range warmer.Jobs() {
+			if j.ID == id {
+				job = j
+			}
+		}
+		return !job.Finished.IsZero()
+	}, 2*time.Second, time.Millisecond)
+	return job
+}
+
+// recordTranscoder records what it was asked to transcode, and if block is set waits to be cancelled
+type recordTranscoder struct {
+	block bool
+
+	mu sync.Mutex
+	in []string
+}
+
+func (rt *recordTranscoder) Transcode(ctx context.Context, _ transcode.Profile, in string, _ io.Writer) error {
+	rt.mu.Lock()
+	rt.in = append(rt.in, in)
+	rt.mu.Unlock()
+	if rt.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (rt *recordTranscoder) paths() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]string(nil), rt.in...)
+}
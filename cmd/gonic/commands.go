@@ -0,0 +1,469 @@
+//nolint:forbidigo
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mmcdole/gofeed"
+
+	"go.senan.xyz/gonic/backup"
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/deps"
+	"go.senan.xyz/gonic/importer"
+	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/podcast"
+	"go.senan.xyz/gonic/scanner"
+)
+
+// commands run instead of the server when they're given after the flags, eg. `gonic -db-path gonic.db user list`.
+// they're for scripting, like provisioning a container, so they use the same config as the server
+var commands = map[string]func(conf *commandConfig, args []string) error{
+	"backup":   cmdBackup,
+	"restore":  cmdRestore,
+	"import":   cmdImport,
+	"user":     cmdUser,
+	"scan":     cmdScan,
+	"podcast":  cmdPodcast,
+	"db":       cmdDB,
+	"playlist": cmdPlaylist,
+}
+
+func commandNames() string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+type commandConfig struct {
+	dbURL        string
+	migrationCtx db.MigrationContext
+
+	backupPath    string
+	backupKeep    int
+	playlistsPath string
+	podcastPath   string
+
+	musicPaths         pathAliases
+	excludePattern     string
+	scanEmbeddedCover  bool
+	multiValueSettings map[scanner.Tag]scanner.MultiValueSetting
+}
+
+// openDB opens and migrates the database
+func (c *commandConfig) openDB() (*db.DB, error) {
+	dbc, err := db.New(c.dbURL, deps.DBDriverOptions(), false)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if err := dbc.Migrate(c.migrationCtx); err != nil {
+		dbc.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return dbc, nil
+}
+
+// subcommand runs one of subcommands, which are the first of args
+func subcommand(name string, args []string, subcommands map[string]func(args []string) error) error {
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	if len(args) == 0 {
+		return fmt.Errorf("please provide a %s command, one of %s", name, strings.Join(names, ", "))
+	}
+	run, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown %s command %q, expected one of %s", name, args[0], strings.Join(names, ", "))
+	}
+	return run(args[1:])
+}
+
+// cmdBackup writes a snapshot of the database to the backup path
+func cmdBackup(conf *commandConfig, _ []string) error {
+	dbc, err := db.New(conf.dbURL, deps.DBDriverOptions(), false)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer dbc.Close()
+
+	backups, err := backup.New(dbc, conf.backupPath, conf.backupKeep)
+	if err != nil {
+		return err
+	}
+	snapshot, err := backups.Snapshot()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", snapshot.Path)
+	return nil
+}
+
+// cmdRestore replaces the database with a snapshot, then migrates it. the snapshot is either a path or the
+// name of a snapshot in the backup path
+func cmdRestore(conf *commandConfig, args []string) error {
+	if !db.IsSQLite(conf.dbURL) {
+		return backup.ErrNotSQLite
+	}
+	dbPath := db.SQLitePath(conf.dbURL)
+	if len(args) == 0 {
+		return errors.New("please provide a snapshot to restore")
+	}
+	snapshot := args[0]
+	if _, err := os.Stat(snapshot); errors.Is(err, os.ErrNotExist) && conf.backupPath != "" {
+		snapshot = filepath.Join(conf.backupPath, snapshot)
+	}
+	if err := backup.Restore(snapshot, dbPath); err != nil {
+		return err
+	}
+
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	fmt.Printf("restored %s to %s\n", snapshot, dbPath)
+	return nil
+}
+
+// cmdImport imports the users, annotations, play counts, and playlists from another server's database. the
+// library should be scanned first, since the other server's files are matched against it
+func cmdImport(conf *commandConfig, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "apply the import instead of only reporting what it would do")
+	airsonicPlaysUser := flags.String("airsonic-plays-user", "admin", "user to give Airsonic's play counts to, since it doesn't count per user")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: gonic [flags] import [-apply] [-airsonic-plays-user <name>] navidrome|airsonic <path>\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("please provide a kind of server and the path to its database")
+	}
+
+	var src *importer.Source
+	var err error
+	switch kind, srcPath := flags.Arg(0), flags.Arg(1); kind {
+	case "navidrome":
+		src, err = importer.ReadNavidrome(srcPath)
+	case "airsonic":
+		src, err = importer.ReadAirsonic(srcPath, *airsonicPlaysUser)
+	default:
+		return fmt.Errorf("unknown server %q, expected one of navidrome, airsonic", kind)
+	}
+	if err != nil {
+		return fmt.Errorf("read source: %w", err)
+	}
+
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	var playlistStore *playlist.Store
+	if conf.playlistsPath != "" {
+		if playlistStore, err = playlist.NewStore(conf.playlistsPath); err != nil {
+			return fmt.Errorf("create playlist store: %w", err)
+		}
+	}
+
+	report, err := importer.Import(dbc, playlistStore, src, !*apply)
+	if err != nil {
+		return err
+	}
+	report.Write(os.Stdout)
+	if !*apply {
+		fmt.Printf("run again with -apply to import\n")
+	}
+	return nil
+}
+
+// cmdUser manages users. passwords which aren't given as arguments are read from stdin, so that they can be
+// kept out of the process list
+func cmdUser(conf *commandConfig, args []string) error {
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	findUser := func(name string) (*db.User, error) {
+		user := dbc.GetUserByName(name)
+		if user == nil {
+			return nil, fmt.Errorf("no user %q", name)
+		}
+		return user, nil
+	}
+
+	return subcommand("user", args, map[string]func(args []string) error{
+		"add": func(args []string) error {
+			flags := flag.NewFlagSet("user add", flag.ExitOnError)
+			admin := flags.Bool("admin", false, "make the user an admin")
+			_ = flags.Parse(args)
+			if flags.NArg() == 0 {
+				return errors.New("usage: user add [-admin] <name> [password]")
+			}
+			password, err := argOrStdin(flags.Args(), 1, "password")
+			if err != nil {
+				return err
+			}
+			user := db.User{Name: flags.Arg(0), Password: password, IsAdmin: *admin}
+			if err := dbc.Create(&user).Error; err != nil {
+				return fmt.Errorf("create user %q: %w", user.Name, err)
+			}
+			fmt.Printf("created user %q\n", user.Name)
+			return nil
+		},
+		"list": func([]string) error {
+			var users []*db.User
+			if err := dbc.Order("name").Find(&users).Error; err != nil {
+				return fmt.Errorf("find users: %w", err)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, u := range users {
+				role := "user"
+				if u.IsAdmin {
+					role = "admin"
+				}
+				fmt.Fprintf(tw, "%s\t%s\n", u.Name, role)
+			}
+			return tw.Flush()
+		},
+		"passwd": func(args []string) error {
+			if len(args) == 0 {
+				return errors.New("usage: user passwd <name> [password]")
+			}
+			user, err := findUser(args[0])
+			if err != nil {
+				return err
+			}
+			if user.Password, err = argOrStdin(args, 1, "password"); err != nil {
+				return err
+			}
+			if err := dbc.Save(user).Error; err != nil {
+				return fmt.Errorf("save user: %w", err)
+			}
+			fmt.Printf("changed password of %q\n", user.Name)
+			return nil
+		},
+		"delete": func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("usage: user delete <name>")
+			}
+			user, err := findUser(args[0])
+			if err != nil {
+				return err
+			}
+			if user.IsAdmin {
+				return errors.New("can't delete an admin user")
+			}
+			if err := dbc.Delete(user).Error; err != nil {
+				return fmt.Errorf("delete user: %w", err)
+			}
+			fmt.Printf("deleted user %q\n", user.Name)
+			return nil
+		},
+	})
+}
+
+// cmdScan scans the music paths, or only some directories in them
+func cmdScan(conf *commandConfig, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	full := flags.Bool("full", false, "rescan files which haven't changed")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: gonic [flags] scan [-full] [path...]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if len(conf.musicPaths) == 0 {
+		return errors.New("please provide a music directory")
+	}
+	if _, err := regexp.Compile(conf.excludePattern); err != nil {
+		return fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+	var musicPaths []string
+	for _, p := range conf.musicPaths {
+		musicPath, err := validatePath(p.path)
+		if err != nil {
+			return fmt.Errorf("checking music dir %q: %w", p.path, err)
+		}
+		musicPaths = append(musicPaths, musicPath)
+	}
+
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	scannr := scanner.New(musicPaths, dbc, conf.multiValueSettings, deps.TagReader, conf.excludePattern, conf.scanEmbeddedCover)
+	st, err := scannr.ScanAndClean(scanner.ScanOptions{IsFull: *full, Paths: flags.Args()})
+	if st != nil {
+		fmt.Printf("scanned %d tracks, %d new\n", st.SeenTracks(), st.SeenTracksNew())
+	}
+	return err
+}
+
+// cmdPodcast adds and refreshes podcasts. new episodes are downloaded by the server
+func cmdPodcast(conf *commandConfig, args []string) error {
+	podcastPath, err := validatePath(conf.podcastPath)
+	if err != nil {
+		return fmt.Errorf("checking podcast directory: %w", err)
+	}
+
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	podcasts := podcast.New(dbc, podcastPath, deps.TagReader)
+
+	return subcommand("podcast", args, map[string]func(args []string) error{
+		"add": func(args []string) error {
+			if len(args) == 0 {
+				return errors.New("usage: podcast add <rss url>...")
+			}
+			for _, rssURL := range args {
+				feed, err := gofeed.NewParser().ParseURL(rssURL)
+				if err != nil {
+					return fmt.Errorf("parse feed %q: %w", rssURL, err)
+				}
+				p, err := podcasts.AddNewPodcast(rssURL, feed)
+				if err != nil {
+					return fmt.Errorf("add podcast %q: %w", rssURL, err)
+				}
+				fmt.Printf("added podcast %q\n", p.Title)
+			}
+			return nil
+		},
+		"refresh": func([]string) error {
+			return podcasts.RefreshPodcasts()
+		},
+	})
+}
+
+// cmdDB maintains the database
+func cmdDB(conf *commandConfig, args []string) error {
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	return subcommand("db", args, map[string]func(args []string) error{
+		"migrate": func([]string) error {
+			// openDB migrates
+			fmt.Printf("migrated %s\n", conf.dbURL)
+			return nil
+		},
+		"vacuum": func([]string) error {
+			if err := dbc.Exec("VACUUM").Error; err != nil {
+				return fmt.Errorf("vacuum: %w", err)
+			}
+			fmt.Printf("vacuumed %s\n", conf.dbURL)
+			return nil
+		},
+		"integrity-check": func([]string) error {
+			if !dbc.IsSQLite() {
+				return errors.New("integrity checks are only supported for SQLite databases")
+			}
+			var problems []string
+			if err := dbc.Raw("PRAGMA integrity_check").Pluck("integrity_check", &problems).Error; err != nil {
+				return fmt.Errorf("integrity check: %w", err)
+			}
+			if len(problems) == 1 && problems[0] == "ok" {
+				fmt.Printf("ok\n")
+				return nil
+			}
+			for _, p := range problems {
+				fmt.Println(p)
+			}
+			return fmt.Errorf("found %d problems", len(problems))
+		},
+	})
+}
+
+// cmdPlaylist imports m3u files into the playlists path. relative paths in the files are made absolute
+func cmdPlaylist(conf *commandConfig, args []string) error {
+	store, err := playlist.NewStore(conf.playlistsPath)
+	if err != nil {
+		return fmt.Errorf("create playlist store: %w", err)
+	}
+
+	dbc, err := conf.openDB()
+	if err != nil {
+		return err
+	}
+	defer dbc.Close()
+
+	return subcommand("playlist", args, map[string]func(args []string) error{
+		"import": func(args []string) error {
+			flags := flag.NewFlagSet("playlist import", flag.ExitOnError)
+			public := flags.Bool("public", false, "make the playlists public")
+			_ = flags.Parse(args)
+			if flags.NArg() < 2 {
+				return errors.New("usage: playlist import [-public] <user> <file.m3u>...")
+			}
+			user := dbc.GetUserByName(flags.Arg(0))
+			if user == nil {
+				return fmt.Errorf("no user %q", flags.Arg(0))
+			}
+			for _, m3uPath := range flags.Args()[1:] {
+				m3uPath, err := filepath.Abs(m3uPath)
+				if err != nil {
+					return fmt.Errorf("make absolute: %w", err)
+				}
+				pl, err := playlist.ReadFile(m3uPath)
+				if err != nil {
+					return fmt.Errorf("read %q: %w", m3uPath, err)
+				}
+				for i, item := range pl.Items {
+					if !filepath.IsAbs(item) {
+						pl.Items[i] = filepath.Join(filepath.Dir(m3uPath), item)
+					}
+				}
+				pl.UserID = user.ID
+				pl.IsPublic = pl.IsPublic || *public
+				if err := store.Write(playlist.NewPath(user.ID, pl.Name), pl); err != nil {
+					return fmt.Errorf("write %q: %w", pl.Name, err)
+				}
+				fmt.Printf("imported %q with %d items\n", pl.Name, len(pl.Items))
+			}
+			return nil
+		},
+	})
+}
+
+// argOrStdin returns args[i], or reads a line from stdin if there's no such argument
+func argOrStdin(args []string, i int, name string) (string, error) {
+	if i < len(args) {
+		return args[i], nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		if err != nil {
+			return "", fmt.Errorf("read %s from stdin: %w", name, err)
+		}
+		return "", fmt.Errorf("%s can't be empty", name)
+	}
+	return line, nil
+}
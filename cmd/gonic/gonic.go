@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
@@ -25,13 +26,14 @@ import (
 	_ "image/png"
 
 	"github.com/google/shlex"
-	"github.com/gorilla/securecookie"
 	"github.com/sentriz/gormstore"
 	"golang.org/x/sync/errgroup"
 
 	"go.senan.xyz/flagconf"
 
 	"go.senan.xyz/gonic"
+	"go.senan.xyz/gonic/backup"
+	"go.senan.xyz/gonic/cachewarm"
 	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/deps"
 	"go.senan.xyz/gonic/handlerutil"
@@ -66,6 +68,11 @@ func main() {
 	confPlaylistsPath := flag.String("playlists-path", "", "path to your list of new or existing m3u playlists that gonic can manage")
 
 	confDBPath := flag.String("db-path", "gonic.db", "path to database (optional)")
+	confDBURL := flag.String("db-url", "", "postgres:// url of a database to use instead of -db-path (optional)")
+
+	confBackupPath := flag.String("backup-path", "", "path to store database snapshots (optional)")
+	confBackupIntervalMins := flag.Uint("backup-interval", 0, "interval (in minutes) to automatically snapshot the database (optional)")
+	confBackupKeep := flag.Uint("backup-keep", 7, "number of database snapshots to keep (0 = all) (optional)")
 
 	confScanIntervalMins := flag.Uint("scan-interval", 0, "interval (in minutes) to automatically scan music (optional)")
 	confScanAtStart := flag.Bool("scan-at-start-enabled", false, "whether to perform an initial scan at startup (optional)")
@@ -76,6 +83,8 @@ func main() {
 	confJukeboxMPVExtraArgs := flag.String("jukebox-mpv-extra-args", "", "extra command line arguments to pass to the jukebox mpv daemon (optional)")
 
 	confProxyPrefix := flag.String("proxy-prefix", "", "url path prefix to use if behind proxy. eg '/gonic' (optional)")
+	var confTrustedProxies trustedProxies
+	flag.Var(&confTrustedProxies, "trusted-proxies", "comma separated addresses or CIDRs of proxies to take the client address from X-Forwarded-For (optional)")
 	confHTTPLog := flag.Bool("http-log", true, "http request logging (optional)")
 
 	confShowVersion := flag.Bool("version", false, "show gonic version")
@@ -95,7 +104,12 @@ func main() {
 	deprecatedConfGenreSplit := flag.String("genre-split", "", "(deprecated, see multi-value settings)")
 
 	confTranscodeCacheSize := flag.Int("transcode-cache-size", 0, "size of the transcode cache in MB (0 = no limit) (optional)")
-	confTranscodeEjectInterval := flag.Int("transcode-eject-interval", 0, "interval (in minutes) to eject transcode cache (0 = never) (optional)")
+	confTranscodeEjectInterval := flag.Int("transcode-eject-interval", 0, "interval (in minutes) to remove transcodes of changed or deleted files from the cache (0 = never) (optional)")
+	confTranscodeConcurrency := flag.Int("transcode-concurrency", 0, "max number of transcodes to run at once, the rest wait their turn (0 = no limit) (optional)")
+	confTranscodeWebProfiles := flag.Bool("transcode-web-profiles", false, "let admins add ffmpeg transcode profiles on the web interface (optional)")
+
+	var confTranscodeProfiles transcodeProfiles
+	flag.Var(&confTranscodeProfiles, "transcode-profile", "extra transcode profile, as \"<name> <mime> <suffix> <bitrate> <exec>\" (optional)")
 
 	flag.Parse()
 	flagconf.ParseEnv()
@@ -106,6 +120,69 @@ func main() {
 		os.Exit(0)
 	}
 
+	dbURL := *confDBPath
+	if *confDBURL != "" {
+		dbURL = *confDBURL
+	}
+
+	if *deprecatedConfGenreSplit != "" && *deprecatedConfGenreSplit != "\n" {
+		confMultiValueGenre = multiValueSetting{Mode: scanner.Delim, Delim: *deprecatedConfGenreSplit}
+		*deprecatedConfGenreSplit = "<deprecated>"
+	}
+	if confMultiValueArtist.Mode == scanner.None && confMultiValueAlbumArtist.Mode > scanner.None {
+		confMultiValueArtist.Mode = confMultiValueAlbumArtist.Mode
+		confMultiValueArtist.Delim = confMultiValueAlbumArtist.Delim
+	}
+	if confMultiValueArtist.Mode != confMultiValueAlbumArtist.Mode {
+		log.Panic("differing multi artist and album artist modes have been tested yet. please set them to be the same")
+	}
+
+	for _, p := range confTranscodeProfiles {
+		if _, ok := transcode.UserProfiles[p.name]; ok || p.name == db.TranscodeRuleRaw {
+			log.Panicf("transcode profile name %q is already taken, please pick another", p.name)
+		}
+		transcode.UserProfiles[p.name] = p.profile
+	}
+
+	multiValueSettings := map[scanner.Tag]scanner.MultiValueSetting{
+		scanner.Genre:       scanner.MultiValueSetting(confMultiValueGenre),
+		scanner.Artist:      scanner.MultiValueSetting(confMultiValueArtist),
+		scanner.AlbumArtist: scanner.MultiValueSetting(confMultiValueAlbumArtist),
+	}
+
+	migrationCtx := db.MigrationContext{
+		Production:    true,
+		DBPath:        *confDBPath,
+		PlaylistsPath: *confPlaylistsPath,
+		PodcastsPath:  *confPodcastPath,
+	}
+	if len(confMusicPaths) > 0 {
+		migrationCtx.OriginalMusicPath = confMusicPaths[0].path
+	}
+
+	if cmd := flag.Arg(0); cmd != "" {
+		run, ok := commands[cmd]
+		if !ok {
+			log.Fatalf("unknown command %q, expected one of %s", cmd, commandNames())
+		}
+		conf := &commandConfig{
+			dbURL:              dbURL,
+			migrationCtx:       migrationCtx,
+			backupPath:         *confBackupPath,
+			backupKeep:         int(*confBackupKeep),
+			playlistsPath:      *confPlaylistsPath,
+			podcastPath:        *confPodcastPath,
+			musicPaths:         confMusicPaths,
+			excludePattern:     *confExcludePattern,
+			scanEmbeddedCover:  *confScanEmbeddedCover,
+			multiValueSettings: multiValueSettings,
+		}
+		if err := run(conf, flag.Args()[1:]); err != nil {
+			log.Fatalf("error running %s: %v\n", cmd, err)
+		}
+		os.Exit(0)
+	}
+
 	if _, err := regexp.Compile(*confExcludePattern); err != nil {
 		log.Fatalf("invalid exclude pattern: %v\n", err)
 	}
@@ -140,7 +217,7 @@ func main() {
 		log.Fatalf("couldn't create covers cache path: %v\n", err)
 	}
 
-	dbc, err := db.New(*confDBPath, deps.DBDriverOptions(), *confLogDB)
+	dbc, err := db.New(dbURL, deps.DBDriverOptions(), *confLogDB)
 	if err != nil {
 		log.Fatalf("error opening database: %v\n", err)
 	}
@@ -165,18 +242,6 @@ func main() {
 	proxyPrefixExpr := regexp.MustCompile(`^\/*(.*?)\/*$`)
 	*confProxyPrefix = proxyPrefixExpr.ReplaceAllString(*confProxyPrefix, `/$1`)
 
-	if *deprecatedConfGenreSplit != "" && *deprecatedConfGenreSplit != "\n" {
-		confMultiValueGenre = multiValueSetting{Mode: scanner.Delim, Delim: *deprecatedConfGenreSplit}
-		*deprecatedConfGenreSplit = "<deprecated>"
-	}
-	if confMultiValueArtist.Mode == scanner.None && confMultiValueAlbumArtist.Mode > scanner.None {
-		confMultiValueArtist.Mode = confMultiValueAlbumArtist.Mode
-		confMultiValueArtist.Delim = confMultiValueAlbumArtist.Delim
-	}
-	if confMultiValueArtist.Mode != confMultiValueAlbumArtist.Mode {
-		log.Panic("differing multi artist and album artist modes have been tested yet. please set them to be the same")
-	}
-
 	log.Printf("starting gonic v%s\n", gonic.Version)
 	log.Printf("provided config\n")
 	flag.VisitAll(func(f *flag.Flag) {
@@ -189,21 +254,26 @@ func main() {
 	scannr := scanner.New(
 		ctrlsubsonic.MusicPaths(musicPaths),
 		dbc,
-		map[scanner.Tag]scanner.MultiValueSetting{
-			scanner.Genre:       scanner.MultiValueSetting(confMultiValueGenre),
-			scanner.Artist:      scanner.MultiValueSetting(confMultiValueArtist),
-			scanner.AlbumArtist: scanner.MultiValueSetting(confMultiValueAlbumArtist),
-		},
+		multiValueSettings,
 		tagReader,
 		*confExcludePattern,
 		*confScanEmbeddedCover,
 	)
 	podcast := podcast.New(dbc, *confPodcastPath, tagReader)
-	transcoder := transcode.NewCachingTranscoder(
+	transcodeJobs := transcode.NewLimitedTranscoder(
 		transcode.NewFFmpegTranscoder(),
+		*confTranscodeConcurrency,
+	)
+	transcoder := transcode.NewCachingTranscoder(
+		transcodeJobs,
 		cacheDirAudio,
 		*confTranscodeCacheSize,
 	)
+	segmenter := transcode.NewSegmenter(
+		transcoder,
+		transcode.HLSSegmentLength,
+		hlsIdleTimeout,
+	)
 
 	lastfmClientKeySecretFunc := func() (string, string, error) {
 		apiKey, _ := dbc.GetSetting(db.LastFMAPIKey)
@@ -222,25 +292,26 @@ func main() {
 		log.Panicf("error creating playlists store: %v", err)
 	}
 
+	cacheWarmer := cachewarm.New(dbc, playlistStore, transcoder)
+
 	var jukebx *jukebox.Jukebox
 	if *confJukeboxEnabled {
 		jukebx = jukebox.New()
 	}
 
-	sessKey, err := dbc.GetSetting("session_key")
+	sessKey, err := dbc.GetOrCreateSecret(db.SessionKey, 32)
 	if err != nil {
 		log.Panicf("error getting session key: %v\n", err)
 	}
-	if sessKey == "" {
-		sessKey = string(securecookie.GenerateRandomKey(32))
-		if err := dbc.SetSetting("session_key", sessKey); err != nil {
-			log.Panicf("error setting session key: %v\n", err)
-		}
-	}
-	sessDB := gormstore.New(dbc.DB, []byte(sessKey))
+	sessDB := gormstore.New(dbc.DB, sessKey)
 	sessDB.SessionOpts.HttpOnly = true
 	sessDB.SessionOpts.SameSite = http.SameSiteLaxMode
 
+	signKey, err := dbc.GetOrCreateSecret(db.SignURLKey, 32)
+	if err != nil {
+		log.Panicf("error getting sign url key: %v\n", err)
+	}
+
 	artistInfoCache := artistinfocache.New(dbc, lastfmClient)
 	albumInfoCache := albuminfocache.New(dbc, lastfmClient)
 
@@ -252,11 +323,18 @@ func main() {
 		return url.String()
 	}
 
-	ctrlAdmin, err := ctrladmin.New(dbc, sessDB, scannr, podcast, lastfmClient, resolveProxyPath)
+	var backups *backup.Backups
+	if *confBackupPath != "" {
+		if backups, err = backup.New(dbc, *confBackupPath, int(*confBackupKeep)); err != nil {
+			log.Panicf("error creating backups: %v\n", err)
+		}
+	}
+
+	ctrlAdmin, err := ctrladmin.New(dbc, sessDB, scannr, podcast, lastfmClient, backups, transcodeJobs, cacheWarmer, playlistStore, *confTranscodeWebProfiles, resolveProxyPath)
 	if err != nil {
 		log.Panicf("error creating admin controller: %v\n", err)
 	}
-	ctrlSubsonic, err := ctrlsubsonic.New(dbc, scannr, musicPaths, *confPodcastPath, cacheDirAudio, cacheDirCovers, jukebx, playlistStore, scrobblers, podcast, transcoder, lastfmClient, artistInfoCache, albumInfoCache, tagReader, resolveProxyPath)
+	ctrlSubsonic, err := ctrlsubsonic.New(dbc, scannr, musicPaths, *confPodcastPath, cacheDirAudio, cacheDirCovers, jukebx, playlistStore, scrobblers, podcast, transcoder, segmenter, lastfmClient, artistInfoCache, albumInfoCache, tagReader, signKey, resolveProxyPath)
 	if err != nil {
 		log.Panicf("error creating subsonic controller: %v\n", err)
 	}
@@ -268,6 +346,7 @@ func main() {
 	chain = handlerutil.Chain(
 		chain,
 		handlerutil.BasicCORS,
+		handlerutil.TrustedProxies(confTrustedProxies),
 	)
 	trim := handlerutil.TrimPathSuffix(".view") // /x.view and /x should match the same
 
@@ -283,6 +362,15 @@ func main() {
 			stats, _ := dbc.Stats()
 			return stats
 		}))
+		expvar.Publish("transcodes", expvar.Func(func() any {
+			return struct {
+				transcode.Stats
+				Jobs []transcode.Job `json:"jobs"`
+			}{transcodeJobs.Stats(), transcodeJobs.Jobs()}
+		}))
+		expvar.Publish("transcode_cache", expvar.Func(func() any {
+			return transcoder.CacheStats()
+		}))
 	}
 
 	var (
@@ -407,14 +495,20 @@ func main() {
 	})
 
 	errgrp.Go(func() error {
-		if *confTranscodeEjectInterval == 0 || *confTranscodeCacheSize == 0 {
-			return nil
-		}
-
 		defer logJob("transcode cache eject")()
+		defer func() {
+			if err := transcoder.SaveIndex(); err != nil {
+				log.Printf("error saving transcode cache index: %v", err)
+			}
+		}()
 
-		ctxTick(ctx, time.Duration(*confTranscodeEjectInterval)*time.Minute, func() {
-			if err := transcoder.CacheEject(); err != nil {
+		// ejecting saves the index too. if ejecting is off, the index is still saved now and then
+		interval, tick := time.Duration(*confTranscodeEjectInterval)*time.Minute, transcoder.CacheEject
+		if interval == 0 {
+			interval, tick = transcodeIndexSaveInterval, transcoder.SaveIndex
+		}
+		ctxTick(ctx, interval, func() {
+			if err := tick(); err != nil {
 				log.Printf("error ejecting transcode cache: %v", err)
 			}
 		})
@@ -436,6 +530,21 @@ func main() {
 		return nil
 	})
 
+	errgrp.Go(func() error {
+		if backups == nil || *confBackupIntervalMins == 0 {
+			return nil
+		}
+
+		defer logJob("backup timer")()
+
+		ctxTick(ctx, time.Duration(*confBackupIntervalMins)*time.Minute, func() {
+			if _, err := backups.Snapshot(); err != nil {
+				log.Printf("error backing up: %v", err)
+			}
+		})
+		return nil
+	})
+
 	errgrp.Go(func() error {
 		if _, _, err := lastfmClientKeySecretFunc(); err != nil {
 			return nil
@@ -471,6 +580,12 @@ func main() {
 	fmt.Println("shutdown complete")
 }
 
+// how often the transcode cache index is saved if the cache isn't being ejected, which saves it too
+const transcodeIndexSaveInterval = 5 * time.Minute
+
+// how long an HLS transcode carries on without any of its segments being asked for, for players which have stopped
+const hlsIdleTimeout = 2 * time.Minute
+
 const pathAliasSep = "->"
 
 type (
@@ -544,6 +659,60 @@ func (mvs *multiValueSetting) Set(value string) error {
 	return nil
 }
 
+type (
+	transcodeProfiles []transcodeProfile
+	transcodeProfile  struct {
+		name    string
+		profile transcode.Profile
+	}
+)
+
+func (tp transcodeProfiles) String() string {
+	var names []string
+	for _, p := range tp {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (tp *transcodeProfiles) Set(value string) error {
+	name, profile, err := transcode.ParseUserProfile(value)
+	if err != nil {
+		return err
+	}
+	*tp = append(*tp, transcodeProfile{name: name, profile: profile})
+	return nil
+}
+
+type trustedProxies []netip.Prefix
+
+func (tp trustedProxies) String() string {
+	var prefixes []string
+	for _, p := range tp {
+		prefixes = append(prefixes, p.String())
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (tp *trustedProxies) Set(value string) error {
+	for v := range strings.SplitSeq(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(v); err == nil {
+			*tp = append(*tp, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("invalid proxy address %q", v)
+		}
+		*tp = append(*tp, prefix.Masked())
+	}
+	return nil
+}
+
 func logJob(jobName string) func() {
 	log.Printf("starting job %q", jobName)
 	return func() { log.Printf("stopped job %q", jobName) }
@@ -1,14 +1,20 @@
 package db
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"mime"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -19,16 +25,15 @@ import (
 
 type DB struct {
 	*gorm.DB
-}
 
-func New(path string, opts url.Values, logQueries bool) (*DB, error) {
-	u := url.URL{
-		Scheme:   "file",
-		Opaque:   path,
-		RawQuery: opts.Encode(),
-	}
+	// searchIndex is if the search index can be queried, worked out after migrating and rebuilding it.
+	// it's shared with transactions
+	searchIndex *atomic.Bool
+}
 
-	db, err := gorm.Open("sqlite3", u.String())
+// New opens the database at dbURL, see ParseURL
+func New(dbURL string, sqliteOpts url.Values, logQueries bool) (*DB, error) {
+	db, err := gorm.Open(ParseURL(dbURL, sqliteOpts))
 	if err != nil {
 		return nil, fmt.Errorf("with gorm: %w", err)
 	}
@@ -40,10 +45,15 @@ func New(path string, opts url.Values, logQueries bool) (*DB, error) {
 
 	db.DB().SetMaxOpenConns(4)
 
-	return &DB{DB: db}, nil
+	return &DB{DB: db, searchIndex: new(atomic.Bool)}, nil
 }
 
+// NewMock returns an empty in-memory SQLite database, or a database in a new schema if
+// TestDBURLEnv is set
 func NewMock(opts url.Values) (*DB, error) {
+	if dbURL := os.Getenv(TestDBURLEnv); dbURL != "" {
+		return newMockPostgres(dbURL)
+	}
 	d, err := New(":memory:", opts, false)
 	if err != nil {
 		return nil, err
@@ -63,7 +73,7 @@ func (db *DB) InsertBulkLeftMany(table string, head []string, left int, col []in
 		rows = append(rows, "(?, ?)")
 		values = append(values, left, c)
 	}
-	q := fmt.Sprintf("INSERT OR IGNORE INTO %q (%s) VALUES %s",
+	q := fmt.Sprintf("INSERT INTO %q (%s) VALUES %s ON CONFLICT DO NOTHING",
 		table,
 		strings.Join(head, ", "),
 		strings.Join(rows, ", "),
@@ -112,12 +122,12 @@ func (db *DB) GetUserByName(name string) *User {
 }
 
 func (db *DB) Begin() *DB {
-	return &DB{DB: db.DB.Begin()}
+	return &DB{DB: db.DB.Begin(), searchIndex: db.searchIndex}
 }
 
 func (db *DB) Transaction(cb func(*DB) error) error {
 	return db.DB.Transaction(func(tx *gorm.DB) error {
-		return cb(&DB{DB: tx})
+		return cb(&DB{DB: tx, searchIndex: db.searchIndex})
 	})
 }
 
@@ -144,6 +154,8 @@ const (
 	LastFMAPIKey SettingKey = "lastfm_api_key" //nolint:gosec
 	LastFMSecret SettingKey = "lastfm_secret"
 	LastScanTime SettingKey = "last_scan_time"
+	SignURLKey   SettingKey = "sign_url_key"
+	SessionKey   SettingKey = "session_key"
 )
 
 func (db *DB) GetSetting(key SettingKey) (string, error) {
@@ -162,6 +174,30 @@ func (db *DB) SetSetting(key SettingKey, value string) error {
 		Error
 }
 
+// GetOrCreateSecret returns the random secret stored under key, generating one of size bytes if there isn't one yet.
+// secrets are stored base64 encoded since the settings value column is text. older versions stored the raw bytes,
+// those are still returned as is so that sessions survive an upgrade
+func (db *DB) GetOrCreateSecret(key SettingKey, size int) ([]byte, error) {
+	value, err := db.GetSetting(key)
+	if err != nil {
+		return nil, fmt.Errorf("get setting: %w", err)
+	}
+	if value != "" {
+		if secret, err := base64.StdEncoding.DecodeString(value); err == nil && len(secret) == size {
+			return secret, nil
+		}
+		return []byte(value), nil
+	}
+	secret := make([]byte, size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate secret: %w", err)
+	}
+	if err := db.SetSetting(key, base64.StdEncoding.EncodeToString(secret)); err != nil {
+		return nil, fmt.Errorf("set setting: %w", err)
+	}
+	return secret, nil
+}
+
 type Artist struct {
 	ID              int      `gorm:"primary_key"`
 	Name            string   `gorm:"not null; unique_index"`
@@ -234,6 +270,7 @@ type Track struct {
 
 	TrackStar     *TrackStar
 	TrackRating   *TrackRating
+	TrackPlay     *TrackPlay
 	AverageRating float64 `sql:"default: null"`
 }
 
@@ -311,6 +348,24 @@ type Play struct {
 	Length  int
 }
 
+// Listen is an entry in a user's append-only listening history. the track's details are
+// copied so that the history still reads well after the track is removed from the library
+type Listen struct {
+	ID         int `gorm:"primary_key"`
+	User       *User
+	UserID     int `gorm:"not null; index:idx_listens_user_id_time" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Track      *Track
+	TrackID    *int      `gorm:"index" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE SET NULL"`
+	Time       time.Time `gorm:"not null; index:idx_listens_user_id_time"`
+	Client     string
+	Submission bool // false for "now playing" notifications
+	Skipped    bool // the track was replaced by another before it could have finished
+	TrackTitle string
+	ArtistName string
+	AlbumTitle string
+	Length     int
+}
+
 type Album struct {
 	ID                   int `gorm:"primary_key"`
 	CreatedAt            time.Time
@@ -362,16 +417,19 @@ func (a *Album) IndexRightPath() string {
 	return a.RightPath
 }
 
+// PlayQueue is a user's saved queue. a user has one per name, which is usually the client that saved it
 type PlayQueue struct {
-	ID        int `gorm:"primary_key"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	User      *User
-	UserID    int `sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
-	Current   string
-	Position  int
-	ChangedBy string
-	Items     string
+	ID           int `gorm:"primary_key"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	User         *User
+	UserID       int    `gorm:"unique_index:idx_play_queues_user_id_name" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Name         string `gorm:"unique_index:idx_play_queues_user_id_name"`
+	Current      string
+	CurrentIndex int // the index of Current in Items, since an item can be in the queue more than once
+	Position     int
+	ChangedBy    string
+	Items        string
 }
 
 func (p *PlayQueue) CurrentSID() *specid.ID {
@@ -387,12 +445,137 @@ func (p *PlayQueue) SetItems(items []specid.ID) {
 	p.Items = join(items, ",")
 }
 
+// SetCurrentIndex sets the current item by its index in the queue, returning false if it's out of range
+func (p *PlayQueue) SetCurrentIndex(index int) bool {
+	items := p.GetItems()
+	if index < 0 || index >= len(items) {
+		return false
+	}
+	p.Current = items[index].String()
+	p.CurrentIndex = index
+	return true
+}
+
 type TranscodePreference struct {
 	UserID  int    `gorm:"not null; unique_index:idx_user_id_client" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
 	Client  string `gorm:"not null; unique_index:idx_user_id_client" sql:"default: null"`
 	Profile string `gorm:"not null" sql:"default: null"`
 }
 
+// TranscodeProfile is a transcode profile added by an admin, alongside the built in ones and those from the config.
+// it only has the arguments to ffmpeg, see transcode.NewFFmpegProfile
+type TranscodeProfile struct {
+	ID      int    `gorm:"primary_key"`
+	Name    string `gorm:"not null; unique_index" sql:"default: null"`
+	MIME    string `gorm:"not null" sql:"default: null"`
+	Suffix  string `gorm:"not null" sql:"default: null"`
+	BitRate int
+	Args    string `gorm:"not null" sql:"default: null"`
+}
+
+// TranscodeRule picks a transcode profile by where a request comes from. rules are checked in order of position
+// before the user's transcode preferences. empty fields match anything
+type TranscodeRule struct {
+	ID       int  `gorm:"primary_key"`
+	UserID   *int `sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	User     *User
+	Client   string
+	CIDR     string
+	Profile  string `gorm:"not null" sql:"default: null"`
+	Position int    `gorm:"not null" sql:"default: 0"`
+}
+
+// TranscodeRuleRaw is the profile of a rule which serves the file as it is
+const TranscodeRuleRaw = "raw"
+
+// Match is true if the rule applies to a request by the user, from the client and address
+func (tr *TranscodeRule) Match(userID int, client string, addr netip.Addr) bool {
+	if tr.UserID != nil && *tr.UserID != userID {
+		return false
+	}
+	if tr.Client != "" && tr.Client != "*" && !strings.EqualFold(tr.Client, client) {
+		return false
+	}
+	if tr.CIDR != "" {
+		prefix, err := netip.ParsePrefix(tr.CIDR)
+		if err != nil || !addr.IsValid() || !prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateTranscodeRule adds a rule after the others
+func (db *DB) CreateTranscodeRule(rule *TranscodeRule) error {
+	return db.Transaction(func(tx *DB) error {
+		var last TranscodeRule
+		if err := tx.Order("position DESC").First(&last).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("find last rule: %w", err)
+		}
+		rule.Position = last.Position + 1
+		return tx.Create(rule).Error
+	})
+}
+
+// MoveTranscodeRule swaps a rule with the one before it, or after it if down is set. moving the first rule up or the
+// last one down does nothing
+func (db *DB) MoveTranscodeRule(id int, down bool) error {
+	return db.Transaction(func(tx *DB) error {
+		var rules []*TranscodeRule
+		if err := tx.Order("position, id").Find(&rules).Error; err != nil {
+			return fmt.Errorf("find transcode rules: %w", err)
+		}
+		i := slices.IndexFunc(rules, func(r *TranscodeRule) bool { return r.ID == id })
+		if i < 0 {
+			return gorm.ErrRecordNotFound
+		}
+		j := i - 1
+		if down {
+			j = i + 1
+		}
+		if j < 0 || j >= len(rules) {
+			return nil
+		}
+		rules[i], rules[j] = rules[j], rules[i]
+		// renumber them all, in case some had the same position
+		for pos, rule := range rules {
+			if err := tx.Model(rule).Update("position", pos+1).Error; err != nil {
+				return fmt.Errorf("update position: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetTranscodePreference finds the first transcode rule which matches the request, then the user's preference
+// for the client. a nil preference, or one with the raw profile, means serving the file as it is
+func (db *DB) GetTranscodePreference(userID int, client string, addr netip.Addr) (*TranscodePreference, error) {
+	var rules []*TranscodeRule
+	if err := db.Order("position, id").Find(&rules).Error; err != nil {
+		return nil, fmt.Errorf("find transcode rules: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.Match(userID, client, addr) {
+			return &TranscodePreference{UserID: userID, Client: client, Profile: rule.Profile}, nil
+		}
+	}
+
+	var pref TranscodePreference
+	err := db.
+		Where("user_id=?", userID).
+		Where("lower(client) IN (?)", []string{"*", strings.ToLower(client)}).
+		Order("client DESC"). // ensure "*" is last if it's there
+		First(&pref).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find transcode preference: %w", err)
+	}
+	return &pref, nil
+}
+
 type AlbumArtist struct {
 	AlbumID  int `gorm:"not null; unique_index:idx_album_id_artist_id" sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
 	ArtistID int `gorm:"not null; unique_index:idx_album_id_artist_id" sql:"default: null; type:int REFERENCES artists(id) ON DELETE CASCADE"`
@@ -460,6 +643,40 @@ type TrackRating struct {
 	Rating  int `gorm:"not null; check:(rating >= 1 AND rating <= 5)"`
 }
 
+// UpdateArtistAverageRating stores the average of the artist's ratings on the artist, for after its ratings change
+func (db *DB) UpdateArtistAverageRating(id int) error {
+	return db.updateAverageRating("artists", "artist_ratings", "artist_id", id)
+}
+
+// UpdateAlbumAverageRating stores the average of the album's ratings on the album, for after its ratings change
+func (db *DB) UpdateAlbumAverageRating(id int) error {
+	return db.updateAverageRating("albums", "album_ratings", "album_id", id)
+}
+
+// UpdateTrackAverageRating stores the average of the track's ratings on the track, for after its ratings change
+func (db *DB) UpdateTrackAverageRating(id int) error {
+	return db.updateAverageRating("tracks", "track_ratings", "track_id", id)
+}
+
+func (db *DB) updateAverageRating(table, ratingsTable, column string, id int) error {
+	var averageRating float64
+	if err := db.Table(ratingsTable).Select("coalesce(avg(rating), 0)").Where(column+"=?", id).Row().Scan(&averageRating); err != nil {
+		return fmt.Errorf("find average rating: %w", err)
+	}
+	averageRating = math.Trunc(averageRating*100) / 100
+	if err := db.Table(table).Where("id=?", id).UpdateColumn("average_rating", averageRating).Error; err != nil {
+		return fmt.Errorf("save average rating: %w", err)
+	}
+	return nil
+}
+
+type TrackPlay struct {
+	UserID  int       `gorm:"primary_key; not null" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	TrackID int       `gorm:"primary_key; not null; index" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE CASCADE"`
+	Count   int       `gorm:"not null"`
+	Time    time.Time `sql:"default: null"`
+}
+
 type PodcastAutoDownload string
 
 const (
@@ -567,6 +784,14 @@ type InternetRadioStation struct {
 	HomepageURL string
 }
 
+type ChatMessage struct {
+	ID        int `gorm:"primary_key"`
+	User      *User
+	UserID    int `gorm:"not null; index" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Message   string
+	CreatedAt time.Time `gorm:"index"`
+}
+
 func (ir *InternetRadioStation) SID() *specid.ID {
 	return &specid.ID{Type: specid.InternetRadioStation, Value: ir.ID}
 }
@@ -1,9 +1,11 @@
 package db
 
 import (
+	"encoding/base64"
 	"io"
 	"log"
 	"math/rand"
+	"net/netip"
 	"os"
 	"testing"
 
@@ -43,6 +45,39 @@ func TestGetSetting(t *testing.T) {
 	require.Equal(t, value, actual)
 }
 
+func TestGetOrCreateSecret(t *testing.T) {
+	t.Parallel()
+
+	testDB, err := NewMock(deps.DBDriverOptions())
+	if err != nil {
+		t.Fatalf("error creating db: %v", err)
+	}
+	if err := testDB.Migrate(MigrationContext{}); err != nil {
+		t.Fatalf("error migrating db: %v", err)
+	}
+
+	key := SettingKey(randKey())
+	secret, err := testDB.GetOrCreateSecret(key, 32)
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+
+	// stored as text, and the same secret comes back next time
+	stored, err := testDB.GetSetting(key)
+	require.NoError(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString(secret), stored)
+
+	again, err := testDB.GetOrCreateSecret(key, 32)
+	require.NoError(t, err)
+	require.Equal(t, secret, again)
+
+	// secrets stored raw by older versions are still used
+	legacyKey := SettingKey(randKey())
+	require.NoError(t, testDB.SetSetting(legacyKey, "raw-legacy-secret"))
+	legacy, err := testDB.GetOrCreateSecret(legacyKey, 32)
+	require.NoError(t, err)
+	require.Equal(t, []byte("raw-legacy-secret"), legacy)
+}
+
 func randKey() string {
 	letters := []rune("abcdef0123456789")
 	b := make([]rune, 16)
@@ -51,3 +86,41 @@ func randKey() string {
 	}
 	return string(b)
 }
+
+func TestTranscodeRuleOrder(t *testing.T) {
+	t.Parallel()
+
+	testDB, err := NewMock(deps.DBDriverOptions())
+	if err != nil {
+		t.Fatalf("error creating db: %v", err)
+	}
+	if err := testDB.Migrate(MigrationContext{}); err != nil {
+		t.Fatalf("error migrating db: %v", err)
+	}
+
+	first := &TranscodeRule{Profile: "opus"}
+	second := &TranscodeRule{Client: "DSub", Profile: TranscodeRuleRaw}
+	require.NoError(t, testDB.CreateTranscodeRule(first))
+	require.NoError(t, testDB.CreateTranscodeRule(second))
+
+	profile := func() string {
+		t.Helper()
+		pref, err := testDB.GetTranscodePreference(1, "DSub", netip.Addr{})
+		require.NoError(t, err)
+		return pref.Profile
+	}
+	require.Equal(t, "opus", profile())
+
+	require.NoError(t, testDB.MoveTranscodeRule(second.ID, false))
+	require.Equal(t, TranscodeRuleRaw, profile())
+
+	// moving past the ends does nothing
+	require.NoError(t, testDB.MoveTranscodeRule(second.ID, false))
+	require.NoError(t, testDB.MoveTranscodeRule(first.ID, true))
+	require.Equal(t, TranscodeRuleRaw, profile())
+
+	require.NoError(t, testDB.MoveTranscodeRule(second.ID, true))
+	require.Equal(t, "opus", profile())
+
+	require.Error(t, testDB.MoveTranscodeRule(second.ID+1, true))
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+)
+
+// gorm dialect names
+const (
+	DialectSQLite   = "sqlite3"
+	DialectPostgres = "postgres"
+)
+
+// TestDBURLEnv can be set to a postgres:// URL to run the tests against Postgres instead of
+// in-memory SQLite databases. each mock database gets a schema of its own, so the URL should
+// point to a throwaway database
+const TestDBURLEnv = "GONIC_TEST_DB_URL"
+
+// ParseURL returns the gorm dialect and data source name for a database URL. the URL is either
+// a postgres:// (or postgresql://) URL, or the path to an SQLite database, optionally prefixed
+// with sqlite3://. sqliteOpts are only used for SQLite
+func ParseURL(dbURL string, sqliteOpts url.Values) (dialect, dsn string) {
+	switch {
+	case strings.HasPrefix(dbURL, "postgres://"), strings.HasPrefix(dbURL, "postgresql://"):
+		return DialectPostgres, dbURL
+	}
+	u := url.URL{
+		Scheme:   "file",
+		Opaque:   SQLitePath(dbURL),
+		RawQuery: sqliteOpts.Encode(),
+	}
+	return DialectSQLite, u.String()
+}
+
+// IsSQLite returns if a database URL is for SQLite
+func IsSQLite(dbURL string) bool {
+	dialect, _ := ParseURL(dbURL, nil)
+	return dialect == DialectSQLite
+}
+
+// SQLitePath returns the path to the database of an SQLite database URL
+func SQLitePath(dbURL string) string {
+	return strings.TrimPrefix(dbURL, "sqlite3://")
+}
+
+func (db *DB) IsSQLite() bool {
+	return db.Dialect().GetName() == DialectSQLite
+}
+
+func newMockPostgres(dbURL string) (*DB, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+
+	d, err := New(dbURL, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	schema := fmt.Sprintf("gonic_test_%x", rand.Uint64()) //nolint:gosec
+	if err := d.Exec(`CREATE SCHEMA ` + schema).Error; err != nil {
+		d.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	d.Close()
+
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	d, err = New(u.String(), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	// the tests make lots of these in parallel, keep them under postgres's connection limit
+	d.DB.DB().SetMaxOpenConns(2)
+	return d, nil
+}
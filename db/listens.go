@@ -0,0 +1,157 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// listens are counted towards stats when they were submitted, "now playing" notifications are
+// only kept for the history and to detect skips
+const listenStatsWhere = `listens.user_id=? AND listens.submission AND listens.time >= ? AND listens.time < ?`
+
+type ListenStat struct {
+	ID     int
+	Name   string
+	Artist string // for albums and tracks
+	Count  int
+	Length int
+}
+
+type ListenTotals struct {
+	Listens int
+	Length  int
+	Skipped int
+	Tracks  int
+	Albums  int
+	Artists int
+}
+
+// ListenTime normalises a listen time so that times can be compared as stored, regardless of
+// the driver or the time zone of the client
+func ListenTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+func (db *DB) TopListenedArtists(userID int, from, to time.Time, limit int) ([]*ListenStat, error) {
+	return db.topListened(`
+		SELECT artists.id, artists.name, '' artist, count(*) count, sum(listens.length) length
+		FROM listens
+		JOIN track_artists ON track_artists.track_id=listens.track_id
+		JOIN artists ON artists.id=track_artists.artist_id
+		WHERE `+listenStatsWhere+`
+		GROUP BY artists.id
+		ORDER BY count DESC, length DESC, artists.name
+		LIMIT ?
+	`, userID, from, to, limit)
+}
+
+func (db *DB) TopListenedAlbums(userID int, from, to time.Time, limit int) ([]*ListenStat, error) {
+	return db.topListened(`
+		SELECT albums.id, albums.tag_title name, albums.tag_album_artist artist, count(*) count, sum(listens.length) length
+		FROM listens
+		JOIN tracks ON tracks.id=listens.track_id
+		JOIN albums ON albums.id=tracks.album_id
+		WHERE `+listenStatsWhere+`
+		GROUP BY albums.id
+		ORDER BY count DESC, length DESC, albums.tag_title
+		LIMIT ?
+	`, userID, from, to, limit)
+}
+
+func (db *DB) TopListenedTracks(userID int, from, to time.Time, limit int) ([]*ListenStat, error) {
+	return db.topListened(`
+		SELECT tracks.id, tracks.tag_title name, tracks.tag_track_artist artist, count(*) count, sum(listens.length) length
+		FROM listens
+		JOIN tracks ON tracks.id=listens.track_id
+		WHERE `+listenStatsWhere+`
+		GROUP BY tracks.id
+		ORDER BY count DESC, length DESC, tracks.tag_title
+		LIMIT ?
+	`, userID, from, to, limit)
+}
+
+func (db *DB) TopListenedGenres(userID int, from, to time.Time, limit int) ([]*ListenStat, error) {
+	return db.topListened(`
+		SELECT genres.id, genres.name, '' artist, count(*) count, sum(listens.length) length
+		FROM listens
+		JOIN track_genres ON track_genres.track_id=listens.track_id
+		JOIN genres ON genres.id=track_genres.genre_id
+		WHERE `+listenStatsWhere+`
+		GROUP BY genres.id
+		ORDER BY count DESC, length DESC, genres.name
+		LIMIT ?
+	`, userID, from, to, limit)
+}
+
+func (db *DB) topListened(query string, userID int, from, to time.Time, limit int) ([]*ListenStat, error) {
+	var stats []*ListenStat
+	if err := db.Raw(query, userID, ListenTime(from), ListenTime(to), limit).Scan(&stats).Error; err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return stats, nil
+}
+
+func (db *DB) ListenTotals(userID int, from, to time.Time) (ListenTotals, error) {
+	from, to = ListenTime(from), ListenTime(to)
+	var totals ListenTotals
+	err := db.Raw(`
+		SELECT count(*), coalesce(sum(listens.length), 0), count(DISTINCT listens.track_id)
+		FROM listens
+		WHERE `+listenStatsWhere, userID, from, to).
+		Row().
+		Scan(&totals.Listens, &totals.Length, &totals.Tracks)
+	if err != nil {
+		return ListenTotals{}, fmt.Errorf("count listens: %w", err)
+	}
+	err = db.Raw(`
+		SELECT count(DISTINCT tracks.album_id), count(DISTINCT track_artists.artist_id)
+		FROM listens
+		JOIN tracks ON tracks.id=listens.track_id
+		LEFT JOIN track_artists ON track_artists.track_id=listens.track_id
+		WHERE `+listenStatsWhere, userID, from, to).
+		Row().
+		Scan(&totals.Albums, &totals.Artists)
+	if err != nil {
+		return ListenTotals{}, fmt.Errorf("count albums and artists: %w", err)
+	}
+	err = db.Model(Listen{}).
+		Where("user_id=? AND skipped AND time >= ? AND time < ?", userID, from, to).
+		Count(&totals.Skipped).
+		Error
+	if err != nil {
+		return ListenTotals{}, fmt.Errorf("count skipped: %w", err)
+	}
+	return totals, nil
+}
+
+// ListensByMonth returns the number of listens in each month of a year, in the given location
+func (db *DB) ListensByMonth(userID int, year int, loc *time.Location) ([12]int, error) {
+	var counts [12]int
+	for m := range counts {
+		from := time.Date(year, time.Month(m+1), 1, 0, 0, 0, 0, loc)
+		to := from.AddDate(0, 1, 0)
+		err := db.Model(Listen{}).
+			Where(listenStatsWhere, userID, ListenTime(from), ListenTime(to)).
+			Count(&counts[m]).
+			Error
+		if err != nil {
+			return counts, fmt.Errorf("count %s: %w", from.Month(), err)
+		}
+	}
+	return counts, nil
+}
+
+// RecentListens returns the user's most recent submitted or skipped listens
+func (db *DB) RecentListens(userID int, limit int) ([]*Listen, error) {
+	var listens []*Listen
+	err := db.
+		Where("user_id=? AND (submission OR skipped)", userID).
+		Order("time DESC, id DESC").
+		Limit(limit).
+		Find(&listens).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find listens: %w", err)
+	}
+	return listens, nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/deps"
+)
+
+func TestListenStats(t *testing.T) {
+	t.Parallel()
+
+	testDB, err := NewMock(deps.DBDriverOptions())
+	require.NoError(t, err)
+	require.NoError(t, testDB.Migrate(MigrationContext{}))
+
+	user := User{Name: "listener", Password: "password"}
+	require.NoError(t, testDB.Create(&user).Error)
+
+	artistA := Artist{Name: "artist a"}
+	artistB := Artist{Name: "artist b"}
+	require.NoError(t, testDB.Create(&artistA).Error)
+	require.NoError(t, testDB.Create(&artistB).Error)
+	genre := Genre{Name: "idm"}
+	require.NoError(t, testDB.Create(&genre).Error)
+
+	album := Album{TagTitle: "album", TagAlbumArtist: "artist a", RightPath: "album"}
+	require.NoError(t, testDB.Create(&album).Error)
+	track1 := Track{AlbumID: album.ID, Filename: "1.flac", TagTitle: "one", TagTrackArtist: "artist a", Length: 100}
+	track2 := Track{AlbumID: album.ID, Filename: "2.flac", TagTitle: "two", TagTrackArtist: "artist a & artist b", Length: 200}
+	require.NoError(t, testDB.Create(&track1).Error)
+	require.NoError(t, testDB.Create(&track2).Error)
+	require.NoError(t, testDB.Create(&TrackArtist{TrackID: track1.ID, ArtistID: artistA.ID}).Error)
+	require.NoError(t, testDB.Create(&TrackArtist{TrackID: track2.ID, ArtistID: artistA.ID}).Error)
+	require.NoError(t, testDB.Create(&TrackArtist{TrackID: track2.ID, ArtistID: artistB.ID}).Error)
+	require.NoError(t, testDB.Create(&TrackGenre{TrackID: track2.ID, GenreID: genre.ID}).Error)
+
+	listen := func(track *Track, at time.Time, submission, skipped bool) {
+		t.Helper()
+		require.NoError(t, testDB.Create(&Listen{
+			UserID:     user.ID,
+			TrackID:    &track.ID,
+			Time:       ListenTime(at),
+			Submission: submission,
+			Skipped:    skipped,
+			TrackTitle: track.TagTitle,
+			Length:     track.Length,
+		}).Error)
+	}
+
+	jan := time.Date(2025, time.January, 10, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2025, time.March, 10, 0, 0, 0, 0, time.UTC)
+	listen(&track1, jan, true, false)
+	listen(&track2, jan.Add(time.Hour), true, false)
+	listen(&track2, mar, true, false)
+	listen(&track1, mar.Add(time.Hour), false, true) // skipped, not counted
+	listen(&track2, time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC), true, false)
+
+	from := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, 0)
+
+	artists, err := testDB.TopListenedArtists(user.ID, from, to, 10)
+	require.NoError(t, err)
+	require.Equal(t, []*ListenStat{
+		{ID: artistA.ID, Name: "artist a", Count: 3, Length: 500},
+		{ID: artistB.ID, Name: "artist b", Count: 2, Length: 400},
+	}, artists)
+
+	albums, err := testDB.TopListenedAlbums(user.ID, from, to, 10)
+	require.NoError(t, err)
+	require.Equal(t, []*ListenStat{
+		{ID: album.ID, Name: "album", Artist: "artist a", Count: 3, Length: 500},
+	}, albums)
+
+	tracks, err := testDB.TopListenedTracks(user.ID, from, to, 1)
+	require.NoError(t, err)
+	require.Equal(t, []*ListenStat{
+		{ID: track2.ID, Name: "two", Artist: "artist a & artist b", Count: 2, Length: 400},
+	}, tracks)
+
+	genres, err := testDB.TopListenedGenres(user.ID, from, to, 10)
+	require.NoError(t, err)
+	require.Equal(t, []*ListenStat{
+		{ID: genre.ID, Name: "idm", Count: 2, Length: 400},
+	}, genres)
+
+	totals, err := testDB.ListenTotals(user.ID, from, to)
+	require.NoError(t, err)
+	require.Equal(t, ListenTotals{Listens: 3, Length: 500, Skipped: 1, Tracks: 2, Albums: 1, Artists: 2}, totals)
+
+	months, err := testDB.ListensByMonth(user.ID, 2025, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, [12]int{2, 0, 1}, months)
+
+	recent, err := testDB.RecentListens(user.ID, 2)
+	require.NoError(t, err)
+	require.Len(t, recent, 2)
+	require.True(t, recent[0].Skipped)
+	require.Equal(t, track2.ID, *recent[1].TrackID)
+}
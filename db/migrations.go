@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -83,11 +84,31 @@ func (db *DB) Migrate(ctx MigrationContext) error {
 		construct(ctx, "202509301448", migrateAddTrackEmbeddedCover),
 		construct(ctx, "202512021147", migrateAlbumAddIndexOnCreatedAt),
 		construct(ctx, "202601201000", migrateAddAlbumDiscTitles),
+		constructNoTx(ctx, "202610181200", migrateSearchIndex),
+		construct(ctx, "202610181300", migrateAddListens),
+		construct(ctx, "202610181400", migrateAddTrackPlays),
+		construct(ctx, "202610181500", migrateAddChatMessages),
+		construct(ctx, "202610181600", migratePlayQueueCurrentIndex),
+		construct(ctx, "202610181700", migratePlayQueueNames),
+		construct(ctx, "202610181800", migrateAddTranscodeRules),
+		construct(ctx, "202610191000", migrateTranscodeRulePositions),
+		construct(ctx, "202610191100", migrateAddTranscodeProfiles),
 	}
 
-	return gormigrate.
-		New(db.DB, options, migrations).
-		Migrate()
+	m := gormigrate.New(db.DB, options, migrations)
+	if !db.IsSQLite() {
+		// the migrations above were written for SQLite. other databases are always new to gonic,
+		// so they start from the current schema and every migration is marked as done. from now
+		// on migrations must work with every dialect
+		m.InitSchema(func(tx *gorm.DB) error {
+			return migrateCurrentSchema(tx, ctx)
+		})
+	}
+	if err := m.Migrate(); err != nil {
+		return err
+	}
+	db.checkSearchIndex()
+	return nil
 }
 
 func construct(ctx MigrationContext, id string, f func(*gorm.DB, MigrationContext) error) *gormigrate.Migration {
@@ -114,6 +135,88 @@ func constructNoTx(ctx MigrationContext, id string, f func(*gorm.DB, MigrationCo
 	}
 }
 
+// migrateCurrentSchema creates the schema that running every migration on an empty
+// database would, for databases which can't run the older SQLite specific migrations
+func migrateCurrentSchema(tx *gorm.DB, ctx MigrationContext) error {
+	if tx.Dialect().GetName() != DialectSQLite {
+		// albums and tracks reference each other, and only SQLite allows a reference to a table
+		// that doesn't exist yet. start with the tracks table's key and let the tracks step add the rest
+		if err := tx.Exec(`CREATE TABLE tracks (id serial PRIMARY KEY)`).Error; err != nil {
+			return fmt.Errorf("step create tracks: %w", err)
+		}
+	}
+
+	// in order of references
+	step := tx.AutoMigrate(
+		User{},
+		Setting{},
+		Artist{},
+		ArtistInfo{},
+		Genre{},
+		Album{},
+		AlbumInfo{},
+		AlbumDiscTitle{},
+		Track{},
+	)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate library: %w", err)
+	}
+
+	// the join tables were created above for the many2many fields. recreate them from their own
+	// models to get their references and indexes
+	joins := []any{
+		AlbumArtist{},
+		TrackArtist{},
+		ArtistAppearances{},
+		AlbumGenre{},
+		TrackGenre{},
+	}
+	if err := tx.DropTableIfExists(joins...).Error; err != nil {
+		return fmt.Errorf("step drop join tables: %w", err)
+	}
+	if err := tx.AutoMigrate(joins...).Error; err != nil {
+		return fmt.Errorf("step auto migrate join tables: %w", err)
+	}
+
+	step = tx.AutoMigrate(
+		AlbumStar{},
+		AlbumRating{},
+		ArtistStar{},
+		ArtistRating{},
+		TrackStar{},
+		TrackRating{},
+		TrackPlay{},
+		Play{},
+		Listen{},
+		PlayQueue{},
+		TranscodePreference{},
+		TranscodeRule{},
+		TranscodeProfile{},
+		Podcast{},
+		PodcastEpisode{},
+		Bookmark{},
+		InternetRadioStation{},
+		ChatMessage{},
+	)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate user data: %w", err)
+	}
+	for _, f := range []func(*gorm.DB, MigrationContext) error{
+		migrateAddExtraIndexes,
+		migrateTrackAddIndexOnAlbumID,
+		migrateAlbumAddIndexOnParentID,
+		migrateTrackAddIndexOnBrainzID,
+		migrateAlbumAddIndexOnBrainzID,
+		migrateAlbumAddIndexOnCreatedAt,
+		migrateCreateInitUser,
+	} {
+		if err := f(tx, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func migrateInitSchema(tx *gorm.DB, _ MigrationContext) error {
 	return tx.AutoMigrate(
 		Genre{},
@@ -879,3 +982,88 @@ func migrateAlbumAddIndexOnCreatedAt(tx *gorm.DB, _ MigrationContext) error {
 func migrateAddAlbumDiscTitles(tx *gorm.DB, _ MigrationContext) error {
 	return tx.AutoMigrate(AlbumDiscTitle{}).Error
 }
+
+func migrateSearchIndex(tx *gorm.DB, _ MigrationContext) error {
+	db := &DB{DB: tx}
+	if err := db.RebuildSearchIndex(); err != nil {
+		return fmt.Errorf("rebuild search index: %w", err)
+	}
+	if db.IsSQLite() && !probeSearchIndex(db) {
+		log.Printf("sqlite was built without fts5, search will not use a full text index")
+	}
+	return nil
+}
+
+func migrateAddListens(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(Listen{}).Error
+}
+
+func migrateAddTrackPlays(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(TrackPlay{}).Error
+}
+
+func migrateAddChatMessages(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(ChatMessage{}).Error
+}
+
+func migratePlayQueueCurrentIndex(tx *gorm.DB, _ MigrationContext) error {
+	step := tx.AutoMigrate(PlayQueue{})
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate: %w", err)
+	}
+
+	var queues []*PlayQueue
+	if err := tx.Find(&queues).Error; err != nil {
+		return fmt.Errorf("find queues: %w", err)
+	}
+	for _, queue := range queues {
+		index := slices.Index(queue.GetItems(), *queue.CurrentSID())
+		if index <= 0 {
+			continue
+		}
+		if err := tx.Model(queue).UpdateColumn("current_index", index).Error; err != nil {
+			return fmt.Errorf("update queue %d: %w", queue.ID, err)
+		}
+	}
+	return nil
+}
+
+func migratePlayQueueNames(tx *gorm.DB, _ MigrationContext) error {
+	step := tx.AutoMigrate(PlayQueue{})
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate: %w", err)
+	}
+
+	// the one queue a user had is now the queue of the client which last saved it
+	step = tx.Exec(`
+		UPDATE play_queues SET name=coalesce(changed_by, '') WHERE name IS NULL;
+	`)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step set names: %w", err)
+	}
+	return nil
+}
+
+func migrateAddTranscodeRules(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(TranscodeRule{}).Error
+}
+
+func migrateTranscodeRulePositions(tx *gorm.DB, _ MigrationContext) error {
+	step := tx.AutoMigrate(TranscodeRule{})
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate: %w", err)
+	}
+
+	// rules were checked in order of ID before
+	step = tx.Exec(`
+		UPDATE transcode_rules SET position=id;
+	`)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step set positions: %w", err)
+	}
+	return nil
+}
+
+func migrateAddTranscodeProfiles(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(TranscodeProfile{}).Error
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/deps"
+)
+
+// databases other than SQLite start from migrateCurrentSchema, make sure it matches what
+// running every migration does
+func TestMigrateCurrentSchema(t *testing.T) {
+	t.Parallel()
+
+	migrated, err := NewMock(deps.DBDriverOptions())
+	require.NoError(t, err)
+	if !migrated.IsSQLite() {
+		t.Skip("schema comparison needs sqlite")
+	}
+	require.NoError(t, migrated.Migrate(MigrationContext{}))
+
+	current, err := NewMock(deps.DBDriverOptions())
+	require.NoError(t, err)
+	require.NoError(t, migrateCurrentSchema(current.DB, MigrationContext{}))
+
+	require.Equal(t, sqliteSchema(t, migrated), sqliteSchema(t, current))
+
+	var users []*User
+	require.NoError(t, current.Find(&users).Error)
+	require.Len(t, users, 1)
+	require.True(t, users[0].IsAdmin)
+}
+
+// runs on whichever database the tests use, set TestDBURLEnv to check Postgres
+func TestMigrateAgain(t *testing.T) {
+	t.Parallel()
+
+	db, err := NewMock(deps.DBDriverOptions())
+	require.NoError(t, err)
+	require.NoError(t, db.Migrate(MigrationContext{}))
+	require.NoError(t, db.Migrate(MigrationContext{}))
+
+	for _, model := range []any{User{}, Setting{}, Album{}, Track{}, Play{}, Listen{}, TranscodeRule{}, TranscodeProfile{}, ChatMessage{}} {
+		require.True(t, db.HasTable(model), "%T", model)
+	}
+
+	var users []*User
+	require.NoError(t, db.Find(&users).Error)
+	require.Len(t, users, 1)
+}
+
+// sqliteSchema returns a description of every table's columns and indexes, ignoring gonic's
+// migrations table and the search index
+func sqliteSchema(t *testing.T, db *DB) []string {
+	t.Helper()
+
+	var tables []string
+	err := db.
+		Table("sqlite_master").
+		Where("type=? AND name NOT LIKE ? AND name NOT LIKE ? AND name<>?", "table", "sqlite_%", "search_%", "migrations").
+		Pluck("name", &tables).
+		Error
+	require.NoError(t, err)
+
+	var schema []string
+	for _, table := range tables {
+		rows, err := db.Raw(fmt.Sprintf(`SELECT name, "notnull", pk FROM pragma_table_info('%s')`, table)).Rows()
+		require.NoError(t, err)
+		for rows.Next() {
+			var name string
+			var notNull, pk int
+			require.NoError(t, rows.Scan(&name, &notNull, &pk))
+			schema = append(schema, fmt.Sprintf("column %s.%s not null=%d pk=%d", table, name, notNull, pk))
+		}
+		require.NoError(t, rows.Close())
+
+		rows, err = db.Raw(fmt.Sprintf(`
+			SELECT il.name, il."unique", group_concat(ii.name)
+			FROM pragma_index_list('%s') il, pragma_index_info(il.name) ii
+			WHERE il.origin<>'pk'
+			GROUP BY il.name
+		`, table)).Rows()
+		require.NoError(t, err)
+		for rows.Next() {
+			var name, columns string
+			var unique int
+			require.NoError(t, rows.Scan(&name, &unique, &columns))
+			schema = append(schema, fmt.Sprintf("index %s.%s unique=%d (%s)", table, name, unique, columns))
+		}
+		require.NoError(t, rows.Close())
+	}
+	sort.Strings(schema)
+	return schema
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// the search index is a set of FTS5 tables, one per searchable model, with the rowid of each
+// row matching the id of the model. FTS5 is compiled in to the Wasm SQLite build, but the Cgo build
+// needs the sqlite_fts5 build tag. when it's not available, the tables are not created and
+// HasSearchIndex reports false so that callers can fall back to LIKE queries. the same goes for
+// databases other than SQLite
+
+const searchTokenize = `tokenize='unicode61 remove_diacritics 2'`
+
+// column weights for ranking, eg. a match in a track title is worth more than one in its genre
+const (
+	searchRankArtists = `bm25(1.0)`
+	searchRankAlbums  = `bm25(10.0, 5.0, 2.0, 1.0)`
+	searchRankTracks  = `bm25(10.0, 5.0, 2.0, 2.0, 1.0)`
+)
+
+const searchInsertArtists = `
+	INSERT INTO search_artists (rowid, name)
+	SELECT artists.id,
+		concat_ws(' ', artists.name, artists.name_u_dec)
+	FROM artists
+	WHERE %s
+`
+
+const searchInsertAlbums = `
+	INSERT INTO search_albums (rowid, title, path, artist, genre)
+	SELECT albums.id,
+		concat_ws(' ', albums.tag_title, albums.tag_title_u_dec),
+		concat_ws(' ', albums.right_path, albums.right_path_u_dec),
+		(
+			SELECT group_concat(concat_ws(' ', artists.name, artists.name_u_dec), ' ')
+			FROM album_artists
+			JOIN artists ON artists.id=album_artists.artist_id
+			WHERE album_artists.album_id=albums.id
+		),
+		(
+			SELECT group_concat(genres.name, ' ')
+			FROM album_genres
+			JOIN genres ON genres.id=album_genres.genre_id
+			WHERE album_genres.album_id=albums.id
+		)
+	FROM albums
+	WHERE %s
+`
+
+const searchInsertTracks = `
+	INSERT INTO search_tracks (rowid, title, filename, artist, album, genre)
+	SELECT tracks.id,
+		concat_ws(' ', tracks.tag_title, tracks.tag_title_u_dec),
+		concat_ws(' ', tracks.filename, tracks.filename_u_dec),
+		(
+			SELECT group_concat(concat_ws(' ', artists.name, artists.name_u_dec), ' ')
+			FROM track_artists
+			JOIN artists ON artists.id=track_artists.artist_id
+			WHERE track_artists.track_id=tracks.id
+		),
+		concat_ws(' ', albums.tag_title, albums.tag_title_u_dec),
+		(
+			SELECT group_concat(genres.name, ' ')
+			FROM track_genres
+			JOIN genres ON genres.id=track_genres.genre_id
+			WHERE track_genres.track_id=tracks.id
+		)
+	FROM tracks
+	JOIN albums ON albums.id=tracks.album_id
+	WHERE %s
+`
+
+// HasSearchIndex reports if the search index exists and can be queried with the current driver. it's
+// worked out once after migrating, and again after each rebuild
+func (db *DB) HasSearchIndex() bool {
+	return db.searchIndex != nil && db.searchIndex.Load()
+}
+
+func (db *DB) checkSearchIndex() {
+	if db.searchIndex != nil {
+		db.searchIndex.Store(probeSearchIndex(db))
+	}
+}
+
+func probeSearchIndex(db *DB) bool {
+	if !db.IsSQLite() {
+		return false
+	}
+	return db.Exec(`SELECT 1 FROM search_artists, search_albums, search_tracks LIMIT 0`).Error == nil
+}
+
+// RebuildSearchIndex creates the search index if needed and repopulates it from scratch. it's a no-op
+// if FTS5 isn't available, or the database isn't SQLite
+func (db *DB) RebuildSearchIndex() error {
+	if !db.IsSQLite() {
+		return nil
+	}
+	defer db.checkSearchIndex()
+	if err := createSearchIndex(db); err != nil {
+		if isNoFTS(err) {
+			return nil
+		}
+		return fmt.Errorf("create: %w", err)
+	}
+	return db.Transaction(func(tx *DB) error {
+		for _, q := range []string{
+			`DELETE FROM search_artists`,
+			`DELETE FROM search_albums`,
+			`DELETE FROM search_tracks`,
+			fmt.Sprintf(searchInsertArtists, "1"),
+			fmt.Sprintf(searchInsertAlbums, "1"),
+			fmt.Sprintf(searchInsertTracks, "1"),
+		} {
+			if err := tx.Exec(q).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateSearchIndex reindexes the albums with the given IDs, their tracks, and any of
+// their artists that aren't indexed yet
+func (db *DB) UpdateSearchIndex(albumIDs []int64) error {
+	if len(albumIDs) == 0 {
+		return nil
+	}
+	steps := []struct {
+		query string
+		args  []any
+	}{
+		{`DELETE FROM search_albums WHERE rowid IN (?)`, []any{albumIDs}},
+		{`DELETE FROM search_tracks WHERE rowid IN (SELECT id FROM tracks WHERE album_id IN (?))`, []any{albumIDs}},
+		{fmt.Sprintf(searchInsertAlbums, "albums.id IN (?)"), []any{albumIDs}},
+		{fmt.Sprintf(searchInsertTracks, "tracks.album_id IN (?)"), []any{albumIDs}},
+		{fmt.Sprintf(searchInsertArtists, "artists.id IN (SELECT artist_id FROM artist_appearances WHERE album_id IN (?)) AND artists.id NOT IN (SELECT rowid FROM search_artists)"), []any{albumIDs}},
+	}
+	for _, step := range steps {
+		if err := db.Exec(step.query, step.args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanSearchIndex removes rows from the search index that no longer have a matching model
+func (db *DB) CleanSearchIndex() error {
+	for _, q := range []string{
+		`DELETE FROM search_artists WHERE rowid NOT IN (SELECT id FROM artists)`,
+		`DELETE FROM search_albums WHERE rowid NOT IN (SELECT id FROM albums)`,
+		`DELETE FROM search_tracks WHERE rowid NOT IN (SELECT id FROM tracks)`,
+	} {
+		if err := db.Exec(q).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchQuery converts a user's search query into an FTS5 query. every word must match a prefix of
+// a token in any column of the row. an empty string is returned if there is nothing to match
+func SearchQuery(query string) string {
+	var terms []string
+	for field := range strings.FieldsSeq(query) {
+		if !strings.ContainsFunc(field, isSearchTokenRune) {
+			continue
+		}
+		terms = append(terms, `"`+strings.ReplaceAll(field, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func isSearchTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+func createSearchIndex(db *DB) error {
+	for _, q := range []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS search_artists USING fts5(name, ` + searchTokenize + `)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS search_albums USING fts5(title, path, artist, genre, ` + searchTokenize + `)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS search_tracks USING fts5(title, filename, artist, album, genre, ` + searchTokenize + `)`,
+		`INSERT INTO search_artists (search_artists, rank) VALUES ('rank', '` + searchRankArtists + `')`,
+		`INSERT INTO search_albums (search_albums, rank) VALUES ('rank', '` + searchRankAlbums + `')`,
+		`INSERT INTO search_tracks (search_tracks, rank) VALUES ('rank', '` + searchRankTracks + `')`,
+	} {
+		if err := db.Exec(q).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNoFTS(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such module: fts5")
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchQuery(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		query    string
+		expected string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"radiohead", `"radiohead"*`},
+		{"radiohead  creep", `"radiohead"* "creep"*`},
+		{"ac/dc", `"ac/dc"*`},
+		{`say "hello"`, `"say"* """hello"""*`},
+		{"- & -", ""},
+		{"sigur rós", `"sigur"* "rós"*`},
+	}
+	for _, tc := range tcases {
+		t.Run(tc.query, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.expected, SearchQuery(tc.query))
+		})
+	}
+}
@@ -5,7 +5,8 @@ package deps
 import (
 	"net/url"
 
-	// Cgo database
+	// Cgo database. build with the sqlite_fts5 tag too for the full text search index,
+	// otherwise searching falls back to LIKE queries
 	_ "github.com/mattn/go-sqlite3"
 
 	// Cgo tagger
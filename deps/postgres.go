@@ -0,0 +1,6 @@
+package deps
+
+import (
+	// PostgreSQL database, for -db-url
+	_ "github.com/lib/pq"
+)
@@ -3,7 +3,9 @@ package handlerutil
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
@@ -56,6 +58,60 @@ func BasicCORS(next http.Handler) http.Handler {
 	})
 }
 
+// TrustedProxies sets the request's RemoteAddr to the client's address from X-Forwarded-For or X-Real-IP,
+// but only if the request came from one of the trusted proxies. otherwise anyone could say where they are
+func TrustedProxies(trusted []netip.Prefix) Middleware {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if addr := RemoteAddr(r); addr.IsValid() && isTrusted(addr) {
+				if client, ok := forwardedAddr(r, isTrusted); ok {
+					r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedAddr walks X-Forwarded-For from the closest hop, skipping our own proxies
+func forwardedAddr(r *http.Request, isTrusted func(netip.Addr) bool) (netip.Addr, bool) {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		if !isTrusted(addr) || i == 0 {
+			return addr.Unmap(), true
+		}
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// RemoteAddr is the address of the client, without the port
+func RemoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
 func Message(message string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, message)
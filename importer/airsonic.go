@@ -0,0 +1,171 @@
+package importer
+
+import (
+	"fmt"
+	"os"
+)
+
+// roleAdmin is the ID of the admin role in Airsonic's ROLE table
+const roleAdmin = 1
+
+// ReadAirsonic reads the SQL script of an Airsonic or Subsonic database. that's the .script file of an
+// HSQLDB database (eg. db/airsonic.script), or the output of H2's SCRIPT command.
+//
+// Airsonic doesn't count plays per user, so all plays are given to playsUser. if it's empty plays aren't read
+func ReadAirsonic(scriptPath string, playsUser string) (*Source, error) {
+	f, err := os.Open(scriptPath)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	script, err := parseSQLScript(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	src := &Source{}
+	users := script.Table("USERS")
+	for i := range users.Rows {
+		src.user(scriptString(users.Get(i, "USERNAME")))
+	}
+	roles := script.Table("USER_ROLE")
+	for i := range roles.Rows {
+		if scriptInt(roles.Get(i, "ROLE_ID")) == roleAdmin {
+			src.user(scriptString(roles.Get(i, "USERNAME"))).IsAdmin = true
+		}
+	}
+
+	type mediaFile struct {
+		path    string
+		isMusic bool
+	}
+	filesByID := map[int]mediaFile{}
+	filesByPath := map[string]mediaFile{}
+	files := script.Table("MEDIA_FILE")
+	for i := range files.Rows {
+		file := mediaFile{
+			path:    scriptString(files.Get(i, "PATH")),
+			isMusic: scriptString(files.Get(i, "TYPE")) == "MUSIC",
+		}
+		filesByID[scriptInt(files.Get(i, "ID"))] = file
+		filesByPath[file.path] = file
+
+		if playsUser != "" && file.isMusic {
+			if count := scriptInt(files.Get(i, "PLAY_COUNT")); count > 0 {
+				user := src.user(playsUser)
+				user.TrackPlays = append(user.TrackPlays, Play{Ref: file.path, Count: count, Time: parseTime(files.Get(i, "LAST_PLAYED"))})
+			}
+		}
+	}
+
+	// media files which aren't music are directories, which gonic treats as albums
+	starredFiles := script.Table("STARRED_MEDIA_FILE")
+	for i := range starredFiles.Rows {
+		file, ok := filesByID[scriptInt(starredFiles.Get(i, "MEDIA_FILE_ID"))]
+		if !ok {
+			continue
+		}
+		user := src.user(scriptString(starredFiles.Get(i, "USERNAME")))
+		star := Star{Ref: file.path, Time: parseTime(starredFiles.Get(i, "CREATED"))}
+		if file.isMusic {
+			user.TrackStars = append(user.TrackStars, star)
+		} else {
+			user.AlbumStars = append(user.AlbumStars, star)
+		}
+	}
+
+	albumPaths := map[int]string{}
+	albums := script.Table("ALBUM")
+	for i := range albums.Rows {
+		albumPaths[scriptInt(albums.Get(i, "ID"))] = scriptString(albums.Get(i, "PATH"))
+	}
+	starredAlbums := script.Table("STARRED_ALBUM")
+	for i := range starredAlbums.Rows {
+		albumPath, ok := albumPaths[scriptInt(starredAlbums.Get(i, "ALBUM_ID"))]
+		if !ok {
+			continue
+		}
+		user := src.user(scriptString(starredAlbums.Get(i, "USERNAME")))
+		user.AlbumStars = append(user.AlbumStars, Star{Ref: albumPath, Time: parseTime(starredAlbums.Get(i, "CREATED"))})
+	}
+
+	artistNames := map[int]string{}
+	artists := script.Table("ARTIST")
+	for i := range artists.Rows {
+		artistNames[scriptInt(artists.Get(i, "ID"))] = scriptString(artists.Get(i, "NAME"))
+	}
+	starredArtists := script.Table("STARRED_ARTIST")
+	for i := range starredArtists.Rows {
+		name, ok := artistNames[scriptInt(starredArtists.Get(i, "ARTIST_ID"))]
+		if !ok {
+			continue
+		}
+		user := src.user(scriptString(starredArtists.Get(i, "USERNAME")))
+		user.ArtistStars = append(user.ArtistStars, Star{Ref: name, Time: parseTime(starredArtists.Get(i, "CREATED"))})
+	}
+
+	// ratings refer to files by path, or by ID in newer versions
+	ratings := script.Table("USER_RATING")
+	for i := range ratings.Rows {
+		file, ok := filesByPath[scriptString(ratings.Get(i, "PATH"))]
+		if !ok {
+			file, ok = filesByID[scriptInt(ratings.Get(i, "MEDIA_FILE_ID"))]
+		}
+		rating := int(scriptFloat(ratings.Get(i, "RATING")))
+		if !ok || rating < 1 || rating > 5 {
+			continue
+		}
+		user := src.user(scriptString(ratings.Get(i, "USERNAME")))
+		if file.isMusic {
+			user.TrackRatings = append(user.TrackRatings, Rating{Ref: file.path, Rating: rating})
+		} else {
+			user.AlbumRatings = append(user.AlbumRatings, Rating{Ref: file.path, Rating: rating})
+		}
+	}
+
+	playlistsByID := map[int]*Playlist{}
+	playlists := script.Table("PLAYLIST")
+	for i := range playlists.Rows {
+		p := &Playlist{
+			Owner:   scriptString(playlists.Get(i, "USERNAME")),
+			Name:    scriptString(playlists.Get(i, "NAME")),
+			Comment: scriptString(playlists.Get(i, "COMMENT")),
+			Public:  playlists.Get(i, "IS_PUBLIC") == true,
+		}
+		src.user(p.Owner)
+		playlistsByID[scriptInt(playlists.Get(i, "ID"))] = p
+		src.Playlists = append(src.Playlists, p)
+	}
+	playlistFiles := script.Table("PLAYLIST_FILE")
+	for i := range playlistFiles.Rows {
+		p, ok := playlistsByID[scriptInt(playlistFiles.Get(i, "PLAYLIST_ID"))]
+		if !ok {
+			continue
+		}
+		if file, ok := filesByID[scriptInt(playlistFiles.Get(i, "MEDIA_FILE_ID"))]; ok {
+			p.Paths = append(p.Paths, file.path)
+		}
+	}
+
+	return src, nil
+}
+
+func scriptString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func scriptInt(v any) int {
+	return int(scriptFloat(v))
+}
+
+func scriptFloat(v any) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,453 @@
+// Package importer reads the users, annotations, play counts, and playlists from the database of another
+// Subsonic server, and maps them onto gonic's library.
+//
+// the other server's files are matched with gonic's by path. since the other server might have had its
+// music somewhere else, a path matches a track or album if it ends with the track or album's path relative
+// to one of gonic's music paths. everything matched for a user is imported with the userdata package, and
+// their play counts are added to the ones they already have in gonic
+package importer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/userdata"
+)
+
+// Source is what was read from the other server's database
+type Source struct {
+	Users     []*User
+	Playlists []*Playlist
+}
+
+// User is a user of the other server. artists are referred to by name, albums by the path of their
+// directory, and tracks by the path of their file
+type User struct {
+	Name          string
+	IsAdmin       bool
+	ArtistStars   []Star
+	ArtistRatings []Rating
+	AlbumStars    []Star
+	AlbumRatings  []Rating
+	TrackStars    []Star
+	TrackRatings  []Rating
+	TrackPlays    []Play
+}
+
+type Star struct {
+	Ref  string
+	Time time.Time
+}
+
+type Rating struct {
+	Ref    string
+	Rating int
+}
+
+type Play struct {
+	Ref   string
+	Count int
+	Time  time.Time
+}
+
+type Playlist struct {
+	Owner   string
+	Name    string
+	Comment string
+	Public  bool
+	Paths   []string
+}
+
+// user returns the user with the name, adding them if they haven't been seen yet
+func (s *Source) user(name string) *User {
+	for _, u := range s.Users {
+		if u.Name == name {
+			return u
+		}
+	}
+	u := &User{Name: name}
+	s.Users = append(s.Users, u)
+	return u
+}
+
+// Report describes what an import did, or would do if it's a dry run
+type Report struct {
+	DryRun    bool
+	Users     []*UserReport
+	Playlists []string
+	Unmatched []string
+}
+
+type UserReport struct {
+	Name     string
+	Password string // set if the user was created
+	Imported map[string]int
+}
+
+func (r *Report) unmatched(kind string, ref string) {
+	r.Unmatched = append(r.Unmatched, fmt.Sprintf("%s: %s", kind, ref))
+}
+
+func (r *Report) Write(w io.Writer) {
+	if r.DryRun {
+		fmt.Fprintf(w, "dry run, nothing was changed\n")
+	}
+	for _, u := range r.Users {
+		switch {
+		case u.Password != "" && r.DryRun:
+			fmt.Fprintf(w, "user %q would be created\n", u.Name)
+		case u.Password != "":
+			fmt.Fprintf(w, "user %q created with password %q\n", u.Name, u.Password)
+		default:
+			fmt.Fprintf(w, "user %q\n", u.Name)
+		}
+		kinds := make([]string, 0, len(u.Imported))
+		for kind := range u.Imported {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "\t%s: %d\n", kind, u.Imported[kind])
+		}
+	}
+	for _, p := range r.Playlists {
+		fmt.Fprintf(w, "playlist %s\n", p)
+	}
+	if len(r.Unmatched) > 0 {
+		fmt.Fprintf(w, "%d unmatched:\n", len(r.Unmatched))
+		for _, u := range r.Unmatched {
+			fmt.Fprintf(w, "\t%s\n", u)
+		}
+	}
+}
+
+var errDryRun = errors.New("dry run")
+
+// Import maps src onto the library. if dryRun is set nothing is changed, and the report says what would
+// be imported. playlists are written to playlistStore, or skipped if it's nil
+func Import(dbc *db.DB, playlistStore *playlist.Store, src *Source, dryRun bool) (*Report, error) {
+	lib, err := loadLibrary(dbc)
+	if err != nil {
+		return nil, fmt.Errorf("load library: %w", err)
+	}
+
+	// every user is imported in one transaction, so that a failure part way doesn't leave some of them done.
+	// a dry run does the same and rolls it back, so that its report is the same as the real one's
+	report := &Report{DryRun: dryRun}
+	err = dbc.Transaction(func(tx *db.DB) error {
+		for _, srcUser := range src.Users {
+			data, userReport := mapUser(lib, srcUser, report)
+			report.Users = append(report.Users, userReport)
+
+			user := tx.GetUserByName(srcUser.Name)
+			if user == nil {
+				userReport.Password = randomPassword()
+				user = &db.User{Name: srcUser.Name, Password: userReport.Password, IsAdmin: srcUser.IsAdmin}
+				if err := tx.Create(user).Error; err != nil {
+					return fmt.Errorf("create user %q: %w", srcUser.Name, err)
+				}
+			}
+			userdataReport, err := userdata.Add(tx, user, data)
+			if err != nil {
+				return fmt.Errorf("import user %q: %w", srcUser.Name, err)
+			}
+			for _, u := range userdataReport.Unmatched {
+				report.unmatched(fmt.Sprintf("user %q", srcUser.Name), u)
+			}
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	// playlists which were imported before are replaced, so that importing again doesn't add copies of them
+	var existing map[playlistKey]string
+	if playlistStore != nil {
+		if existing, err = existingPlaylists(playlistStore); err != nil {
+			return nil, fmt.Errorf("find existing playlists: %w", err)
+		}
+	}
+
+	for _, srcPlaylist := range src.Playlists {
+		var items []string
+		for _, p := range srcPlaylist.Paths {
+			track, ok := lib.track(p)
+			if !ok {
+				report.unmatched(fmt.Sprintf("playlist %q item", srcPlaylist.Name), p)
+				continue
+			}
+			items = append(items, track.absPath)
+		}
+		desc := fmt.Sprintf("%q of %q, %d of %d items", srcPlaylist.Name, srcPlaylist.Owner, len(items), len(srcPlaylist.Paths))
+		if playlistStore == nil {
+			report.Playlists = append(report.Playlists, desc+", skipped since there's no playlists path")
+			continue
+		}
+		user := dbc.GetUserByName(srcPlaylist.Owner)
+		var relPath string
+		if user != nil {
+			relPath = existing[playlistKey{userID: user.ID, name: srcPlaylist.Name}]
+		}
+		if relPath != "" {
+			desc += ", replacing the existing one"
+		}
+		report.Playlists = append(report.Playlists, desc)
+		if dryRun {
+			continue
+		}
+		if user == nil {
+			return nil, fmt.Errorf("find owner of playlist %q", srcPlaylist.Name)
+		}
+		if relPath == "" {
+			relPath = playlist.NewPath(user.ID, srcPlaylist.Name)
+		}
+		err := playlistStore.Write(relPath, &playlist.Playlist{
+			UserID:    user.ID,
+			Name:      srcPlaylist.Name,
+			Comment:   srcPlaylist.Comment,
+			IsPublic:  srcPlaylist.Public,
+			Items:     items,
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("write playlist %q: %w", srcPlaylist.Name, err)
+		}
+	}
+
+	return report, nil
+}
+
+type playlistKey struct {
+	userID int
+	name   string
+}
+
+// existingPlaylists finds the paths of the playlists in the store by their owner and name
+func existingPlaylists(store *playlist.Store) (map[playlistKey]string, error) {
+	paths, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	existing := map[playlistKey]string{}
+	for _, relPath := range paths {
+		p, err := store.Read(relPath)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", relPath, err)
+		}
+		existing[playlistKey{userID: p.UserID, name: p.Name}] = relPath
+	}
+	return existing, nil
+}
+
+// mapUser finds the library's refs for a user's items. album plays are made from the track plays, since
+// gonic counts both
+func mapUser(lib *library, u *User, report *Report) (*userdata.Data, *UserReport) {
+	data := &userdata.Data{
+		Version: userdata.Version,
+		User:    userdata.User{Name: u.Name},
+	}
+	userReport := &UserReport{Name: u.Name, Imported: map[string]int{}}
+	unmatched := func(kind, ref string) {
+		report.unmatched(fmt.Sprintf("%s of %q", kind, u.Name), ref)
+	}
+
+	for _, s := range u.ArtistStars {
+		if !lib.artists[s.Ref] {
+			unmatched("artist star", s.Ref)
+			continue
+		}
+		data.ArtistStars = append(data.ArtistStars, &userdata.ArtistStar{Artist: userdata.ArtistRef{Name: s.Ref}, StarDate: s.Time})
+	}
+	for _, r := range u.ArtistRatings {
+		if !lib.artists[r.Ref] {
+			unmatched("artist rating", r.Ref)
+			continue
+		}
+		data.ArtistRatings = append(data.ArtistRatings, &userdata.ArtistRating{Artist: userdata.ArtistRef{Name: r.Ref}, Rating: r.Rating})
+	}
+	for _, s := range u.AlbumStars {
+		album, ok := lib.album(s.Ref)
+		if !ok {
+			unmatched("album star", s.Ref)
+			continue
+		}
+		data.AlbumStars = append(data.AlbumStars, &userdata.AlbumStar{Album: album.toAlbumRef(), StarDate: s.Time})
+	}
+	for _, r := range u.AlbumRatings {
+		album, ok := lib.album(r.Ref)
+		if !ok {
+			unmatched("album rating", r.Ref)
+			continue
+		}
+		data.AlbumRatings = append(data.AlbumRatings, &userdata.AlbumRating{Album: album.toAlbumRef(), Rating: r.Rating})
+	}
+	for _, s := range u.TrackStars {
+		track, ok := lib.track(s.Ref)
+		if !ok {
+			unmatched("track star", s.Ref)
+			continue
+		}
+		data.TrackStars = append(data.TrackStars, &userdata.TrackStar{Track: track.toTrackRef(), StarDate: s.Time})
+	}
+	for _, r := range u.TrackRatings {
+		track, ok := lib.track(r.Ref)
+		if !ok {
+			unmatched("track rating", r.Ref)
+			continue
+		}
+		data.TrackRatings = append(data.TrackRatings, &userdata.TrackRating{Track: track.toTrackRef(), Rating: r.Rating})
+	}
+	albumPlays := map[string]*userdata.AlbumPlay{}
+	for _, p := range u.TrackPlays {
+		track, ok := lib.track(p.Ref)
+		if !ok {
+			unmatched("track play", p.Ref)
+			continue
+		}
+		data.TrackPlays = append(data.TrackPlays, &userdata.TrackPlay{Track: track.toTrackRef(), Count: p.Count, Time: p.Time})
+
+		albumKey := path.Join(track.musicFolder, track.albumRef)
+		albumPlay, ok := albumPlays[albumKey]
+		if !ok {
+			albumPlay = &userdata.AlbumPlay{Album: userdata.AlbumRef{Path: track.albumRef, MusicFolder: track.musicFolder}}
+			albumPlays[albumKey] = albumPlay
+			data.AlbumPlays = append(data.AlbumPlays, albumPlay)
+		}
+		albumPlay.Count += p.Count
+		albumPlay.Length += p.Count * track.length
+		if p.Time.After(albumPlay.Time) {
+			albumPlay.Time = p.Time
+		}
+	}
+
+	userReport.Imported["artist stars"] = len(data.ArtistStars)
+	userReport.Imported["artist ratings"] = len(data.ArtistRatings)
+	userReport.Imported["album stars"] = len(data.AlbumStars)
+	userReport.Imported["album ratings"] = len(data.AlbumRatings)
+	userReport.Imported["track stars"] = len(data.TrackStars)
+	userReport.Imported["track ratings"] = len(data.TrackRatings)
+	userReport.Imported["track plays"] = len(data.TrackPlays)
+	for kind, n := range userReport.Imported {
+		if n == 0 {
+			delete(userReport.Imported, kind)
+		}
+	}
+	return data, userReport
+}
+
+type libraryItem struct {
+	ref         string // the path in the userdata format, see userdata.AlbumRef and userdata.TrackRef
+	musicFolder string
+	absPath     string
+	albumRef    string
+	length      int
+}
+
+func (i *libraryItem) toAlbumRef() userdata.AlbumRef {
+	return userdata.AlbumRef{Path: i.ref, MusicFolder: i.musicFolder}
+}
+
+func (i *libraryItem) toTrackRef() userdata.TrackRef {
+	return userdata.TrackRef{Path: i.ref, MusicFolder: i.musicFolder}
+}
+
+// library indexes the tracks and albums by their absolute path and their path relative to their music path,
+// and artists by name. the absolute path wins when there's more than one music path with the same relative path
+type library struct {
+	tracks  libraryItems
+	albums  libraryItems
+	artists map[string]bool
+}
+
+func loadLibrary(dbc *db.DB) (*library, error) {
+	var rows []struct {
+		RootDir   string
+		LeftPath  string
+		RightPath string
+		Filename  string
+		Length    int
+	}
+	err := dbc.
+		Table("tracks").
+		Select("albums.root_dir, albums.left_path, albums.right_path, tracks.filename, tracks.length").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Order("tracks.id").
+		Scan(&rows).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	var artistNames []string
+	if err := dbc.Model(db.Artist{}).Pluck("name", &artistNames).Error; err != nil {
+		return nil, err
+	}
+
+	lib := &library{
+		tracks:  libraryItems{},
+		albums:  libraryItems{},
+		artists: map[string]bool{},
+	}
+	for _, name := range artistNames {
+		lib.artists[name] = true
+	}
+	for _, r := range rows {
+		albumRef := r.LeftPath + r.RightPath
+		albumAbsPath := path.Join(r.RootDir, r.LeftPath, r.RightPath)
+		if _, ok := lib.albums[matchKey(albumAbsPath)]; !ok {
+			lib.albums.add(albumRef, &libraryItem{ref: albumRef, musicFolder: r.RootDir, absPath: albumAbsPath})
+		}
+		trackRef := albumRef + "/" + r.Filename
+		trackAbsPath := path.Join(albumAbsPath, r.Filename)
+		lib.tracks.add(trackRef, &libraryItem{ref: trackRef, musicFolder: r.RootDir, absPath: trackAbsPath, albumRef: albumRef, length: r.Length})
+	}
+	return lib, nil
+}
+
+type libraryItems map[string]*libraryItem
+
+// add indexes item by its absolute path, and by its relative path if no other music path has it
+func (l libraryItems) add(ref string, item *libraryItem) {
+	l[matchKey(item.absPath)] = item
+	if _, ok := l[path.Clean(ref)]; !ok {
+		l[path.Clean(ref)] = item
+	}
+}
+
+func (l *library) track(p string) (*libraryItem, bool) { return matchSuffix(l.tracks, p) }
+func (l *library) album(p string) (*libraryItem, bool) { return matchSuffix(l.albums, p) }
+
+// matchSuffix finds the item whose path is the longest suffix of p
+func matchSuffix(items libraryItems, p string) (*libraryItem, bool) {
+	parts := strings.Split(matchKey(p), "/")
+	for i := range parts {
+		if item, ok := items[strings.Join(parts[i:], "/")]; ok {
+			return item, true
+		}
+	}
+	return nil, false
+}
+
+// matchKey normalises a path from another server, or one of ours, for matchSuffix
+func matchKey(p string) string {
+	return strings.TrimPrefix(path.Clean(strings.ReplaceAll(p, `\`, "/")), "/")
+}
+
+func randomPassword() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
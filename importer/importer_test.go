@@ -0,0 +1,301 @@
+package importer_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/deps"
+	"go.senan.xyz/gonic/importer"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/playlist"
+)
+
+func TestNavidrome(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	srcPath := filepath.Join(t.TempDir(), "navidrome.db")
+	dialect, dsn := db.ParseURL(srcPath, deps.DBDriverOptions())
+	srcDB, err := sql.Open(dialect, dsn)
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE user (id varchar PRIMARY KEY, user_name varchar, is_admin bool)`,
+		`CREATE TABLE media_file (id varchar PRIMARY KEY, path varchar, album_id varchar)`,
+		`CREATE TABLE artist (id varchar PRIMARY KEY, name varchar)`,
+		`CREATE TABLE annotation (user_id varchar, item_id varchar, item_type varchar, play_count integer, play_date datetime, rating integer, starred bool, starred_at datetime)`,
+		`CREATE TABLE playlist (id varchar PRIMARY KEY, name varchar, comment varchar, owner_id varchar, public bool)`,
+		`CREATE TABLE playlist_tracks (id integer, playlist_id varchar, media_file_id varchar)`,
+		`INSERT INTO user VALUES ('u1', 'admin', true), ('u2', 'listener', false)`,
+		`INSERT INTO media_file VALUES
+			('f1', '/music/artist-0/album-0/track-0.flac', 'a1'),
+			('f2', '/music/artist-0/album-0/track-1.flac', 'a1'),
+			('f3', '/music/artist-9/album-0/track-0.flac', 'a2')`,
+		`INSERT INTO artist VALUES ('r1', 'artist-1'), ('r2', 'artist-9')`,
+		`INSERT INTO annotation VALUES
+			('u2', 'f1', 'media_file', 3, '2023-05-06 07:08:09', 0, true, '2023-01-02 03:04:05'),
+			('u2', 'f2', 'media_file', 2, '2023-05-07 07:08:09', 4, false, NULL),
+			('u2', 'f3', 'media_file', 1, '2023-05-08 07:08:09', 0, false, NULL),
+			('u2', 'a1', 'album', 0, NULL, 5, true, '2023-01-02 03:04:05'),
+			('u2', 'r1', 'artist', 0, NULL, 0, true, '2023-01-02 03:04:05'),
+			('u2', 'r2', 'artist', 0, NULL, 0, true, '2023-01-02 03:04:05')`,
+		`INSERT INTO playlist VALUES ('p1', 'road trip', 'for the car', 'u2', true)`,
+		`INSERT INTO playlist_tracks VALUES (1, 'p1', 'f2'), (2, 'p1', 'f3'), (3, 'p1', 'f1')`,
+	} {
+		_, err := srcDB.Exec(stmt)
+		require.NoError(t, err)
+	}
+	require.NoError(t, srcDB.Close())
+
+	src, err := importer.ReadNavidrome(srcPath)
+	require.NoError(t, err)
+
+	store, err := playlist.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	// a dry run reports, but doesn't change anything
+	report, err := importer.Import(m.DB(), store, src, true)
+	require.NoError(t, err)
+	require.Len(t, report.Users, 2)
+	require.Equal(t, "listener", report.Users[1].Name)
+	require.NotEmpty(t, report.Users[1].Password)
+	require.Equal(t, map[string]int{
+		"artist stars":  1,
+		"album stars":   1,
+		"album ratings": 1,
+		"track stars":   1,
+		"track ratings": 1,
+		"track plays":   2,
+	}, report.Users[1].Imported)
+	require.Equal(t, []string{
+		`artist star of "listener": artist-9`,
+		`track play of "listener": /music/artist-9/album-0/track-0.flac`,
+		`playlist "road trip" item: /music/artist-9/album-0/track-0.flac`,
+	}, report.Unmatched)
+	require.Nil(t, m.DB().GetUserByName("listener"))
+	paths, err := store.List()
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	_, err = importer.Import(m.DB(), store, src, false)
+	require.NoError(t, err)
+
+	user := m.DB().GetUserByName("listener")
+	require.NotNil(t, user)
+	require.False(t, user.IsAdmin)
+
+	track0 := findTrack(t, m.DB(), "artist-0/album-0/track-0.flac")
+	track1 := findTrack(t, m.DB(), "artist-0/album-0/track-1.flac")
+
+	var trackStar db.TrackStar
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).First(&trackStar).Error)
+	require.Equal(t, track0.ID, trackStar.TrackID)
+	require.Equal(t, time.Date(2023, time.January, 2, 3, 4, 5, 0, time.UTC), trackStar.StarDate.UTC())
+
+	var trackRating db.TrackRating
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).First(&trackRating).Error)
+	require.Equal(t, track1.ID, trackRating.TrackID)
+	require.Equal(t, 4, trackRating.Rating)
+
+	var trackPlays []*db.TrackPlay
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).Order("track_id").Find(&trackPlays).Error)
+	require.Len(t, trackPlays, 2)
+	require.Equal(t, 3, trackPlays[0].Count)
+
+	var albumPlay db.Play
+	require.NoError(t, m.DB().Where("user_id=? AND album_id=?", user.ID, track0.AlbumID).First(&albumPlay).Error)
+	require.Equal(t, 5, albumPlay.Count)
+
+	var albumRating db.AlbumRating
+	require.NoError(t, m.DB().Where("user_id=? AND album_id=?", user.ID, track0.AlbumID).First(&albumRating).Error)
+	require.Equal(t, 5, albumRating.Rating)
+
+	var count int
+	require.NoError(t, m.DB().Model(db.ArtistStar{}).Where("user_id=?", user.ID).Count(&count).Error)
+	require.Equal(t, 1, count)
+
+	paths, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	pl, err := store.Read(paths[0])
+	require.NoError(t, err)
+	require.Equal(t, "road trip", pl.Name)
+	require.Equal(t, user.ID, pl.UserID)
+	require.True(t, pl.IsPublic)
+	require.Equal(t, []string{track1.AbsPath(), track0.AbsPath()}, pl.Items)
+
+	// importing again replaces the playlist, and adds the plays again
+	report, err = importer.Import(m.DB(), store, src, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{`"road trip" of "listener", 2 of 3 items, replacing the existing one`}, report.Playlists)
+	paths, err = store.List()
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+
+	require.NoError(t, m.DB().Where("user_id=? AND track_id=?", user.ID, trackPlays[0].TrackID).First(trackPlays[0]).Error)
+	require.Equal(t, 6, trackPlays[0].Count)
+	var albumPlays []*db.Play
+	require.NoError(t, m.DB().Where("user_id=? AND album_id=?", user.ID, track0.AlbumID).Find(&albumPlays).Error)
+	require.Len(t, albumPlays, 1)
+	require.Equal(t, 10, albumPlays[0].Count)
+}
+
+func TestAirsonic(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	src, err := importer.ReadAirsonic(filepath.Join("testdata", "airsonic.script"), "admin")
+	require.NoError(t, err)
+
+	report, err := importer.Import(m.DB(), nil, src, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		`track play of "admin": /var/music/artist-9/album-0/track-0.flac`,
+		`track star of "o'brien": /var/music/artist-9/album-0/track-0.flac`,
+		`playlist "mix" item: /var/music/artist-9/album-0/track-0.flac`,
+	}, report.Unmatched)
+	require.Equal(t, []string{`"mix" of "o'brien", 2 of 3 items, skipped since there's no playlists path`}, report.Playlists)
+
+	admin := m.DB().GetUserByName("admin")
+	user := m.DB().GetUserByName("o'brien")
+	require.NotNil(t, user)
+	require.False(t, user.IsAdmin)
+
+	track0 := findTrack(t, m.DB(), "artist-0/album-0/track-0.flac")
+	track1 := findTrack(t, m.DB(), "artist-0/album-0/track-1.flac")
+
+	var trackPlay db.TrackPlay
+	require.NoError(t, m.DB().Where("user_id=? AND track_id=?", admin.ID, track0.ID).First(&trackPlay).Error)
+	require.Equal(t, 4, trackPlay.Count)
+
+	// a starred directory is an album
+	var count int
+	require.NoError(t, m.DB().Model(db.AlbumStar{}).Where("user_id=? AND album_id=?", admin.ID, track0.AlbumID).Count(&count).Error)
+	require.Equal(t, 1, count)
+
+	var trackStar db.TrackStar
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).First(&trackStar).Error)
+	require.Equal(t, track0.ID, trackStar.TrackID)
+
+	var albumStars []*db.AlbumStar
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).Find(&albumStars).Error)
+	require.Len(t, albumStars, 1)
+	require.NotEqual(t, track0.AlbumID, albumStars[0].AlbumID)
+
+	var albumRating db.AlbumRating
+	require.NoError(t, m.DB().Where("user_id=? AND album_id=?", user.ID, track0.AlbumID).First(&albumRating).Error)
+	require.Equal(t, 4, albumRating.Rating)
+
+	var trackRating db.TrackRating
+	require.NoError(t, m.DB().Where("user_id=? AND track_id=?", user.ID, track1.ID).First(&trackRating).Error)
+	require.Equal(t, 5, trackRating.Rating)
+
+	require.NoError(t, m.DB().Model(db.ArtistStar{}).Where("user_id=?", user.ID).Count(&count).Error)
+	require.Equal(t, 1, count)
+}
+
+func TestMusicFolders(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.NewWithDirs(t, []string{"m-0", "m-1"})
+	m.AddItemsPrefix("m-0")
+	m.AddItemsPrefix("m-1")
+	m.ScanAndClean()
+
+	// the other server had the same music folders
+	srcPath := filepath.Join(t.TempDir(), "navidrome.db")
+	dialect, dsn := db.ParseURL(srcPath, deps.DBDriverOptions())
+	srcDB, err := sql.Open(dialect, dsn)
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE user (id varchar PRIMARY KEY, user_name varchar, is_admin bool)`,
+		`CREATE TABLE media_file (id varchar PRIMARY KEY, path varchar, album_id varchar)`,
+		`CREATE TABLE artist (id varchar PRIMARY KEY, name varchar)`,
+		`CREATE TABLE annotation (user_id varchar, item_id varchar, item_type varchar, play_count integer, play_date datetime, rating integer, starred bool, starred_at datetime)`,
+		`CREATE TABLE playlist (id varchar PRIMARY KEY, name varchar, comment varchar, owner_id varchar, public bool)`,
+		`CREATE TABLE playlist_tracks (id integer, playlist_id varchar, media_file_id varchar)`,
+		`INSERT INTO user VALUES ('u1', 'listener', false)`,
+		`INSERT INTO media_file VALUES ('f1', '` + filepath.Join(m.TmpDir(), "m-1", "artist-0/album-0/track-0.flac") + `', 'a1')`,
+		`INSERT INTO annotation VALUES ('u1', 'f1', 'media_file', 3, '2023-05-06 07:08:09', 0, true, '2023-01-02 03:04:05')`,
+	} {
+		_, err := srcDB.Exec(stmt)
+		require.NoError(t, err)
+	}
+	require.NoError(t, srcDB.Close())
+
+	src, err := importer.ReadNavidrome(srcPath)
+	require.NoError(t, err)
+	store, err := playlist.NewStore(t.TempDir())
+	require.NoError(t, err)
+	report, err := importer.Import(m.DB(), store, src, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Unmatched)
+
+	var track db.Track
+	err = m.DB().
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.root_dir=? AND albums.left_path=? AND albums.right_path=? AND tracks.filename=?", filepath.Join(m.TmpDir(), "m-1"), "artist-0/", "album-0", "track-0.flac").
+		First(&track).
+		Error
+	require.NoError(t, err)
+
+	user := m.DB().GetUserByName("listener")
+	require.NotNil(t, user)
+	var trackStar db.TrackStar
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).First(&trackStar).Error)
+	require.Equal(t, track.ID, trackStar.TrackID)
+	var albumPlay db.Play
+	require.NoError(t, m.DB().Where("user_id=?", user.ID).First(&albumPlay).Error)
+	require.Equal(t, track.AlbumID, albumPlay.AlbumID)
+}
+
+func TestImportAtomic(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+	if !m.DB().IsSQLite() {
+		t.Skip("failing the import needs an sqlite trigger")
+	}
+	require.NoError(t, m.DB().Exec(`CREATE TRIGGER fail_user BEFORE INSERT ON users WHEN NEW.name='second' BEGIN SELECT RAISE(ABORT, 'no'); END`).Error)
+
+	src := &importer.Source{Users: []*importer.User{
+		{Name: "first", TrackStars: []importer.Star{{Ref: "/music/artist-0/album-0/track-0.flac"}}},
+		{Name: "second"},
+	}}
+	_, err := importer.Import(m.DB(), nil, src, false)
+	require.ErrorContains(t, err, `create user "second"`)
+
+	// the first user was rolled back too
+	require.Nil(t, m.DB().GetUserByName("first"))
+	var count int
+	require.NoError(t, m.DB().Model(db.TrackStar{}).Count(&count).Error)
+	require.Zero(t, count)
+}
+
+func findTrack(t *testing.T, dbc *db.DB, relPath string) *db.Track {
+	t.Helper()
+
+	albumPath, filename := filepath.Split(relPath)
+	left, right := filepath.Split(filepath.Clean(albumPath))
+	var track db.Track
+	err := dbc.
+		Preload("Album").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.left_path=? AND albums.right_path=? AND tracks.filename=?", left, right, filename).
+		First(&track).
+		Error
+	require.NoError(t, err)
+	return &track
+}
@@ -0,0 +1,190 @@
+package importer
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// ReadNavidrome reads a Navidrome SQLite database (navidrome.db). annotations of media files, albums, and
+// artists are read per user. albums are referred to by the directory of one of their files
+func ReadNavidrome(dbPath string) (*Source, error) {
+	dialect, dsn := db.ParseURL(dbPath, url.Values{"mode": {"ro"}})
+	sqlDB, err := sql.Open(dialect, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer sqlDB.Close()
+
+	src := &Source{}
+	usersByID := map[string]*User{}
+	err = query(sqlDB, `SELECT id, user_name, is_admin FROM user ORDER BY user_name`, func(rows *sql.Rows) error {
+		var id, name string
+		var isAdmin bool
+		if err := rows.Scan(&id, &name, &isAdmin); err != nil {
+			return err
+		}
+		user := src.user(name)
+		user.IsAdmin = isAdmin
+		usersByID[id] = user
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read users: %w", err)
+	}
+
+	filePaths := map[string]string{}
+	albumPaths := map[string]string{}
+	err = query(sqlDB, `SELECT id, path, album_id FROM media_file ORDER BY path`, func(rows *sql.Rows) error {
+		var id, filePath, albumID string
+		if err := rows.Scan(&id, &filePath, &albumID); err != nil {
+			return err
+		}
+		filePaths[id] = filePath
+		if _, ok := albumPaths[albumID]; !ok {
+			albumPaths[albumID] = path.Dir(filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read media files: %w", err)
+	}
+
+	artistNames := map[string]string{}
+	err = query(sqlDB, `SELECT id, name FROM artist`, func(rows *sql.Rows) error {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		artistNames[id] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read artists: %w", err)
+	}
+
+	err = query(sqlDB, `
+		SELECT user_id, item_id, item_type, coalesce(play_count, 0), play_date, coalesce(rating, 0), coalesce(starred, false), starred_at
+		FROM annotation
+		ORDER BY item_type, item_id`,
+		func(rows *sql.Rows) error {
+			var userID, itemID, itemType string
+			var playCount, rating int
+			var starred bool
+			var playDate, starredAt any
+			if err := rows.Scan(&userID, &itemID, &itemType, &playCount, &playDate, &rating, &starred, &starredAt); err != nil {
+				return err
+			}
+			user, ok := usersByID[userID]
+			if !ok {
+				return nil
+			}
+			var ref string
+			var stars *[]Star
+			var ratings *[]Rating
+			switch itemType {
+			case "media_file":
+				ref, stars, ratings = filePaths[itemID], &user.TrackStars, &user.TrackRatings
+				if ref != "" && playCount > 0 {
+					user.TrackPlays = append(user.TrackPlays, Play{Ref: ref, Count: playCount, Time: parseTime(playDate)})
+				}
+			case "album":
+				ref, stars, ratings = albumPaths[itemID], &user.AlbumStars, &user.AlbumRatings
+			case "artist":
+				ref, stars, ratings = artistNames[itemID], &user.ArtistStars, &user.ArtistRatings
+			}
+			if ref == "" {
+				return nil
+			}
+			if starred {
+				*stars = append(*stars, Star{Ref: ref, Time: parseTime(starredAt)})
+			}
+			if rating >= 1 && rating <= 5 {
+				*ratings = append(*ratings, Rating{Ref: ref, Rating: rating})
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("read annotations: %w", err)
+	}
+
+	playlistsByID := map[string]*Playlist{}
+	err = query(sqlDB, `SELECT id, name, coalesce(comment, ''), owner_id, coalesce(public, false) FROM playlist ORDER BY name`, func(rows *sql.Rows) error {
+		var id, ownerID string
+		var p Playlist
+		if err := rows.Scan(&id, &p.Name, &p.Comment, &ownerID, &p.Public); err != nil {
+			return err
+		}
+		owner, ok := usersByID[ownerID]
+		if !ok {
+			return nil
+		}
+		p.Owner = owner.Name
+		playlistsByID[id] = &p
+		src.Playlists = append(src.Playlists, &p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read playlists: %w", err)
+	}
+	err = query(sqlDB, `SELECT playlist_id, media_file_id FROM playlist_tracks ORDER BY playlist_id, id`, func(rows *sql.Rows) error {
+		var playlistID, fileID string
+		if err := rows.Scan(&playlistID, &fileID); err != nil {
+			return err
+		}
+		if p, ok := playlistsByID[playlistID]; ok && filePaths[fileID] != "" {
+			p.Paths = append(p.Paths, filePaths[fileID])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read playlist tracks: %w", err)
+	}
+
+	return src, nil
+}
+
+func query(sqlDB *sql.DB, q string, f func(*sql.Rows) error) error {
+	rows, err := sqlDB.Query(q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := f(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02",
+}
+
+// parseTime parses the times that SQLite drivers and SQL scripts return, which might be a time, a string in
+// one of a few layouts, or nothing
+func parseTime(v any) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case []byte:
+		return parseTime(string(v))
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,409 @@
+package importer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// a reader for the SQL scripts that HSQLDB keeps its data in (the .script file), and that H2 writes
+// with its SCRIPT command. only CREATE TABLE and INSERT statements are read, which is enough to get
+// the rows of each table
+
+var errBadScript = errors.New("bad sql script")
+
+type scriptTable struct {
+	Columns []string
+	Rows    [][]any // string, int64, float64, bool, or nil
+}
+
+// Get returns the value of the column in row i, or nil if there's no such column
+func (t *scriptTable) Get(i int, column string) any {
+	for j, c := range t.Columns {
+		if c == column && j < len(t.Rows[i]) {
+			return t.Rows[i][j]
+		}
+	}
+	return nil
+}
+
+type sqlScript map[string]*scriptTable
+
+// Table returns the table with the name, or an empty table if there isn't one
+func (s sqlScript) Table(name string) *scriptTable {
+	if t, ok := s[name]; ok {
+		return t
+	}
+	return &scriptTable{}
+}
+
+type tokenKind int
+
+const (
+	tokenWord   tokenKind = iota // keywords and identifiers, upper cased
+	tokenQuoted                  // "quoted identifiers"
+	tokenString                  // 'string literals'
+	tokenNumber
+	tokenPunct
+)
+
+type token struct {
+	kind        tokenKind
+	text        string
+	startOfLine bool
+}
+
+// statement keywords that start a new statement when they're at the start of a line. HSQLDB
+// scripts have one statement per line and don't end them with semicolons
+var statementKeywords = map[string]struct{}{
+	"CREATE": {}, "INSERT": {}, "SET": {}, "ALTER": {}, "GRANT": {}, "DROP": {}, "DELETE": {}, "UPDATE": {}, "COMMIT": {},
+}
+
+func parseSQLScript(r io.Reader) (sqlScript, error) {
+	tokens, err := tokenizeSQL(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	script := sqlScript{}
+	var stmt []token
+	var depth int
+	flush := func() error {
+		defer func() { stmt = nil }()
+		return parseStatement(script, stmt)
+	}
+	for _, tok := range tokens {
+		if depth == 0 && tok.kind == tokenWord && tok.startOfLine && len(stmt) > 0 {
+			if _, ok := statementKeywords[tok.text]; ok {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if tok.kind == tokenPunct {
+			switch tok.text {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case ";":
+				if depth == 0 {
+					if err := flush(); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+		}
+		stmt = append(stmt, tok)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+func tokenizeSQL(r *bufio.Reader) ([]token, error) {
+	var tokens []token
+	startOfLine := true
+	for {
+		c, _, err := r.ReadRune()
+		if errors.Is(err, io.EOF) {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == '\n':
+			startOfLine = true
+			continue
+		case unicode.IsSpace(c):
+			continue
+		case c == '-' && peekIs(r, '-'):
+			// comment until the end of the line
+			if _, err := r.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			startOfLine = true
+			continue
+		case c == '\'' || c == '"':
+			text, err := readQuoted(r, c)
+			if err != nil {
+				return nil, err
+			}
+			kind := tokenString
+			if c == '"' {
+				kind = tokenQuoted
+			}
+			tokens = append(tokens, token{kind: kind, text: text, startOfLine: startOfLine})
+		case unicode.IsDigit(c) || (c == '-' && peekDigit(r)):
+			text := string(c) + readWhile(r, func(c rune) bool { return unicode.IsDigit(c) || c == '.' || c == 'E' || c == 'e' })
+			tokens = append(tokens, token{kind: tokenNumber, text: text, startOfLine: startOfLine})
+		case unicode.IsLetter(c) || c == '_':
+			text := string(c) + readWhile(r, func(c rune) bool { return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '$' })
+			tokens = append(tokens, token{kind: tokenWord, text: strings.ToUpper(text), startOfLine: startOfLine})
+		default:
+			tokens = append(tokens, token{kind: tokenPunct, text: string(c), startOfLine: startOfLine})
+		}
+		startOfLine = false
+	}
+}
+
+func peekIs(r *bufio.Reader, want rune) bool {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return false
+	}
+	if c == want {
+		return true
+	}
+	_ = r.UnreadRune()
+	return false
+}
+
+func peekDigit(r *bufio.Reader) bool {
+	b, err := r.Peek(1)
+	return err == nil && b[0] >= '0' && b[0] <= '9'
+}
+
+func readWhile(r *bufio.Reader, f func(rune) bool) string {
+	var sb strings.Builder
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return sb.String()
+		}
+		if !f(c) {
+			_ = r.UnreadRune()
+			return sb.String()
+		}
+		sb.WriteRune(c)
+	}
+}
+
+// readQuoted reads until the closing quote, where two quotes in a row are an escaped quote
+func readQuoted(r *bufio.Reader, quote rune) (string, error) {
+	var sb strings.Builder
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return "", fmt.Errorf("%w: unterminated quote", errBadScript)
+		}
+		if c == quote {
+			if peekIs(r, quote) {
+				sb.WriteRune(quote)
+				continue
+			}
+			return sb.String(), nil
+		}
+		sb.WriteRune(c)
+	}
+}
+
+func parseStatement(script sqlScript, stmt []token) error {
+	p := &tokenParser{tokens: stmt}
+	switch {
+	case p.word("CREATE"):
+		// CREATE [MEMORY | CACHED | TEXT | ...] TABLE [IF NOT EXISTS] name (columns...)
+		for !p.done() && !p.word("TABLE") {
+			if p.peek().kind != tokenWord {
+				return nil // not a table
+			}
+			p.next()
+		}
+		if p.done() {
+			return nil
+		}
+		if p.word("IF") {
+			p.word("NOT")
+			p.word("EXISTS")
+		}
+		name := p.tableName()
+		if !p.punct("(") {
+			return nil // eg. CREATE TABLE AS SELECT
+		}
+		table := &scriptTable{}
+		for _, def := range p.list() {
+			if len(def) == 0 {
+				continue
+			}
+			switch first := def[0]; {
+			case first.kind == tokenQuoted:
+				table.Columns = append(table.Columns, strings.ToUpper(first.text))
+			case first.kind == tokenWord && !isConstraintKeyword(first.text):
+				table.Columns = append(table.Columns, first.text)
+			}
+		}
+		script[name] = table
+	case p.word("INSERT"):
+		// INSERT INTO name [(columns...)] VALUES (values...)[, (values...)]
+		if !p.word("INTO") {
+			return fmt.Errorf("%w: expected INTO", errBadScript)
+		}
+		name := p.tableName()
+		table, ok := script[name]
+		if !ok {
+			table = &scriptTable{}
+			script[name] = table
+		}
+		var columns []string
+		if p.punct("(") {
+			for _, col := range p.list() {
+				if len(col) == 1 {
+					columns = append(columns, strings.ToUpper(col[0].text))
+				}
+			}
+		}
+		if !p.word("VALUES") {
+			return nil // eg. INSERT INTO SELECT
+		}
+		for p.punct("(") {
+			var row []any
+			for _, value := range p.list() {
+				row = append(row, parseValue(value))
+			}
+			if columns != nil {
+				row = reorder(table, columns, row)
+			}
+			table.Rows = append(table.Rows, row)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// reorder maps values named by columns onto the table's column order, adding any new columns
+func reorder(table *scriptTable, columns []string, values []any) []any {
+	row := make([]any, len(table.Columns))
+	for i, column := range columns {
+		if i >= len(values) {
+			break
+		}
+		j := -1
+		for k, c := range table.Columns {
+			if c == column {
+				j = k
+				break
+			}
+		}
+		if j == -1 {
+			table.Columns = append(table.Columns, column)
+			row = append(row, nil)
+			j = len(table.Columns) - 1
+		}
+		row[j] = values[i]
+	}
+	return row
+}
+
+func isConstraintKeyword(word string) bool {
+	switch word {
+	case "CONSTRAINT", "PRIMARY", "UNIQUE", "FOREIGN", "CHECK", "INDEX", "KEY":
+		return true
+	}
+	return false
+}
+
+// parseValue parses a literal. typed literals like TIMESTAMP '...' are returned as their string
+func parseValue(toks []token) any {
+	if len(toks) == 0 {
+		return nil
+	}
+	last := toks[len(toks)-1]
+	switch last.kind {
+	case tokenString:
+		return last.text
+	case tokenNumber:
+		if i, err := strconv.ParseInt(last.text, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(last.text, 64); err == nil {
+			return f
+		}
+		return last.text
+	case tokenWord:
+		switch last.text {
+		case "TRUE":
+			return true
+		case "FALSE":
+			return false
+		}
+	}
+	return nil
+}
+
+type tokenParser struct {
+	tokens []token
+	i      int
+}
+
+func (p *tokenParser) done() bool  { return p.i >= len(p.tokens) }
+func (p *tokenParser) peek() token { return p.tokens[p.i] }
+func (p *tokenParser) next()       { p.i++ }
+
+func (p *tokenParser) word(w string) bool {
+	if !p.done() && p.peek().kind == tokenWord && p.peek().text == w {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *tokenParser) punct(s string) bool {
+	if !p.done() && p.peek().kind == tokenPunct && p.peek().text == s {
+		p.next()
+		return true
+	}
+	return false
+}
+
+// tableName reads a possibly schema qualified name, and returns it without the schema
+func (p *tokenParser) tableName() string {
+	var name string
+	for !p.done() {
+		tok := p.peek()
+		if tok.kind != tokenWord && tok.kind != tokenQuoted {
+			break
+		}
+		name = strings.ToUpper(tok.text)
+		p.next()
+		if !p.punct(".") {
+			break
+		}
+	}
+	return name
+}
+
+// list reads comma separated items until the closing paren, after an opening paren has been read
+func (p *tokenParser) list() [][]token {
+	var items [][]token
+	var item []token
+	depth := 0
+	for !p.done() {
+		tok := p.peek()
+		p.next()
+		if tok.kind == tokenPunct {
+			switch {
+			case tok.text == "(":
+				depth++
+			case tok.text == ")" && depth == 0:
+				return append(items, item)
+			case tok.text == ")":
+				depth--
+			case tok.text == "," && depth == 0:
+				items = append(items, item)
+				item = nil
+				continue
+			}
+		}
+		item = append(item, tok)
+	}
+	return append(items, item)
+}
@@ -0,0 +1,52 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSQLScriptH2(t *testing.T) {
+	t.Parallel()
+
+	// the output of H2's SCRIPT command. statements end with semicolons and can span lines
+	script, err := parseSQLScript(strings.NewReader(`
+-- H2 2.1.214;
+CREATE USER IF NOT EXISTS "SA" SALT '4f' HASH 'a1' ADMIN;
+CREATE CACHED TABLE "PUBLIC"."USERS"(
+    "USERNAME" CHARACTER VARYING NOT NULL,
+    "PASSWORD" CHARACTER VARYING NOT NULL,
+    "BYTES_STREAMED" BIGINT DEFAULT 0 NOT NULL
+);
+ALTER TABLE "PUBLIC"."USERS" ADD CONSTRAINT "PUBLIC"."CONSTRAINT_4" PRIMARY KEY("USERNAME");
+INSERT INTO "PUBLIC"."USERS" VALUES
+('admin', 'pass;word', 10),
+('guest', 'it''s', -1);
+CREATE CACHED TABLE "PUBLIC"."MEDIA_FILE"(
+    "ID" INTEGER NOT NULL,
+    "PATH" CHARACTER VARYING NOT NULL,
+    "LAST_PLAYED" TIMESTAMP,
+    "PLAY_COUNT" INTEGER
+);
+INSERT INTO "PUBLIC"."MEDIA_FILE"("PATH", "ID", "LAST_PLAYED") VALUES
+('/music/a.flac', 1, TIMESTAMP '2021-03-04 05:06:07');
+`))
+	require.NoError(t, err)
+
+	users := script.Table("USERS")
+	require.Equal(t, []string{"USERNAME", "PASSWORD", "BYTES_STREAMED"}, users.Columns)
+	require.Equal(t, [][]any{
+		{"admin", "pass;word", int64(10)},
+		{"guest", "it's", int64(-1)},
+	}, users.Rows)
+
+	files := script.Table("MEDIA_FILE")
+	require.Len(t, files.Rows, 1)
+	require.Equal(t, "/music/a.flac", files.Get(0, "PATH"))
+	require.Equal(t, int64(1), files.Get(0, "ID"))
+	require.Equal(t, "2021-03-04 05:06:07", files.Get(0, "LAST_PLAYED"))
+	require.Nil(t, files.Get(0, "PLAY_COUNT"))
+
+	require.Empty(t, script.Table("MISSING").Rows)
+}
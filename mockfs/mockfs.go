@@ -100,6 +100,16 @@ func (m *MockFS) ScanAndCleanErr() (*scanner.State, error) {
 	return m.scanner.ScanAndClean(scanner.ScanOptions{})
 }
 
+func (m *MockFS) ScanPaths(relPaths ...string) (*scanner.State, error) {
+	m.t.Helper()
+
+	var paths []string
+	for _, p := range relPaths {
+		paths = append(paths, filepath.Join(m.dir, p))
+	}
+	return m.scanner.ScanAndClean(scanner.ScanOptions{Paths: paths})
+}
+
 func (m *MockFS) ResetDates() {
 	t := time.Date(2020, 0, 0, 0, 0, 0, 0, time.UTC)
 	if err := m.db.Model(db.Album{}).Updates(db.Album{CreatedAt: t, UpdatedAt: t, ModifiedAt: t}).Error; err != nil {
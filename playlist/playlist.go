@@ -92,7 +92,19 @@ func (s *Store) Read(relPath string) (*Playlist, error) {
 		return nil, err
 	}
 
-	absPath := filepath.Join(s.basePath, relPath)
+	playlist, err := ReadFile(filepath.Join(s.basePath, relPath))
+	if err != nil {
+		return nil, err
+	}
+	playlist.UserID, err = userIDFromPath(relPath)
+	if err != nil {
+		playlist.UserID = 1
+	}
+	return playlist, nil
+}
+
+// ReadFile reads an m3u file from anywhere. the playlist's UserID isn't set
+func ReadFile(absPath string) (*Playlist, error) {
 	stat, err := os.Stat(absPath)
 	if err != nil {
 		return nil, fmt.Errorf("stat m3u: %w", err)
@@ -104,13 +116,7 @@ func (s *Store) Read(relPath string) (*Playlist, error) {
 
 	var playlist Playlist
 	playlist.UpdatedAt = stat.ModTime()
-
-	playlist.UserID, err = userIDFromPath(relPath)
-	if err != nil {
-		playlist.UserID = 1
-	}
-
-	playlist.Name = strings.TrimSuffix(filepath.Base(relPath), filepath.Ext(relPath))
+	playlist.Name = strings.TrimSuffix(filepath.Base(absPath), filepath.Ext(absPath))
 
 	file, err := os.Open(absPath)
 	if err != nil {
@@ -34,6 +34,7 @@ import (
 var (
 	ErrAlreadyScanning = errors.New("already scanning")
 	ErrReadingTags     = errors.New("could not read tags")
+	ErrNotInMusicDir   = errors.New("path is not in a music dir")
 )
 
 type Scanner struct {
@@ -69,9 +70,27 @@ func (s *Scanner) StopScanning()       { atomic.StoreInt32(s.scanning, 0) }
 
 type ScanOptions struct {
 	IsFull bool
+	// Paths limits the scan to these directories in the music dirs. since the rest of the library
+	// isn't seen, nothing is cleaned
+	Paths []string
 }
 
 func (s *Scanner) ScanAndClean(opts ScanOptions) (*State, error) {
+	dirs := s.musicDirs
+	if len(opts.Paths) > 0 {
+		dirs = nil
+		for _, p := range opts.Paths {
+			absPath, err := filepath.Abs(p)
+			if err != nil {
+				return nil, fmt.Errorf("abs path: %w", err)
+			}
+			if musicDir, _ := musicDirRelative(s.musicDirs, absPath); musicDir == "" {
+				return nil, fmt.Errorf("%q: %w", p, ErrNotInMusicDir)
+			}
+			dirs = append(dirs, absPath)
+		}
+	}
+
 	if !s.StartScanning() {
 		return nil, ErrAlreadyScanning
 	}
@@ -90,7 +109,7 @@ func (s *Scanner) ScanAndClean(opts ScanOptions) (*State, error) {
 			durSince(start), st.SeenTracksNew(), st.SeenTracks(), len(st.errs))
 	}()
 
-	for _, dir := range s.musicDirs {
+	for _, dir := range dirs {
 		err := filepath.WalkDir(dir, func(absPath string, d fs.DirEntry, err error) error {
 			return s.scanCallback(st, absPath, d, err)
 		})
@@ -99,6 +118,13 @@ func (s *Scanner) ScanAndClean(opts ScanOptions) (*State, error) {
 		}
 	}
 
+	if len(opts.Paths) > 0 {
+		if err := s.updateSearchIndex(st); err != nil {
+			return nil, fmt.Errorf("update search index: %w", err)
+		}
+		return st, errors.Join(st.errs...)
+	}
+
 	if err := s.cleanTracks(st); err != nil {
 		return nil, fmt.Errorf("clean tracks: %w", err)
 	}
@@ -117,6 +143,9 @@ func (s *Scanner) ScanAndClean(opts ScanOptions) (*State, error) {
 	if err := s.cleanBookmarks(st); err != nil {
 		return nil, fmt.Errorf("clean bookmarks: %w", err)
 	}
+	if err := s.updateSearchIndex(st); err != nil {
+		return nil, fmt.Errorf("update search index: %w", err)
+	}
 
 	if err := s.db.SetSetting(db.LastScanTime, strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
 		return nil, fmt.Errorf("set scan time: %w", err)
@@ -181,6 +210,10 @@ func (s *Scanner) ExecuteWatch(ctx context.Context) error {
 					log.Printf("error walking: %v", err)
 					continue
 				}
+				if err := s.updateSearchIndex(st); err != nil {
+					log.Printf("error updating search index: %v", err)
+					continue
+				}
 			}
 			s.StopScanning()
 			clear(batchSeen)
@@ -313,11 +346,15 @@ func (s *Scanner) scanDir(st *State, absPath string) error {
 
 	dir, basename := filepath.Split(relPath)
 	var album db.Album
-	if err := populateAlbumBasics(s.db, musicDir, &parent, &album, dir, basename, cover); err != nil {
+	albumChanged, err := populateAlbumBasics(s.db, musicDir, &parent, &album, dir, basename, cover)
+	if err != nil {
 		return fmt.Errorf("populate album basics: %w", err)
 	}
 
 	st.seenAlbums[album.ID] = struct{}{}
+	if albumChanged {
+		st.searchUpdated = append(st.searchUpdated, int64(album.ID))
+	}
 
 	if len(trackPaths) == 0 {
 		return nil
@@ -371,6 +408,10 @@ func (s *Scanner) scanDir(st *State, absPath string) error {
 		return nil
 	}
 
+	if !albumChanged {
+		st.searchUpdated = append(st.searchUpdated, int64(album.ID))
+	}
+
 	return s.db.Transaction(func(tx *db.DB) error {
 		var discTitles = map[int]string{}
 		for _, t := range trackUpdates {
@@ -531,14 +572,14 @@ func populateAlbum(tx *db.DB, album *db.Album, trags map[string][]string, modTim
 	return nil
 }
 
-func populateAlbumBasics(tx *db.DB, musicDir string, parent, album *db.Album, dir, basename string, cover string) error {
+func populateAlbumBasics(tx *db.DB, musicDir string, parent, album *db.Album, dir, basename string, cover string) (bool, error) {
 	if err := tx.Where("root_dir=? AND left_path=? AND right_path=?", musicDir, dir, basename).First(album).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return fmt.Errorf("find album: %w", err)
+		return false, fmt.Errorf("find album: %w", err)
 	}
 
 	// see if we can save ourselves from an extra write if it's found and nothing has changed
 	if album.ID != 0 && album.Cover == cover && album.ParentID == parent.ID {
-		return nil
+		return false, nil
 	}
 
 	album.RootDir = musicDir
@@ -549,10 +590,10 @@ func populateAlbumBasics(tx *db.DB, musicDir string, parent, album *db.Album, di
 	album.ParentID = parent.ID
 
 	if err := tx.Save(album).Error; err != nil {
-		return fmt.Errorf("saving album: %w", err)
+		return false, fmt.Errorf("saving album: %w", err)
 	}
 
-	return nil
+	return true, nil
 }
 
 func populateTrack(tx *db.DB, scanEmbeddedCover bool, album *db.Album, track *db.Track, trprops tags.Properties, trags map[string][]string, basename string, size int) error {
@@ -885,6 +926,27 @@ func (s *Scanner) cleanBookmarks(st *State) error {
 	return nil
 }
 
+func (s *Scanner) updateSearchIndex(st *State) error {
+	start := time.Now()
+	defer func() {
+		log.Printf("finished update search index in %s, %d albums updated", durSince(start), len(st.searchUpdated))
+	}()
+
+	// full scans rebuild from scratch, which also creates the index if FTS5 has become available since migrating
+	if st.isFull {
+		return s.db.RebuildSearchIndex()
+	}
+	if !s.db.HasSearchIndex() {
+		return nil
+	}
+	if err := s.db.CleanSearchIndex(); err != nil {
+		return fmt.Errorf("clean: %w", err)
+	}
+	return s.db.TransactionChunked(st.searchUpdated, func(tx *db.DB, chunk []int64) error {
+		return tx.UpdateSearchIndex(chunk)
+	})
+}
+
 // decoded converts a string to it's latin equivalent.
 // it will be used by the model's *UDec fields, and is only set if it
 // differs from the original. the fields are used for searching.
@@ -912,6 +974,8 @@ type State struct {
 	artistsMissing   int
 	genresMissing    int
 	bookmarksRemoved int
+
+	searchUpdated []int64
 }
 
 func (s *State) SeenTracks() int    { return len(s.seenTracks) }
@@ -66,6 +66,29 @@ func TestWithExcludePattern(t *testing.T) {
 	assert.Equal(t, artists, 2)                                         // not all artists
 }
 
+func TestScanPaths(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+
+	m.AddItemsGlob("artist-0/*/*")
+	m.ScanAndClean()
+
+	m.AddItemsGlob("artist-1/*/*")
+	m.RemoveAll("artist-0/album-0")
+
+	st, err := m.ScanPaths("artist-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 9, st.SeenTracksNew())
+
+	// only artist-1 was seen, so the removed album isn't cleaned
+	var tracks int
+	assert.NoError(t, m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	assert.Equal(t, 18, tracks)
+
+	_, err = m.ScanPaths("../elsewhere")
+	assert.ErrorIs(t, err, scanner.ErrNotInMusicDir)
+}
+
 func TestParentID(t *testing.T) {
 	t.Parallel()
 	m := mockfs.New(t)
@@ -266,6 +289,47 @@ func TestDeleteArtist(t *testing.T) {
 	assert.Equal(t, m.DB().Where("name=?", "artist-2").Find(&db.Artist{}).Error, gorm.ErrRecordNotFound)                                  // artist doesn't exist
 }
 
+func TestSearchIndex(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+
+	m.AddItems()
+	m.ScanAndClean()
+	if !m.DB().HasSearchIndex() {
+		t.Skip("search index needs sqlite with fts5")
+	}
+
+	searchTracks := func(query string) []string {
+		var titles []string
+		err := m.DB().
+			Model(db.Track{}).
+			Joins("JOIN search_tracks ON search_tracks.rowid=tracks.id").
+			Where("search_tracks MATCH ?", db.SearchQuery(query)).
+			Order("tracks.id").
+			Pluck("tracks.tag_title", &titles).
+			Error
+		require.NoError(t, err)
+		return titles
+	}
+
+	require.Len(t, searchTracks("artist-1 title-2"), 3) // matches across fields
+	require.Len(t, searchTracks("artist-3"), 0)
+
+	m.SetTags("artist-1/album-0/track-2.flac", func(tags *mockfs.TagInfo) {
+		normtag.Set(tags.Tags, normtag.Title, "Jóga")
+	})
+	m.ScanAndClean()
+
+	require.Len(t, searchTracks("artist-1 title-2"), 2)
+	require.Equal(t, []string{"Jóga"}, searchTracks("joga")) // matches without diacritics
+
+	m.RemoveAll("artist-1")
+	m.ScanAndClean()
+
+	require.Len(t, searchTracks("artist-1"), 0)
+	require.Len(t, searchTracks("artist-0"), 9)
+}
+
 func TestGenres(t *testing.T) {
 	t.Parallel()
 	m := mockfs.New(t)
@@ -445,7 +509,7 @@ func TestMultiFolderWithSharedArtist(t *testing.T) {
 
 	var artistAlbums []*db.Album
 	assert.NoError(t, m.DB().
-		Select("*, count(sub.id) child_count, sum(sub.length) duration").
+		Select("albums.*, count(sub.id) child_count, sum(sub.length) duration").
 		Joins("JOIN album_artists ON album_artists.album_id=albums.id").
 		Joins("LEFT JOIN tracks sub ON albums.id=sub.album_id").
 		Where("album_artists.artist_id=?", artist.ID).
@@ -714,6 +778,9 @@ func TestNoOrphanedGenresButOnlyDeleteTracks(t *testing.T) {
 func TestMultiArtistSupport(t *testing.T) {
 	t.Parallel()
 	m := mockfs.New(t)
+	if !m.DB().IsSQLite() {
+		t.Skip("listing each artist's albums needs sqlite's group_concat")
+	}
 
 	m.AddItemsGlob("artist-0/album-[012]/track-0.*")
 	m.SetTags("artist-0/album-0/track-0.flac", func(tags *mockfs.TagInfo) {
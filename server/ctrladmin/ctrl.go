@@ -24,12 +24,16 @@ import (
 	"github.com/sentriz/gormstore"
 
 	"go.senan.xyz/gonic"
+	"go.senan.xyz/gonic/backup"
+	"go.senan.xyz/gonic/cachewarm"
 	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/handlerutil"
 	"go.senan.xyz/gonic/lastfm"
+	"go.senan.xyz/gonic/playlist"
 	"go.senan.xyz/gonic/podcast"
 	"go.senan.xyz/gonic/scanner"
 	"go.senan.xyz/gonic/server/ctrladmin/adminui"
+	"go.senan.xyz/gonic/transcode"
 )
 
 type CtxKey int
@@ -47,12 +51,18 @@ type Controller struct {
 	scanner          *scanner.Scanner
 	podcasts         *podcast.Podcasts
 	lastfmClient     *lastfm.Client
+	backups          *backup.Backups // nil if backups aren't configured
+	transcodeJobs    *transcode.LimitedTranscoder
+	warmer           *cachewarm.Warmer
+	playlistStore    *playlist.Store
 	resolveProxyPath ProxyPathResolver
+
+	webTranscodeProfiles bool // if admins can add transcode profiles here
 }
 
 type ProxyPathResolver func(in string) string
 
-func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts *podcast.Podcasts, lastfmClient *lastfm.Client, resolveProxyPath ProxyPathResolver) (*Controller, error) {
+func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts *podcast.Podcasts, lastfmClient *lastfm.Client, backups *backup.Backups, transcodeJobs *transcode.LimitedTranscoder, warmer *cachewarm.Warmer, playlistStore *playlist.Store, webTranscodeProfiles bool, resolveProxyPath ProxyPathResolver) (*Controller, error) {
 	c := Controller{
 		ServeMux: http.NewServeMux(),
 
@@ -61,7 +71,17 @@ func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts
 		scanner:          scanner,
 		podcasts:         podcasts,
 		lastfmClient:     lastfmClient,
+		backups:          backups,
+		transcodeJobs:    transcodeJobs,
+		warmer:           warmer,
+		playlistStore:    playlistStore,
 		resolveProxyPath: resolveProxyPath,
+
+		webTranscodeProfiles: webTranscodeProfiles,
+	}
+
+	if err := c.loadTranscodeProfiles(); err != nil {
+		return nil, err
 	}
 
 	resp := respHandler(adminui.TemplatesFS, resolveProxyPath)
@@ -85,6 +105,7 @@ func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts
 	// user routes (if session is valid)
 	c.Handle("/logout", userChain(respRaw(c.ServeLogout)))
 	c.Handle("/home", userChain(resp(c.ServeHome)))
+	c.Handle("/listening", userChain(resp(c.ServeListening)))
 	c.Handle("/change_username", userChain(resp(c.ServeChangeUsername)))
 	c.Handle("/change_username_do", userChain(resp(c.ServeChangeUsernameDo)))
 	c.Handle("/change_password", userChain(resp(c.ServeChangePassword)))
@@ -100,6 +121,10 @@ func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts
 	c.Handle("/unlink_listenbrainz_do", userChain(resp(c.ServeUnlinkListenBrainzDo)))
 	c.Handle("/create_transcode_pref_do", userChain(resp(c.ServeCreateTranscodePrefDo)))
 	c.Handle("/delete_transcode_pref_do", userChain(resp(c.ServeDeleteTranscodePrefDo)))
+	c.Handle("/warm_cache_do", userChain(resp(c.ServeWarmCacheDo)))
+	c.Handle("/cancel_warm_cache_do", userChain(resp(c.ServeCancelWarmCacheDo)))
+	c.Handle("/export_user_data", userChain(respRaw(c.ServeExportUserData)))
+	c.Handle("/import_user_data_do", userChain(resp(c.ServeImportUserDataDo)))
 
 	// admin routes (if session is valid, and is admin)
 	c.Handle("/create_user", adminChain(resp(c.ServeCreateUser)))
@@ -108,6 +133,7 @@ func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts
 	c.Handle("/update_lastfm_api_key_do", adminChain(resp(c.ServeUpdateLastFMAPIKeyDo)))
 	c.Handle("/start_scan_inc_do", adminChain(resp(c.ServeStartScanIncDo)))
 	c.Handle("/start_scan_full_do", adminChain(resp(c.ServeStartScanFullDo)))
+	c.Handle("/backup_do", adminChain(resp(c.ServeBackupDo)))
 	c.Handle("/add_podcast_do", adminChain(resp(c.ServePodcastAddDo)))
 	c.Handle("/delete_podcast_do", adminChain(resp(c.ServePodcastDeleteDo)))
 	c.Handle("/download_podcast_do", adminChain(resp(c.ServePodcastDownloadDo)))
@@ -115,12 +141,50 @@ func New(dbc *db.DB, sessDB *gormstore.Store, scanner *scanner.Scanner, podcasts
 	c.Handle("/add_internet_radio_station_do", adminChain(resp(c.ServeInternetRadioStationAddDo)))
 	c.Handle("/delete_internet_radio_station_do", adminChain(resp(c.ServeInternetRadioStationDeleteDo)))
 	c.Handle("/update_internet_radio_station_do", adminChain(resp(c.ServeInternetRadioStationUpdateDo)))
+	c.Handle("/transcodes", adminChain(resp(c.ServeTranscodes)))
+	c.Handle("/cancel_transcode_do", adminChain(resp(c.ServeCancelTranscodeDo)))
+	c.Handle("/create_transcode_rule_do", adminChain(resp(c.ServeCreateTranscodeRuleDo)))
+	c.Handle("/move_transcode_rule_do", adminChain(resp(c.ServeMoveTranscodeRuleDo)))
+	c.Handle("/delete_transcode_rule_do", adminChain(resp(c.ServeDeleteTranscodeRuleDo)))
+	c.Handle("/create_transcode_profile_do", adminChain(resp(c.ServeCreateTranscodeProfileDo)))
+	c.Handle("/delete_transcode_profile_do", adminChain(resp(c.ServeDeleteTranscodeProfileDo)))
 
 	c.Handle("/", baseChain(resp(c.ServeNotFound)))
 
 	return &c, nil
 }
 
+// loadTranscodeProfiles makes the transcode profiles admins have added available to everything else, if they're
+// turned on. one whose name has since been taken by the config is left out
+func (c *Controller) loadTranscodeProfiles() error {
+	var rows []*db.TranscodeProfile
+	if err := c.dbc.Find(&rows).Error; err != nil {
+		return fmt.Errorf("find transcode profiles: %w", err)
+	}
+	if !c.webTranscodeProfiles {
+		if len(rows) > 0 {
+			log.Printf("skipping %d transcode profiles from the database, web transcode profiles are turned off", len(rows))
+		}
+		transcode.SetDBProfiles(nil)
+		return nil
+	}
+	profiles := map[string]transcode.Profile{}
+	for _, row := range rows {
+		if _, ok := transcode.UserProfiles[row.Name]; ok {
+			log.Printf("skipping transcode profile %q from the database, the name is taken by the config", row.Name)
+			continue
+		}
+		profile, err := transcode.NewFFmpegProfile(row.Name, row.MIME, row.Suffix, transcode.BitRate(row.BitRate), row.Args)
+		if err != nil {
+			log.Printf("skipping transcode profile %q from the database: %v", row.Name, err)
+			continue
+		}
+		profiles[row.Name] = profile
+	}
+	transcode.SetDBProfiles(profiles)
+	return nil
+}
+
 func withSession(sessDB *gormstore.Store) handlerutil.Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -284,6 +348,11 @@ type templateData struct {
 	IsScanning           bool
 	TranscodePreferences []*db.TranscodePreference
 	TranscodeProfiles    []string
+	TranscodeRules       []*db.TranscodeRule
+	DBTranscodeProfiles  []*db.TranscodeProfile
+	WebTranscodeProfiles bool
+	WarmPlaylists        []warmPlaylist
+	WarmJobs             []cachewarm.Job
 
 	CurrentLastFMAPIKey    string
 	CurrentLastFMAPISecret string
@@ -293,8 +362,46 @@ type templateData struct {
 	Podcasts              []*db.Podcast
 	InternetRadioStations []*db.InternetRadioStation
 
+	BackupPath string // empty if backups aren't configured
+	Backups    []*backup.Snapshot
+
 	// avatar
 	Avatar []byte
+
+	// listening
+	ListenPeriod  string
+	ListenPeriods []string
+	TopArtists    []*db.ListenStat
+	TopAlbums     []*db.ListenStat
+	TopTracks     []*db.ListenStat
+	TopGenres     []*db.ListenStat
+	RecentListens []*db.Listen
+	Review        listenReview
+
+	// transcodes
+	TranscodeJobs  []transcode.Job
+	TranscodeStats transcode.Stats
+}
+
+type warmPlaylist struct {
+	Path string
+	Name string
+}
+
+type listenReview struct {
+	Year       int
+	Prev, Next int // 0 if there's nothing to navigate to
+	Totals     db.ListenTotals
+	TopArtists []*db.ListenStat
+	TopAlbums  []*db.ListenStat
+	TopTracks  []*db.ListenStat
+	TopGenres  []*db.ListenStat
+	Months     []listenMonth
+}
+
+type listenMonth struct {
+	Name  string
+	Count int
 }
 
 func funcMap() template.FuncMap {
@@ -315,6 +422,12 @@ func funcMap() template.FuncMap {
 		},
 		"dateHuman": humanize.Time,
 		"base64":    base64.StdEncoding.EncodeToString,
+		"bytes": func(n int64) string {
+			return humanize.Bytes(uint64(n)) //nolint:gosec
+		},
+		"duration": func(secs int) string {
+			return (time.Duration(secs) * time.Second).String()
+		},
 		"props": func(parent any, values ...any) map[string]any {
 			if len(values)%2 != 0 {
 				panic("uneven number of key/value pairs")
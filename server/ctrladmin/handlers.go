@@ -3,24 +3,28 @@ package ctrladmin
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"log"
 	"net/http"
+	"net/netip"
 	"net/url"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mmcdole/gofeed"
 	"github.com/nfnt/resize"
 
+	"go.senan.xyz/gonic/backup"
 	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/handlerutil"
 	"go.senan.xyz/gonic/listenbrainz"
 	"go.senan.xyz/gonic/scanner"
 	"go.senan.xyz/gonic/transcode"
+	"go.senan.xyz/gonic/userdata"
 )
 
 func (c *Controller) ServeNotFound(_ *http.Request) *Response {
@@ -65,22 +69,125 @@ func (c *Controller) ServeHome(r *http.Request) *Response {
 	c.dbc.
 		Where("user_id=?", user.ID).
 		Find(&data.TranscodePreferences)
-	for profile := range transcode.UserProfiles {
-		data.TranscodeProfiles = append(data.TranscodeProfiles, profile)
+	data.TranscodeProfiles = transcode.ProfileNames()
+	if user.IsAdmin {
+		c.dbc.
+			Preload("User").
+			Order("position, id").
+			Find(&data.TranscodeRules)
+		c.dbc.
+			Order("name").
+			Find(&data.DBTranscodeProfiles)
+		data.WebTranscodeProfiles = c.webTranscodeProfiles
+	}
+	// warm cache box
+	playlistPaths, _ := c.playlistStore.List()
+	for _, path := range playlistPaths {
+		if pl, err := c.playlistStore.Read(path); err == nil && pl.UserID == user.ID {
+			data.WarmPlaylists = append(data.WarmPlaylists, warmPlaylist{Path: path, Name: pl.Name})
+		}
+	}
+	for _, job := range c.warmer.Jobs() {
+		if job.UserID == user.ID {
+			data.WarmJobs = append(data.WarmJobs, job)
+		}
 	}
-	sort.Strings(data.TranscodeProfiles)
 	// podcasts box
 	c.dbc.Find(&data.Podcasts)
 
 	// internet radio box
 	c.dbc.Find(&data.InternetRadioStations)
 
+	// backups box
+	if user.IsAdmin && c.backups != nil {
+		data.BackupPath = c.backups.BasePath()
+		data.Backups, _ = c.backups.List()
+	}
+
 	return &Response{
 		template: "home.tmpl",
 		data:     data,
 	}
 }
 
+func (c *Controller) ServeListening(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+
+	now := time.Now()
+	data := &templateData{}
+	data.ListenPeriods = []string{"week", "month", "year", "all"}
+	data.ListenPeriod = r.URL.Query().Get("period")
+	var from time.Time
+	switch data.ListenPeriod {
+	case "week":
+		from = now.AddDate(0, 0, -7)
+	case "year":
+		from = now.AddDate(-1, 0, 0)
+	case "all":
+	default:
+		data.ListenPeriod = "month"
+		from = now.AddDate(0, -1, 0)
+	}
+
+	var err error
+	if data.TopArtists, err = c.dbc.TopListenedArtists(user.ID, from, now, 10); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("top artists: %v", err)}
+	}
+	if data.TopAlbums, err = c.dbc.TopListenedAlbums(user.ID, from, now, 10); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("top albums: %v", err)}
+	}
+	if data.TopTracks, err = c.dbc.TopListenedTracks(user.ID, from, now, 10); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("top tracks: %v", err)}
+	}
+	if data.TopGenres, err = c.dbc.TopListenedGenres(user.ID, from, now, 10); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("top genres: %v", err)}
+	}
+	if data.RecentListens, err = c.dbc.RecentListens(user.ID, 20); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("recent listens: %v", err)}
+	}
+
+	// year in review box
+	year := now.Year()
+	if v, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil && v > 0 && v <= year {
+		year = v
+	}
+	review := &data.Review
+	review.Year = year
+	review.Prev = year - 1
+	if year < now.Year() {
+		review.Next = year + 1
+	}
+	yearFrom := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+	yearTo := yearFrom.AddDate(1, 0, 0)
+	if review.Totals, err = c.dbc.ListenTotals(user.ID, yearFrom, yearTo); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("year totals: %v", err)}
+	}
+	if review.TopArtists, err = c.dbc.TopListenedArtists(user.ID, yearFrom, yearTo, 5); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("year top artists: %v", err)}
+	}
+	if review.TopAlbums, err = c.dbc.TopListenedAlbums(user.ID, yearFrom, yearTo, 5); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("year top albums: %v", err)}
+	}
+	if review.TopTracks, err = c.dbc.TopListenedTracks(user.ID, yearFrom, yearTo, 5); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("year top tracks: %v", err)}
+	}
+	if review.TopGenres, err = c.dbc.TopListenedGenres(user.ID, yearFrom, yearTo, 5); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("year top genres: %v", err)}
+	}
+	months, err := c.dbc.ListensByMonth(user.ID, year, time.Local)
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("year months: %v", err)}
+	}
+	for i, count := range months {
+		review.Months = append(review.Months, listenMonth{Name: time.Month(i + 1).String(), Count: count})
+	}
+
+	return &Response{
+		template: "listening.tmpl",
+		data:     data,
+	}
+}
+
 func (c *Controller) ServeLinkLastFMDo(r *http.Request) *Response {
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -253,6 +360,45 @@ func (c *Controller) ServeDeleteAvatarDo(r *http.Request) *Response {
 	}
 }
 
+func (c *Controller) ServeImportUserDataDo(r *http.Request) *Response {
+	user, err := selectedUserIfAdmin(c, r)
+	if err != nil {
+		return &Response{code: 400, err: err.Error()}
+	}
+	if user == nil {
+		return &Response{code: 404, err: "couldn't find a user with that name"}
+	}
+	data, err := getUserDataFile(r)
+	if err != nil {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{err.Error()},
+		}
+	}
+	report, err := userdata.Import(c.dbc, user, data)
+	if err != nil {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{fmt.Sprintf("error importing: %v", err)},
+		}
+	}
+
+	// the list could be very long, show the first few
+	const maxUnmatched = 10
+	flashW := report.Unmatched
+	if len(flashW) > maxUnmatched {
+		flashW = append(flashW[:maxUnmatched:maxUnmatched], fmt.Sprintf("and %d more", len(report.Unmatched)-maxUnmatched))
+	}
+	if len(report.Unmatched) > 0 {
+		flashW = append([]string{fmt.Sprintf("%d items couldn't be found in the library and were skipped", len(report.Unmatched))}, flashW...)
+	}
+	return &Response{
+		redirect: r.Referer(),
+		flashN:   []string{fmt.Sprintf("imported %d items", report.Imported)},
+		flashW:   flashW,
+	}
+}
+
 func (c *Controller) ServeDeleteUser(r *http.Request) *Response {
 	user, err := selectedUserIfAdmin(c, r)
 	if err != nil {
@@ -365,6 +511,20 @@ func (c *Controller) ServeStartScanFullDo(_ *http.Request) *Response {
 	}
 }
 
+func (c *Controller) ServeBackupDo(_ *http.Request) *Response {
+	if c.backups == nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"backups are not configured, please set a backup path"},
+		}
+	}
+	defer doBackup(c.backups)
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"backup started. refresh for results"},
+	}
+}
+
 func (c *Controller) ServeCreateTranscodePrefDo(r *http.Request) *Response {
 	client := r.FormValue("client")
 	profile := r.FormValue("profile")
@@ -374,6 +534,12 @@ func (c *Controller) ServeCreateTranscodePrefDo(r *http.Request) *Response {
 			flashW:   []string{"please provide a client name"},
 		}
 	}
+	if _, ok := transcode.LookupProfile(profile); !ok {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("unknown transcode profile %q", profile)},
+		}
+	}
 	user := r.Context().Value(CtxUser).(*db.User)
 	pref := db.TranscodePreference{
 		UserID:  user.ID,
@@ -403,6 +569,221 @@ func (c *Controller) ServeDeleteTranscodePrefDo(r *http.Request) *Response {
 	}
 }
 
+func (c *Controller) ServeWarmCacheDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	client := strings.TrimSpace(r.FormValue("client"))
+
+	var err error
+	switch target := r.FormValue("target"); target {
+	case "":
+		_, err = c.warmer.WarmStarred(user, client)
+	default:
+		_, err = c.warmer.WarmPlaylist(user, client, target)
+	}
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't warm transcode cache: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"warming transcode cache. refresh for progress"},
+	}
+}
+
+func (c *Controller) ServeCancelWarmCacheDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid job id"}
+	}
+	for _, job := range c.warmer.Jobs() {
+		if job.ID == id && job.UserID == user.ID && c.warmer.Cancel(id) {
+			return &Response{
+				redirect: "/admin/home",
+				flashN:   []string{"warming cancelled"},
+			}
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashW:   []string{"warming already finished"},
+	}
+}
+
+func (c *Controller) ServeTranscodes(_ *http.Request) *Response {
+	data := &templateData{}
+	data.TranscodeJobs = c.transcodeJobs.Jobs()
+	data.TranscodeStats = c.transcodeJobs.Stats()
+	return &Response{
+		template: "transcodes.tmpl",
+		data:     data,
+	}
+}
+
+func (c *Controller) ServeCancelTranscodeDo(r *http.Request) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid job id"}
+	}
+	if !c.transcodeJobs.Cancel(id) {
+		return &Response{
+			redirect: "/admin/transcodes",
+			flashW:   []string{"transcode already finished"},
+		}
+	}
+	return &Response{
+		redirect: "/admin/transcodes",
+		flashN:   []string{"transcode cancelled"},
+	}
+}
+
+func (c *Controller) ServeCreateTranscodeRuleDo(r *http.Request) *Response {
+	rule := db.TranscodeRule{
+		Client:  strings.TrimSpace(r.FormValue("client")),
+		Profile: r.FormValue("profile"),
+	}
+	if _, ok := transcode.LookupProfile(rule.Profile); !ok && rule.Profile != db.TranscodeRuleRaw {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("unknown transcode profile %q", rule.Profile)},
+		}
+	}
+	if userID := r.FormValue("user"); userID != "" {
+		id, err := strconv.Atoi(userID)
+		if err != nil || c.dbc.GetUserByID(id) == nil {
+			return &Response{
+				redirect: "/admin/home",
+				flashW:   []string{fmt.Sprintf("unknown user %q", userID)},
+			}
+		}
+		rule.UserID = &id
+	}
+	if cidr := strings.TrimSpace(r.FormValue("cidr")); cidr != "" {
+		prefix, err := parseCIDR(cidr)
+		if err != nil {
+			return &Response{
+				redirect: "/admin/home",
+				flashW:   []string{fmt.Sprintf("invalid network %q, should be an address or a cidr like 192.168.1.0/24", cidr)},
+			}
+		}
+		rule.CIDR = prefix.String()
+	}
+	if err := c.dbc.CreateTranscodeRule(&rule); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("could not create rule: %v", err)},
+		}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeMoveTranscodeRuleDo(r *http.Request) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid rule id"}
+	}
+	if err := c.dbc.MoveTranscodeRule(id, r.URL.Query().Get("dir") == "down"); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("could not move rule: %v", err)},
+		}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeDeleteTranscodeRuleDo(r *http.Request) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid rule id"}
+	}
+	c.dbc.
+		Where("id=?", id).
+		Delete(db.TranscodeRule{})
+	return &Response{
+		redirect: "/admin/home",
+	}
+}
+
+func (c *Controller) ServeCreateTranscodeProfileDo(r *http.Request) *Response {
+	if !c.webTranscodeProfiles {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"adding transcode profiles here is turned off, see the transcode-web-profiles option"},
+		}
+	}
+	name, args, profile, err := transcode.ParseFFmpegProfile(r.FormValue("profile"))
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("invalid profile, should be \"<name> <mime> <suffix> <bitrate> <args>\": %v", err)},
+		}
+	}
+	if _, ok := transcode.LookupProfile(name); ok || name == db.TranscodeRuleRaw {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("transcode profile name %q is already taken", name)},
+		}
+	}
+	row := db.TranscodeProfile{
+		Name:    name,
+		MIME:    profile.MIME(),
+		Suffix:  profile.Suffix(),
+		BitRate: int(profile.BitRate()),
+		Args:    args,
+	}
+	if err := c.dbc.Create(&row).Error; err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("could not create profile: %v", err)},
+		}
+	}
+	if err := c.loadTranscodeProfiles(); err != nil {
+		return &Response{code: 500, err: err.Error()}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeDeleteTranscodeProfileDo(r *http.Request) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid profile id"}
+	}
+	var row db.TranscodeProfile
+	if err := c.dbc.Where("id=?", id).First(&row).Error; err != nil {
+		return &Response{code: 404, err: "couldn't find a profile with that id"}
+	}
+	var uses int
+	c.dbc.Model(db.TranscodePreference{}).Where("profile=?", row.Name).Count(&uses)
+	if uses == 0 {
+		c.dbc.Model(db.TranscodeRule{}).Where("profile=?", row.Name).Count(&uses)
+	}
+	if uses > 0 {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("transcode profile %q is still used by a device profile or rule", row.Name)},
+		}
+	}
+	c.dbc.Delete(&row)
+	if err := c.loadTranscodeProfiles(); err != nil {
+		return &Response{code: 500, err: err.Error()}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
+// parseCIDR takes a network like "10.0.0.0/8", or a single address
+func parseCIDR(in string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(in); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(in)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
 func (c *Controller) ServePodcastAddDo(r *http.Request) *Response {
 	rssURL := r.FormValue("feed")
 	fp := gofeed.NewParser()
@@ -601,6 +982,22 @@ func getAvatarFile(r *http.Request) ([]byte, error) {
 	return buff.Bytes(), nil
 }
 
+func getUserDataFile(r *http.Request) (*userdata.Data, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil { // keep up to 10MB in memory
+		return nil, err
+	}
+	file, _, err := r.FormFile("data")
+	if err != nil {
+		return nil, fmt.Errorf("read form file: %w", err)
+	}
+	defer file.Close()
+	var data userdata.Data
+	if err := json.NewDecoder(file).Decode(&data); err != nil {
+		return nil, fmt.Errorf("decode export: %w", err)
+	}
+	return &data, nil
+}
+
 func selectedUserIfAdmin(c *Controller, r *http.Request) (*db.User, error) {
 	selectedUsername := r.URL.Query().Get("user")
 	if selectedUsername == "" {
@@ -614,6 +1011,14 @@ func selectedUserIfAdmin(c *Controller, r *http.Request) (*db.User, error) {
 	return selectedUser, nil
 }
 
+func doBackup(backups *backup.Backups) {
+	go func() {
+		if _, err := backups.Snapshot(); err != nil {
+			log.Printf("error while backing up: %v\n", err)
+		}
+	}()
+}
+
 func doScan(scanner *scanner.Scanner, opts scanner.ScanOptions) {
 	go func() {
 		if _, err := scanner.ScanAndClean(opts); err != nil {
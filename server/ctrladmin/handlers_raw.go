@@ -1,9 +1,14 @@
 package ctrladmin
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/sessions"
+
+	"go.senan.xyz/gonic/userdata"
 )
 
 func (c *Controller) ServeLoginDo(w http.ResponseWriter, r *http.Request) {
@@ -37,3 +42,27 @@ func (c *Controller) ServeLogout(w http.ResponseWriter, r *http.Request) {
 	sessLogSave(session, w, r)
 	http.Redirect(w, r, c.resolveProxyPath("/admin/login"), http.StatusSeeOther)
 }
+
+func (c *Controller) ServeExportUserData(w http.ResponseWriter, r *http.Request) {
+	user, err := selectedUserIfAdmin(c, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user == nil {
+		http.Error(w, "couldn't find a user with that name", http.StatusNotFound)
+		return
+	}
+	data, err := userdata.Export(c.dbc, user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error exporting: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("gonic-%s.json", user.Name)))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(data); err != nil {
+		log.Printf("error writing export: %v\n", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
 	"time"
 
 	"go.senan.xyz/gonic/db"
@@ -64,15 +65,17 @@ type Controller struct {
 	scrobblers      []scrobble.Scrobbler
 	podcasts        *podcast.Podcasts
 	transcoder      transcode.Transcoder
+	segmenter       *transcode.Segmenter
 	lastFMClient    *lastfm.Client
 	artistInfoCache *artistinfocache.ArtistInfoCache
 	albumInfoCache  *albuminfocache.AlbumInfoCache
 	tagReader       tags.Reader
+	signKey         []byte
 
 	resolveProxyPath ProxyPathResolver
 }
 
-func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPath string, cacheAudioPath string, cacheCoverPath string, jukebox *jukebox.Jukebox, playlistStore *playlist.Store, scrobblers []scrobble.Scrobbler, podcasts *podcast.Podcasts, transcoder transcode.Transcoder, lastFMClient *lastfm.Client, artistInfoCache *artistinfocache.ArtistInfoCache, albumInfoCache *albuminfocache.AlbumInfoCache, tagReader tags.Reader, resolveProxyPath ProxyPathResolver) (*Controller, error) {
+func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPath string, cacheAudioPath string, cacheCoverPath string, jukebox *jukebox.Jukebox, playlistStore *playlist.Store, scrobblers []scrobble.Scrobbler, podcasts *podcast.Podcasts, transcoder transcode.Transcoder, segmenter *transcode.Segmenter, lastFMClient *lastfm.Client, artistInfoCache *artistinfocache.ArtistInfoCache, albumInfoCache *albuminfocache.AlbumInfoCache, tagReader tags.Reader, signKey []byte, resolveProxyPath ProxyPathResolver) (*Controller, error) {
 	c := Controller{
 		ServeMux: http.NewServeMux(),
 
@@ -87,10 +90,12 @@ func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPa
 		scrobblers:      scrobblers,
 		podcasts:        podcasts,
 		transcoder:      transcoder,
+		segmenter:       segmenter,
 		lastFMClient:    lastFMClient,
 		artistInfoCache: artistInfoCache,
 		albumInfoCache:  albumInfoCache,
 		tagReader:       tagReader,
+		signKey:         signKey,
 
 		resolveProxyPath: resolveProxyPath,
 	}
@@ -104,6 +109,12 @@ func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPa
 		chain,
 		slow,
 	)
+	// like chainRaw, but a signed URL from getSignedUrl can be used instead of credentials
+	chainSigned := handlerutil.Chain(
+		withParams,
+		withSignedUser(dbc, signKey, handlerutil.Chain(withRequiredParams, withUser(dbc))),
+		slow,
+	)
 
 	c.Handle("/getLicense", chain(resp(c.ServeGetLicence)))
 	c.Handle("/ping", chain(resp(c.ServePing)))
@@ -121,9 +132,14 @@ func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPa
 	c.Handle("/deletePlaylist", chain(resp(c.ServeDeletePlaylist)))
 	c.Handle("/savePlayQueue", chain(resp(c.ServeSavePlayQueue)))
 	c.Handle("/getPlayQueue", chain(resp(c.ServeGetPlayQueue)))
+	c.Handle("/savePlayQueueByIndex", chain(resp(c.ServeSavePlayQueueByIndex)))
+	c.Handle("/getPlayQueueByIndex", chain(resp(c.ServeGetPlayQueueByIndex)))
+	c.Handle("/getPlayQueues", chain(resp(c.ServeGetPlayQueues)))
+	c.Handle("/takeOverPlayQueue", chain(resp(c.ServeTakeOverPlayQueue)))
 	c.Handle("/getSong", chain(resp(c.ServeGetSong)))
 	c.Handle("/getRandomSongs", chain(resp(c.ServeGetRandomSongs)))
 	c.Handle("/getSongsByGenre", chain(resp(c.ServeGetSongsByGenre)))
+	c.Handle("/getSongList", chain(resp(c.ServeGetSongList)))
 	c.Handle("/jukeboxControl", chain(resp(c.ServeJukebox)))
 	c.Handle("/getBookmarks", chain(resp(c.ServeGetBookmarks)))
 	c.Handle("/createBookmark", chain(resp(c.ServeCreateBookmark)))
@@ -133,12 +149,19 @@ func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPa
 	c.Handle("/getSimilarSongs2", chain(resp(c.ServeGetSimilarSongsTwo)))
 	c.Handle("/getLyrics", chain(resp(c.ServeGetLyrics)))
 	c.Handle("/getLyricsBySongId", chain(resp(c.ServeGetLyricsBySongID)))
+	c.Handle("/getVideos", chain(resp(c.ServeGetVideos)))
+	c.Handle("/getVideoInfo", chain(resp(c.ServeGetVideoInfo)))
+	c.Handle("/getTranscodeDecision", chain(resp(c.ServeGetTranscodeDecision)))
+	c.Handle("/getSignedUrl", chain(resp(c.ServeGetSignedURL)))
 
 	// raw
-	c.Handle("/getCoverArt", chainRaw(respRaw(c.ServeGetCoverArt)))
-	c.Handle("/stream", chainRaw(respRaw(c.ServeStream)))
-	c.Handle("/download", chainRaw(respRaw(c.ServeStream)))
+	c.Handle("/getCoverArt", chainSigned(respRaw(c.ServeGetCoverArt)))
+	c.Handle("/stream", chainSigned(respRaw(c.ServeStream)))
+	c.Handle("/download", chainRaw(respRaw(c.ServeDownload)))
 	c.Handle("/getAvatar", chainRaw(respRaw(c.ServeGetAvatar)))
+	c.Handle("/hls.m3u8", chainRaw(respRaw(c.ServeHLS)))
+	c.Handle("/hlsSegment", chainRaw(respRaw(c.ServeHLSSegment)))
+	c.Handle("/getTranscodeStream", chainRaw(respRaw(c.ServeGetTranscodeStream)))
 
 	// browse by tag
 	c.Handle("/getAlbum", chain(resp(c.ServeGetAlbum)))
@@ -154,9 +177,11 @@ func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPa
 	c.Handle("/getIndexes", chain(resp(c.ServeGetIndexes)))
 	c.Handle("/getMusicDirectory", chain(resp(c.ServeGetMusicDirectory)))
 	c.Handle("/getAlbumList", chain(resp(c.ServeGetAlbumList)))
+	c.Handle("/search", chain(resp(c.ServeSearch)))
 	c.Handle("/search2", chain(resp(c.ServeSearchTwo)))
 	c.Handle("/getGenres", chain(resp(c.ServeGetGenres)))
 	c.Handle("/getArtistInfo", chain(resp(c.ServeGetArtistInfo)))
+	c.Handle("/getAlbumInfo", chain(resp(c.ServeGetAlbumInfo)))
 	c.Handle("/getStarred", chain(resp(c.ServeGetStarred)))
 
 	// star / rating
@@ -179,6 +204,10 @@ func New(dbc *db.DB, scannr *scanner.Scanner, musicPaths []MusicPath, podcastsPa
 	c.Handle("/updateInternetRadioStation", chain(resp(c.ServeUpdateInternetRadioStation)))
 	c.Handle("/deleteInternetRadioStation", chain(resp(c.ServeDeleteInternetRadioStation)))
 
+	// chat
+	c.Handle("/getChatMessages", chain(resp(c.ServeGetChatMessages)))
+	c.Handle("/addChatMessage", chain(resp(c.ServeAddChatMessage)))
+
 	c.Handle("/", chain(resp(c.ServeNotFound)))
 
 	return &c, nil
@@ -268,6 +297,34 @@ func withUser(dbc *db.DB) handlerutil.Middleware {
 	}
 }
 
+// withSignedUser is an alternative to withUser for requests with a signed URL. the user is the one the URL was
+// signed for, and the endpoint must be the one it was signed for too. requests without a signature go through
+// unsigned instead
+func withSignedUser(dbc *db.DB, key []byte, unsigned handlerutil.Middleware) handlerutil.Middleware {
+	return func(next http.Handler) http.Handler {
+		unsignedNext := unsigned(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			params := r.Context().Value(CtxParams).(params.Params)
+			if _, err := params.Get("sig"); err != nil {
+				unsignedNext.ServeHTTP(w, r)
+				return
+			}
+			userID, err := checkSignedURL(key, path.Base(r.URL.Path), params, time.Now())
+			if err != nil {
+				_ = writeResp(w, r, spec.NewError(40, "%v", err))
+				return
+			}
+			var user db.User
+			if err := dbc.First(&user, userID).Error; err != nil {
+				_ = writeResp(w, r, spec.NewError(40, "invalid user for signature"))
+				return
+			}
+			withUser := context.WithValue(r.Context(), CtxUser, &user)
+			next.ServeHTTP(w, r.WithContext(withUser))
+		})
+	}
+}
+
 func slow(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rc := http.NewResponseController(w)  //nolint:bodyclose
@@ -3,6 +3,8 @@ package ctrlsubsonic
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -24,6 +26,7 @@ import (
 	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/mockfs"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 	"go.senan.xyz/gonic/transcode"
 )
 
@@ -78,13 +81,60 @@ func makeHTTPMock(query url.Values) (*httptest.ResponseRecorder, *http.Request)
 	return rr, req
 }
 
-func makeHTTPMockWithAdmin(query url.Values) (*httptest.ResponseRecorder, *http.Request) {
-	rr, req := makeHTTPMock(query)
-	ctx := req.Context()
-	ctx = context.WithValue(ctx, CtxUser, &db.User{IsAdmin: true})
-	req = req.WithContext(ctx)
+// serveTestCase serves a request to h as user, or as the mock user if it's nil. edit can change the request
+// first, eg. to set headers
+func serveTestCase(h http.Handler, user *db.User, q url.Values, edit func(*http.Request)) *httptest.ResponseRecorder {
+	rr, req := makeHTTPMock(q)
+	if user != nil {
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+	}
+	if edit != nil {
+		edit(req)
+	}
+	h.ServeHTTP(rr, req)
+	return rr
+}
 
-	return rr, req
+func runTestCase(t *testing.T, h handlerSubsonic, q url.Values, admin bool) *spec.SubsonicResponse {
+	t.Helper()
+	var user *db.User
+	if admin {
+		user = &db.User{IsAdmin: true}
+	}
+	return runTestCaseAs(t, h, user, q)
+}
+
+// runTestCaseAs is like runTestCase, but as user, or as the mock user if it's nil
+func runTestCaseAs(t *testing.T, h handlerSubsonic, user *db.User, q url.Values) *spec.SubsonicResponse {
+	t.Helper()
+	return decodeTestCase(t, serveTestCase(resp(h), user, q, nil))
+}
+
+// decodeTestCase decodes a response from serveTestCase
+func decodeTestCase(t *testing.T, rr *httptest.ResponseRecorder) *spec.SubsonicResponse {
+	t.Helper()
+
+	body := rr.Body.String()
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("didn't give a 200\n%s", body)
+	}
+
+	var response spec.SubsonicResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		var jsonSyntaxError *json.SyntaxError
+		if errors.As(err, &jsonSyntaxError) {
+			t.Fatalf("invalid character at offset %v\n %s <--", jsonSyntaxError.Offset, body[0:jsonSyntaxError.Offset])
+		}
+
+		var jsonUnmarshalTypeError *json.UnmarshalTypeError
+		if errors.As(err, &jsonSyntaxError) {
+			t.Fatalf("invalid type at offset %v\n %s <--", jsonUnmarshalTypeError.Offset, body[0:jsonUnmarshalTypeError.Offset])
+		}
+
+		t.Fatalf("json unmarshal failed: %v", err)
+	}
+
+	return &response
 }
 
 func runQueryCases(t *testing.T, h handlerSubsonic, cases []*queryCase) {
@@ -133,10 +183,27 @@ func runQueryCases(t *testing.T, h handlerSubsonic, cases []*queryCase) {
 	}
 }
 
-func makeController(tb testing.TB) *Controller                  { return makec(tb, []string{""}, false) }
-func makeControllerRoots(tb testing.TB, r []string) *Controller { return makec(tb, r, false) }
+// searchGolden names the golden file of a search case whose results depend on the full text search index. without
+// the index, like with the nowasm build without sqlite_fts5 or on other databases, search falls back to LIKE
+// queries which match and order differently
+func searchGolden(dbc *db.DB) func(string) string {
+	return func(name string) string {
+		if dbc.HasSearchIndex() {
+			return name
+		}
+		return name + "_like"
+	}
+}
+
+func makeController(tb testing.TB) *Controller                  { return makec(tb, []string{""}, false, nil) }
+func makeControllerRoots(tb testing.TB, r []string) *Controller { return makec(tb, r, false, nil) }
 
-func makec(tb testing.TB, roots []string, audio bool) *Controller {
+// makeControllerTags is like makeController, but with a chance to change the tags before scanning
+func makeControllerTags(tb testing.TB, setTags func(m *mockfs.MockFS)) *Controller {
+	return makec(tb, []string{""}, false, setTags)
+}
+
+func makec(tb testing.TB, roots []string, audio bool, setTags func(m *mockfs.MockFS)) *Controller {
 	tb.Helper()
 
 	m := mockfs.NewWithDirs(tb, roots)
@@ -149,6 +216,9 @@ func makec(tb testing.TB, roots []string, audio bool) *Controller {
 		m.SetAudio(filepath.Join(root, "artist-0/album-0/track-1.flac"), 10*time.Second, 0, audioPath10s)
 		m.SetAudio(filepath.Join(root, "artist-0/album-0/track-2.flac"), 10*time.Second, 0, audioPath10s)
 	}
+	if setTags != nil {
+		setTags(m)
+	}
 
 	m.ScanAndClean()
 	m.ResetDates()
@@ -162,6 +232,7 @@ func makec(tb testing.TB, roots []string, audio bool) *Controller {
 		dbc:        m.DB(),
 		musicPaths: absRoots,
 		transcoder: transcode.NewFFmpegTranscoder(),
+		segmenter:  transcode.NewSegmenter(transcode.NewCachingTranscoder(transcode.NewFFmpegTranscoder(), filepath.Join(m.TmpDir(), "cache"), 0), transcode.HLSSegmentLength, time.Minute),
 	}
 
 	return contr
@@ -44,6 +44,8 @@ func (c *Controller) ServeGetBookmarks(r *http.Request) *spec.Response {
 				Preload("Album").
 				Preload("Album.Artists").
 				Preload("Artists").
+				Preload("Genres").
+				Preload("TrackPlay", "user_id=?", user.ID).
 				Find(&track, "id=?", bookmark.EntryID).
 				Error
 			if err != nil {
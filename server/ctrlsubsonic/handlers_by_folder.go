@@ -1,6 +1,8 @@
 package ctrlsubsonic
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"strings"
 
@@ -8,7 +10,9 @@ import (
 	"github.com/jinzhu/gorm"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/searchquery"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 )
 
@@ -31,13 +35,13 @@ func (c *Controller) ServeGetIndexes(r *http.Request) *spec.Response {
 	}
 	var folders []*db.Album
 	c.dbc.
-		Select("*, count(sub.id) child_count").
+		Select("albums.*, count(sub.id) child_count").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
 		Joins("LEFT JOIN albums sub ON albums.id=sub.parent_id").
 		Where("albums.parent_id IN ?", rootQ.SubQuery()).
 		Group("albums.id").
-		Order("albums.right_path COLLATE NOCASE").
+		Order("lower(albums.right_path)").
 		Find(&folders)
 	// [a-z#] -> 27
 	indexMap := make(map[string]*spec.Index, 27)
@@ -71,6 +75,7 @@ func (c *Controller) ServeGetMusicDirectory(r *http.Request) *spec.Response {
 	childrenObj := []*spec.TrackChild{}
 	folder := &db.Album{}
 	c.dbc.
+		Preload("Artists").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
 		First(folder, id.Value)
@@ -78,10 +83,12 @@ func (c *Controller) ServeGetMusicDirectory(r *http.Request) *spec.Response {
 	var childFolders []*db.Album
 	c.dbc.
 		Where("parent_id=?", id.Value).
+		Preload("Artists").
+		Preload("Genres").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
 		Order("tag_year").
-		Order("albums.right_path COLLATE NOCASE").
+		Order("lower(albums.right_path)").
 		Find(&childFolders)
 	for _, ch := range childFolders {
 		childrenObj = append(childrenObj, spec.NewTCAlbumByFolder(ch))
@@ -94,13 +101,15 @@ func (c *Controller) ServeGetMusicDirectory(r *http.Request) *spec.Response {
 		Preload("Album").
 		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Order("tracks.tag_disc_number, tracks.tag_track_number").
 		Order("filename").
 		Find(&childTracks)
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for _, ch := range childTracks {
 		toAppend := spec.NewTCTrackByFolder(ch, folder)
@@ -125,33 +134,34 @@ func (c *Controller) ServeGetAlbumList(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
 	user := r.Context().Value(CtxUser).(*db.User)
 	q := c.dbc.DB
+	// albums are grouped below, so ordering by a joined table needs an aggregate
 	switch v, _ := params.Get("type"); v {
 	case "alphabeticalByArtist":
 		q = q.Joins(`
 			JOIN albums parent_albums
 			ON albums.parent_id=parent_albums.id`)
-		q = q.Order("parent_albums.right_path")
+		q = q.Order("min(parent_albums.right_path)")
 	case "alphabeticalByName":
-		q = q.Order("right_path")
+		q = q.Order("albums.right_path")
 	case "byYear":
 		y1, y2 := params.GetOrInt("fromYear", 1800),
 			params.GetOrInt("toYear", 2200)
 		// support some clients sending wrong order like DSub
-		q = q.Where("tag_year BETWEEN ? AND ?", min(y1, y2), max(y1, y2))
-		q = q.Order("tag_year DESC")
+		q = q.Where("albums.tag_year BETWEEN ? AND ?", min(y1, y2), max(y1, y2))
+		q = q.Order("albums.tag_year DESC")
 	case "byGenre":
 		genre, _ := params.Get("genre")
 		q = q.Joins("JOIN album_genres ON album_genres.album_id=albums.id")
 		q = q.Joins("JOIN genres ON genres.id=album_genres.genre_id AND genres.name=?", genre)
-		q = q.Order("right_path")
+		q = q.Order("albums.right_path")
 	case "frequent":
 		q = q.Joins(`
 			JOIN plays
 			ON albums.id=plays.album_id AND plays.user_id=?`,
 			user.ID)
-		q = q.Order("plays.length DESC")
+		q = q.Order("max(plays.length) DESC")
 	case "newest":
-		q = q.Order("created_at DESC")
+		q = q.Order("albums.created_at DESC")
 	case "random":
 		q = q.Order(gorm.Expr("random()"))
 	case "recent":
@@ -159,24 +169,24 @@ func (c *Controller) ServeGetAlbumList(r *http.Request) *spec.Response {
 			JOIN plays
 			ON albums.id=plays.album_id AND plays.user_id=?`,
 			user.ID)
-		q = q.Order("plays.time DESC")
+		q = q.Order("max(plays.time) DESC")
 	case "starred":
 		q = q.Joins("JOIN album_stars ON albums.id=album_stars.album_id AND album_stars.user_id=?", user.ID)
-		q = q.Order("right_path")
+		q = q.Order("albums.right_path")
 	case "highest":
 		q = q.Joins("JOIN album_ratings ON album_ratings.album_id=albums.id AND album_ratings.user_id=?", user.ID)
-		q = q.Order("album_ratings.rating DESC")
+		q = q.Order("max(album_ratings.rating) DESC")
 	default:
 		return spec.NewError(10, "unknown value %q for parameter 'type'", v)
 	}
 
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
-		q = q.Where("root_dir=?", m)
+		q = q.Where("albums.root_dir=?", m)
 	}
 	var folders []*db.Album
 	// TODO: think about removing this extra join to count number
 	// of children. it might make sense to store that in the db
-	q.
+	err := q.
 		Select("albums.*, count(tracks.id) child_count, sum(tracks.length) duration").
 		Joins("LEFT JOIN tracks ON tracks.album_id=albums.id").
 		Group("albums.id").
@@ -184,9 +194,15 @@ func (c *Controller) ServeGetAlbumList(r *http.Request) *spec.Response {
 		Offset(params.GetOrInt("offset", 0)).
 		Limit(params.GetOrInt("size", 10)).
 		Preload("Parent").
+		Preload("Artists").
+		Preload("Genres").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
-		Find(&folders)
+		Find(&folders).
+		Error
+	if err != nil {
+		return spec.NewError(0, "error finding albums: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.Albums = &spec.Albums{
 		List: make([]*spec.Album, len(folders)),
@@ -208,6 +224,18 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	var isUUID = uuid.Validate(query) == nil
 	var isAll = query == `""`
 
+	// pull out any field filters, leaving the free text to match as usual
+	var filters searchquery.Query
+	if !isUUID && !isAll {
+		if filters, err = searchquery.Parse(query); err != nil {
+			return spec.NewError(0, "invalid search query: %v", err)
+		}
+		query = filters.Text
+		isAll = query == "" && filters.HasFilters()
+	}
+
+	var match = searchMatch(c.dbc, query)
+
 	var fuzzy = query
 	fuzzy = strings.Join(strings.Fields(fuzzy), "%")
 	fuzzy = strings.ToLower(fuzzy)
@@ -230,9 +258,12 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	case isUUID:
 		q = q.Where(0)
 	case isAll:
+	case match != "":
+		q = withSearchMatch(q, "albums", match)
 	default:
-		q = q.Where(`right_path LIKE ? OR right_path_u_dec LIKE ?`, fuzzy, fuzzy)
+		q = q.Where(`lower(right_path) LIKE lower(?) OR lower(right_path_u_dec) LIKE lower(?)`, fuzzy, fuzzy)
 	}
+	q = filters.Folders(q, user.ID)
 	q = q.
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
@@ -253,10 +284,15 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	case isUUID:
 		q = q.Where(`tag_brainz_id = ?`, query)
 	case isAll:
+	case match != "":
+		q = withSearchMatch(q, "albums", match)
 	default:
-		q = q.Where(`right_path LIKE ? OR right_path_u_dec LIKE ?`, fuzzy, fuzzy)
+		q = q.Where(`lower(right_path) LIKE lower(?) OR lower(right_path_u_dec) LIKE lower(?)`, fuzzy, fuzzy)
 	}
+	q = filters.Albums(q, user.ID)
 	q = q.
+		Preload("Artists").
+		Preload("Genres").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
 		Offset(params.GetOrInt("albumOffset", 0)).
@@ -278,12 +314,18 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	case isUUID:
 		q = q.Where(`tag_brainz_id = ?`, query)
 	case isAll:
+	case match != "":
+		q = withSearchMatch(q, "tracks", match)
 	default:
-		q = q.Where(`filename LIKE ?`, fuzzy)
+		q = q.Where(`lower(filename) LIKE lower(?)`, fuzzy)
 	}
+	q = filters.Tracks(q, user.ID)
 	q = q.
+		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Offset(params.GetOrInt("songOffset", 0)).
 		Limit(params.GetOrInt("songCount", 20))
@@ -296,7 +338,7 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 		return spec.NewError(0, "find tracks: %v", err)
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for _, t := range tracks {
 		track := spec.NewTCTrackByFolder(t, t.Album)
@@ -309,8 +351,210 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	return sub
 }
 
-func (c *Controller) ServeGetArtistInfo(_ *http.Request) *spec.Response {
-	return spec.NewResponse()
+// ServeSearch is the subsonic v1 search, replaced by search2 in 1.4.0. it only finds tracks,
+// which must match every one of `artist`, `album`, `title`, `any`, and `newerThan` that is given
+func (c *Controller) ServeSearch(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+
+	var filters searchquery.Query
+	if v := params.GetOr("artist", ""); v != "" {
+		filters.Artist = append(filters.Artist, v)
+	}
+	if v := params.GetOr("album", ""); v != "" {
+		filters.Album = append(filters.Album, v)
+	}
+	if v := params.GetOr("title", ""); v != "" {
+		filters.Title = append(filters.Title, v)
+	}
+	anyText := params.GetOr("any", "")
+	newerThan, newerThanErr := params.GetTime("newerThan")
+	if !filters.HasFilters() && anyText == "" && newerThanErr != nil {
+		return spec.NewError(10, "please provide one of `artist`, `album`, `title`, `any`, or `newerThan`")
+	}
+
+	q := c.dbc.Model(&db.Track{})
+	q = filters.Tracks(q, user.ID)
+	if anyText != "" {
+		if match := searchMatch(c.dbc, anyText); match != "" {
+			q = withSearchMatch(q, "tracks", match, "title", "filename", "artist", "album")
+		} else {
+			fuzzy := "%" + anyText + "%"
+			q = q.Where(`lower(tracks.tag_title) LIKE lower(?) OR lower(tracks.filename) LIKE lower(?)
+				OR tracks.id IN (SELECT track_artists.track_id FROM track_artists JOIN artists ON artists.id=track_artists.artist_id WHERE lower(artists.name) LIKE lower(?))
+				OR tracks.album_id IN (SELECT id FROM albums WHERE lower(tag_title) LIKE lower(?) OR lower(right_path) LIKE lower(?))`,
+				fuzzy, fuzzy, fuzzy, fuzzy, fuzzy)
+		}
+	}
+	if newerThanErr == nil {
+		q = q.Where("tracks.created_at > ?", newerThan)
+	}
+	if m := getMusicFolder(c.musicPaths, params); m != "" {
+		q = q.
+			Joins("JOIN albums ON albums.id=tracks.album_id").
+			Where("albums.root_dir=?", m)
+	}
+
+	results := &spec.SearchResult{
+		Offset: params.GetOrInt("offset", 0),
+	}
+	if err := q.Count(&results.TotalHits).Error; err != nil {
+		return spec.NewError(0, "count tracks: %v", err)
+	}
+
+	var tracks []*db.Track
+	err := q.
+		Preload("Album").
+		Preload("Album.Artists").
+		Preload("Artists").
+		Preload("Genres").
+		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
+		Preload("TrackRating", "user_id=?", user.ID).
+		Order("tracks.album_id, tracks.tag_disc_number, tracks.tag_track_number").
+		Offset(results.Offset).
+		Limit(params.GetOrInt("count", 20)).
+		Find(&tracks).
+		Error
+	if err != nil {
+		return spec.NewError(0, "find tracks: %v", err)
+	}
+
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+
+	for _, t := range tracks {
+		track := spec.NewTCTrackByFolder(t, t.Album)
+		track.TranscodeMeta = transcodeMeta
+		results.Matches = append(results.Matches, track)
+	}
+
+	sub := spec.NewResponse()
+	sub.SearchResult = results
+	return sub
+}
+
+func (c *Controller) ServeGetArtistInfo(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+
+	var folder db.Album
+	if err := c.dbc.First(&folder, id.Value).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.NewError(70, "folder with id %q not found", id)
+	}
+
+	sub := spec.NewResponse()
+	sub.ArtistInfo = &spec.ArtistInfo{}
+
+	// a folder doesn't have an artist of its own, so take the most common
+	// album artist of the folder and the folders directly under it
+	var artist db.Artist
+	err = c.dbc.
+		Select("artists.*").
+		Joins("JOIN album_artists ON album_artists.artist_id=artists.id").
+		Joins("JOIN albums ON albums.id=album_artists.album_id").
+		Where("albums.id=? OR albums.parent_id=?", folder.ID, folder.ID).
+		Group("artists.id").
+		Order("count(albums.id) DESC").
+		Limit(1).
+		Find(&artist).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return sub
+	}
+
+	info, similarNames, err := c.lookupArtistInfo(r, &artist)
+	if err != nil {
+		log.Printf("error fetching artist info from lastfm: %v", err)
+		return sub
+	}
+	sub.ArtistInfo = info
+
+	inclNotPresent := params.GetOrBool("includeNotPresent", false)
+
+	rootQ := c.dbc.
+		Select("id").
+		Model(&db.Album{}).
+		Where("parent_id IS NULL")
+
+	for _, similarName := range similarNames {
+		// like getIndexes, the "artist" is a folder directly under a root. find one where
+		// it or a folder directly under it has the similar artist as an album artist
+		matchQ := c.dbc.
+			Select("albums.id").
+			Model(&db.Album{}).
+			Joins("JOIN albums sub ON sub.id=albums.id OR sub.parent_id=albums.id").
+			Joins("JOIN album_artists ON album_artists.album_id=sub.id").
+			Joins("JOIN artists ON artists.id=album_artists.artist_id").
+			Where("albums.parent_id IN ?", rootQ.SubQuery()).
+			Where("artists.name=?", similarName)
+
+		var similarFolder db.Album
+		err = c.dbc.
+			Select("albums.*, count(sub.id) child_count").
+			Preload("AlbumStar", "user_id=?", user.ID).
+			Preload("AlbumRating", "user_id=?", user.ID).
+			Joins("LEFT JOIN albums sub ON albums.id=sub.parent_id").
+			Where("albums.id IN ?", matchQ.SubQuery()).
+			Group("albums.id").
+			First(&similarFolder).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) && !inclNotPresent {
+			continue
+		}
+
+		if similarFolder.ID == 0 {
+			sub.ArtistInfo.Similar = append(sub.ArtistInfo.Similar, notPresentArtist(similarName))
+			continue
+		}
+
+		sub.ArtistInfo.Similar = append(sub.ArtistInfo.Similar, spec.NewArtistByFolder(&similarFolder))
+	}
+
+	return sub
+}
+
+func (c *Controller) ServeGetAlbumInfo(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+
+	var folder db.Album
+	if err := c.dbc.First(&folder, id.Value).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.NewError(70, "folder with id %q not found", id)
+	}
+
+	sub := spec.NewResponse()
+	sub.AlbumInfo = &spec.AlbumInfo{}
+
+	// folders without tracks have no tags, so use the first album under it instead
+	album := &folder
+	if folder.TagTitle == "" {
+		album = &db.Album{}
+		err := c.dbc.
+			Where("parent_id=? AND tag_title<>''", folder.ID).
+			Order("tag_year").
+			Order("lower(albums.right_path)").
+			First(album).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return sub
+		}
+	}
+
+	info, err := c.lookupAlbumInfo(r, album)
+	if err != nil {
+		log.Printf("error fetching album info from lastfm: %v", err)
+		return sub
+	}
+	sub.AlbumInfo = info
+
+	return sub
 }
 
 func (c *Controller) ServeGetStarred(r *http.Request) *spec.Response {
@@ -348,6 +592,8 @@ func (c *Controller) ServeGetStarred(r *http.Request) *spec.Response {
 		Joins("JOIN album_artists ON album_artists.album_id=albums.id").
 		Joins("JOIN album_stars ON albums.id=album_stars.album_id").
 		Where("album_stars.user_id=?", user.ID).
+		Preload("Artists").
+		Preload("Genres").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID)
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
@@ -366,8 +612,11 @@ func (c *Controller) ServeGetStarred(r *http.Request) *spec.Response {
 		Preload("Album").
 		Joins("JOIN track_stars ON tracks.id=track_stars.track_id").
 		Where("track_stars.user_id=?", user.ID).
+		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID)
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
 		q = q.
@@ -378,7 +627,7 @@ func (c *Controller) ServeGetStarred(r *http.Request) *spec.Response {
 		return spec.NewError(0, "find tracks: %v", err)
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for _, t := range tracks {
 		track := spec.NewTCTrackByFolder(t, t.Album)
@@ -3,6 +3,13 @@ package ctrlsubsonic
 import (
 	"net/url"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/infocache/albuminfocache"
+	"go.senan.xyz/gonic/infocache/artistinfocache"
 )
 
 func TestGetIndexes(t *testing.T) {
@@ -35,12 +42,91 @@ func TestGetAlbumList(t *testing.T) {
 	})
 }
 
+func TestSearch(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+	runQueryCases(t, contr.ServeSearch, []*queryCase{
+		{url.Values{"artist": {"artist-1"}, "count": {"5"}}, "q_artist", false},
+		{url.Values{"artist": {"artist-1"}, "album": {"album-2"}, "title": {"track-0"}}, "q_artist_album_title", false},
+		{url.Values{"any": {"album-1"}, "offset": {"6"}}, "q_any", false},
+		{url.Values{"newerThan": {"0"}, "count": {"2"}}, "q_newer_than", false},
+		{url.Values{"newerThan": {"4102444800000"}}, "q_newer_than_future", false},
+	})
+}
+
 func TestSearchTwo(t *testing.T) {
 	t.Parallel()
 	contr := makeController(t)
+	fts := searchGolden(contr.dbc)
 	runQueryCases(t, contr.ServeSearchTwo, []*queryCase{
-		{url.Values{"query": {"art"}}, "q_art", false},
-		{url.Values{"query": {"alb"}}, "q_alb", false},
+		{url.Values{"query": {"art"}}, fts("q_art"), false},
+		{url.Values{"query": {"alb"}}, fts("q_alb"), false},
 		{url.Values{"query": {"tra"}}, "q_tra", false},
+		{url.Values{"query": {"tra artist:artist-1"}}, "q_filter", false},
 	})
 }
+
+func TestGetArtistInfo(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+	contr.artistInfoCache = artistinfocache.New(contr.dbc, nil)
+	contr.resolveProxyPath = func(in string) string { return in }
+
+	var artist db.Artist
+	require.NoError(t, contr.dbc.Where("name=?", "artist-0").First(&artist).Error)
+	require.NoError(t, contr.dbc.Create(&db.ArtistInfo{
+		ID:             artist.ID,
+		UpdatedAt:      time.Now(),
+		Biography:      "a bio",
+		ImageURL:       "http://example.com/artist-0.jpg",
+		SimilarArtists: "artist-1;artist-9",
+	}).Error)
+
+	var folder, similarFolder db.Album
+	require.NoError(t, contr.dbc.Where("right_path=?", "artist-0").First(&folder).Error)
+	require.NoError(t, contr.dbc.Where("right_path=?", "artist-1").First(&similarFolder).Error)
+
+	// the artist folder and an album folder under it both resolve to the album artist
+	var album db.Album
+	require.NoError(t, contr.dbc.Where("parent_id=?", folder.ID).First(&album).Error)
+	for _, id := range []string{folder.SID().String(), album.SID().String()} {
+		sub := runTestCase(t, contr.ServeGetArtistInfo, url.Values{"id": {id}}, false)
+		require.NotNil(t, sub.Response.ArtistInfo)
+		require.Equal(t, "a bio", sub.Response.ArtistInfo.Biography)
+		require.Equal(t, "http://example.com/artist-0.jpg", sub.Response.ArtistInfo.LargeImageURL)
+		require.Len(t, sub.Response.ArtistInfo.Similar, 1)
+		require.Equal(t, similarFolder.SID(), sub.Response.ArtistInfo.Similar[0].ID)
+		require.Equal(t, "artist-1", sub.Response.ArtistInfo.Similar[0].Name)
+		require.Equal(t, 3, sub.Response.ArtistInfo.Similar[0].AlbumCount)
+	}
+
+	// artists not in the library have no real id, so check the raw response
+	rr := serveTestCase(resp(contr.ServeGetArtistInfo), nil, url.Values{"id": {folder.SID().String()}, "includeNotPresent": {"true"}}, nil)
+	require.Contains(t, rr.Body.String(), `{"id":"-1","name":"artist-9"`)
+
+	sub := runTestCase(t, contr.ServeGetArtistInfo, url.Values{"id": {folder.SID().String()}, "count": {"0"}}, false)
+	require.Empty(t, sub.Response.ArtistInfo.Similar)
+}
+
+func TestGetAlbumInfo(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+	contr.albumInfoCache = albuminfocache.New(contr.dbc, nil)
+
+	var folder, album db.Album
+	require.NoError(t, contr.dbc.Where("right_path=?", "artist-0").First(&folder).Error)
+	require.NoError(t, contr.dbc.Where("parent_id=?", folder.ID).Order("right_path").First(&album).Error)
+	require.NoError(t, contr.dbc.Create(&db.AlbumInfo{
+		ID:        album.ID,
+		UpdatedAt: time.Now(),
+		Notes:     "some notes",
+	}).Error)
+
+	sub := runTestCase(t, contr.ServeGetAlbumInfo, url.Values{"id": {album.SID().String()}}, false)
+	require.NotNil(t, sub.Response.AlbumInfo)
+	require.Equal(t, "some notes", sub.Response.AlbumInfo.Notes)
+
+	// an artist folder has no tags, so we use the first album under it
+	sub = runTestCase(t, contr.ServeGetAlbumInfo, url.Values{"id": {folder.SID().String()}}, false)
+	require.Equal(t, "some notes", sub.Response.AlbumInfo.Notes)
+}
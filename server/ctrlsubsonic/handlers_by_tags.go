@@ -3,8 +3,8 @@ package ctrlsubsonic
 import (
 	"errors"
 	"log"
-	"math"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -17,6 +17,7 @@ import (
 	"go.senan.xyz/gonic/handlerutil"
 	"go.senan.xyz/gonic/lastfm"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/searchquery"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 )
@@ -26,13 +27,13 @@ func (c *Controller) ServeGetArtists(r *http.Request) *spec.Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	var artists []*db.Artist
 	q := c.dbc.
-		Select("*, count(album_artists.album_id) album_count").
+		Select("artists.*, count(album_artists.album_id) album_count").
 		Joins("JOIN album_artists ON album_artists.artist_id=artists.id").
 		Preload("ArtistStar", "user_id=?", user.ID).
 		Preload("ArtistRating", "user_id=?", user.ID).
 		Preload("Info").
 		Group("artists.id").
-		Order("artists.name COLLATE NOCASE")
+		Order("lower(artists.name)")
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
 		q = q.
 			Joins("JOIN albums ON albums.id=album_artists.album_id").
@@ -73,10 +74,10 @@ func (c *Controller) ServeGetArtist(r *http.Request) *spec.Response {
 	c.dbc.
 		Preload("Appearances", func(db *gorm.DB) *gorm.DB {
 			return db.
-				Select("*, count(sub.id) child_count, sum(sub.length) duration").
+				Select("albums.*, artist_appearances.artist_id, count(sub.id) child_count, sum(sub.length) duration").
 				Joins("LEFT JOIN tracks sub ON albums.id=sub.album_id").
 				Order("albums.right_path").
-				Group("albums.id")
+				Group("albums.id, artist_appearances.artist_id")
 		}).
 		Preload("Appearances.Artists").
 		Preload("Appearances.Genres").
@@ -113,7 +114,9 @@ func (c *Controller) ServeGetAlbum(r *http.Request) *spec.Response {
 			return db.
 				Order("tracks.tag_disc_number, tracks.tag_track_number").
 				Preload("Artists").
+				Preload("Genres").
 				Preload("TrackStar", "user_id=?", user.ID).
+				Preload("TrackPlay", "user_id=?", user.ID).
 				Preload("TrackRating", "user_id=?", user.ID)
 		}).
 		Preload("AlbumStar", "user_id=?", user.ID).
@@ -129,7 +132,7 @@ func (c *Controller) ServeGetAlbum(r *http.Request) *spec.Response {
 	sub.Album = spec.NewAlbumByTags(album, album.Artists)
 	sub.Album.Tracks = make([]*spec.TrackChild, len(album.Tracks))
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for i, track := range album.Tracks {
 		sub.Album.Tracks[i] = spec.NewTrackByTags(track, album)
@@ -149,50 +152,51 @@ func (c *Controller) ServeGetAlbumListTwo(r *http.Request) *spec.Response {
 		return spec.NewError(10, "please provide a `type` parameter")
 	}
 	q := c.dbc.DB
+	// albums are grouped below, so ordering by a joined table needs an aggregate
 	switch listType {
 	case "alphabeticalByArtist":
 		q = q.Joins("JOIN artists ON artists.id=album_artists.artist_id")
-		q = q.Order("artists.name")
+		q = q.Order("min(artists.name)")
 	case "alphabeticalByName":
-		q = q.Order("tag_title")
+		q = q.Order("albums.tag_title")
 	case "byYear":
 		y1, y2 := params.GetOrInt("fromYear", 1800),
 			params.GetOrInt("toYear", 2200)
 		// support some clients sending wrong order like DSub
-		q = q.Where("tag_year BETWEEN ? AND ?", min(y1, y2), max(y1, y2))
-		q = q.Order("tag_year DESC")
+		q = q.Where("albums.tag_year BETWEEN ? AND ?", min(y1, y2), max(y1, y2))
+		q = q.Order("albums.tag_year DESC")
 	case "byGenre":
 		genre, _ := params.Get("genre")
 		q = q.Joins("JOIN album_genres ON album_genres.album_id=albums.id")
 		q = q.Joins("JOIN genres ON genres.id=album_genres.genre_id AND genres.name=?", genre)
-		q = q.Order("tag_title")
+		q = q.Order("albums.tag_title")
 	case "frequent":
 		user := r.Context().Value(CtxUser).(*db.User)
 		q = q.Joins("JOIN plays ON albums.id=plays.album_id AND plays.user_id=?", user.ID)
-		q = q.Order("plays.length DESC")
+		q = q.Order("max(plays.length) DESC")
 	case "newest":
-		q = q.Order("created_at DESC")
+		q = q.Order("albums.created_at DESC")
 	case "random":
 		q = q.Order(gorm.Expr("random()"))
 	case "recent":
 		q = q.Joins("JOIN plays ON albums.id=plays.album_id AND plays.user_id=?", user.ID)
-		q = q.Order("plays.time DESC")
+		q = q.Order("max(plays.time) DESC")
 	case "starred":
 		q = q.Joins("JOIN album_stars ON albums.id=album_stars.album_id AND album_stars.user_id=?", user.ID)
-		q = q.Order("tag_title")
+		q = q.Order("albums.tag_title")
 	case "highest":
 		q = q.Joins("JOIN album_ratings ON album_ratings.album_id=albums.id AND album_ratings.user_id=?", user.ID)
-		q = q.Order("album_ratings.rating DESC")
+		q = q.Order("max(album_ratings.rating) DESC")
 	default:
 		return spec.NewError(10, "unknown value %q for parameter 'type'", listType)
 	}
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
-		q = q.Where("root_dir=?", m)
+		q = q.Where("albums.root_dir=?", m)
 	}
 	var albums []*db.Album
 	// TODO: think about removing this extra join to count number
 	// of children. it might make sense to store that in the db
-	q.
+	err = q.
 		Select("albums.*, count(tracks.id) child_count, sum(tracks.length) duration").
 		Joins("LEFT JOIN tracks ON tracks.album_id=albums.id").
 		Group("albums.id").
@@ -205,7 +209,11 @@ func (c *Controller) ServeGetAlbumListTwo(r *http.Request) *spec.Response {
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
 		Preload("Play", "user_id=?", user.ID).
-		Find(&albums)
+		Find(&albums).
+		Error
+	if err != nil {
+		return spec.NewError(0, "error finding albums: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.AlbumsTwo = &spec.Albums{
 		List: make([]*spec.Album, len(albums)),
@@ -227,6 +235,18 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	var isUUID = uuid.Validate(query) == nil
 	var isAll = query == `""`
 
+	// pull out any field filters, leaving the free text to match as usual
+	var filters searchquery.Query
+	if !isUUID && !isAll {
+		if filters, err = searchquery.Parse(query); err != nil {
+			return spec.NewError(0, "invalid search query: %v", err)
+		}
+		query = filters.Text
+		isAll = query == "" && filters.HasFilters()
+	}
+
+	var match = searchMatch(c.dbc, query)
+
 	var fuzzy = query
 	fuzzy = strings.Join(strings.Fields(fuzzy), "%")
 	fuzzy = strings.ToLower(fuzzy)
@@ -237,15 +257,18 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	// search artists
 	var artists []*db.Artist
 	q := c.dbc.
-		Select("*, count(albums.id) album_count").
+		Select("artists.*, count(albums.id) album_count").
 		Group("artists.id")
 	switch {
 	case isUUID:
 		q = q.Where(0)
 	case isAll:
+	case match != "":
+		q = withSearchMatch(q, "artists", match)
 	default:
-		q = q.Where(`name LIKE ? OR name_u_dec LIKE ?`, fuzzy, fuzzy)
+		q = q.Where(`lower(name) LIKE lower(?) OR lower(name_u_dec) LIKE lower(?)`, fuzzy, fuzzy)
 	}
+	q = filters.Artists(q, user.ID)
 	q = q.
 		Joins("JOIN album_artists ON album_artists.artist_id=artists.id").
 		Joins("JOIN albums ON albums.id=album_artists.album_id").
@@ -277,9 +300,12 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	case isUUID:
 		q = q.Where(`tag_brainz_id = ?`, query)
 	case isAll:
+	case match != "":
+		q = withSearchMatch(q, "albums", match, "title", "artist", "genre")
 	default:
-		q = q.Where(`tag_title LIKE ? OR tag_title_u_dec LIKE ?`, fuzzy, fuzzy)
+		q = q.Where(`lower(tag_title) LIKE lower(?) OR lower(tag_title_u_dec) LIKE lower(?)`, fuzzy, fuzzy)
 	}
+	q = filters.Albums(q, user.ID)
 	q = q.
 		Offset(params.GetOrInt("albumOffset", 0)).
 		Limit(params.GetOrInt("albumCount", 20))
@@ -301,14 +327,18 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 		Preload("Genres").
 		Preload("Artists").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID)
 	switch {
 	case isUUID:
 		q = q.Where(`tracks.tag_brainz_id = ?`, query)
 	case isAll:
+	case match != "":
+		q = withSearchMatch(q, "tracks", match, "title", "artist", "album", "genre")
 	default:
-		q = q.Where(`tracks.tag_title LIKE ? OR tracks.tag_title_u_dec LIKE ?`, fuzzy, fuzzy)
+		q = q.Where(`lower(tracks.tag_title) LIKE lower(?) OR lower(tracks.tag_title_u_dec) LIKE lower(?)`, fuzzy, fuzzy)
 	}
+	q = filters.Tracks(q, user.ID)
 	q = q.Offset(params.GetOrInt("songOffset", 0)).
 		Limit(params.GetOrInt("songCount", 20))
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
@@ -320,7 +350,7 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 		return spec.NewError(0, "find tracks: %v", err)
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for _, t := range tracks {
 		track := spec.NewTrackByTags(t, t.Album)
@@ -352,34 +382,16 @@ func (c *Controller) ServeGetArtistInfoTwo(r *http.Request) *spec.Response {
 	sub := spec.NewResponse()
 	sub.ArtistInfoTwo = &spec.ArtistInfo{}
 
-	info, err := c.artistInfoCache.GetOrLookup(r.Context(), artist.ID)
+	info, similarNames, err := c.lookupArtistInfo(r, &artist)
 	if err != nil {
 		log.Printf("error fetching artist info from lastfm: %v", err)
 		return sub
 	}
+	sub.ArtistInfoTwo = info
 
-	sub.ArtistInfoTwo.Biography = spec.CleanExternalText(info.Biography)
-	sub.ArtistInfoTwo.MusicBrainzID = info.MusicBrainzID
-	sub.ArtistInfoTwo.LastFMURL = info.LastFMURL
-
-	sub.ArtistInfoTwo.SmallImageURL = c.genArtistCoverURL(r, &artist, 64)
-	sub.ArtistInfoTwo.MediumImageURL = c.genArtistCoverURL(r, &artist, 126)
-	sub.ArtistInfoTwo.LargeImageURL = c.genArtistCoverURL(r, &artist, 256)
-
-	if info.ImageURL != "" {
-		sub.ArtistInfoTwo.SmallImageURL = info.ImageURL
-		sub.ArtistInfoTwo.MediumImageURL = info.ImageURL
-		sub.ArtistInfoTwo.LargeImageURL = info.ImageURL
-		sub.ArtistInfoTwo.ArtistImageURL = info.ImageURL
-	}
-
-	count := params.GetOrInt("count", 20)
 	inclNotPresent := params.GetOrBool("includeNotPresent", false)
 
-	for i, similarName := range info.GetSimilarArtists() {
-		if i == count {
-			break
-		}
+	for _, similarName := range similarNames {
 		var artist db.Artist
 		err = c.dbc.
 			Preload("Info").
@@ -396,10 +408,7 @@ func (c *Controller) ServeGetArtistInfoTwo(r *http.Request) *spec.Response {
 
 		if artist.ID == 0 {
 			// add a very limited artist, since we don't have everything with `inclNotPresent`
-			sub.ArtistInfoTwo.Similar = append(sub.ArtistInfoTwo.Similar, &spec.Artist{
-				ID:   &specid.ID{},
-				Name: similarName,
-			})
+			sub.ArtistInfoTwo.Similar = append(sub.ArtistInfoTwo.Similar, notPresentArtist(similarName))
 			continue
 		}
 
@@ -428,19 +437,12 @@ func (c *Controller) ServeGetAlbumInfoTwo(r *http.Request) *spec.Response {
 	sub := spec.NewResponse()
 	sub.AlbumInfo = &spec.AlbumInfo{}
 
-	info, err := c.albumInfoCache.GetOrLookup(r.Context(), album.ID)
+	info, err := c.lookupAlbumInfo(r, &album)
 	if err != nil {
 		log.Printf("error fetching album info from lastfm: %v", err)
 		return sub
 	}
-
-	sub.AlbumInfo.Notes = spec.CleanExternalText(info.Notes)
-	sub.AlbumInfo.MusicBrainzID = info.MusicBrainzID
-	sub.AlbumInfo.LastFMURL = info.LastFMURL
-
-	if err := uuid.Validate(album.TagBrainzID); err == nil {
-		sub.AlbumInfo.MusicBrainzID = album.TagBrainzID // prefer db musicbrainz ID over lastfm's
-	}
+	sub.AlbumInfo = info
 
 	return sub
 }
@@ -478,7 +480,9 @@ func (c *Controller) ServeGetSongsByGenre(r *http.Request) *spec.Response {
 		Preload("Album").
 		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Offset(params.GetOrInt("offset", 0)).
 		Limit(params.GetOrInt("count", 10))
@@ -494,7 +498,7 @@ func (c *Controller) ServeGetSongsByGenre(r *http.Request) *spec.Response {
 		List: make([]*spec.TrackChild, len(tracks)),
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for i, t := range tracks {
 		sub.TracksByGenre.List[i] = spec.NewTrackByTags(t, t.Album)
@@ -540,6 +544,7 @@ func (c *Controller) ServeGetStarredTwo(r *http.Request) *spec.Response {
 		Where("album_stars.user_id=?", user.ID).
 		Order("album_stars.star_date DESC").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("DiscTitles").
 		Preload("AlbumStar", "user_id=?", user.ID).
 		Preload("AlbumRating", "user_id=?", user.ID).
@@ -563,7 +568,9 @@ func (c *Controller) ServeGetStarredTwo(r *http.Request) *spec.Response {
 		Preload("Album").
 		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID)
 	if m := getMusicFolder(c.musicPaths, params); m != "" {
 		q = q.
@@ -574,7 +581,7 @@ func (c *Controller) ServeGetStarredTwo(r *http.Request) *spec.Response {
 		return spec.NewError(0, "find tracks: %v", err)
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for _, t := range tracks {
 		track := spec.NewTrackByTags(t, t.Album)
@@ -635,8 +642,11 @@ func (c *Controller) ServeGetTopSongs(r *http.Request) *spec.Response {
 		Joins("JOIN artists ON artists.id=track_artists.artist_id").
 		Where("artists.id=?", artist.ID).
 		Preload("Album").
+		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Group("tracks.id").
 		Limit(count).
@@ -649,7 +659,7 @@ func (c *Controller) ServeGetTopSongs(r *http.Request) *spec.Response {
 		return sub
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for _, track := range tracks {
 		tc := spec.NewTrackByTags(track, track.Album)
@@ -673,11 +683,11 @@ func (c *Controller) ServeGetSimilarSongs(r *http.Request) *spec.Response {
 
 	switch id.Type {
 	case specid.Track:
-		tracks, sub = getSimilarSongsFromTrack(c, id, params, user, count)
+		tracks, sub = getSimilarSongsFromTrack(c, id, params, user, handlerutil.RemoteAddr(r), count)
 	case specid.Album:
-		tracks, sub = getSimilarSongsFromAlbum(c, id, params, user, count)
+		tracks, sub = getSimilarSongsFromAlbum(c, id, params, user, handlerutil.RemoteAddr(r), count)
 	case specid.Artist:
-		tracks, sub = getSimilarSongsFromArtist(c, id, params, user, count)
+		tracks, sub = getSimilarSongsFromArtist(c, id, params, user, handlerutil.RemoteAddr(r), count)
 	default:
 		return spec.NewError(10, "please provide a artist, album or track `id` parameter")
 	}
@@ -702,7 +712,7 @@ func (c *Controller) ServeGetSimilarSongsTwo(r *http.Request) *spec.Response {
 		return spec.NewError(10, "please provide an artist `id` parameter")
 	}
 
-	tracks, sub := getSimilarSongsFromArtist(c, id, params, user, count)
+	tracks, sub := getSimilarSongsFromArtist(c, id, params, user, handlerutil.RemoteAddr(r), count)
 	if sub != nil {
 		return sub
 	}
@@ -714,7 +724,7 @@ func (c *Controller) ServeGetSimilarSongsTwo(r *http.Request) *spec.Response {
 	return sub
 }
 
-func getSimilarSongsFromTrack(c *Controller, id specid.ID, params params.Params, user *db.User, count int) ([]*spec.TrackChild, *spec.Response) {
+func getSimilarSongsFromTrack(c *Controller, id specid.ID, params params.Params, user *db.User, addr netip.Addr, count int) ([]*spec.TrackChild, *spec.Response) {
 	var track db.Track
 	err := c.dbc.
 		Preload("Album").
@@ -744,8 +754,11 @@ func getSimilarSongsFromTrack(c *Controller, id specid.ID, params params.Params,
 	err = c.dbc.
 		Select("tracks.*").
 		Preload("Album").
+		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Where("tracks.tag_title IN (?)", similarTrackNames).
 		Order(gorm.Expr("random()")).
@@ -760,7 +773,7 @@ func getSimilarSongsFromTrack(c *Controller, id specid.ID, params params.Params,
 	}
 
 	trackChildren := make([]*spec.TrackChild, len(tracks))
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), addr)
 
 	for i, track := range tracks {
 		trackChildren[i] = spec.NewTrackByTags(track, track.Album)
@@ -770,7 +783,7 @@ func getSimilarSongsFromTrack(c *Controller, id specid.ID, params params.Params,
 	return trackChildren, nil
 }
 
-func getSimilarSongsFromArtist(c *Controller, id specid.ID, params params.Params, user *db.User, count int) ([]*spec.TrackChild, *spec.Response) {
+func getSimilarSongsFromArtist(c *Controller, id specid.ID, params params.Params, user *db.User, addr netip.Addr, count int) ([]*spec.TrackChild, *spec.Response) {
 	var artist db.Artist
 	err := c.dbc.
 		Where("id=?", id.Value).
@@ -797,8 +810,11 @@ func getSimilarSongsFromArtist(c *Controller, id specid.ID, params params.Params
 	var tracks []*db.Track
 	err = c.dbc.
 		Preload("Album").
+		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Joins("JOIN track_artists ON track_artists.track_id=tracks.id").
 		Joins("JOIN artists ON artists.id=track_artists.artist_id").
@@ -816,7 +832,7 @@ func getSimilarSongsFromArtist(c *Controller, id specid.ID, params params.Params
 	}
 
 	trackChildren := make([]*spec.TrackChild, len(tracks))
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), addr)
 
 	for i, track := range tracks {
 		trackChildren[i] = spec.NewTrackByTags(track, track.Album)
@@ -826,7 +842,7 @@ func getSimilarSongsFromArtist(c *Controller, id specid.ID, params params.Params
 	return trackChildren, nil
 }
 
-func getSimilarSongsFromAlbum(c *Controller, id specid.ID, params params.Params, user *db.User, count int) ([]*spec.TrackChild, *spec.Response) {
+func getSimilarSongsFromAlbum(c *Controller, id specid.ID, params params.Params, user *db.User, addr netip.Addr, count int) ([]*spec.TrackChild, *spec.Response) {
 	var album db.Album
 	err := c.dbc.
 		Preload("Tracks").
@@ -865,8 +881,11 @@ func getSimilarSongsFromAlbum(c *Controller, id specid.ID, params params.Params,
 	err = c.dbc.
 		Select("tracks.*").
 		Preload("Album").
+		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Where("tracks.tag_title IN (?)", similarTrackNames).
 		Order(gorm.Expr("random()")).
@@ -881,7 +900,7 @@ func getSimilarSongsFromAlbum(c *Controller, id specid.ID, params params.Params,
 	}
 
 	trackChildren := make([]*spec.TrackChild, len(tracks))
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), addr)
 
 	for i, track := range tracks {
 		trackChildren[i] = spec.NewTrackByTags(track, track.Album)
@@ -1011,13 +1030,8 @@ func (c *Controller) ServeSetRating(r *http.Request) *spec.Response {
 				return spec.NewError(0, "save album rating: %v", err)
 			}
 		}
-		var averageRating float64
-		if err := c.dbc.Model(db.AlbumRating{}).Select("coalesce(avg(rating), 0)").Where("album_id=?", id.Value).Row().Scan(&averageRating); err != nil {
-			return spec.NewError(0, "find average album rating: %v", err)
-		}
-		album.AverageRating = math.Trunc(averageRating*100) / 100
-		if err := c.dbc.Save(&album).Error; err != nil {
-			return spec.NewError(0, "save album: %v", err)
+		if err := c.dbc.UpdateAlbumAverageRating(album.ID); err != nil {
+			return spec.NewError(0, "update average album rating: %v", err)
 		}
 	case specid.Artist:
 		var artist db.Artist
@@ -1042,13 +1056,8 @@ func (c *Controller) ServeSetRating(r *http.Request) *spec.Response {
 				return spec.NewError(0, "save artist rating: %v", err)
 			}
 		}
-		var averageRating float64
-		if err := c.dbc.Model(db.ArtistRating{}).Select("coalesce(avg(rating), 0)").Where("artist_id=?", id.Value).Row().Scan(&averageRating); err != nil {
-			return spec.NewError(0, "find average artist rating: %v", err)
-		}
-		artist.AverageRating = math.Trunc(averageRating*100) / 100
-		if err := c.dbc.Save(&artist).Error; err != nil {
-			return spec.NewError(0, "save artist: %v", err)
+		if err := c.dbc.UpdateArtistAverageRating(artist.ID); err != nil {
+			return spec.NewError(0, "update average artist rating: %v", err)
 		}
 	case specid.Track:
 		var track db.Track
@@ -1073,13 +1082,8 @@ func (c *Controller) ServeSetRating(r *http.Request) *spec.Response {
 				return spec.NewError(0, "save track rating: %v", err)
 			}
 		}
-		var averageRating float64
-		if err := c.dbc.Model(db.TrackRating{}).Select("coalesce(avg(rating), 0)").Where("track_id=?", id.Value).Row().Scan(&averageRating); err != nil {
-			return spec.NewError(0, "find average track rating: %v", err)
-		}
-		track.AverageRating = math.Trunc(averageRating*100) / 100
-		if err := c.dbc.Save(&track).Error; err != nil {
-			return spec.NewError(0, "save track: %v", err)
+		if err := c.dbc.UpdateTrackAverageRating(track.ID); err != nil {
+			return spec.NewError(0, "update average track rating: %v", err)
 		}
 	default:
 		return spec.NewError(0, "non-album non-artist non-track id cannot be rated")
@@ -1,8 +1,16 @@
 package ctrlsubsonic
 
 import (
+	"fmt"
 	"net/url"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/wrtag/tags/normtag"
 )
 
 func TestGetArtists(t *testing.T) {
@@ -45,12 +53,86 @@ func TestGetAlbumListTwo(t *testing.T) {
 	})
 }
 
+// every list type, for both album lists. the ones for the user's plays, stars, and ratings order by
+// joined tables, which the grouping by album mustn't break
+func TestGetAlbumListTypes(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+
+	user := contr.dbc.GetUserByName(mockUsername)
+	require.NotNil(t, user)
+
+	var album db.Album
+	require.NoError(t, contr.dbc.Where("tag_title IS NOT NULL").First(&album).Error)
+	require.NoError(t, contr.dbc.Create(&db.Play{UserID: user.ID, AlbumID: album.ID, Time: time.Now(), Count: 1, Length: 100}).Error)
+	require.NoError(t, contr.dbc.Create(&db.AlbumStar{UserID: user.ID, AlbumID: album.ID, StarDate: time.Now()}).Error)
+	require.NoError(t, contr.dbc.Create(&db.AlbumRating{UserID: user.ID, AlbumID: album.ID, Rating: 5}).Error)
+
+	for _, listType := range []string{"alphabeticalByArtist", "alphabeticalByName", "byYear", "byGenre", "frequent", "newest", "random", "recent", "starred", "highest"} {
+		t.Run(listType, func(t *testing.T) {
+			t.Parallel()
+			q := url.Values{"type": {listType}, "genre": {"genre-a"}, "fromYear": {"0"}}
+
+			sub := runTestCaseAs(t, contr.ServeGetAlbumListTwo, user, q)
+			require.Nil(t, sub.Response.Error)
+			byTags := sub.Response.AlbumsTwo.List
+
+			sub = runTestCaseAs(t, contr.ServeGetAlbumList, user, q)
+			require.Nil(t, sub.Response.Error)
+			byFolder := sub.Response.Albums.List
+
+			switch listType {
+			case "frequent", "recent", "starred", "highest":
+				require.Len(t, byTags, 1)
+				require.Equal(t, album.SID(), byTags[0].ID)
+				require.Len(t, byFolder, 1)
+				require.Equal(t, album.SID(), byFolder[0].ID)
+			case "byGenre":
+				// the mock library has no genres
+				require.Empty(t, byTags)
+				require.Empty(t, byFolder)
+			default:
+				require.NotEmpty(t, byTags)
+				require.NotEmpty(t, byFolder)
+			}
+		})
+	}
+}
+
 func TestSearchThree(t *testing.T) {
 	t.Parallel()
 	contr := makeController(t)
+	fts := searchGolden(contr.dbc)
 	runQueryCases(t, contr.ServeSearchThree, []*queryCase{
-		{url.Values{"query": {"art"}}, "q_art", false},
-		{url.Values{"query": {"alb"}}, "q_alb", false},
+		{url.Values{"query": {"art"}}, fts("q_art"), false},
+		{url.Values{"query": {"alb"}}, fts("q_alb"), false},
 		{url.Values{"query": {"tit"}}, "q_tra", false},
+		{url.Values{"query": {"artist-1 title-2"}}, fts("q_across_fields"), false},
+		{url.Values{"query": {"artist:artist-1 title:title-2"}}, "q_filter_fields", false},
+		{url.Values{"query": {"album-2 year:2021 artist:artist-0 starred:false"}}, fts("q_filter_text_and_fields"), false},
+		{url.Values{"query": {"year:2030.."}}, "q_filter_no_match", false},
+		{url.Values{"query": {"artist:artist_1"}}, "q_filter_escaped", false},
+		{url.Values{"query": {"year:abc"}}, "q_filter_invalid", false},
+	})
+}
+
+func TestMultiValueFields(t *testing.T) {
+	t.Parallel()
+	contr := makeControllerTags(t, func(m *mockfs.MockFS) {
+		for i := range 3 {
+			m.SetTags(fmt.Sprintf("artist-0/album-0/track-%d.flac", i), func(tags *mockfs.TagInfo) {
+				normtag.Set(tags.Tags, normtag.AlbumArtist, "Alan Vega & Liz Lamere")
+				normtag.Set(tags.Tags, normtag.AlbumArtists, "Alan Vega", "Liz Lamere")
+				normtag.Set(tags.Tags, normtag.Genre, "electronic;punk")
+				normtag.Set(tags.Tags, normtag.ReleaseType, "album", "compilation")
+			})
+		}
+	})
+	runQueryCases(t, contr.ServeGetAlbum, []*queryCase{
+		{url.Values{"id": {"al-3"}}, "album", false},
+	})
+	runQueryCases(t, contr.ServeGetMusicDirectory, []*queryCase{
+		{url.Values{"id": {"al-2"}}, "directory_artist", false},
+		{url.Values{"id": {"al-3"}}, "directory_album", false},
 	})
 }
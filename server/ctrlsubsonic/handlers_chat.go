@@ -0,0 +1,54 @@
+package ctrlsubsonic
+
+import (
+	"net/http"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func (c *Controller) ServeGetChatMessages(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+
+	var messages []*db.ChatMessage
+	err := c.dbc.
+		Preload("User").
+		Where("created_at > ?", params.GetOrTime("since", time.Time{})).
+		Order("created_at").
+		Find(&messages).
+		Error
+	if err != nil {
+		return spec.NewError(0, "find chat messages: %v", err)
+	}
+
+	sub := spec.NewResponse()
+	sub.ChatMessages = &spec.ChatMessages{
+		List: make([]*spec.ChatMessage, len(messages)),
+	}
+	for i, message := range messages {
+		sub.ChatMessages.List[i] = spec.NewChatMessage(message)
+	}
+	return sub
+}
+
+func (c *Controller) ServeAddChatMessage(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+
+	text, err := params.Get("message")
+	if err != nil || text == "" {
+		return spec.NewError(10, "please provide a `message` parameter")
+	}
+
+	message := db.ChatMessage{
+		UserID:  user.ID,
+		Message: text,
+	}
+	if err := c.dbc.Create(&message).Error; err != nil {
+		return spec.NewError(0, "save chat message: %v", err)
+	}
+
+	return spec.NewResponse()
+}
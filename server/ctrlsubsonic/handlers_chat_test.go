@@ -0,0 +1,49 @@
+package ctrlsubsonic
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestChatMessages(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	alice := db.User{Name: "alice", Password: "password"}
+	require.NoError(t, contr.dbc.Create(&alice).Error)
+	bob := db.User{Name: "bob", Password: "password"}
+	require.NoError(t, contr.dbc.Create(&bob).Error)
+
+	sub := runTestCaseAs(t, contr.ServeAddChatMessage, &alice, url.Values{})
+	require.NotNil(t, sub.Response.Error)
+
+	sub = runTestCaseAs(t, contr.ServeAddChatMessage, &alice, url.Values{"message": {"hello"}})
+	require.Nil(t, sub.Response.Error)
+
+	// back date the first message so that we can query around it
+	first := time.Now().Add(-time.Hour)
+	require.NoError(t, contr.dbc.Model(db.ChatMessage{}).Update("created_at", first).Error)
+
+	sub = runTestCaseAs(t, contr.ServeAddChatMessage, &bob, url.Values{"message": {"hi alice"}})
+	require.Nil(t, sub.Response.Error)
+
+	sub = runTestCaseAs(t, contr.ServeGetChatMessages, &alice, url.Values{})
+	require.Nil(t, sub.Response.Error)
+	require.Len(t, sub.Response.ChatMessages.List, 2)
+	require.Equal(t, "alice", sub.Response.ChatMessages.List[0].Username)
+	require.Equal(t, "hello", sub.Response.ChatMessages.List[0].Message)
+	require.Equal(t, first.UnixMilli(), sub.Response.ChatMessages.List[0].Time)
+	require.Equal(t, "bob", sub.Response.ChatMessages.List[1].Username)
+
+	since := strconv.FormatInt(first.Add(time.Minute).UnixMilli(), 10)
+	sub = runTestCaseAs(t, contr.ServeGetChatMessages, &alice, url.Values{"since": {since}})
+	require.Len(t, sub.Response.ChatMessages.List, 1)
+	require.Equal(t, "hi alice", sub.Response.ChatMessages.List[0].Message)
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -19,12 +21,14 @@ import (
 	"github.com/jinzhu/gorm"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
 	"go.senan.xyz/gonic/scanner"
 	"go.senan.xyz/gonic/scrobble"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/specidpaths"
+	"go.senan.xyz/gonic/transcode"
 )
 
 func (c *Controller) ServeGetLicence(_ *http.Request) *spec.Response {
@@ -45,6 +49,8 @@ func (c *Controller) ServeGetOpenSubsonicExtensions(_ *http.Request) *spec.Respo
 		{Name: "transcodeOffset", Versions: []int{1}},
 		{Name: "formPost", Versions: []int{1}},
 		{Name: "songLyrics", Versions: []int{1}},
+		{Name: "indexBasedQueue", Versions: []int{1}},
+		{Name: "transcoding", Versions: []int{1}},
 	}
 	return sub
 }
@@ -89,6 +95,14 @@ func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 		if err := scrobbleStatsUpdateTrack(c.dbc, &track, user.ID, optStamp); err != nil {
 			return spec.NewError(0, "error updating stats: %v", err)
 		}
+		if optSubmission {
+			if err := scrobbleStatsUpdateTrackPlay(c.dbc, &track, user.ID, optStamp); err != nil {
+				return spec.NewError(0, "error updating track stats: %v", err)
+			}
+		}
+		if err := scrobbleLogListen(c.dbc, &track, user.ID, params.GetOr("c", ""), optStamp, optSubmission); err != nil {
+			return spec.NewError(0, "error logging listen: %v", err)
+		}
 
 	case specid.PodcastEpisode:
 		var podcastEpisode db.PodcastEpisode
@@ -190,94 +204,15 @@ func (c *Controller) ServeNotFound(_ *http.Request) *spec.Response {
 	return spec.NewError(70, "view not found")
 }
 
-func (c *Controller) ServeGetPlayQueue(r *http.Request) *spec.Response {
-	params := r.Context().Value(CtxParams).(params.Params)
-	user := r.Context().Value(CtxUser).(*db.User)
-	var queue db.PlayQueue
-	err := c.dbc.
-		Where("user_id=?", user.ID).
-		Find(&queue).
-		Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return spec.NewResponse()
-	}
+// gonic doesn't scan video files, so there are never any videos
+func (c *Controller) ServeGetVideos(_ *http.Request) *spec.Response {
 	sub := spec.NewResponse()
-	sub.PlayQueue = &spec.PlayQueue{}
-	sub.PlayQueue.Username = user.Name
-	sub.PlayQueue.Position = queue.Position
-	sub.PlayQueue.Current = queue.CurrentSID()
-	sub.PlayQueue.Changed = queue.UpdatedAt
-	sub.PlayQueue.ChangedBy = queue.ChangedBy
-
-	trackIDs := queue.GetItems()
-	sub.PlayQueue.List = make([]*spec.TrackChild, 0, len(trackIDs))
-
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
-
-	for _, id := range trackIDs {
-		switch id.Type {
-		case specid.Track:
-			var track db.Track
-			err := c.dbc.
-				Where("id=?", id.Value).
-				Preload("Album").
-				Preload("Artists").
-				Preload("TrackStar", "user_id=?", user.ID).
-				Preload("TrackRating", "user_id=?", user.ID).
-				Find(&track).
-				Error
-			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-				return spec.NewError(0, "error finding track")
-			}
-			if track.ID != 0 {
-				tc := spec.NewTCTrackByFolder(&track, track.Album)
-				tc.TranscodeMeta = transcodeMeta
-				sub.PlayQueue.List = append(sub.PlayQueue.List, tc)
-			}
-		case specid.PodcastEpisode:
-			var pe db.PodcastEpisode
-			err := c.dbc.
-				Where("id=?", id.Value).
-				Find(&pe).
-				Error
-			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-				return spec.NewError(0, "error finding podcast episode")
-			}
-			if pe.ID != 0 {
-				tc := spec.NewTCPodcastEpisode(&pe)
-				tc.TranscodeMeta = transcodeMeta
-				sub.PlayQueue.List = append(sub.PlayQueue.List, tc)
-			}
-		}
-	}
+	sub.Videos = &spec.Videos{List: []*spec.TrackChild{}}
 	return sub
 }
 
-func (c *Controller) ServeSavePlayQueue(r *http.Request) *spec.Response {
-	params := r.Context().Value(CtxParams).(params.Params)
-	tracks, err := params.GetIDList("id")
-	if err != nil {
-		return spec.NewError(10, "please provide some `id` parameters")
-	}
-	trackIDs := make([]specid.ID, 0, len(tracks))
-	for _, id := range tracks {
-		if (id.Type == specid.Track) || (id.Type == specid.PodcastEpisode) {
-			trackIDs = append(trackIDs, id)
-		}
-	}
-	if len(trackIDs) == 0 {
-		return spec.NewError(10, "no track ids provided")
-	}
-	user := r.Context().Value(CtxUser).(*db.User)
-	var queue db.PlayQueue
-	c.dbc.Where("user_id=?", user.ID).First(&queue)
-	queue.UserID = user.ID
-	queue.Current = params.GetOrID("current", specid.ID{}).String()
-	queue.Position = params.GetOrInt("position", 0)
-	queue.ChangedBy = params.GetOr("c", "") // must exist, middleware checks
-	queue.SetItems(trackIDs)
-	c.dbc.Save(&queue)
-	return spec.NewResponse()
+func (c *Controller) ServeGetVideoInfo(_ *http.Request) *spec.Response {
+	return spec.NewError(70, "video not found")
 }
 
 func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
@@ -293,7 +228,9 @@ func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
 		Preload("Album").
 		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		First(&track).
 		Error
@@ -301,7 +238,7 @@ func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
 		return spec.NewError(70, "couldn't find a track with that id")
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	sub := spec.NewResponse()
 	sub.Track = spec.NewTrackByTags(&track, track.Album)
@@ -320,7 +257,9 @@ func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
 		Preload("Album").
 		Preload("Album.Artists").
 		Preload("Artists").
+		Preload("Genres").
 		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
 		Preload("TrackRating", "user_id=?", user.ID).
 		Joins("JOIN albums ON tracks.album_id=albums.id").
 		Order(gorm.Expr("random()"))
@@ -344,7 +283,7 @@ func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
 	sub.RandomTracks = &spec.RandomTracks{}
 	sub.RandomTracks.List = make([]*spec.TrackChild, len(tracks))
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
 
 	for i, track := range tracks {
 		sub.RandomTracks.List[i] = spec.NewTrackByTags(track, track.Album)
@@ -353,22 +292,105 @@ func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
 	return sub
 }
 
+// ServeGetSongList handles the getSongList view, a counterpart to getAlbumList2's
+// frequent and recent types for songs
+func (c *Controller) ServeGetSongList(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	listType, err := params.Get("type")
+	if err != nil {
+		return spec.NewError(10, "please provide a `type` parameter")
+	}
+	q := c.dbc.DB.
+		Joins("JOIN track_plays ON track_plays.track_id=tracks.id AND track_plays.user_id=?", user.ID)
+	switch listType {
+	case "frequent":
+		q = q.Order("track_plays.count DESC, track_plays.time DESC")
+	case "recent":
+		q = q.Order("track_plays.time DESC")
+	default:
+		return spec.NewError(10, "unknown value %q for parameter 'type'", listType)
+	}
+	if m := getMusicFolder(c.musicPaths, params); m != "" {
+		q = q.
+			Joins("JOIN albums ON albums.id=tracks.album_id").
+			Where("albums.root_dir=?", m)
+	}
+	var tracks []*db.Track
+	err = q.
+		Offset(params.GetOrInt("offset", 0)).
+		Limit(params.GetOrInt("size", 10)).
+		Preload("Album").
+		Preload("Album.Artists").
+		Preload("Artists").
+		Preload("Genres").
+		Preload("TrackStar", "user_id=?", user.ID).
+		Preload("TrackPlay", "user_id=?", user.ID).
+		Preload("TrackRating", "user_id=?", user.ID).
+		Find(&tracks).
+		Error
+	if err != nil {
+		return spec.NewError(0, "get song list: %v", err)
+	}
+
+	sub := spec.NewResponse()
+	sub.TrackList = &spec.TrackList{}
+	sub.TrackList.List = make([]*spec.TrackChild, len(tracks))
+
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+
+	for i, track := range tracks {
+		sub.TrackList.List[i] = spec.NewTrackByTags(track, track.Album)
+		sub.TrackList.List[i].TranscodeMeta = transcodeMeta
+	}
+	return sub
+}
+
 var errUnknownPlaylistEntry = errors.New("unknown playlist entry")
 
+// jukeboxClient is the client name of the jukebox, for picking its transcode profile
+const jukeboxClient = "jukebox"
+
+// jukeboxStreamURL is a signed stream URL for mpv to play. it expires at the end of a day, so that the URL for a track
+// is the same all day and the jukebox can tell it's already playing it
+func (c *Controller) jukeboxStreamURL(r *http.Request, user *db.User, id specid.ID) string {
+	expires := time.Now().Add(signedURLMaxExpiry).Truncate(24 * time.Hour)
+	extra := url.Values{
+		"c":                     {jukeboxClient},
+		"estimateContentLength": {"true"}, // so that mpv can seek
+	}
+	return c.signedURL(r, "stream", id, user.ID, expires, extra)
+}
+
 func (c *Controller) ServeJukebox(r *http.Request) *spec.Response { // nolint:gocyclo
 	if c.jukebox == nil {
 		return spec.NewError(0, "jukebox not enabled")
 	}
 
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	trackPaths := func(ids []specid.ID) ([]string, error) {
+		// mpv plays files from disk, unless the user has a transcode profile for the jukebox. then it streams them from
+		// us. the jukebox isn't on the requester's network, so rules with a network don't apply here
+		pref, err := c.dbc.GetTranscodePreference(user.ID, jukeboxClient, netip.Addr{})
+		if err != nil {
+			return nil, fmt.Errorf("find transcode preference: %w", err)
+		}
+		var transcoding bool
+		if pref != nil {
+			_, transcoding = transcode.LookupProfile(pref.Profile)
+		}
 		var paths []string
 		for _, id := range ids {
-			r, err := specidpaths.Locate(c.dbc, id)
+			file, err := specidpaths.Locate(c.dbc, id)
 			if err != nil {
 				return nil, fmt.Errorf("find track by id: %w", err)
 			}
-			paths = append(paths, r.AbsPath())
+			if _, ok := file.(db.AudioFile); ok && transcoding {
+				paths = append(paths, c.jukeboxStreamURL(r, user, id))
+				continue
+			}
+			paths = append(paths, file.AbsPath())
 		}
 		return paths, nil
 	}
@@ -391,14 +413,16 @@ func (c *Controller) ServeJukebox(r *http.Request) *spec.Response { // nolint:go
 			return nil, fmt.Errorf("get playlist: %w", err)
 		}
 		for _, path := range playlist {
-			id, err := specidpaths.Lookup(c.dbc, MusicPaths(c.musicPaths), c.podcastsPath, path)
-			if err != nil {
+			id := &specid.ID{}
+			if signedID, ok := signedURLID(path); ok {
+				*id = signedID
+			} else if id, err = specidpaths.Lookup(c.dbc, MusicPaths(c.musicPaths), c.podcastsPath, path); err != nil {
 				return nil, fmt.Errorf("fetch track: %w", err)
 			}
 			switch id.Type {
 			case specid.Track:
 				var track db.Track
-				if err := c.dbc.Where("id=?", id.Value).Preload("Album").Preload("Album.Artists").Preload("Artists").Find(&track).Error; err != nil {
+				if err := c.dbc.Where("id=?", id.Value).Preload("Album").Preload("Album.Artists").Preload("Artists").Preload("Genres").Find(&track).Error; err != nil {
 					return nil, fmt.Errorf("load track: %w", err)
 				}
 				ret = append(ret, spec.NewTrackByTags(&track, track.Album))
@@ -513,7 +537,7 @@ func (c *Controller) ServeGetLyrics(r *http.Request) *spec.Response {
 		Preload("Album").
 		Joins("JOIN track_artists ON track_artists.track_id = tracks.id").
 		Joins("JOIN artists ON artists.id = track_artists.artist_id").
-		Where("tracks.tag_title LIKE ? AND artists.name LIKE ?", title, artist).
+		Where("lower(tracks.tag_title) LIKE lower(?) AND lower(artists.name) LIKE lower(?)", title, artist).
 		First(&track).
 		Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -763,6 +787,63 @@ func scrobbleStatsUpdateTrack(dbc *db.DB, track *db.Track, userID int, playTime
 	return nil
 }
 
+func scrobbleStatsUpdateTrackPlay(dbc *db.DB, track *db.Track, userID int, playTime time.Time) error {
+	var play db.TrackPlay
+	if err := dbc.Where("track_id=? AND user_id=?", track.ID, userID).First(&play).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find track play: %w", err)
+	}
+
+	play.TrackID = track.ID
+	play.UserID = userID
+	play.Count++ // for getSongList?type=frequent
+	if playTime.After(play.Time) {
+		play.Time = playTime // for getSongList?type=recent
+	}
+
+	if err := dbc.Save(&play).Error; err != nil {
+		return fmt.Errorf("save track play: %w", err)
+	}
+	return nil
+}
+
+// scrobbleLogListen appends to the user's listening history. if the client's previous entry was
+// a "now playing" for another track which was replaced before it could have finished, it's marked
+// as skipped
+func scrobbleLogListen(dbc *db.DB, track *db.Track, userID int, client string, playTime time.Time, submission bool) error {
+	playTime = db.ListenTime(playTime)
+
+	var prev db.Listen
+	if err := dbc.Where("user_id=? AND client=?", userID, client).Order("id DESC").First(&prev).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find previous listen: %w", err)
+	}
+	// submissions of listens cached by offline clients can be older than the previous entry
+	elapsed := playTime.Sub(prev.Time)
+	if prev.ID != 0 && !prev.Submission && !prev.Skipped && (prev.TrackID == nil || *prev.TrackID != track.ID) &&
+		elapsed >= 0 && elapsed < time.Duration(prev.Length)*time.Second {
+		if err := dbc.Model(&prev).Update("skipped", true).Error; err != nil {
+			return fmt.Errorf("mark skipped: %w", err)
+		}
+	}
+
+	listen := db.Listen{
+		UserID:     userID,
+		TrackID:    &track.ID,
+		Time:       playTime,
+		Client:     client,
+		Submission: submission,
+		TrackTitle: track.TagTitle,
+		ArtistName: track.TagTrackArtist,
+		Length:     track.Length,
+	}
+	if track.Album != nil {
+		listen.AlbumTitle = track.Album.TagTitle
+	}
+	if err := dbc.Create(&listen).Error; err != nil {
+		return fmt.Errorf("create listen: %w", err)
+	}
+	return nil
+}
+
 func scrobbleStatsUpdatePodcastEpisode(dbc *db.DB, peID int) error {
 	var pe db.PodcastEpisode
 	if err := dbc.Where("id=?", peID).First(&pe).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -788,6 +869,28 @@ func getMusicFolder(musicPaths []MusicPath, p params.Params) string {
 	return musicPaths[idx].Path
 }
 
+// searchMatch returns the full text search query for a search request, or an empty string
+// if the search index is unavailable and the handler should fall back to LIKE queries
+func searchMatch(dbc *db.DB, query string) string {
+	if !dbc.HasSearchIndex() {
+		return ""
+	}
+	return db.SearchQuery(query)
+}
+
+// withSearchMatch limits q to rows of table which match the full text search, most relevant first then by id.
+// if columns are provided, only those columns of the search index are matched
+func withSearchMatch(q *gorm.DB, table string, match string, columns ...string) *gorm.DB {
+	if len(columns) > 0 {
+		match = fmt.Sprintf("{%s} : (%s)", strings.Join(columns, " "), match)
+	}
+	join := fmt.Sprintf(`JOIN (SELECT rowid AS search_id, rank AS search_rank FROM search_%[1]s WHERE search_%[1]s MATCH ?) search ON search.search_id=%[1]s.id`, table)
+	return q.
+		Joins(join, match).
+		Order("search.search_rank").
+		Order(table + ".id")
+}
+
 func lowerUDecOrHash(in string) string {
 	inRunes := []rune(in)
 	if len(inRunes) == 0 {
@@ -799,3 +902,64 @@ func lowerUDecOrHash(in string) string {
 	}
 	return string(lower)
 }
+
+// lookupArtistInfo builds the parts of an artist info response that are the same whether
+// browsing by tags or by folder. the similar artist names are limited by the `count` param
+func (c *Controller) lookupArtistInfo(r *http.Request, artist *db.Artist) (*spec.ArtistInfo, []string, error) {
+	params := r.Context().Value(CtxParams).(params.Params)
+
+	info, err := c.artistInfoCache.GetOrLookup(r.Context(), artist.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp := &spec.ArtistInfo{}
+	resp.Biography = spec.CleanExternalText(info.Biography)
+	resp.MusicBrainzID = info.MusicBrainzID
+	resp.LastFMURL = info.LastFMURL
+
+	resp.SmallImageURL = c.genArtistCoverURL(r, artist, 64)
+	resp.MediumImageURL = c.genArtistCoverURL(r, artist, 126)
+	resp.LargeImageURL = c.genArtistCoverURL(r, artist, 256)
+
+	if info.ImageURL != "" {
+		resp.SmallImageURL = info.ImageURL
+		resp.MediumImageURL = info.ImageURL
+		resp.LargeImageURL = info.ImageURL
+		resp.ArtistImageURL = info.ImageURL
+	}
+
+	similarNames := info.GetSimilarArtists()
+	if count := params.GetOrInt("count", 20); count >= 0 && len(similarNames) > count {
+		similarNames = similarNames[:count]
+	}
+
+	return resp, similarNames, nil
+}
+
+func (c *Controller) lookupAlbumInfo(r *http.Request, album *db.Album) (*spec.AlbumInfo, error) {
+	info, err := c.albumInfoCache.GetOrLookup(r.Context(), album.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &spec.AlbumInfo{}
+	resp.Notes = spec.CleanExternalText(info.Notes)
+	resp.MusicBrainzID = info.MusicBrainzID
+	resp.LastFMURL = info.LastFMURL
+
+	if err := uuid.Validate(album.TagBrainzID); err == nil {
+		resp.MusicBrainzID = album.TagBrainzID // prefer db musicbrainz ID over lastfm's
+	}
+
+	return resp, nil
+}
+
+// notPresentArtist is a very limited artist for `includeNotPresent`, since we don't
+// have anything but the name
+func notPresentArtist(name string) *spec.Artist {
+	return &spec.Artist{
+		ID:   &specid.ID{},
+		Name: name,
+	}
+}
@@ -0,0 +1,144 @@
+package ctrlsubsonic
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func TestScrobbleListens(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	user := db.User{Name: "listener", Password: "password"}
+	require.NoError(t, contr.dbc.Create(&user).Error)
+
+	var tracks []*db.Track
+	require.NoError(t, contr.dbc.Preload("Album").Order("id").Limit(2).Find(&tracks).Error)
+	require.Len(t, tracks, 2)
+
+	start := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	scrobble := func(track *db.Track, at time.Duration, submission bool) {
+		t.Helper()
+		q := url.Values{}
+		q.Set("id", "tr-"+strconv.Itoa(track.ID))
+		q.Set("time", strconv.FormatInt(start.Add(at).UnixMilli(), 10))
+		q.Set("submission", strconv.FormatBool(submission))
+		sub := runTestCaseAs(t, contr.ServeScrobble, &user, q)
+		require.Nil(t, sub.Response.Error)
+	}
+
+	scrobble(tracks[0], 0, false)              // now playing
+	scrobble(tracks[0], 100*time.Second, true) // played through
+	scrobble(tracks[1], 100*time.Second, false)
+	scrobble(tracks[0], 110*time.Second, false) // replaced tracks[1] after 10s of 100s
+	scrobble(tracks[0], 210*time.Second, true)
+
+	var listens []*db.Listen
+	require.NoError(t, contr.dbc.Order("id").Find(&listens).Error)
+	require.Len(t, listens, 5)
+
+	type row struct {
+		TrackID    int
+		Time       time.Time
+		Client     string
+		Submission bool
+		Skipped    bool
+	}
+	var rows []row
+	for _, l := range listens {
+		require.NotNil(t, l.TrackID)
+		require.Equal(t, tracks[0].Album.TagTitle, l.AlbumTitle)
+		rows = append(rows, row{*l.TrackID, l.Time.UTC(), l.Client, l.Submission, l.Skipped})
+	}
+	require.Equal(t, []row{
+		{tracks[0].ID, start, mockClientName, false, false},
+		{tracks[0].ID, start.Add(100 * time.Second), mockClientName, true, false},
+		{tracks[1].ID, start.Add(100 * time.Second), mockClientName, false, true},
+		{tracks[0].ID, start.Add(110 * time.Second), mockClientName, false, false},
+		{tracks[0].ID, start.Add(210 * time.Second), mockClientName, true, false},
+	}, rows)
+
+	top, err := contr.dbc.TopListenedTracks(user.ID, start, start.Add(time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, top, 1)
+	require.Equal(t, tracks[0].ID, top[0].ID)
+	require.Equal(t, 2, top[0].Count)
+}
+
+func TestGetSongList(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	user := db.User{Name: "listener", Password: "password"}
+	require.NoError(t, contr.dbc.Create(&user).Error)
+
+	var tracks []*db.Track
+	require.NoError(t, contr.dbc.Order("id").Limit(3).Find(&tracks).Error)
+	require.Len(t, tracks, 3)
+
+	start := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	scrobble := func(track *db.Track, at time.Duration, submission bool) {
+		t.Helper()
+		sub := runTestCaseAs(t, contr.ServeScrobble, &user, url.Values{
+			"id":         {"tr-" + strconv.Itoa(track.ID)},
+			"time":       {strconv.FormatInt(start.Add(at).UnixMilli(), 10)},
+			"submission": {strconv.FormatBool(submission)},
+		})
+		require.Nil(t, sub.Response.Error)
+	}
+	songList := func(listType string) []*spec.TrackChild {
+		t.Helper()
+		sub := runTestCaseAs(t, contr.ServeGetSongList, &user, url.Values{"type": {listType}})
+		require.Nil(t, sub.Response.Error)
+		require.NotNil(t, sub.Response.TrackList)
+		return sub.Response.TrackList.List
+	}
+	type play struct {
+		ID        string
+		PlayCount int
+		Played    time.Time
+	}
+	plays := func(list []*spec.TrackChild) []play {
+		var ret []play
+		for _, tc := range list {
+			require.NotNil(t, tc.Played)
+			ret = append(ret, play{tc.ID.String(), tc.PlayCount, tc.Played.UTC()})
+		}
+		return ret
+	}
+
+	scrobble(tracks[0], 0, true)
+	scrobble(tracks[1], 1*time.Minute, true)
+	scrobble(tracks[0], 2*time.Minute, true)
+	scrobble(tracks[2], 3*time.Minute, false) // now playing doesn't count
+
+	require.Equal(t, []play{
+		{tracks[0].SID().String(), 2, start.Add(2 * time.Minute)},
+		{tracks[1].SID().String(), 1, start.Add(1 * time.Minute)},
+	}, plays(songList("frequent")))
+
+	scrobble(tracks[1], 4*time.Minute, true)
+	scrobble(tracks[1], 5*time.Minute, true)
+
+	require.Equal(t, []play{
+		{tracks[1].SID().String(), 3, start.Add(5 * time.Minute)},
+		{tracks[0].SID().String(), 2, start.Add(2 * time.Minute)},
+	}, plays(songList("recent")))
+
+	// and other views show the user's play count too
+	sub := runTestCaseAs(t, contr.ServeGetSong, &user, url.Values{"id": {tracks[1].SID().String()}})
+	require.Nil(t, sub.Response.Error)
+	require.Equal(t, 3, sub.Response.Track.PlayCount)
+
+	sub = runTestCaseAs(t, contr.ServeGetSongList, &user, url.Values{"type": {"loved"}})
+	require.NotNil(t, sub.Response.Error)
+}
@@ -0,0 +1,270 @@
+package ctrlsubsonic
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
+	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/transcode"
+)
+
+var errNotYourPlaylist = errors.New("playlist belongs to another user")
+
+// downloadEntry is a file to put in a download zip
+type downloadEntry struct {
+	name  string // path in the zip
+	path  string
+	audio bool // transcoded if asked for, covers aren't
+}
+
+// ServeDownload streams a zip of an album or directory, an artist, or a playlist, as it's made. with `transcode`
+// the audio is transcoded with the user's profile for the client. single files are the same as ServeStream
+func (c *Controller) ServeDownload(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+
+	var name string
+	var entries []downloadEntry
+	switch id.Type {
+	case specid.Album:
+		name, entries, err = downloadAlbumEntries(c.dbc, id.Value)
+	case specid.Artist:
+		name, entries, err = downloadArtistEntries(c.dbc, id.Value)
+	case specid.Playlist:
+		name, entries, err = downloadPlaylistEntries(c.playlistStore, user.ID, id)
+	default:
+		return c.ServeStream(w, r)
+	}
+	if err != nil {
+		return spec.NewError(70, "couldn't find %s: %v", id, err)
+	}
+	if len(entries) == 0 {
+		return spec.NewError(70, "nothing to download for %s", id)
+	}
+
+	var profile *transcode.Profile
+	if params.GetOrBool("transcode", false) {
+		profile, err = downloadProfile(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+		if err != nil {
+			return spec.NewError(0, "couldn't find transcode profile: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		if err := writeDownloadEntry(transcodeContext(r), c.transcoder, zw, entry, profile); err != nil {
+			// the headers are gone, all we can do is stop
+			log.Printf("error writing download zip for %s: %v", id, err)
+			return nil
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("error finishing download zip for %s: %v", id, err)
+	}
+	return nil
+}
+
+// downloadProfile is the profile to transcode downloads with, or nil if the files should be as they are
+func downloadProfile(dbc *db.DB, userID int, client string, addr netip.Addr) (*transcode.Profile, error) {
+	pref, err := dbc.GetTranscodePreference(userID, client, addr)
+	if err != nil {
+		return nil, err
+	}
+	if pref == nil || pref.Profile == db.TranscodeRuleRaw {
+		return nil, nil
+	}
+	profile, ok := transcode.LookupProfile(pref.Profile)
+	if !ok {
+		return nil, fmt.Errorf("unknown transcode user profile %q", pref.Profile)
+	}
+	return &profile, nil
+}
+
+// writeDownloadEntry adds a file to the zip. audio is stored without compressing it again. a file which has gone
+// missing since the scan is skipped
+func writeDownloadEntry(ctx context.Context, transcoder transcode.Transcoder, zw *zip.Writer, entry downloadEntry, profile *transcode.Profile) error {
+	f, err := os.Open(entry.path)
+	if err != nil {
+		log.Printf("skipping %q in download zip: %v", entry.path, err)
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %q: %w", entry.path, err)
+	}
+
+	header := &zip.FileHeader{Name: entry.name, Method: zip.Store, Modified: info.ModTime()}
+	if !entry.audio {
+		header.Method = zip.Deflate
+	}
+	if entry.audio && profile != nil {
+		header.Name = strings.TrimSuffix(entry.name, path.Ext(entry.name)) + "." + profile.Suffix()
+	}
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("create zip entry: %w", err)
+	}
+
+	if entry.audio && profile != nil {
+		if err := transcoder.Transcode(ctx, *profile, entry.path, fw); err != nil {
+			return fmt.Errorf("transcode %q: %w", entry.path, err)
+		}
+		return nil
+	}
+	if _, err := io.Copy(fw, f); err != nil {
+		return fmt.Errorf("copy %q: %w", entry.path, err)
+	}
+	return nil
+}
+
+// downloadAlbumEntries are the tracks and cover of an album, then everything in the directories inside it
+func downloadAlbumEntries(dbc *db.DB, albumID int) (string, []downloadEntry, error) {
+	var album db.Album
+	if err := dbc.First(&album, albumID).Error; err != nil {
+		return "", nil, fmt.Errorf("find album: %w", err)
+	}
+	name := downloadName(album.RightPath)
+	entries, err := downloadAlbumTree(dbc, &album, name)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, entries, nil
+}
+
+func downloadAlbumTree(dbc *db.DB, album *db.Album, dir string) ([]downloadEntry, error) {
+	entries, err := downloadAlbumFiles(dbc, album, dir)
+	if err != nil {
+		return nil, err
+	}
+	var children []*db.Album
+	if err := dbc.Where("parent_id=?", album.ID).Order("right_path").Find(&children).Error; err != nil {
+		return nil, fmt.Errorf("find child albums: %w", err)
+	}
+	for _, child := range children {
+		childEntries, err := downloadAlbumTree(dbc, child, path.Join(dir, child.RightPath))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, childEntries...)
+	}
+	return entries, nil
+}
+
+// downloadAlbumFiles are the tracks and cover of just the album itself
+func downloadAlbumFiles(dbc *db.DB, album *db.Album, dir string) ([]downloadEntry, error) {
+	var tracks []*db.Track
+	err := dbc.
+		Where("album_id=?", album.ID).
+		Order("tracks.tag_disc_number, tracks.tag_track_number").
+		Order("filename").
+		Find(&tracks).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find tracks: %w", err)
+	}
+
+	albumPath := filepath.Join(album.RootDir, album.LeftPath, album.RightPath)
+	var entries []downloadEntry
+	if album.Cover != "" {
+		entries = append(entries, downloadEntry{name: path.Join(dir, album.Cover), path: filepath.Join(albumPath, album.Cover)})
+	}
+	for _, track := range tracks {
+		entries = append(entries, downloadEntry{name: path.Join(dir, track.Filename), path: filepath.Join(albumPath, track.Filename), audio: true})
+	}
+	return entries, nil
+}
+
+// downloadArtistEntries are the artist's albums, each in its own directory
+func downloadArtistEntries(dbc *db.DB, artistID int) (string, []downloadEntry, error) {
+	var artist db.Artist
+	if err := dbc.First(&artist, artistID).Error; err != nil {
+		return "", nil, fmt.Errorf("find artist: %w", err)
+	}
+	var albums []*db.Album
+	err := dbc.
+		Joins("JOIN album_artists ON album_artists.album_id=albums.id").
+		Where("album_artists.artist_id=?", artist.ID).
+		Order("tag_year").
+		Order("lower(albums.right_path)").
+		Find(&albums).
+		Error
+	if err != nil {
+		return "", nil, fmt.Errorf("find albums: %w", err)
+	}
+
+	name := downloadName(artist.Name)
+	var entries []downloadEntry
+	for _, album := range albums {
+		albumEntries, err := downloadAlbumFiles(dbc, album, path.Join(name, album.RightPath))
+		if err != nil {
+			return "", nil, err
+		}
+		entries = append(entries, albumEntries...)
+	}
+	return name, entries, nil
+}
+
+// downloadPlaylistEntries are the items of a playlist, numbered to keep their order, and its cover. the playlist
+// must be the user's own, or public
+func downloadPlaylistEntries(store *playlist.Store, userID int, id specid.ID) (string, []downloadEntry, error) {
+	pl, err := store.Read(playlistIDDecode(id))
+	if err != nil {
+		return "", nil, fmt.Errorf("read playlist: %w", err)
+	}
+	if pl.UserID != userID && !pl.IsPublic {
+		return "", nil, errNotYourPlaylist
+	}
+
+	name := downloadName(pl.Name)
+	var entries []downloadEntry
+	if cover, err := coverForPlaylist(store, id); err == nil {
+		_ = cover.Close()
+		entries = append(entries, downloadEntry{name: path.Join(name, "cover"+filepath.Ext(cover.Name())), path: cover.Name()})
+	}
+	width := len(strconv.Itoa(len(pl.Items)))
+	for i, item := range pl.Items {
+		itemName := fmt.Sprintf("%0*d %s", width, i+1, filepath.Base(item))
+		entries = append(entries, downloadEntry{name: path.Join(name, itemName), path: item, audio: true})
+	}
+	return name, entries, nil
+}
+
+// downloadName makes a name from the library safe to use as a directory in the zip
+func downloadName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return "download"
+	}
+	return name
+}
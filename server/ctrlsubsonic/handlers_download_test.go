@@ -0,0 +1,124 @@
+package ctrlsubsonic
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+func TestServeDownload(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+	store, err := playlist.NewStore(t.TempDir())
+	require.NoError(t, err)
+	contr.playlistStore = store
+
+	download := func(q url.Values) (*httptest.ResponseRecorder, map[string]string) {
+		t.Helper()
+		rr := serveTestCase(respRaw(contr.ServeDownload), nil, q, nil)
+		if rr.Header().Get("Content-Type") != "application/zip" {
+			return rr, nil
+		}
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		require.NoError(t, err)
+		files := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			require.NoError(t, err)
+			data, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			files[f.Name] = string(data)
+		}
+		return rr, files
+	}
+	names := func(files map[string]string) []string {
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		return names
+	}
+
+	var album, artistDir db.Album
+	require.NoError(t, contr.dbc.Where("right_path=?", "album-0").Where("parent_id=(SELECT id FROM albums WHERE right_path=?)", "artist-0").First(&album).Error)
+	require.NoError(t, contr.dbc.Where("right_path=?", "artist-0").First(&artistDir).Error)
+
+	t.Run("album", func(t *testing.T) {
+		t.Parallel()
+		rr, files := download(url.Values{"id": {album.SID().String()}})
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Header().Get("Content-Disposition"), `filename=album-0.zip`)
+		require.ElementsMatch(t, []string{"album-0/cover.png", "album-0/track-0.flac", "album-0/track-1.flac", "album-0/track-2.flac"}, names(files))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		t.Parallel()
+		_, files := download(url.Values{"id": {artistDir.SID().String()}})
+		require.Len(t, files, 3*4)
+		require.Contains(t, files, "artist-0/album-2/track-1.flac")
+	})
+
+	t.Run("artist", func(t *testing.T) {
+		t.Parallel()
+		var artist db.Artist
+		require.NoError(t, contr.dbc.Where("name=?", "artist-1").First(&artist).Error)
+		_, files := download(url.Values{"id": {specid.ID{Type: specid.Artist, Value: artist.ID}.String()}})
+		require.Len(t, files, 3*4)
+		require.Contains(t, files, "artist-1/album-0/cover.png")
+	})
+
+	t.Run("playlist", func(t *testing.T) {
+		t.Parallel()
+		var tracks []*db.Track
+		require.NoError(t, contr.dbc.Preload("Album").Order("id").Limit(2).Find(&tracks).Error)
+		path := playlist.NewPath(1, "road trip")
+		require.NoError(t, store.Write(path, &playlist.Playlist{Name: "road trip", Items: []string{tracks[1].AbsPath(), tracks[0].AbsPath()}}))
+
+		// the mock user isn't the owner
+		rr, files := download(url.Values{"id": {playlistIDEncode(path).String()}})
+		require.Nil(t, files)
+		require.Contains(t, rr.Body.String(), errNotYourPlaylist.Error())
+
+		require.NoError(t, store.Write(path, &playlist.Playlist{Name: "road trip", Items: []string{tracks[1].AbsPath(), tracks[0].AbsPath()}, IsPublic: true}))
+		_, files = download(url.Values{"id": {playlistIDEncode(path).String()}})
+		require.ElementsMatch(t, []string{"road trip/1 " + tracks[1].Filename, "road trip/2 " + tracks[0].Filename}, names(files))
+	})
+}
+
+func TestServeDownloadTranscode(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+	contr.transcoder = &seekTranscoder{size: 10}
+	require.NoError(t, contr.dbc.Create(&db.TranscodeRule{Profile: "mp3"}).Error)
+
+	var album db.Album
+	require.NoError(t, contr.dbc.Where("right_path=? AND cover IS NOT NULL", "album-1").First(&album).Error)
+
+	rr := serveTestCase(respRaw(contr.ServeDownload), nil, url.Values{"id": {album.SID().String()}, "transcode": {"true"}}, nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name != "album-1/cover.png" {
+			require.Equal(t, uint64(10), f.UncompressedSize64)
+		}
+	}
+	// covers are as they are
+	require.ElementsMatch(t, []string{"album-1/cover.png", "album-1/track-0.mp3", "album-1/track-1.mp3", "album-1/track-2.mp3"}, names)
+}
@@ -0,0 +1,194 @@
+package ctrlsubsonic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specidpaths"
+	"go.senan.xyz/gonic/transcode"
+)
+
+const hlsMIME = "application/vnd.apple.mpegurl"
+
+// ServeHLS writes an HLS playlist for a track or podcast episode. with a single `bitRate` that's a media playlist
+// of segments, otherwise it's a master playlist with a variant for each bit rate so the client can adapt
+func (c *Controller) ServeHLS(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+	_, audioFile, resp := hlsLocate(c.dbc, id)
+	if resp != nil {
+		return resp
+	}
+
+	bitRates, err := hlsBitRates(params.GetOrList("bitRate", nil))
+	if err != nil {
+		return spec.NewError(10, "invalid `bitRate` parameter: %v", err)
+	}
+	if len(bitRates) == 0 {
+		bitRates = hlsDefaultBitRates(audioFile.AudioBitrate())
+	}
+
+	var playlist string
+	if len(bitRates) == 1 {
+		playlist = hlsMediaPlaylist(time.Duration(audioFile.AudioLength())*time.Second, func(segment int) string {
+			return "hlsSegment?" + hlsQuery(params, id, bitRates[0], &segment)
+		})
+	} else {
+		playlist = hlsMasterPlaylist(bitRates, func(bitRate transcode.BitRate) string {
+			return "hls.m3u8?" + hlsQuery(params, id, bitRate, nil)
+		})
+	}
+
+	w.Header().Set("Content-Type", hlsMIME)
+	_, _ = w.Write([]byte(playlist))
+	return nil
+}
+
+// ServeHLSSegment serves a single segment of a media playlist from ServeHLS. the segments of a track are cut from
+// one transcode of the whole thing, so the first request for one starts it and the rest wait for it to get there
+func (c *Controller) ServeHLSSegment(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+	segment, err := params.GetInt("segment")
+	if err != nil || segment < 0 {
+		return spec.NewError(10, "please provide a valid `segment` parameter")
+	}
+	path, audioFile, resp := hlsLocate(c.dbc, id)
+	if resp != nil {
+		return resp
+	}
+
+	if time.Duration(segment)*transcode.HLSSegmentLength >= time.Duration(audioFile.AudioLength())*time.Second {
+		return spec.NewError(70, "segment %d is past the end of the file", segment)
+	}
+
+	user := r.Context().Value(CtxUser).(*db.User)
+	profile, err := hlsSegmentProfile(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+	if err != nil {
+		return spec.NewError(0, "find segment profile: %v", err)
+	}
+	if bitRate := params.GetOrInt("bitRate", 0); bitRate > 0 {
+		profile = transcode.WithBitrate(profile, transcode.BitRate(bitRate))
+	}
+
+	log.Printf("serving hls segment %d at bitrate %d", segment, profile.BitRate())
+
+	w.Header().Set("Content-Type", profile.MIME())
+	switch err := c.segmenter.Segment(transcodeContext(r), profile, path, segment, w); {
+	case errors.Is(err, transcode.ErrNoSegment):
+		return spec.NewError(70, "segment %d is past the end of the transcode", segment)
+	case err != nil && !errors.Is(err, transcode.ErrFFmpegKilled):
+		return spec.NewError(0, "error transcoding: %v", err)
+	}
+	return nil
+}
+
+// hlsSegmentProfile is the client's transcode preference if it can be segmented, otherwise the default
+func hlsSegmentProfile(dbc *db.DB, userID int, client string, addr netip.Addr) (transcode.Profile, error) {
+	pref, err := dbc.GetTranscodePreference(userID, client, addr)
+	if err != nil {
+		return transcode.Profile{}, err
+	}
+	if pref != nil {
+		if profile, ok := transcode.LookupProfile(pref.Profile); ok && profile.Segmentable() {
+			return profile, nil
+		}
+	}
+	return transcode.HLS, nil
+}
+
+func hlsLocate(dbc *db.DB, id specid.ID) (string, db.AudioFile, *spec.Response) {
+	file, err := specidpaths.Locate(dbc, id)
+	if err != nil {
+		return "", nil, spec.NewError(70, "error looking up id %s: %v", id, err)
+	}
+	audioFile, ok := file.(db.AudioFile)
+	if !ok {
+		return "", nil, spec.NewError(0, "type of id does not contain audio")
+	}
+	if audioFile.AudioLength() <= 0 {
+		return "", nil, spec.NewError(0, "can't segment a file without a known length")
+	}
+	return file.AbsPath(), audioFile, nil
+}
+
+// hlsBitRates parses the `bitRate` params. video clients may send a size too, as in "1000@480x360"
+func hlsBitRates(values []string) ([]transcode.BitRate, error) {
+	var bitRates []transcode.BitRate
+	for _, v := range values {
+		v, _, _ = strings.Cut(v, "@")
+		bitRate, err := strconv.Atoi(v)
+		if err != nil || bitRate <= 0 {
+			return nil, fmt.Errorf("bad bit rate %q", v)
+		}
+		bitRates = append(bitRates, transcode.BitRate(bitRate))
+	}
+	return bitRates, nil
+}
+
+// hlsDefaultBitRates skips variants higher than the file's own bit rate, there's nothing to gain there
+func hlsDefaultBitRates(fileBitRate int) []transcode.BitRate {
+	var bitRates []transcode.BitRate
+	for _, bitRate := range transcode.HLSBitRates {
+		if fileBitRate > 0 && int(bitRate) > fileBitRate && len(bitRates) > 0 {
+			break
+		}
+		bitRates = append(bitRates, bitRate)
+	}
+	return bitRates
+}
+
+func hlsQuery(params params.Params, id specid.ID, bitRate transcode.BitRate, segment *int) string {
+	set := url.Values{
+		"id":      {id.String()},
+		"bitRate": {strconv.Itoa(int(bitRate))},
+	}
+	if segment != nil {
+		set.Set("segment", strconv.Itoa(*segment))
+	}
+	return linkQuery(params, set)
+}
+
+func hlsMasterPlaylist(bitRates []transcode.BitRate, variantURL func(transcode.BitRate) string) string {
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:3\n")
+	for _, bitRate := range bitRates {
+		fmt.Fprintf(&sb, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n", bitRate*1000)
+		sb.WriteString(variantURL(bitRate) + "\n")
+	}
+	return sb.String()
+}
+
+func hlsMediaPlaylist(length time.Duration, segmentURL func(int) string) string {
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:3\n")
+	sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&sb, "#EXT-X-TARGETDURATION:%d\n", int(transcode.HLSSegmentLength.Seconds()))
+	sb.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	for segment, seek := 0, time.Duration(0); seek < length; segment, seek = segment+1, seek+transcode.HLSSegmentLength {
+		fmt.Fprintf(&sb, "#EXTINF:%.3f,\n", min(transcode.HLSSegmentLength, length-seek).Seconds())
+		sb.WriteString(segmentURL(segment) + "\n")
+	}
+	sb.WriteString("#EXT-X-ENDLIST\n")
+	return sb.String()
+}
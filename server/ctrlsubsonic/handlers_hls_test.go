@@ -0,0 +1,55 @@
+package ctrlsubsonic
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLS(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	// the mock tracks are 100 seconds long, so ten segments
+	rr := serveTestCase(respRaw(contr.ServeHLS), nil, url.Values{"id": {"tr-1"}, "bitRate": {"128"}}, nil)
+	require.Equal(t, hlsMIME, rr.Header().Get("Content-Type"))
+	body := rr.Body.String()
+	require.True(t, strings.HasPrefix(body, "#EXTM3U\n"))
+	require.Equal(t, 10, strings.Count(body, "#EXTINF:10.000,\n"))
+	require.Contains(t, body, "#EXT-X-ENDLIST\n")
+
+	var segments []url.Values
+	for line := range strings.Lines(body) {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "hlsSegment?"); ok {
+			query, err := url.ParseQuery(rest)
+			require.NoError(t, err)
+			segments = append(segments, query)
+		}
+	}
+	require.Len(t, segments, 10)
+	require.Equal(t, "0", segments[0].Get("segment"))
+	require.Equal(t, "9", segments[9].Get("segment"))
+	require.Equal(t, "128", segments[9].Get("bitRate"))
+	require.Equal(t, mockUsername, segments[9].Get("u")) // so the segment is authenticated too
+
+	// more than one bit rate is a master playlist with a variant for each
+	body = serveTestCase(respRaw(contr.ServeHLS), nil, url.Values{"id": {"tr-1"}, "bitRate": {"64", "256@480x360"}}, nil).Body.String()
+	require.Contains(t, body, "#EXT-X-STREAM-INF:BANDWIDTH=64000\n")
+	require.Contains(t, body, "#EXT-X-STREAM-INF:BANDWIDTH=256000\n")
+	require.Contains(t, body, "hls.m3u8?")
+	require.NotContains(t, body, "#EXTINF")
+
+	// the default variants stop at the file's bit rate
+	require.Len(t, hlsDefaultBitRates(100), 1)
+	require.Len(t, hlsDefaultBitRates(320), 3)
+
+	body = serveTestCase(respRaw(contr.ServeHLS), nil, url.Values{"id": {"tr-1"}, "bitRate": {"fast"}}, nil).Body.String()
+	require.Contains(t, body, `"code":10`)
+	body = serveTestCase(respRaw(contr.ServeHLSSegment), nil, url.Values{"id": {"tr-1"}}, nil).Body.String()
+	require.Contains(t, body, `"code":10`)
+	body = serveTestCase(respRaw(contr.ServeHLSSegment), nil, url.Values{"id": {"tr-1"}, "segment": {"10"}}, nil).Body.String()
+	require.Contains(t, body, `"code":70`)
+}
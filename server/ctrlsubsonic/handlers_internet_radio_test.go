@@ -2,10 +2,6 @@
 package ctrlsubsonic
 
 import (
-	"encoding/json"
-	"errors"
-	"net/http"
-	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -61,41 +57,6 @@ func TestInternetRadio(t *testing.T) {
 	t.Run("deletes", func(t *testing.T) { testInternetRadioDeletes(t, contr) })
 }
 
-func runTestCase(t *testing.T, h handlerSubsonic, q url.Values, admin bool) *spec.SubsonicResponse {
-	t.Helper()
-
-	var rr *httptest.ResponseRecorder
-	var req *http.Request
-
-	if admin {
-		rr, req = makeHTTPMockWithAdmin(q)
-	} else {
-		rr, req = makeHTTPMock(q)
-	}
-	resp(h).ServeHTTP(rr, req)
-	body := rr.Body.String()
-	if status := rr.Code; status != http.StatusOK {
-		t.Fatalf("didn't give a 200\n%s", body)
-	}
-
-	var response spec.SubsonicResponse
-	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
-		var jsonSyntaxError *json.SyntaxError
-		if errors.As(err, &jsonSyntaxError) {
-			t.Fatalf("invalid character at offset %v\n %s <--", jsonSyntaxError.Offset, body[0:jsonSyntaxError.Offset])
-		}
-
-		var jsonUnmarshalTypeError *json.UnmarshalTypeError
-		if errors.As(err, &jsonSyntaxError) {
-			t.Fatalf("invalid type at offset %v\n %s <--", jsonUnmarshalTypeError.Offset, body[0:jsonUnmarshalTypeError.Offset])
-		}
-
-		t.Fatalf("json unmarshal failed: %v", err)
-	}
-
-	return &response
-}
-
 func checkSuccess(t *testing.T, response *spec.SubsonicResponse) {
 	t.Helper()
 
@@ -0,0 +1,343 @@
+package ctrlsubsonic
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+// a user has a play queue per name. clients can choose the queue with the `queue` param, otherwise
+// each client saves to its own queue named after itself, so devices don't overwrite each other. clients
+// which only know about a single queue still get the most recently changed one, wherever it came from
+
+var errPlayQueueChanged = errors.New("play queue was changed by another client")
+
+func (c *Controller) ServeGetPlayQueue(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	queue, err := c.findPlayQueue(user, params.GetOr("queue", ""))
+	if err != nil {
+		return spec.NewError(0, "error finding play queue: %v", err)
+	}
+	if queue == nil {
+		return spec.NewResponse()
+	}
+
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+
+	sub := spec.NewResponse()
+	sub.PlayQueue, _, err = c.playQueueResponse(user, queue, transcodeMeta)
+	if err != nil {
+		return spec.NewError(0, "error finding play queue entries: %v", err)
+	}
+	return sub
+}
+
+func (c *Controller) ServeSavePlayQueue(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	tracks, err := params.GetIDList("id")
+	if err != nil {
+		return spec.NewError(10, "please provide some `id` parameters")
+	}
+	trackIDs := make([]specid.ID, 0, len(tracks))
+	for _, id := range tracks {
+		if (id.Type == specid.Track) || (id.Type == specid.PodcastEpisode) {
+			trackIDs = append(trackIDs, id)
+		}
+	}
+	if len(trackIDs) == 0 {
+		return spec.NewError(10, "no track ids provided")
+	}
+	queue, err := c.playQueueForSave(r)
+	if err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	// without a current item, or one that's not in the queue, start from the top
+	current := params.GetOrID("current", specid.ID{})
+	queue.SetItems(trackIDs)
+	queue.SetCurrentIndex(max(slices.Index(trackIDs, current), 0))
+	queue.Position = params.GetOrInt("position", 0)
+	c.dbc.Save(queue)
+	return spec.NewResponse()
+}
+
+// ServeGetPlayQueueByIndex is the same as ServeGetPlayQueue, but from the OpenSubsonic `indexBasedQueue`
+// extension. the current entry is an index, so that it works when an item is in the queue more than once
+func (c *Controller) ServeGetPlayQueueByIndex(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	queue, err := c.findPlayQueue(user, params.GetOr("queue", ""))
+	if err != nil {
+		return spec.NewError(0, "error finding play queue: %v", err)
+	}
+	if queue == nil {
+		return spec.NewResponse()
+	}
+
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+
+	resp, currentIndex, err := c.playQueueResponse(user, queue, transcodeMeta)
+	if err != nil {
+		return spec.NewError(0, "error finding play queue entries: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.PlayQueueByIndex = &spec.PlayQueueByIndex{
+		Name:      resp.Name,
+		Position:  resp.Position,
+		Username:  resp.Username,
+		Changed:   resp.Changed,
+		ChangedBy: resp.ChangedBy,
+		List:      resp.List,
+	}
+	if currentIndex >= 0 {
+		sub.PlayQueueByIndex.CurrentIndex = &currentIndex
+	}
+	return sub
+}
+
+func (c *Controller) ServeSavePlayQueueByIndex(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+
+	ids := params.GetOrIDList("id", nil)
+	if len(ids) == 0 {
+		// no items clears the queue
+		name := params.GetFirstOr("", "queue", "c")
+		if err := c.dbc.Where("user_id=? AND name=?", user.ID, name).Delete(db.PlayQueue{}).Error; err != nil {
+			return spec.NewError(0, "error clearing play queue: %v", err)
+		}
+		return spec.NewResponse()
+	}
+
+	currentIndex, err := params.GetInt("currentIndex")
+	if err != nil {
+		return spec.NewError(10, "please provide a `currentIndex` parameter")
+	}
+
+	// skip anything that can't be queued, keeping the current index pointing at the same item
+	trackIDs := make([]specid.ID, 0, len(ids))
+	for i, id := range ids {
+		if (id.Type != specid.Track) && (id.Type != specid.PodcastEpisode) {
+			if i == currentIndex {
+				return spec.NewError(10, "current item %q can't be queued", id)
+			}
+			if i < currentIndex {
+				currentIndex--
+			}
+			continue
+		}
+		trackIDs = append(trackIDs, id)
+	}
+
+	queue, err := c.playQueueForSave(r)
+	if err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	queue.SetItems(trackIDs)
+	if !queue.SetCurrentIndex(currentIndex) {
+		return spec.NewError(10, "`currentIndex` %d is out of range", currentIndex)
+	}
+	queue.Position = params.GetOrInt("position", 0)
+	if err := c.dbc.Save(queue).Error; err != nil {
+		return spec.NewError(0, "error saving play queue: %v", err)
+	}
+	return spec.NewResponse()
+}
+
+// ServeGetPlayQueues lists the user's queues, most recently changed first. the entries aren't
+// included, get a queue by name for those
+func (c *Controller) ServeGetPlayQueues(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	var queues []*db.PlayQueue
+	err := c.dbc.
+		Where("user_id=?", user.ID).
+		Order("updated_at DESC").
+		Find(&queues).
+		Error
+	if err != nil {
+		return spec.NewError(0, "error finding play queues: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.PlayQueues = &spec.PlayQueues{
+		List: make([]*spec.PlayQueue, len(queues)),
+	}
+	for i, queue := range queues {
+		sub.PlayQueues.List[i] = &spec.PlayQueue{
+			Name:       queue.Name,
+			Current:    queue.CurrentSID(),
+			Position:   queue.Position,
+			Username:   user.Name,
+			Changed:    queue.UpdatedAt,
+			ChangedBy:  queue.ChangedBy,
+			EntryCount: len(queue.GetItems()),
+		}
+	}
+	return sub
+}
+
+// ServeTakeOverPlayQueue copies another queue, usually from another device, in to the client's
+// own queue. the position comes with it, so playback can carry on where the other device left off
+func (c *Controller) ServeTakeOverPlayQueue(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	from, err := params.Get("from")
+	if err != nil {
+		return spec.NewError(10, "please provide a `from` parameter")
+	}
+	src, err := c.findPlayQueue(user, from)
+	if err != nil {
+		return spec.NewError(0, "error finding play queue: %v", err)
+	}
+	if src == nil {
+		return spec.NewError(70, "play queue %q not found", from)
+	}
+
+	client := params.GetOr("c", "") // must exist, middleware checks
+	name := params.GetOr("queue", client)
+
+	var queue db.PlayQueue
+	err = c.dbc.
+		Where("user_id=? AND name=?", user.ID, name).
+		First(&queue).
+		Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.NewError(0, "error finding play queue: %v", err)
+	}
+	queue.UserID = user.ID
+	queue.Name = name
+	queue.ChangedBy = client
+	queue.Items = src.Items
+	queue.Current = src.Current
+	queue.CurrentIndex = src.CurrentIndex
+	queue.Position = src.Position
+	if err := c.dbc.Save(&queue).Error; err != nil {
+		return spec.NewError(0, "error saving play queue: %v", err)
+	}
+
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, client, handlerutil.RemoteAddr(r))
+
+	sub := spec.NewResponse()
+	sub.PlayQueue, _, err = c.playQueueResponse(user, &queue, transcodeMeta)
+	if err != nil {
+		return spec.NewError(0, "error finding play queue entries: %v", err)
+	}
+	return sub
+}
+
+// findPlayQueue finds the user's queue with a name, or the most recently changed queue if the
+// name is empty. the queue is nil if there isn't one
+func (c *Controller) findPlayQueue(user *db.User, name string) (*db.PlayQueue, error) {
+	q := c.dbc.Where("user_id=?", user.ID)
+	if name != "" {
+		q = q.Where("name=?", name)
+	}
+	var queue db.PlayQueue
+	err := q.
+		Order("updated_at DESC").
+		First(&queue).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+// playQueueForSave finds or makes the queue that a save is for. if the queue was last changed by
+// another client, it's likely a conflict with another device. so instead of overwriting it, it's an
+// error unless the save is forced with `force`. to carry on from another device's queue, take it over
+func (c *Controller) playQueueForSave(r *http.Request) (*db.PlayQueue, error) {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	client := params.GetOr("c", "") // must exist, middleware checks
+	name := params.GetOr("queue", client)
+
+	var queue db.PlayQueue
+	err := c.dbc.
+		Where("user_id=? AND name=?", user.ID, name).
+		First(&queue).
+		Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("find play queue: %w", err)
+	}
+	if queue.ID != 0 && queue.ChangedBy != client && !params.GetOrBool("force", false) {
+		return nil, fmt.Errorf("%w: %q was last saved by %q", errPlayQueueChanged, name, queue.ChangedBy)
+	}
+	queue.UserID = user.ID
+	queue.Name = name
+	queue.ChangedBy = client
+	return &queue, nil
+}
+
+// playQueueResponse finds the entries of a queue. since items which no longer exist are skipped, the
+// current index is adjusted to match. it's -1 if the current item is gone
+func (c *Controller) playQueueResponse(user *db.User, queue *db.PlayQueue, transcodeMeta spec.TranscodeMeta) (*spec.PlayQueue, int, error) {
+	trackIDs := queue.GetItems()
+	resp := &spec.PlayQueue{
+		Name:      queue.Name,
+		Current:   queue.CurrentSID(),
+		Position:  queue.Position,
+		Username:  user.Name,
+		Changed:   queue.UpdatedAt,
+		ChangedBy: queue.ChangedBy,
+		List:      make([]*spec.TrackChild, 0, len(trackIDs)),
+	}
+	currentIndex := -1
+
+	for i, id := range trackIDs {
+		var entry *spec.TrackChild
+		switch id.Type {
+		case specid.Track:
+			var track db.Track
+			err := c.dbc.
+				Where("id=?", id.Value).
+				Preload("Album").
+				Preload("Album.Artists").
+				Preload("Artists").
+				Preload("Genres").
+				Preload("TrackStar", "user_id=?", user.ID).
+				Preload("TrackPlay", "user_id=?", user.ID).
+				Preload("TrackRating", "user_id=?", user.ID).
+				Find(&track).
+				Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, 0, fmt.Errorf("finding track: %w", err)
+			}
+			if track.ID != 0 {
+				entry = spec.NewTCTrackByFolder(&track, track.Album)
+			}
+		case specid.PodcastEpisode:
+			var pe db.PodcastEpisode
+			err := c.dbc.
+				Where("id=?", id.Value).
+				Find(&pe).
+				Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, 0, fmt.Errorf("finding podcast episode: %w", err)
+			}
+			if pe.ID != 0 {
+				entry = spec.NewTCPodcastEpisode(&pe)
+			}
+		}
+		if entry == nil {
+			continue
+		}
+		if i == queue.CurrentIndex {
+			currentIndex = len(resp.List)
+		}
+		entry.TranscodeMeta = transcodeMeta
+		resp.List = append(resp.List, entry)
+	}
+	return resp, currentIndex, nil
+}
@@ -0,0 +1,121 @@
+package ctrlsubsonic
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestPlayQueueByIndex(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	user := db.User{Name: "listener", Password: "password"}
+	require.NoError(t, contr.dbc.Create(&user).Error)
+
+	var tracks []*db.Track
+	require.NoError(t, contr.dbc.Order("id").Limit(2).Find(&tracks).Error)
+	require.Len(t, tracks, 2)
+
+	a, b := tracks[0].SID().String(), tracks[1].SID().String()
+
+	// the same track is in the queue twice, and we're on the second one
+	sub := runTestCaseAs(t, contr.ServeSavePlayQueueByIndex, &user, url.Values{"id": {a, b, a}, "currentIndex": {"2"}, "position": {"1000"}})
+	require.Nil(t, sub.Response.Error)
+
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueueByIndex, &user, url.Values{})
+	require.Nil(t, sub.Response.Error)
+	queue := sub.Response.PlayQueueByIndex
+	require.NotNil(t, queue)
+	require.NotNil(t, queue.CurrentIndex)
+	require.Equal(t, 2, *queue.CurrentIndex)
+	require.Equal(t, 1000, queue.Position)
+	require.Len(t, queue.List, 3)
+	require.Equal(t, "listener", queue.Username)
+
+	// the id based queue still sees the same thing
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueue, &user, url.Values{})
+	require.Equal(t, a, sub.Response.PlayQueue.Current.String())
+	require.Len(t, sub.Response.PlayQueue.List, 3)
+
+	// and saving with an id finds the index of its first appearance
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueue, &user, url.Values{"id": {b, a, a}, "current": {a}})
+	require.Nil(t, sub.Response.Error)
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueueByIndex, &user, url.Values{})
+	require.Equal(t, 1, *sub.Response.PlayQueueByIndex.CurrentIndex)
+
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueueByIndex, &user, url.Values{"id": {a, b}, "currentIndex": {"2"}})
+	require.NotNil(t, sub.Response.Error)
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueueByIndex, &user, url.Values{"id": {a, b}})
+	require.NotNil(t, sub.Response.Error)
+
+	// no ids clears the queue
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueueByIndex, &user, url.Values{})
+	require.Nil(t, sub.Response.Error)
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueueByIndex, &user, url.Values{})
+	require.Nil(t, sub.Response.PlayQueueByIndex)
+}
+
+func TestPlayQueueNamed(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	user := db.User{Name: "listener", Password: "password"}
+	require.NoError(t, contr.dbc.Create(&user).Error)
+
+	var tracks []*db.Track
+	require.NoError(t, contr.dbc.Order("id").Limit(3).Find(&tracks).Error)
+	require.Len(t, tracks, 3)
+
+	a, b, c := tracks[0].SID().String(), tracks[1].SID().String(), tracks[2].SID().String()
+
+	// each client saves to its own queue
+	sub := runTestCaseAs(t, contr.ServeSavePlayQueue, &user, url.Values{"c": {"phone"}, "id": {a, b}, "current": {b}, "position": {"30"}})
+	require.Nil(t, sub.Response.Error)
+	require.NoError(t, contr.dbc.Model(db.PlayQueue{}).Where("name=?", "phone").UpdateColumn("updated_at", time.Now().Add(-time.Hour)).Error)
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueue, &user, url.Values{"c": {"desktop"}, "id": {c}, "current": {c}})
+	require.Nil(t, sub.Response.Error)
+
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueues, &user, url.Values{})
+	require.Nil(t, sub.Response.Error)
+	require.Len(t, sub.Response.PlayQueues.List, 2)
+	require.Equal(t, "desktop", sub.Response.PlayQueues.List[0].Name)
+	require.Equal(t, "phone", sub.Response.PlayQueues.List[1].Name)
+	require.Equal(t, 2, sub.Response.PlayQueues.List[1].EntryCount)
+
+	// without a name, it's the most recent
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueue, &user, url.Values{})
+	require.Equal(t, "desktop", sub.Response.PlayQueue.Name)
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueue, &user, url.Values{"queue": {"phone"}})
+	require.Equal(t, "phone", sub.Response.PlayQueue.Name)
+	require.Len(t, sub.Response.PlayQueue.List, 2)
+
+	// saving over another client's queue is a conflict unless forced
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueue, &user, url.Values{"c": {"desktop"}, "queue": {"phone"}, "id": {c}})
+	require.NotNil(t, sub.Response.Error)
+	require.Contains(t, sub.Response.Error.Message, `"phone" was last saved by "phone"`)
+
+	// taking over brings the position with it
+	sub = runTestCaseAs(t, contr.ServeTakeOverPlayQueue, &user, url.Values{"c": {"desktop"}, "from": {"phone"}})
+	require.Nil(t, sub.Response.Error)
+	require.Equal(t, "desktop", sub.Response.PlayQueue.Name)
+	require.Equal(t, "desktop", sub.Response.PlayQueue.ChangedBy)
+	require.Equal(t, b, sub.Response.PlayQueue.Current.String())
+	require.Equal(t, 30, sub.Response.PlayQueue.Position)
+	require.Len(t, sub.Response.PlayQueue.List, 2)
+
+	sub = runTestCaseAs(t, contr.ServeTakeOverPlayQueue, &user, url.Values{"from": {"watch"}})
+	require.NotNil(t, sub.Response.Error)
+
+	sub = runTestCaseAs(t, contr.ServeSavePlayQueue, &user, url.Values{"c": {"desktop"}, "queue": {"phone"}, "id": {c}, "force": {"true"}})
+	require.Nil(t, sub.Response.Error)
+	sub = runTestCaseAs(t, contr.ServeGetPlayQueue, &user, url.Values{"queue": {"phone"}})
+	require.Equal(t, "desktop", sub.Response.PlayQueue.ChangedBy)
+	require.Len(t, sub.Response.PlayQueue.List, 1)
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"sort"
 	"time"
 
 	"github.com/jinzhu/gorm"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
 	playlistp "go.senan.xyz/gonic/playlist"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
@@ -39,7 +41,7 @@ func (c *Controller) ServeGetPlaylists(r *http.Request) *spec.Response {
 			continue
 		}
 		playlistID := playlistIDEncode(path)
-		rendered, err := playlistRender(c, params, playlist, playlistID, false)
+		rendered, err := playlistRender(c, params, handlerutil.RemoteAddr(r), playlist, playlistID, false)
 		if err != nil {
 			return spec.NewError(0, "error rendering playlist %q: %v", path, err)
 		}
@@ -59,7 +61,7 @@ func (c *Controller) ServeGetPlaylist(r *http.Request) *spec.Response {
 		return spec.NewError(70, "playlist with id %s not found", playlistID)
 	}
 	sub := spec.NewResponse()
-	rendered, err := playlistRender(c, params, playlist, playlistID, true)
+	rendered, err := playlistRender(c, params, handlerutil.RemoteAddr(r), playlist, playlistID, true)
 	if err != nil {
 		return spec.NewError(0, "error rendering playlist: %v", err)
 	}
@@ -112,7 +114,7 @@ func (c *Controller) ServeCreateOrUpdatePlaylist(r *http.Request) *spec.Response
 	}
 
 	sub := spec.NewResponse()
-	rendered, err := playlistRender(c, params, &playlist, playlistID, true)
+	rendered, err := playlistRender(c, params, handlerutil.RemoteAddr(r), &playlist, playlistID, true)
 	if err != nil {
 		return spec.NewError(0, "error rendering playlist: %v", err)
 	}
@@ -198,7 +200,7 @@ func playlistIDDecode(id specid.ID) string {
 	return string(path)
 }
 
-func playlistRender(c *Controller, params params.Params, playlist *playlistp.Playlist, playlistID specid.ID, withItems bool) (*spec.Playlist, error) {
+func playlistRender(c *Controller, params params.Params, addr netip.Addr, playlist *playlistp.Playlist, playlistID specid.ID, withItems bool) (*spec.Playlist, error) {
 	user := &db.User{}
 	if err := c.dbc.Where("id=?", playlist.UserID).Find(user).Error; err != nil {
 		return nil, fmt.Errorf("find user by id: %w", err)
@@ -218,7 +220,7 @@ func playlistRender(c *Controller, params params.Params, playlist *playlistp.Pla
 		return resp, nil
 	}
 
-	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""))
+	transcodeMeta := streamGetTranscodeMeta(c.dbc, user.ID, params.GetOr("c", ""), addr)
 
 	for _, path := range playlist.Items {
 		id, err := specidpaths.Lookup(c.dbc, MusicPaths(c.musicPaths), c.podcastsPath, path)
@@ -231,7 +233,7 @@ func playlistRender(c *Controller, params params.Params, playlist *playlistp.Pla
 		switch id.Type {
 		case specid.Track:
 			var track db.Track
-			if err := c.dbc.Where("id=?", id.Value).Preload("Album").Preload("Album.Artists").Preload("Artists").Preload("TrackStar", "user_id=?", user.ID).Preload("TrackRating", "user_id=?", user.ID).Find(&track).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := c.dbc.Where("id=?", id.Value).Preload("Album").Preload("Album.Artists").Preload("Artists").Preload("Genres").Preload("TrackStar", "user_id=?", user.ID).Preload("TrackRating", "user_id=?", user.ID).Preload("TrackPlay", "user_id=?", user.ID).Find(&track).Error; errors.Is(err, gorm.ErrRecordNotFound) {
 				return nil, fmt.Errorf("load track by id: %w", err)
 			}
 			trch = spec.NewTCTrackByFolder(&track, track.Album)
@@ -8,9 +8,13 @@ import (
 	"image"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +23,7 @@ import (
 	"go.senan.xyz/wrtag/coverparse"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
 	"go.senan.xyz/gonic/infocache/artistinfocache"
 	"go.senan.xyz/gonic/playlist"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
@@ -292,10 +297,15 @@ func (c *Controller) ServeStream(w http.ResponseWriter, r *http.Request) *spec.R
 	}
 
 	client, _ := params.Get("c")
-	pref, err := streamGetTranscodePreference(c.dbc, user.ID, client)
+	pref, err := c.dbc.GetTranscodePreference(user.ID, client, handlerutil.RemoteAddr(r))
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return spec.NewError(0, "couldn't find transcode preference: %v", err)
 	}
+	if pref != nil && pref.Profile == db.TranscodeRuleRaw {
+		log.Printf("serving raw file, transcode rule for user %q and client %q is raw", user.Name, client)
+		http.ServeFile(w, r, file.AbsPath())
+		return nil
+	}
 	if pref == nil {
 		if maxBitRate > 0 && maxBitRate < audioFile.AudioBitrate() {
 			return spec.NewError(0, "param maxBitRate requested and no user transcode preferences found for user %q and client %q. please configure transcode settings if you want to transcode", user.Name, client)
@@ -311,7 +321,7 @@ func (c *Controller) ServeStream(w http.ResponseWriter, r *http.Request) *spec.R
 		return nil
 	}
 
-	profile, ok := transcode.UserProfiles[pref.Profile]
+	profile, ok := transcode.LookupProfile(pref.Profile)
 	if !ok {
 		return spec.NewError(0, "unknown transcode user profile %q", pref.Profile)
 	}
@@ -324,17 +334,264 @@ func (c *Controller) ServeStream(w http.ResponseWriter, r *http.Request) *spec.R
 
 	log.Printf("transcoding to %q with at bitrate %d", profile.MIME(), profile.BitRate())
 
-	w.Header().Set("Content-Type", profile.MIME())
-	if err := c.transcoder.Transcode(r.Context(), profile, file.AbsPath(), w); err != nil && !errors.Is(err, transcode.ErrFFmpegKilled) {
+	estimate := params.GetOrBool("estimateContentLength", false)
+	if err := c.streamTranscode(w, r, profile, file.AbsPath(), audioFile.AudioLength(), estimate); err != nil {
 		return spec.NewError(0, "error transcoding: %v", err)
 	}
+	return nil
+}
+
+// streamTranscode writes a transcode of the file, which is length seconds long. a transcode which is already in the
+// cache is served like a normal file, with ranges. otherwise if the profile has a bit rate, the length of the
+// transcode is estimated from it. then a range is served from the transcode in progress if it has got that far, or
+// else maps to a time offset, and with estimate the response has a Content-Length. the body is cut or padded to match
+func (c *Controller) streamTranscode(w http.ResponseWriter, r *http.Request, profile transcode.Profile, path string, length int, estimate bool) error {
+	w.Header().Set("Content-Type", profile.MIME())
+
+	cacher, _ := c.transcoder.(transcode.CacheOpener)
+	if cacher != nil {
+		if cf, err := cacher.OpenCached(profile, path); err == nil {
+			defer cf.Close()
+			var modTime time.Time
+			if info, err := cf.Stat(); err == nil {
+				modTime = info.ModTime()
+			}
+			http.ServeContent(w, r, "", modTime, cf)
+			return nil
+		}
+	}
+
+	ctx := transcodeContext(r)
+	total := estimateTranscodeLength(profile, length)
+	if total <= 0 {
+		return transcodeTo(ctx, c.transcoder, profile, path, w, -1)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
 
+	rangeHeader := r.Header.Get("Range")
+	start, end, ok := parseByteRange(rangeHeader, total)
+	switch {
+	case rangeHeader != "" && ok:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		if tr := openRunningFrom(ctx, cacher, profile, path, start); tr != nil {
+			w.WriteHeader(http.StatusPartialContent)
+			return copyTo(ctx, tr, start, w, end-start+1)
+		}
+		if start > 0 {
+			bytesPerSec := int64(profile.BitRate()) * 1000 / 8
+			profile = transcode.WithSeek(profile, profile.Seek()+time.Duration(start*int64(time.Second)/bytesPerSec))
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		return transcodeTo(ctx, c.transcoder, profile, path, w, end-start+1)
+	case rangeHeader != "" && start >= total:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	case estimate:
+		w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+		return transcodeTo(ctx, c.transcoder, profile, path, w, total)
+	default:
+		return transcodeTo(ctx, c.transcoder, profile, path, w, -1)
+	}
+}
+
+// openRunningFrom joins the transcode in progress if it has got to offset. a range from anywhere else is a new
+// transcode with a seek, which starts with its own container headers, so the bytes don't line up with the full
+// transcode's. that's only used when there's nothing better
+func openRunningFrom(ctx context.Context, cacher transcode.CacheOpener, profile transcode.Profile, path string, offset int64) *transcode.Transcoding {
+	if cacher == nil || offset == 0 {
+		return nil // from the start the transcode is joined or started anyway
+	}
+	tr, err := cacher.OpenRunning(ctx, profile, path)
+	if err != nil {
+		return nil
+	}
+	if size, _, err := tr.Wait(ctx, 0); err != nil || size < offset {
+		_ = tr.Close()
+		return nil
+	}
+	return tr
+}
+
+// transcodeContext says who the transcode is for, so that users take turns when transcodes are limited
+func transcodeContext(r *http.Request) context.Context {
+	user := r.Context().Value(CtxUser).(*db.User)
+	return transcode.WithUser(r.Context(), user.Name)
+}
+
+// transcodeTo writes the transcode to w. if size isn't negative, exactly that many bytes are written
+func transcodeTo(ctx context.Context, transcoder transcode.Transcoder, profile transcode.Profile, path string, w http.ResponseWriter, size int64) error {
+	defer flush(w)
+
+	if size < 0 {
+		if err := transcoder.Transcode(ctx, profile, path, w); err != nil && !errors.Is(err, transcode.ErrFFmpegKilled) {
+			return err
+		}
+		return nil
+	}
+
+	// a transcode from the start may be shared through the cache, so it's drained. a seek is only for this request
+	return writeFixedLength(ctx, w, size, profile.Seek() == 0, func(ctx context.Context, fw io.Writer) error {
+		return transcoder.Transcode(ctx, profile, path, fw)
+	})
+}
+
+// copyTo writes exactly size bytes of a transcode in progress from offset to w, and closes it once it's drained
+func copyTo(ctx context.Context, tr *transcode.Transcoding, offset int64, w http.ResponseWriter, size int64) error {
+	defer flush(w)
+
+	return writeFixedLength(ctx, w, size, true, func(ctx context.Context, fw io.Writer) error {
+		defer tr.Close()
+		_, err := io.Copy(fw, tr.NewReader(ctx, offset))
+		return err
+	})
+}
+
+// writeFixedLength writes exactly size bytes with write, cutting or padding what it writes. with drain, once size bytes
+// are written it returns, but write carries on in the background with the rest thrown away, even if the client goes.
+// that way a transcode shared through the cache carries on to fill it, and isn't cut off for anyone else reading it
+func writeFixedLength(ctx context.Context, w io.Writer, size int64, drain bool, write func(context.Context, io.Writer) error) error {
+	fw := &fixedLengthWriter{w: w, remaining: size, drain: drain, filled: make(chan struct{})}
+	if !drain {
+		return fw.finish(write(ctx, fw))
+	}
+
+	drainCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		select {
+		case <-fw.filled:
+		default:
+			cancel()
+		}
+	})
+	done := make(chan error, 1)
+	go func() {
+		defer cancel()
+		defer stop()
+		done <- write(drainCtx, fw)
+	}()
+
+	select {
+	case <-fw.filled:
+		return nil
+	case err := <-done:
+		return fw.finish(err)
+	}
+}
+
+func flush(w io.Writer) {
 	if f, ok := w.(http.Flusher); ok {
 		f.Flush()
 	}
+}
+
+// estimateTranscodeLength is the size in bytes of a transcode of length seconds, or 0 if the profile has no bit rate
+func estimateTranscodeLength(profile transcode.Profile, length int) int64 {
+	remaining := time.Duration(length)*time.Second - profile.Seek()
+	if profile.BitRate() == 0 || remaining <= 0 {
+		return 0
+	}
+	return int64(remaining.Seconds() * float64(profile.BitRate()) * 1000 / 8)
+}
+
+// parseByteRange parses a Range header with a single range, like "bytes=100-", "bytes=100-199", or "bytes=-100"
+func parseByteRange(header string, total int64) (start, end int64, ok bool) {
+	ranges, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(ranges, ",") {
+		return 0, 0, false
+	}
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(ranges), "-")
+	if !found {
+		return 0, 0, false
+	}
+	var err error
+	switch {
+	case startStr == "":
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		return max(total-suffix, 0), total - 1, true
+	case endStr == "":
+		end = total - 1
+	default:
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if start, err = strconv.ParseInt(startStr, 10, 64); err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if start >= total {
+		return start, 0, false
+	}
+	if end < start {
+		return 0, 0, false
+	}
+	return start, min(end, total-1), true
+}
+
+var errFixedLengthFull = errors.New("fixed length reached")
+
+// fixedLengthWriter writes no more than its length, so that we stick to a Content-Length we've sent. after that it
+// either drains what's left, or fails to stop the transcode
+type fixedLengthWriter struct {
+	w         io.Writer
+	remaining int64
+	drain     bool
+	filled    chan struct{} // closed once the length is written
+}
+
+func (fw *fixedLengthWriter) Write(p []byte) (int, error) {
+	if fw.remaining == 0 {
+		if fw.drain {
+			return len(p), nil
+		}
+		return 0, errFixedLengthFull
+	}
+	n, err := fw.w.Write(p[:min(int64(len(p)), fw.remaining)])
+	fw.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	if fw.remaining == 0 && fw.filled != nil {
+		close(fw.filled)
+	}
+	if n < len(p) && !fw.drain {
+		return n, errFixedLengthFull
+	}
+	return len(p), nil
+}
+
+// finish is for once writing has stopped. if it stopped short, the rest is padded unless it was an error
+func (fw *fixedLengthWriter) finish(err error) error {
+	if fw.remaining == 0 {
+		return nil // the client has everything it asked for, whatever happened to the transcode after
+	}
+	if err != nil && !errors.Is(err, transcode.ErrFFmpegKilled) {
+		return err
+	}
+	if err == nil {
+		return fw.pad()
+	}
 	return nil
 }
 
+// pad fills the rest with silence, or close enough, when the transcode came out shorter than we guessed
+func (fw *fixedLengthWriter) pad() error {
+	_, err := io.CopyN(fw.w, zeroReader{}, fw.remaining)
+	fw.remaining = 0
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
 func (c *Controller) ServeGetAvatar(w http.ResponseWriter, r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
 	user := r.Context().Value(CtxUser).(*db.User)
@@ -350,29 +607,20 @@ func (c *Controller) ServeGetAvatar(w http.ResponseWriter, r *http.Request) *spe
 	return nil
 }
 
-func streamGetTranscodePreference(dbc *db.DB, userID int, client string) (*db.TranscodePreference, error) {
-	var pref db.TranscodePreference
-	err := dbc.
-		Where("user_id=?", userID).
-		Where("client COLLATE NOCASE IN (?)", []string{"*", client}).
-		Order("client DESC"). // ensure "*" is last if it's there
-		First(&pref).
-		Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("find transcode preference: %w", err)
-	}
-	return &pref, nil
+// linkQuery keeps the request's params, so that relative links to other endpoints are authenticated the same way
+func linkQuery(params params.Params, set url.Values) string {
+	query := url.Values{}
+	maps.Copy(query, url.Values(params))
+	maps.Copy(query, set)
+	return query.Encode()
 }
 
-func streamGetTranscodeMeta(dbc *db.DB, userID int, client string) spec.TranscodeMeta {
-	pref, _ := streamGetTranscodePreference(dbc, userID, client)
+func streamGetTranscodeMeta(dbc *db.DB, userID int, client string, addr netip.Addr) spec.TranscodeMeta {
+	pref, _ := dbc.GetTranscodePreference(userID, client, addr)
 	if pref == nil {
 		return spec.TranscodeMeta{}
 	}
-	profile, ok := transcode.UserProfiles[pref.Profile]
+	profile, ok := transcode.LookupProfile(pref.Profile)
 	if !ok {
 		return spec.TranscodeMeta{}
 	}
@@ -1,12 +1,24 @@
 package ctrlsubsonic
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/playlist"
+	"go.senan.xyz/gonic/transcode"
 )
 
 func TestCoverForPlaylist(t *testing.T) {
@@ -126,3 +138,267 @@ func touch(path string) error {
 	}
 	return f.Close()
 }
+
+func TestStreamGetTranscodePreference(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+	user := contr.dbc.GetUserByName(mockUsername)
+	require.NotNil(t, user)
+
+	require.NoError(t, contr.dbc.Create(&db.TranscodePreference{UserID: user.ID, Client: "DSub", Profile: "opus"}).Error)
+	require.NoError(t, contr.dbc.Create(&db.TranscodeRule{CIDR: "192.168.1.0/24", Profile: db.TranscodeRuleRaw}).Error)
+	require.NoError(t, contr.dbc.Create(&db.TranscodeRule{UserID: &user.ID, Client: "Sonixd", Profile: "mp3"}).Error)
+
+	home, away := netip.MustParseAddr("192.168.1.20"), netip.MustParseAddr("203.0.113.5")
+
+	tcases := []struct {
+		name       string
+		userID     int
+		client     string
+		addr       netip.Addr
+		expProfile string // empty for no preference
+	}{
+		{"first rule wins at home", user.ID, "DSub", home, db.TranscodeRuleRaw},
+		{"mapped addresses match too", user.ID, "DSub", netip.MustParseAddr("::ffff:192.168.1.20"), db.TranscodeRuleRaw},
+		{"rule for the user and client", user.ID, "sonixd", away, "mp3"},
+		{"rule for another user", user.ID + 1, "Sonixd", away, ""},
+		{"falls back to the preference", user.ID, "DSub", away, "opus"},
+		{"unknown address only matches rules without a network", user.ID, "DSub", netip.Addr{}, "opus"},
+		{"nothing matches", user.ID, "other", away, ""},
+	}
+	for _, tcase := range tcases {
+		t.Run(tcase.name, func(t *testing.T) {
+			pref, err := contr.dbc.GetTranscodePreference(tcase.userID, tcase.client, tcase.addr)
+			require.NoError(t, err)
+			if tcase.expProfile == "" {
+				require.Nil(t, pref)
+				return
+			}
+			require.NotNil(t, pref)
+			require.Equal(t, tcase.expProfile, pref.Profile)
+		})
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		header           string
+		expStart, expEnd int64
+		expOK            bool
+	}{
+		{"bytes=0-", 0, 999, true},
+		{"bytes=100-199", 100, 199, true},
+		{"bytes=100-5000", 100, 999, true},
+		{"bytes=-100", 900, 999, true},
+		{"bytes=-5000", 0, 999, true},
+		{"bytes=1000-", 1000, 0, false},
+		{"bytes=200-100", 0, 0, false},
+		{"bytes=0-1,5-6", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+		{"bytes=x-", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tcase := range tcases {
+		start, end, ok := parseByteRange(tcase.header, 1000)
+		require.Equal(t, tcase.expOK, ok, tcase.header)
+		if ok {
+			require.Equal(t, tcase.expStart, start, tcase.header)
+			require.Equal(t, tcase.expEnd, end, tcase.header)
+		}
+	}
+}
+
+func TestStreamTranscodeLength(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+	transcoder := &seekTranscoder{size: 1000}
+	contr.transcoder = transcoder
+
+	// a rule for anyone, the mock tracks are 100 seconds so a 128k transcode is about 1.6MB
+	require.NoError(t, contr.dbc.Create(&db.TranscodeRule{Profile: "mp3"}).Error)
+	const total = 100 * 128 * 1000 / 8
+
+	call := func(q url.Values, rangeHeader string) *http.Response {
+		t.Helper()
+		return serveTestCase(respRaw(contr.ServeStream), nil, q, func(req *http.Request) {
+			req.Header.Set("Range", rangeHeader)
+		}).Result()
+	}
+
+	// the same as before without asking
+	resp := call(url.Values{"id": {"tr-1"}}, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Content-Length"))
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	require.Equal(t, 1000, bodyLen(t, resp))
+
+	// padded up to the estimate
+	resp = call(url.Values{"id": {"tr-1"}, "estimateContentLength": {"true"}}, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1600000", resp.Header.Get("Content-Length"))
+	require.Equal(t, total, bodyLen(t, resp))
+
+	// a range from the middle is a seek to the middle
+	resp = call(url.Values{"id": {"tr-1"}}, "bytes=800000-")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "bytes 800000-1599999/1600000", resp.Header.Get("Content-Range"))
+	require.Equal(t, total-800_000, bodyLen(t, resp))
+	require.Equal(t, 50*time.Second, transcoder.lastSeek)
+
+	// and a short range is cut short
+	resp = call(url.Values{"id": {"tr-1"}}, "bytes=0-99")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, 100, bodyLen(t, resp))
+
+	resp = call(url.Values{"id": {"tr-1"}}, "bytes=1600000-")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+}
+
+func TestStreamTranscodeCached(t *testing.T) {
+	t.Parallel()
+
+	cachedPath := filepath.Join(t.TempDir(), "cached")
+	require.NoError(t, os.WriteFile(cachedPath, []byte("0123456789"), 0o600))
+
+	contr := makeController(t)
+	contr.transcoder = &seekTranscoder{cachedPath: cachedPath}
+	require.NoError(t, contr.dbc.Create(&db.TranscodeRule{Profile: "mp3"}).Error)
+
+	rr := serveTestCase(respRaw(contr.ServeStream), nil, url.Values{"id": {"tr-1"}}, func(req *http.Request) {
+		req.Header.Set("Range", "bytes=2-4")
+	})
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "bytes 2-4/10", rr.Header().Get("Content-Range"))
+	require.Equal(t, "audio/mpeg", rr.Header().Get("Content-Type"))
+	require.Equal(t, "234", rr.Body.String())
+}
+
+func TestStreamTranscodeRunning(t *testing.T) {
+	// the cache looks up the profile's command, but the transcoder here doesn't run it
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "ffmpeg"), nil, 0o700)) //nolint:gosec
+	t.Setenv("PATH", bin)
+
+	contr := makeController(t)
+	transcoder := &runningTranscoder{release: make(chan struct{})}
+	contr.transcoder = transcode.NewCachingTranscoder(transcoder, t.TempDir(), 0)
+	require.NoError(t, contr.dbc.Create(&db.TranscodeRule{Profile: "mp3"}).Error)
+
+	call := func(rangeHeader string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serveTestCase(respRaw(contr.ServeStream), nil, url.Values{"id": {"tr-1"}}, func(req *http.Request) {
+			req.Header.Set("Range", rangeHeader)
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Go(func() { call("") })
+	require.Eventually(t, func() bool { return len(transcoder.seeks()) == 1 }, time.Second, time.Millisecond)
+
+	// a range which the transcode in progress has got to comes from it, with the bytes lined up
+	rr := call("bytes=2-4")
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "bytes 2-4/1600000", rr.Header().Get("Content-Range"))
+	require.Equal(t, "234", rr.Body.String())
+	require.Equal(t, []time.Duration{0}, transcoder.seeks())
+
+	// and one it hasn't got to is a seek
+	rr = call("bytes=800000-800001")
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "01", rr.Body.String())
+	require.Equal(t, []time.Duration{0, 50 * time.Second}, transcoder.seeks())
+
+	close(transcoder.release)
+	wg.Wait()
+}
+
+func TestFixedLengthWriter(t *testing.T) {
+	t.Parallel()
+
+	var buf strings.Builder
+	fw := &fixedLengthWriter{w: &buf, remaining: 5, drain: true}
+	n, err := fw.Write([]byte("0123"))
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	// draining, the rest is taken and thrown away
+	n, err = fw.Write([]byte("4567"))
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	n, err = fw.Write([]byte("89"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, "01234", buf.String())
+
+	buf.Reset()
+	fw = &fixedLengthWriter{w: &buf, remaining: 5}
+	_, err = fw.Write([]byte("01234567"))
+	require.ErrorIs(t, err, errFixedLengthFull)
+	require.Equal(t, "01234", buf.String())
+}
+
+func bodyLen(t *testing.T, resp *http.Response) int {
+	t.Helper()
+	n, err := io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+	return int(n)
+}
+
+// seekTranscoder writes size bytes and remembers the seek, or has everything cached already
+type seekTranscoder struct {
+	size       int
+	cachedPath string
+	lastSeek   time.Duration
+}
+
+func (st *seekTranscoder) Transcode(_ context.Context, profile transcode.Profile, _ string, out io.Writer) error {
+	st.lastSeek = profile.Seek()
+	_, err := io.WriteString(out, strings.Repeat("x", st.size))
+	return err
+}
+
+func (st *seekTranscoder) OpenCached(_ transcode.Profile, _ string) (*os.File, error) {
+	if st.cachedPath == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(st.cachedPath)
+}
+
+func (st *seekTranscoder) OpenRunning(_ context.Context, _ transcode.Profile, _ string) (*transcode.Transcoding, error) {
+	return nil, os.ErrNotExist
+}
+
+// runningTranscoder writes digits and remembers the seek. a transcode from the start then waits to be released
+type runningTranscoder struct {
+	mu      sync.Mutex
+	seeked  []time.Duration
+	release chan struct{}
+}
+
+func (rt *runningTranscoder) seeks() []time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return slices.Clone(rt.seeked)
+}
+
+func (rt *runningTranscoder) Transcode(ctx context.Context, profile transcode.Profile, _ string, out io.Writer) error {
+	rt.mu.Lock()
+	rt.seeked = append(rt.seeked, profile.Seek())
+	rt.mu.Unlock()
+	if _, err := io.WriteString(out, "0123456789"); err != nil {
+		return err
+	}
+	if profile.Seek() > 0 {
+		return nil
+	}
+	select {
+	case <-rt.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
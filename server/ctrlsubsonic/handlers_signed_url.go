@@ -0,0 +1,143 @@
+package ctrlsubsonic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+// signedEndpoints are the endpoints a signed URL can be made for. they're read only and fetched by things which
+// can't do subsonic auth, like casting devices and <audio> elements
+var signedEndpoints = []string{"stream", "getCoverArt"}
+
+const (
+	signedURLDefaultExpiry = 24 * time.Hour
+	signedURLMaxExpiry     = 30 * 24 * time.Hour
+)
+
+var (
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+)
+
+// ServeGetSignedURL makes a URL for `endpoint` and `id` which works without credentials until it expires, `expiresIn`
+// seconds from now. it's bound to the user asking for it. params like `size` or `maxBitRate` can still be added
+// to the URL afterwards, they aren't signed
+func (c *Controller) ServeGetSignedURL(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+	endpoint, err := params.Get("endpoint")
+	if err != nil {
+		return spec.NewError(10, "please provide an `endpoint` parameter")
+	}
+	if !slices.Contains(signedEndpoints, endpoint) {
+		return spec.NewError(0, "can't sign URLs for %q, only %v", endpoint, signedEndpoints)
+	}
+	expiresIn := signedURLDefaultExpiry
+	if secs, err := params.GetInt("expiresIn"); err == nil {
+		expiresIn = time.Duration(secs) * time.Second
+	}
+	if expiresIn <= 0 || expiresIn > signedURLMaxExpiry {
+		return spec.NewError(0, "`expiresIn` must be between 1 and %d seconds", int(signedURLMaxExpiry.Seconds()))
+	}
+
+	expires := time.Now().Add(expiresIn).Truncate(time.Second)
+
+	extra := url.Values{}
+	// so that the user's transcode preference for the client still applies
+	if client, err := params.Get("c"); err == nil {
+		extra.Set("c", client)
+	}
+
+	sub := spec.NewResponse()
+	sub.SignedURL = &spec.SignedURL{
+		URL:     c.signedURL(r, endpoint, id, user.ID, expires, extra),
+		Expires: expires,
+	}
+	return sub
+}
+
+// signedURL makes the URL for endpoint and id, signed for the user until expires, with any extra params
+func (c *Controller) signedURL(r *http.Request, endpoint string, id specid.ID, userID int, expires time.Time, extra url.Values) string {
+	query := url.Values{}
+	for k, v := range extra {
+		query[k] = v
+	}
+	query.Set("id", id.String())
+	query.Set("uid", strconv.Itoa(userID))
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", signURL(c.signKey, endpoint, id, userID, expires))
+
+	signedURL, _ := url.Parse(handlerutil.BaseURL(r))
+	signedURL.Path = c.resolveProxyPath("/rest/" + endpoint)
+	signedURL.RawQuery = query.Encode()
+	return signedURL.String()
+}
+
+// signedURLID is the ID a URL from signedURL is for, if it is one
+func signedURLID(in string) (specid.ID, bool) {
+	u, err := url.Parse(in)
+	if err != nil || !u.Query().Has("sig") {
+		return specid.ID{}, false
+	}
+	id, err := specid.New(u.Query().Get("id"))
+	if err != nil {
+		return specid.ID{}, false
+	}
+	return id, true
+}
+
+func signURL(key []byte, endpoint string, id specid.ID, userID int, expires time.Time) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d", endpoint, id, userID, expires.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignedURL returns the ID of the user a URL was signed for, if the signature matches and hasn't expired
+func checkSignedURL(key []byte, endpoint string, params params.Params, now time.Time) (int, error) {
+	id, err := params.GetID("id")
+	if err != nil {
+		return 0, errSignatureInvalid
+	}
+	userID, err := params.GetInt("uid")
+	if err != nil {
+		return 0, errSignatureInvalid
+	}
+	expiresUnix, err := params.GetInt("expires")
+	if err != nil {
+		return 0, errSignatureInvalid
+	}
+	sig, err := params.Get("sig")
+	if err != nil {
+		return 0, errSignatureInvalid
+	}
+
+	expires := time.Unix(int64(expiresUnix), 0)
+	if !slices.Contains(signedEndpoints, endpoint) {
+		return 0, errSignatureInvalid
+	}
+	if !hmac.Equal([]byte(sig), []byte(signURL(key, endpoint, id, userID, expires))) {
+		return 0, errSignatureInvalid
+	}
+	if now.After(expires) {
+		return 0, errSignatureExpired
+	}
+	return userID, nil
+}
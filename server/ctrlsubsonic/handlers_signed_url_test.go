@@ -0,0 +1,158 @@
+package ctrlsubsonic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+func TestSignedURL(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+	contr.signKey = []byte("key")
+	contr.resolveProxyPath = func(in string) string { return in }
+
+	user := contr.dbc.GetUserByName(mockUsername)
+	require.NotNil(t, user)
+
+	sign := func(q url.Values) (*url.URL, string) {
+		t.Helper()
+		sub := runTestCaseAs(t, contr.ServeGetSignedURL, user, q)
+		if sub.Response.Error != nil {
+			return nil, sub.Response.Error.Message
+		}
+		signedURL, err := url.Parse(sub.Response.SignedURL.URL)
+		require.NoError(t, err)
+		return signedURL, ""
+	}
+
+	// fetch the URL like a device would, with no credentials. the handler just says who it was for
+	fetch := func(signedURL *url.URL) string {
+		t.Helper()
+		handler := withParams(withSignedUser(contr.dbc, contr.signKey, withUser(contr.dbc))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Context().Value(CtxUser).(*db.User).Name))
+		})))
+		req := httptest.NewRequest(http.MethodGet, signedURL.String(), nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	_, errMsg := sign(url.Values{"id": {"tr-1"}, "endpoint": {"getUser"}})
+	require.Contains(t, errMsg, "can't sign")
+	_, errMsg = sign(url.Values{"id": {"tr-1"}, "endpoint": {"stream"}, "expiresIn": {"0"}})
+	require.Contains(t, errMsg, "expiresIn")
+
+	signedURL, errMsg := sign(url.Values{"id": {"tr-1"}, "endpoint": {"stream"}})
+	require.Empty(t, errMsg)
+	require.Equal(t, "/rest/stream", signedURL.Path)
+	require.Equal(t, mockClientName, signedURL.Query().Get("c"))
+	require.Empty(t, signedURL.Query().Get("u"))
+	require.Empty(t, signedURL.Query().Get("p"))
+
+	body := fetch(signedURL)
+	require.Equal(t, mockUsername, body)
+
+	// unsigned params can be added
+	withBitRate := *signedURL
+	query := withBitRate.Query()
+	query.Set("maxBitRate", "128")
+	withBitRate.RawQuery = query.Encode()
+	body = fetch(&withBitRate)
+	require.Equal(t, mockUsername, body)
+
+	// but not changes to what was signed
+	for key, value := range map[string]string{"id": "tr-2", "uid": "2", "expires": "4102444800", "sig": "00"} {
+		tampered := *signedURL
+		query := tampered.Query()
+		query.Set(key, value)
+		tampered.RawQuery = query.Encode()
+		body := fetch(&tampered)
+		require.Contains(t, body, errSignatureInvalid.Error(), key)
+	}
+
+	// or to the endpoint
+	otherEndpoint := *signedURL
+	otherEndpoint.Path = "/rest/getCoverArt"
+	body = fetch(&otherEndpoint)
+	require.Contains(t, body, errSignatureInvalid.Error())
+
+	// and requests without a signature still need credentials
+	unsigned := *signedURL
+	unsigned.RawQuery = url.Values{"id": {"tr-1"}, "u": {mockUsername}, "p": {"wrong"}}.Encode()
+	body = fetch(&unsigned)
+	require.Contains(t, body, "invalid password")
+}
+
+func TestSignedURLExpiry(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("key")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	id := specid.ID{Type: specid.Album, Value: 3}
+	query := url.Values{
+		"id":      {id.String()},
+		"uid":     {"1"},
+		"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":     {signURL(key, "getCoverArt", id, 1, expires)},
+	}
+	p := params.New(&http.Request{URL: &url.URL{RawQuery: query.Encode()}})
+
+	userID, err := checkSignedURL(key, "getCoverArt", p, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, userID)
+
+	_, err = checkSignedURL(key, "getCoverArt", p, expires.Add(time.Second))
+	require.ErrorIs(t, err, errSignatureExpired)
+
+	_, err = checkSignedURL([]byte("other key"), "getCoverArt", p, time.Now())
+	require.ErrorIs(t, err, errSignatureInvalid)
+}
+
+func TestJukeboxStreamURL(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+	contr.signKey = []byte("key")
+	contr.resolveProxyPath = func(in string) string { return in }
+
+	user := contr.dbc.GetUserByName(mockUsername)
+	require.NotNil(t, user)
+
+	r := httptest.NewRequest(http.MethodGet, "http://gonic.example/rest/jukeboxControl", nil)
+	id := specid.ID{Type: specid.Track, Value: 3}
+
+	// the same for repeated calls, so the jukebox can find the track it's playing
+	streamURL := contr.jukeboxStreamURL(r, user, id)
+	require.Equal(t, streamURL, contr.jukeboxStreamURL(r, user, id))
+
+	parsed, err := url.Parse(streamURL)
+	require.NoError(t, err)
+	require.Equal(t, "/rest/stream", parsed.Path)
+	require.Equal(t, jukeboxClient, parsed.Query().Get("c"))
+
+	p := params.New(&http.Request{URL: parsed})
+	userID, err := checkSignedURL(contr.signKey, "stream", p, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, user.ID, userID)
+
+	gotID, ok := signedURLID(streamURL)
+	require.True(t, ok)
+	require.Equal(t, id, gotID)
+
+	_, ok = signedURLID("/music/album/track.flac")
+	require.False(t, ok)
+	_, ok = signedURLID("http://radio.example/stream?id=tr-3")
+	require.False(t, ok)
+}
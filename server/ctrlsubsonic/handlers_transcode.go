@@ -0,0 +1,318 @@
+package ctrlsubsonic
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/handlerutil"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specidpaths"
+	"go.senan.xyz/gonic/transcode"
+)
+
+// clientInfo is what a client can play, posted as json to getTranscodeDecision. bit rates are in bits per second
+type clientInfo struct {
+	Name                       string               `json:"name"`
+	Platform                   string               `json:"platform"`
+	MaxAudioBitrate            int                  `json:"maxAudioBitrate"`
+	MaxTranscodingAudioBitrate int                  `json:"maxTranscodingAudioBitrate"`
+	DirectPlayProfiles         []directPlayProfile  `json:"directPlayProfiles"`
+	TranscodingProfiles        []transcodingProfile `json:"transcodingProfiles"`
+}
+
+// directPlayProfile lists formats the client plays as they are. an empty list matches anything
+type directPlayProfile struct {
+	Containers  []string `json:"containers"`
+	AudioCodecs []string `json:"audioCodecs"`
+	Protocols   []string `json:"protocols"`
+}
+
+// transcodingProfile is a format the client would like to have transcodes in, in order of preference
+type transcodingProfile struct {
+	Container  string `json:"container"`
+	AudioCodec string `json:"audioCodec"`
+	Protocol   string `json:"protocol"`
+}
+
+const (
+	transcodeReasonContainer = "container not supported"
+	transcodeReasonCodec     = "audio codec not supported"
+	transcodeReasonBitRate   = "audio bitrate not supported"
+
+	transcodeDefaultBitRate transcode.BitRate = 192
+)
+
+// transcodeChoice is a decision for one file. if it's not direct play, it's a remux or transcode to the target
+type transcodeChoice struct {
+	directPlay bool
+	reasons    []string
+	target     transcode.Format
+	bitRate    transcode.BitRate
+	remux      bool
+}
+
+func (c *transcodeChoice) params() string {
+	if c.remux {
+		return fmt.Sprintf("remux:%s:%s", c.target.Container, c.target.Codec)
+	}
+	return fmt.Sprintf("transcode:%s:%s:%d", c.target.Container, c.target.Codec, c.bitRate)
+}
+
+var errNoTranscodeProfile = errors.New("no direct play or transcoding profile matches")
+
+// decideTranscode plays the file directly if the client can, otherwise remuxes if only the container is the
+// problem, otherwise transcodes to the first of the client's transcoding profiles that we can write
+func decideTranscode(info *clientInfo, src transcode.Format, srcBitRate int) (*transcodeChoice, error) {
+	overLimit := info.MaxAudioBitrate > 0 && srcBitRate*1000 > info.MaxAudioBitrate
+
+	var choice transcodeChoice
+	var containerOK, codecOK bool
+	for _, p := range info.DirectPlayProfiles {
+		if !matchesAny(p.Protocols, "http") {
+			continue
+		}
+		pContainerOK, pCodecOK := matchesAny(p.Containers, src.Container), matchesAny(p.AudioCodecs, src.Codec)
+		if pContainerOK && pCodecOK && !overLimit {
+			return &transcodeChoice{directPlay: true}, nil
+		}
+		containerOK = containerOK || pContainerOK
+		codecOK = codecOK || pCodecOK
+	}
+	if !containerOK {
+		choice.reasons = append(choice.reasons, transcodeReasonContainer)
+	}
+	if !codecOK {
+		choice.reasons = append(choice.reasons, transcodeReasonCodec)
+	}
+	if overLimit {
+		choice.reasons = append(choice.reasons, transcodeReasonBitRate)
+	}
+
+	if !overLimit {
+		var remuxContainers []string
+		for _, p := range info.DirectPlayProfiles {
+			if matchesAny(p.Protocols, "http") && matchesAny(p.AudioCodecs, src.Codec) {
+				remuxContainers = append(remuxContainers, p.Containers...)
+			}
+		}
+		for _, p := range info.TranscodingProfiles {
+			if matchesAny([]string{p.Protocol}, "http") && strings.EqualFold(p.AudioCodec, src.Codec) {
+				remuxContainers = append(remuxContainers, p.Container)
+			}
+		}
+		for _, container := range remuxContainers {
+			target := transcode.Format{Container: strings.ToLower(container), Codec: src.Codec}
+			if _, err := transcode.NewFormatProfile(target, 0, true); err == nil {
+				choice.target, choice.remux = target, true
+				return &choice, nil
+			}
+		}
+	}
+
+	for _, p := range info.TranscodingProfiles {
+		target := transcode.Format{Container: strings.ToLower(p.Container), Codec: strings.ToLower(p.AudioCodec)}
+		if !matchesAny([]string{p.Protocol}, "http") || !transcode.CanWrite(target) {
+			continue
+		}
+		if transcode.Lossless(target.Codec) {
+			if info.MaxAudioBitrate > 0 || info.MaxTranscodingAudioBitrate > 0 {
+				continue // no way to keep under the limit
+			}
+			choice.target = target
+			return &choice, nil
+		}
+		choice.target = target
+		choice.bitRate = transcodeDefaultBitRate
+		for _, limit := range []int{info.MaxAudioBitrate, info.MaxTranscodingAudioBitrate} {
+			if limit > 0 {
+				choice.bitRate = min(choice.bitRate, transcode.BitRate(limit/1000))
+			}
+		}
+		if srcBitRate > 0 {
+			choice.bitRate = min(choice.bitRate, transcode.BitRate(srcBitRate))
+		}
+		return &choice, nil
+	}
+
+	return &choice, errNoTranscodeProfile
+}
+
+func matchesAny(list []string, v string) bool {
+	if len(list) == 0 || (len(list) == 1 && list[0] == "") {
+		return true
+	}
+	return slices.ContainsFunc(list, func(item string) bool {
+		return strings.EqualFold(item, v)
+	})
+}
+
+// parseTranscodeParams makes a profile from the opaque transcodeParams of a decision
+func parseTranscodeParams(in string) (transcode.Profile, error) {
+	parts := strings.Split(in, ":")
+	switch {
+	case parts[0] == "profile" && len(parts) == 2:
+		profile, ok := transcode.LookupProfile(parts[1])
+		if !ok {
+			return transcode.Profile{}, fmt.Errorf("unknown profile %q", parts[1])
+		}
+		return profile, nil
+	case parts[0] == "remux" && len(parts) == 3:
+		return transcode.NewFormatProfile(transcode.Format{Container: parts[1], Codec: parts[2]}, 0, true)
+	case parts[0] == "transcode" && len(parts) == 4:
+		bitRate, err := strconv.ParseUint(parts[3], 10, 32)
+		if err != nil {
+			return transcode.Profile{}, fmt.Errorf("invalid bit rate %q", parts[3])
+		}
+		return transcode.NewFormatProfile(transcode.Format{Container: parts[1], Codec: parts[2]}, transcode.BitRate(bitRate), false)
+	default:
+		return transcode.Profile{}, fmt.Errorf("unknown transcode params %q", in)
+	}
+}
+
+func (c *Controller) ServeGetTranscodeDecision(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetFirstID("mediaId", "id")
+	if err != nil {
+		return spec.NewError(10, "please provide a `mediaId` parameter")
+	}
+	file, err := specidpaths.Locate(c.dbc, id)
+	if err != nil {
+		return spec.NewError(70, "error looking up id %s: %v", id, err)
+	}
+	audioFile, ok := file.(db.AudioFile)
+	if !ok {
+		return spec.NewError(0, "type of id does not contain audio")
+	}
+
+	var info *clientInfo
+	if r.Body != nil {
+		switch err := json.NewDecoder(r.Body).Decode(&info); {
+		case errors.Is(err, io.EOF):
+		case err != nil:
+			return spec.NewError(10, "invalid client info: %v", err)
+		}
+	}
+
+	src, _ := transcode.FileFormat(filepath.Ext(file.AbsPath()))
+	decision := &spec.TranscodeDecision{
+		SourceStream: &spec.StreamDetails{
+			Protocol:     "http",
+			Container:    cmp.Or(src.Container, strings.TrimPrefix(filepath.Ext(file.AbsPath()), ".")),
+			Codec:        src.Codec,
+			AudioBitrate: audioFile.AudioBitrate() * 1000,
+		},
+	}
+	streamQuery := func(transcodeParams string) string {
+		return "getTranscodeStream?" + linkQuery(params, url.Values{
+			"mediaId":         {id.String()},
+			"transcodeParams": {transcodeParams},
+		})
+	}
+
+	// without client info, it's the same as stream with this client's transcode preference
+	if info == nil {
+		pref, err := c.dbc.GetTranscodePreference(user.ID, params.GetOr("c", ""), handlerutil.RemoteAddr(r))
+		if err != nil {
+			return spec.NewError(0, "couldn't find transcode preference: %v", err)
+		}
+		profile, ok := transcode.Profile{}, false
+		if pref != nil {
+			profile, ok = transcode.LookupProfile(pref.Profile)
+		}
+		if !ok {
+			decision.CanDirectPlay = true
+			decision.StreamURL = "stream?" + linkQuery(params, url.Values{"id": {id.String()}, "format": {"raw"}})
+		} else {
+			target, _ := transcode.FileFormat(profile.Suffix())
+			decision.CanTranscode = true
+			decision.TranscodeParams = "profile:" + pref.Profile
+			decision.StreamURL = streamQuery(decision.TranscodeParams)
+			decision.TranscodeStream = &spec.StreamDetails{
+				Protocol:     "http",
+				Container:    profile.Suffix(),
+				Codec:        target.Codec,
+				AudioBitrate: int(profile.BitRate()) * 1000,
+			}
+		}
+		sub := spec.NewResponse()
+		sub.TranscodeDecision = decision
+		return sub
+	}
+
+	choice, err := decideTranscode(info, src, audioFile.AudioBitrate())
+	decision.TranscodeReason = choice.reasons
+	switch {
+	case err != nil:
+		decision.ErrorReason = err.Error()
+	case choice.directPlay:
+		decision.CanDirectPlay = true
+		decision.StreamURL = "stream?" + linkQuery(params, url.Values{"id": {id.String()}, "format": {"raw"}})
+	default:
+		decision.CanTranscode = true
+		decision.TranscodeParams = choice.params()
+		decision.StreamURL = streamQuery(decision.TranscodeParams)
+		decision.TranscodeStream = &spec.StreamDetails{
+			Protocol:     "http",
+			Container:    choice.target.Container,
+			Codec:        choice.target.Codec,
+			AudioBitrate: int(choice.bitRate) * 1000,
+		}
+		if choice.remux {
+			decision.TranscodeStream.AudioBitrate = decision.SourceStream.AudioBitrate
+		}
+	}
+
+	sub := spec.NewResponse()
+	sub.TranscodeDecision = decision
+	return sub
+}
+
+func (c *Controller) ServeGetTranscodeStream(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	id, err := params.GetFirstID("mediaId", "id")
+	if err != nil {
+		return spec.NewError(10, "please provide a `mediaId` parameter")
+	}
+	transcodeParams, err := params.Get("transcodeParams")
+	if err != nil {
+		return spec.NewError(10, "please provide a `transcodeParams` parameter")
+	}
+	profile, err := parseTranscodeParams(transcodeParams)
+	if err != nil {
+		return spec.NewError(10, "invalid `transcodeParams` parameter: %v", err)
+	}
+	file, err := specidpaths.Locate(c.dbc, id)
+	if err != nil {
+		return spec.NewError(70, "error looking up id %s: %v", id, err)
+	}
+	if offset := params.GetOrInt("offset", 0); offset > 0 {
+		profile = transcode.WithSeek(profile, time.Second*time.Duration(offset))
+	}
+
+	var length int
+	if audioFile, ok := file.(db.AudioFile); ok {
+		length = audioFile.AudioLength()
+	}
+
+	log.Printf("transcoding to %q with at bitrate %d", profile.MIME(), profile.BitRate())
+
+	estimate := params.GetOrBool("estimateContentLength", false)
+	if err := c.streamTranscode(w, r, profile, file.AbsPath(), length, estimate); err != nil {
+		return spec.NewError(0, "error transcoding: %v", err)
+	}
+	return nil
+}
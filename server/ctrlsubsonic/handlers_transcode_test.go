@@ -0,0 +1,165 @@
+package ctrlsubsonic
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func TestDecideTranscode(t *testing.T) {
+	t.Parallel()
+
+	flac := transcode.Format{Container: "flac", Codec: "flac"}
+	mp3 := transcode.Format{Container: "mp3", Codec: "mp3"}
+
+	tcases := []struct {
+		name       string
+		info       clientInfo
+		src        transcode.Format
+		srcBitRate int
+		expParams  string // empty for direct play
+		expReasons []string
+		expErr     error
+	}{
+		{
+			name:       "direct play",
+			info:       clientInfo{DirectPlayProfiles: []directPlayProfile{{Containers: []string{"FLAC"}, AudioCodecs: []string{"flac"}}}},
+			src:        flac,
+			srcBitRate: 900,
+		},
+		{
+			name:       "direct play anything",
+			info:       clientInfo{DirectPlayProfiles: []directPlayProfile{{}}},
+			src:        flac,
+			srcBitRate: 900,
+		},
+		{
+			name: "remux when only the container is wrong",
+			info: clientInfo{DirectPlayProfiles: []directPlayProfile{{Containers: []string{"ogg"}, AudioCodecs: []string{"flac", "opus"}}}},
+			src:  flac, srcBitRate: 900,
+			expParams:  "remux:ogg:flac",
+			expReasons: []string{transcodeReasonContainer},
+		},
+		{
+			name: "transcode when over the bit rate limit",
+			info: clientInfo{
+				MaxAudioBitrate:     320_000,
+				DirectPlayProfiles:  []directPlayProfile{{Containers: []string{"flac"}, AudioCodecs: []string{"flac"}}},
+				TranscodingProfiles: []transcodingProfile{{Container: "flac", AudioCodec: "flac"}, {Container: "mp3", AudioCodec: "mp3"}},
+			},
+			src: flac, srcBitRate: 900,
+			expParams:  "transcode:mp3:mp3:192",
+			expReasons: []string{transcodeReasonBitRate},
+		},
+		{
+			name: "transcode at the transcoding limit",
+			info: clientInfo{
+				MaxTranscodingAudioBitrate: 128_000,
+				TranscodingProfiles:        []transcodingProfile{{Container: "ogg", AudioCodec: "opus", Protocol: "http"}},
+			},
+			src: flac, srcBitRate: 900,
+			expParams:  "transcode:ogg:opus:128",
+			expReasons: []string{transcodeReasonContainer, transcodeReasonCodec},
+		},
+		{
+			name: "transcode lossless",
+			info: clientInfo{
+				DirectPlayProfiles:  []directPlayProfile{{Containers: []string{"mp3"}, AudioCodecs: []string{"mp3"}}},
+				TranscodingProfiles: []transcodingProfile{{Container: "wav", AudioCodec: "pcm"}},
+			},
+			src: flac, srcBitRate: 900,
+			expParams:  "transcode:wav:pcm:0",
+			expReasons: []string{transcodeReasonContainer, transcodeReasonCodec},
+		},
+		{
+			name: "never transcode up",
+			info: clientInfo{
+				DirectPlayProfiles:  []directPlayProfile{{AudioCodecs: []string{"opus"}}},
+				TranscodingProfiles: []transcodingProfile{{Container: "ogg", AudioCodec: "opus"}},
+			},
+			src: mp3, srcBitRate: 96,
+			expParams:  "transcode:ogg:opus:96",
+			expReasons: []string{transcodeReasonCodec},
+		},
+		{
+			name: "skip other protocols and unknown formats",
+			info: clientInfo{
+				DirectPlayProfiles:  []directPlayProfile{{Protocols: []string{"hls"}}},
+				TranscodingProfiles: []transcodingProfile{{Container: "mpegts", AudioCodec: "aac", Protocol: "hls"}, {Container: "mkv", AudioCodec: "dts"}},
+			},
+			src: flac, srcBitRate: 900,
+			expReasons: []string{transcodeReasonContainer, transcodeReasonCodec},
+			expErr:     errNoTranscodeProfile,
+		},
+	}
+
+	for _, tcase := range tcases {
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			choice, err := decideTranscode(&tcase.info, tcase.src, tcase.srcBitRate)
+			require.ErrorIs(t, err, tcase.expErr)
+			require.Equal(t, tcase.expReasons, choice.reasons)
+			if tcase.expErr != nil {
+				return
+			}
+			if tcase.expParams == "" {
+				require.True(t, choice.directPlay)
+				return
+			}
+			require.False(t, choice.directPlay)
+			require.Equal(t, tcase.expParams, choice.params())
+
+			// and the stream can make a profile from it
+			_, err = parseTranscodeParams(choice.params())
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetTranscodeDecision(t *testing.T) {
+	t.Parallel()
+
+	contr := makeController(t)
+
+	call := func(q url.Values, body string) *spec.TranscodeDecision {
+		t.Helper()
+		rr := serveTestCase(resp(contr.ServeGetTranscodeDecision), nil, q, func(req *http.Request) {
+			req.Body = io.NopCloser(strings.NewReader(body))
+		})
+		sub := decodeTestCase(t, rr)
+		require.Nil(t, sub.Response.Error)
+		return sub.Response.TranscodeDecision
+	}
+
+	// clients which send nothing stream as before, with no preferences that's the raw file
+	decision := call(url.Values{"mediaId": {"tr-1"}}, "")
+	require.True(t, decision.CanDirectPlay)
+	require.True(t, strings.HasPrefix(decision.StreamURL, "stream?"))
+	require.Equal(t, "flac", decision.SourceStream.Codec)
+	require.Equal(t, 100_000, decision.SourceStream.AudioBitrate)
+
+	decision = call(url.Values{"mediaId": {"tr-1"}}, `{"name":"client","maxAudioBitrate":64000,"transcodingProfiles":[{"container":"ogg","audioCodec":"opus","protocol":"http"}]}`)
+	require.False(t, decision.CanDirectPlay)
+	require.True(t, decision.CanTranscode)
+	require.Equal(t, "transcode:ogg:opus:64", decision.TranscodeParams)
+	require.Equal(t, 64_000, decision.TranscodeStream.AudioBitrate)
+
+	streamURL, err := url.Parse(decision.StreamURL)
+	require.NoError(t, err)
+	require.Equal(t, "getTranscodeStream", streamURL.Path)
+	require.Equal(t, decision.TranscodeParams, streamURL.Query().Get("transcodeParams"))
+	require.Equal(t, mockUsername, streamURL.Query().Get("u"))
+
+	decision = call(url.Values{"mediaId": {"tr-1"}}, `{"directPlayProfiles":[{"containers":["mp4"],"audioCodecs":["aac"]}]}`)
+	require.False(t, decision.CanDirectPlay)
+	require.False(t, decision.CanTranscode)
+	require.NotEmpty(t, decision.ErrorReason)
+}
@@ -0,0 +1,344 @@
+// package searchquery parses structured search queries for search2 and search3, eg.
+//
+//	artist:"Aphex Twin" year:1990..1999 genre:idm rating:>=4 starred:true windowlicker
+//
+// known fields are filters which are turned into DB conditions, and everything else is
+// free text, left for the caller to match however it usually would.
+//
+// fields:
+//
+//	artist, album, title, genre -> substring match, quote values with spaces
+//	year, rating                -> `N`, `=N`, `>N`, `>=N`, `<N`, `<=N`, `A..B`, `A..`, `..B`
+//	starred                     -> `true` or `false`
+package searchquery
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrUnterminatedQuote = errors.New("unterminated quote")
+	ErrEmptyValue        = errors.New("empty value")
+	ErrInvalidNumber     = errors.New("invalid number")
+	ErrInvalidRange      = errors.New("invalid range")
+	ErrInvalidBool       = errors.New("invalid boolean")
+	ErrOutOfRange        = errors.New("out of range")
+)
+
+type Field string
+
+const (
+	FieldArtist  Field = "artist"
+	FieldAlbum   Field = "album"
+	FieldTitle   Field = "title"
+	FieldGenre   Field = "genre"
+	FieldYear    Field = "year"
+	FieldRating  Field = "rating"
+	FieldStarred Field = "starred"
+)
+
+type Op string
+
+const (
+	OpEq  Op = "="
+	OpLt  Op = "<"
+	OpLte Op = "<="
+	OpGt  Op = ">"
+	OpGte Op = ">="
+)
+
+type Cmp struct {
+	Op    Op
+	Value int
+}
+
+type Query struct {
+	Text    string
+	Artist  []string
+	Album   []string
+	Title   []string
+	Genre   []string
+	Year    []Cmp
+	Rating  []Cmp
+	Starred *bool
+}
+
+// HasFilters reports if the query has any field filters, as opposed to only free text
+func (q Query) HasFilters() bool {
+	return len(q.Artist) > 0 || len(q.Album) > 0 || len(q.Title) > 0 || len(q.Genre) > 0 ||
+		len(q.Year) > 0 || len(q.Rating) > 0 || q.Starred != nil
+}
+
+func Parse(in string) (Query, error) {
+	var q Query
+	var text []string
+
+	rs := []rune(in)
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+
+		if rs[i] == '"' {
+			phrase, end, err := readQuoted(rs, i)
+			if err != nil {
+				return Query{}, err
+			}
+			text = append(text, phrase)
+			i = end
+			continue
+		}
+
+		start := i
+		for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != ':' {
+			i++
+		}
+		field := Field(strings.ToLower(string(rs[start:i])))
+		if i >= len(rs) || rs[i] != ':' || !isField(field) {
+			// not a filter, read the rest of the word as free text
+			for i < len(rs) && !unicode.IsSpace(rs[i]) {
+				i++
+			}
+			text = append(text, string(rs[start:i]))
+			continue
+		}
+		i++ // skip ':'
+
+		var value string
+		if i < len(rs) && rs[i] == '"' {
+			var err error
+			if value, i, err = readQuoted(rs, i); err != nil {
+				return Query{}, fmt.Errorf("%s: %w", field, err)
+			}
+		} else {
+			valueStart := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) {
+				i++
+			}
+			value = string(rs[valueStart:i])
+		}
+		if strings.TrimSpace(value) == "" {
+			return Query{}, fmt.Errorf("%s: %w", field, ErrEmptyValue)
+		}
+		if err := q.add(field, value); err != nil {
+			return Query{}, fmt.Errorf("%s: %w", field, err)
+		}
+	}
+
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+func (q *Query) add(field Field, value string) error {
+	switch field {
+	case FieldArtist:
+		q.Artist = append(q.Artist, value)
+	case FieldAlbum:
+		q.Album = append(q.Album, value)
+	case FieldTitle:
+		q.Title = append(q.Title, value)
+	case FieldGenre:
+		q.Genre = append(q.Genre, value)
+	case FieldYear:
+		cmps, err := parseCmps(value, 0, 9999)
+		if err != nil {
+			return err
+		}
+		q.Year = append(q.Year, cmps...)
+	case FieldRating:
+		cmps, err := parseCmps(value, 1, 5)
+		if err != nil {
+			return err
+		}
+		q.Rating = append(q.Rating, cmps...)
+	case FieldStarred:
+		starred, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidBool, value)
+		}
+		q.Starred = &starred
+	}
+	return nil
+}
+
+func isField(f Field) bool {
+	switch f {
+	case FieldArtist, FieldAlbum, FieldTitle, FieldGenre, FieldYear, FieldRating, FieldStarred:
+		return true
+	}
+	return false
+}
+
+// readQuoted reads a quoted string starting at rs[start], returning the contents and the index after the closing quote
+func readQuoted(rs []rune, start int) (string, int, error) {
+	for i := start + 1; i < len(rs); i++ {
+		if rs[i] == '"' {
+			return string(rs[start+1 : i]), i + 1, nil
+		}
+	}
+	return "", 0, ErrUnterminatedQuote
+}
+
+// parseCmps parses a single value, comparison, or inclusive range of numbers between lo and hi
+func parseCmps(value string, lo, hi int) ([]Cmp, error) {
+	if from, to, ok := strings.Cut(value, ".."); ok {
+		if from == "" && to == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRange, value)
+		}
+		var cmps []Cmp
+		var fromN, toN int
+		var err error
+		if from != "" {
+			if fromN, err = parseNumber(from, lo, hi); err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, Cmp{OpGte, fromN})
+		}
+		if to != "" {
+			if toN, err = parseNumber(to, lo, hi); err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, Cmp{OpLte, toN})
+		}
+		if from != "" && to != "" && fromN > toN {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRange, value)
+		}
+		return cmps, nil
+	}
+
+	op := OpEq
+	for _, o := range []Op{OpGte, OpLte, OpGt, OpLt, OpEq} { // longest first
+		if rest, ok := strings.CutPrefix(value, string(o)); ok {
+			op, value = o, rest
+			break
+		}
+	}
+	n, err := parseNumber(value, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	return []Cmp{{op, n}}, nil
+}
+
+func parseNumber(value string, lo, hi int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidNumber, value)
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("%w: %d not between %d and %d", ErrOutOfRange, n, lo, hi)
+	}
+	return n, nil
+}
+
+// Artists adds the query's filters to a query on the artists table. if the query has
+// filters which don't apply to artists, nothing will match
+func (q Query) Artists(tx *gorm.DB, userID int) *gorm.DB {
+	if len(q.Album) > 0 || len(q.Title) > 0 || len(q.Genre) > 0 || len(q.Year) > 0 {
+		return tx.Where(matchNone)
+	}
+	for _, v := range q.Artist {
+		tx = tx.Where("lower(artists.name) LIKE lower(?) ESCAPE '\\' OR lower(artists.name_u_dec) LIKE lower(?) ESCAPE '\\'", like(v), like(v))
+	}
+	for _, c := range q.Rating {
+		tx = tx.Where("artists.id IN (SELECT artist_id FROM artist_ratings WHERE user_id=? AND rating "+string(c.Op)+" ?)", userID, c.Value)
+	}
+	if q.Starred != nil {
+		tx = tx.Where("artists.id "+notIf(!*q.Starred)+"IN (SELECT artist_id FROM artist_stars WHERE user_id=?)", userID)
+	}
+	return tx
+}
+
+// Folders adds the query's filters to a query on the albums table, where the albums are
+// artist folders when browsing by folder. if the query has filters which don't apply to
+// artist folders, nothing will match
+func (q Query) Folders(tx *gorm.DB, userID int) *gorm.DB {
+	if len(q.Album) > 0 || len(q.Title) > 0 || len(q.Genre) > 0 || len(q.Year) > 0 {
+		return tx.Where(matchNone)
+	}
+	for _, v := range q.Artist {
+		tx = tx.Where("lower(albums.right_path) LIKE lower(?) ESCAPE '\\' OR lower(albums.right_path_u_dec) LIKE lower(?) ESCAPE '\\'", like(v), like(v))
+	}
+	return q.albumStarsRatings(tx, userID)
+}
+
+// Albums adds the query's filters to a query on the albums table. if the query has
+// filters which don't apply to albums, nothing will match
+func (q Query) Albums(tx *gorm.DB, userID int) *gorm.DB {
+	if len(q.Title) > 0 {
+		return tx.Where(matchNone)
+	}
+	for _, v := range q.Artist {
+		tx = tx.Where("albums.id IN (SELECT album_artists.album_id FROM album_artists JOIN artists ON artists.id=album_artists.artist_id WHERE lower(artists.name) LIKE lower(?) ESCAPE '\\' OR lower(artists.name_u_dec) LIKE lower(?) ESCAPE '\\')", like(v), like(v))
+	}
+	for _, v := range q.Album {
+		tx = tx.Where("lower(albums.tag_title) LIKE lower(?) ESCAPE '\\' OR lower(albums.tag_title_u_dec) LIKE lower(?) ESCAPE '\\' OR lower(albums.right_path) LIKE lower(?) ESCAPE '\\'", like(v), like(v), like(v))
+	}
+	for _, v := range q.Genre {
+		tx = tx.Where("albums.id IN (SELECT album_genres.album_id FROM album_genres JOIN genres ON genres.id=album_genres.genre_id WHERE lower(genres.name) LIKE lower(?) ESCAPE '\\')", like(v))
+	}
+	for _, c := range q.Year {
+		tx = tx.Where("albums.tag_year "+string(c.Op)+" ?", c.Value)
+	}
+	return q.albumStarsRatings(tx, userID)
+}
+
+func (q Query) albumStarsRatings(tx *gorm.DB, userID int) *gorm.DB {
+	for _, c := range q.Rating {
+		tx = tx.Where("albums.id IN (SELECT album_id FROM album_ratings WHERE user_id=? AND rating "+string(c.Op)+" ?)", userID, c.Value)
+	}
+	if q.Starred != nil {
+		tx = tx.Where("albums.id "+notIf(!*q.Starred)+"IN (SELECT album_id FROM album_stars WHERE user_id=?)", userID)
+	}
+	return tx
+}
+
+// Tracks adds the query's filters to a query on the tracks table. every filter applies
+// to tracks, with the album and year filters matching the track's album
+func (q Query) Tracks(tx *gorm.DB, userID int) *gorm.DB {
+	for _, v := range q.Artist {
+		tx = tx.Where("tracks.id IN (SELECT track_artists.track_id FROM track_artists JOIN artists ON artists.id=track_artists.artist_id WHERE lower(artists.name) LIKE lower(?) ESCAPE '\\' OR lower(artists.name_u_dec) LIKE lower(?) ESCAPE '\\')", like(v), like(v))
+	}
+	for _, v := range q.Album {
+		tx = tx.Where("tracks.album_id IN (SELECT id FROM albums WHERE lower(tag_title) LIKE lower(?) ESCAPE '\\' OR lower(tag_title_u_dec) LIKE lower(?) ESCAPE '\\' OR lower(right_path) LIKE lower(?) ESCAPE '\\')", like(v), like(v), like(v))
+	}
+	for _, v := range q.Title {
+		tx = tx.Where("lower(tracks.tag_title) LIKE lower(?) ESCAPE '\\' OR lower(tracks.tag_title_u_dec) LIKE lower(?) ESCAPE '\\' OR lower(tracks.filename) LIKE lower(?) ESCAPE '\\'", like(v), like(v), like(v))
+	}
+	for _, v := range q.Genre {
+		tx = tx.Where("tracks.id IN (SELECT track_genres.track_id FROM track_genres JOIN genres ON genres.id=track_genres.genre_id WHERE lower(genres.name) LIKE lower(?) ESCAPE '\\')", like(v))
+	}
+	for _, c := range q.Year {
+		tx = tx.Where("tracks.album_id IN (SELECT id FROM albums WHERE tag_year "+string(c.Op)+" ?)", c.Value)
+	}
+	for _, c := range q.Rating {
+		tx = tx.Where("tracks.id IN (SELECT track_id FROM track_ratings WHERE user_id=? AND rating "+string(c.Op)+" ?)", userID, c.Value)
+	}
+	if q.Starred != nil {
+		tx = tx.Where("tracks.id "+notIf(!*q.Starred)+"IN (SELECT track_id FROM track_stars WHERE user_id=?)", userID)
+	}
+	return tx
+}
+
+const matchNone = "0=1"
+
+// likeEscaper escapes LIKE's wildcards in user input. clauses using it need ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func like(v string) string {
+	return "%" + likeEscaper.Replace(v) + "%"
+}
+
+func notIf(b bool) string {
+	if b {
+		return "NOT "
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package searchquery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		in       string
+		expected Query
+	}{
+		{"", Query{}},
+		{"   ", Query{}},
+		{"aphex twin", Query{Text: "aphex twin"}},
+		{`"aphex twin" windowlicker`, Query{Text: "aphex twin windowlicker"}},
+		{"artist:autechre", Query{Artist: []string{"autechre"}}},
+		{`artist:"Aphex Twin"`, Query{Artist: []string{"Aphex Twin"}}},
+		{`ARTIST:"Aphex Twin"`, Query{Artist: []string{"Aphex Twin"}}},
+		{"artist:a artist:b", Query{Artist: []string{"a", "b"}}},
+		{`album:"Selected Ambient Works" title:xtal`, Query{Album: []string{"Selected Ambient Works"}, Title: []string{"xtal"}}},
+		{"genre:idm", Query{Genre: []string{"idm"}}},
+		{"year:1992", Query{Year: []Cmp{{OpEq, 1992}}}},
+		{"year:=1992", Query{Year: []Cmp{{OpEq, 1992}}}},
+		{"year:>1992", Query{Year: []Cmp{{OpGt, 1992}}}},
+		{"year:>=1992", Query{Year: []Cmp{{OpGte, 1992}}}},
+		{"year:<1992", Query{Year: []Cmp{{OpLt, 1992}}}},
+		{"year:<=1992", Query{Year: []Cmp{{OpLte, 1992}}}},
+		{"year:1990..1999", Query{Year: []Cmp{{OpGte, 1990}, {OpLte, 1999}}}},
+		{"year:1990..", Query{Year: []Cmp{{OpGte, 1990}}}},
+		{"year:..1999", Query{Year: []Cmp{{OpLte, 1999}}}},
+		{"year:1999..1999", Query{Year: []Cmp{{OpGte, 1999}, {OpLte, 1999}}}},
+		{"rating:>=4", Query{Rating: []Cmp{{OpGte, 4}}}},
+		{"rating:1..5", Query{Rating: []Cmp{{OpGte, 1}, {OpLte, 5}}}},
+		{"starred:true", Query{Starred: ptr(true)}},
+		{"starred:false", Query{Starred: ptr(false)}},
+		{"starred:1", Query{Starred: ptr(true)}},
+		{
+			`artist:"Aphex Twin" year:1990..1999 genre:idm rating:>=4 starred:true`,
+			Query{
+				Artist:  []string{"Aphex Twin"},
+				Year:    []Cmp{{OpGte, 1990}, {OpLte, 1999}},
+				Genre:   []string{"idm"},
+				Rating:  []Cmp{{OpGte, 4}},
+				Starred: ptr(true),
+			},
+		},
+		{"windowlicker artist:aphex ambient", Query{Text: "windowlicker ambient", Artist: []string{"aphex"}}},
+		{"interlude: part two", Query{Text: "interlude: part two"}}, // unknown fields are free text
+		{"re:stacks", Query{Text: "re:stacks"}},
+		{"ratio:4", Query{Text: "ratio:4"}},
+		{":artist", Query{Text: ":artist"}},
+		{"artist:a:b", Query{Artist: []string{"a:b"}}},
+		{"title:björk", Query{Title: []string{"björk"}}},
+		{"\tartist:a\n", Query{Artist: []string{"a"}}},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.in, func(t *testing.T) {
+			t.Parallel()
+			actual, err := Parse(tc.in)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		in     string
+		err    error
+		errStr string
+	}{
+		{`"aphex twin`, ErrUnterminatedQuote, `unterminated quote`},
+		{`artist:"aphex twin`, ErrUnterminatedQuote, `artist: unterminated quote`},
+		{`artist:`, ErrEmptyValue, `artist: empty value`},
+		{`artist: aphex`, ErrEmptyValue, `artist: empty value`},
+		{`artist:""`, ErrEmptyValue, `artist: empty value`},
+		{`artist:"  "`, ErrEmptyValue, `artist: empty value`},
+		{`year:nineties`, ErrInvalidNumber, `year: invalid number: "nineties"`},
+		{`year:>=`, ErrInvalidNumber, `year: invalid number: ""`},
+		{`year:1990..x`, ErrInvalidNumber, `year: invalid number: "x"`},
+		{`year:..`, ErrInvalidRange, `year: invalid range: ".."`},
+		{`year:1999..1990`, ErrInvalidRange, `year: invalid range: "1999..1990"`},
+		{`year:1990...1999`, ErrInvalidNumber, `year: invalid number: ".1999"`},
+		{`year:-1`, ErrOutOfRange, `year: out of range: -1 not between 0 and 9999`},
+		{`rating:6`, ErrOutOfRange, `rating: out of range: 6 not between 1 and 5`},
+		{`rating:>=0`, ErrOutOfRange, `rating: out of range: 0 not between 1 and 5`},
+		{`rating:0..3`, ErrOutOfRange, `rating: out of range: 0 not between 1 and 5`},
+		{`starred:maybe`, ErrInvalidBool, `starred: invalid boolean: "maybe"`},
+		{`ok artist:a year:abc`, ErrInvalidNumber, `year: invalid number: "abc"`},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.in, func(t *testing.T) {
+			t.Parallel()
+			_, err := Parse(tc.in)
+			require.ErrorIs(t, err, tc.err)
+			require.EqualError(t, err, tc.errStr)
+		})
+	}
+}
+
+func TestHasFilters(t *testing.T) {
+	t.Parallel()
+
+	require.False(t, Query{}.HasFilters())
+	require.False(t, Query{Text: "aphex"}.HasFilters())
+	require.True(t, Query{Artist: []string{"aphex"}}.HasFilters())
+	require.True(t, Query{Year: []Cmp{{OpEq, 1992}}}.HasFilters())
+	require.True(t, Query{Starred: ptr(false)}.HasFilters())
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -3,7 +3,6 @@ package spec
 import (
 	"cmp"
 	"path/filepath"
-	"sort"
 
 	"go.senan.xyz/gonic/db"
 )
@@ -21,8 +20,11 @@ func NewAlbumByFolder(f *db.Album) *Album {
 		Duration:      f.Duration,
 		Created:       f.CreatedAt,
 		AverageRating: formatRating(f.AverageRating),
-		ReleaseTypes:  []string{},
+		Artists:       newArtistRefs(f.Artists),
+		Genres:        newGenreRefs(f.Genres),
+		ReleaseTypes:  formatReleaseTypes(f.TagReleaseType),
 	}
+	a.DisplayArtist = formatDisplayArtist(f.TagAlbumArtist, a.Artists)
 	if f.AlbumStar != nil {
 		a.Starred = &f.AlbumStar.StarDate
 	}
@@ -46,7 +48,13 @@ func NewTCAlbumByFolder(f *db.Album) *TrackChild {
 		CreatedAt:     f.CreatedAt,
 		AverageRating: formatRating(f.AverageRating),
 		Year:          f.TagYear,
+		Artists:       newArtistRefs(f.Artists),
+		Genres:        newGenreRefs(f.Genres),
 	}
+	// the folder's artists are the album artists, for both fields
+	trCh.DisplayArtist = formatDisplayArtist(f.TagAlbumArtist, trCh.Artists)
+	trCh.AlbumArtists = trCh.Artists
+	trCh.AlbumDisplayArtist = trCh.DisplayArtist
 	if f.AlbumStar != nil {
 		trCh.Starred = &f.AlbumStar.StarDate
 	}
@@ -64,14 +72,13 @@ func NewTCAlbumByFolder(f *db.Album) *TrackChild {
 
 func NewTCTrackByFolder(t *db.Track, parent *db.Album) *TrackChild {
 	trCh := &TrackChild{
-		ID:            t.SID(),
-		ContentType:   t.MIME(),
-		Suffix:        formatExt(t.Ext()),
-		Size:          t.Size,
-		DisplayArtist: t.TagTrackArtist,
-		Title:         cmp.Or(t.TagTitle, t.Filename),
-		TrackNumber:   t.TagTrackNumber,
-		DiscNumber:    t.TagDiscNumber,
+		ID:          t.SID(),
+		ContentType: t.MIME(),
+		Suffix:      formatExt(t.Ext()),
+		Size:        t.Size,
+		Title:       cmp.Or(t.TagTitle, t.Filename),
+		TrackNumber: t.TagTrackNumber,
+		DiscNumber:  t.TagDiscNumber,
 		Path: filepath.Join(
 			parent.LeftPath,
 			parent.RightPath,
@@ -86,7 +93,12 @@ func NewTCTrackByFolder(t *db.Track, parent *db.Album) *TrackChild {
 		MusicBrainzID: t.TagBrainzID,
 		CreatedAt:     t.CreatedAt,
 		AverageRating: formatRating(t.AverageRating),
+		Artists:       newArtistRefs(t.Artists),
+		AlbumArtists:  newArtistRefs(parent.Artists),
+		Genres:        newGenreRefs(t.Genres),
 	}
+	trCh.DisplayArtist = formatDisplayArtist(t.TagTrackArtist, trCh.Artists)
+	trCh.AlbumDisplayArtist = formatDisplayArtist(parent.TagAlbumArtist, trCh.AlbumArtists)
 	if trCh.Title == "" {
 		trCh.Title = t.Filename
 	}
@@ -110,22 +122,17 @@ func NewTCTrackByFolder(t *db.Track, parent *db.Album) *TrackChild {
 	if t.TrackRating != nil {
 		trCh.UserRating = t.TrackRating.Rating
 	}
+	if t.TrackPlay != nil {
+		trCh.PlayCount = t.TrackPlay.Count
+		trCh.Played = &t.TrackPlay.Time
+	}
 	if len(t.Genres) > 0 {
 		trCh.Genre = t.Genres[0].Name
 	}
-	for _, g := range t.Genres {
-		trCh.Genres = append(trCh.Genres, &GenreRef{Name: g.Name})
-	}
-	sort.Slice(t.Artists, func(i, j int) bool {
-		return t.Artists[i].ID < t.Artists[j].ID
-	})
 	if len(t.Artists) > 0 {
 		trCh.Artist = t.Artists[0].Name
 		trCh.ArtistID = t.Artists[0].SID()
 	}
-	for _, a := range t.Artists {
-		trCh.Artists = append(trCh.Artists, &ArtistRef{ID: a.SID(), Name: a.Name})
-	}
 	if t.ReplayGainTrackGain != 0 || t.ReplayGainAlbumGain != 0 {
 		trCh.ReplayGain = &ReplayGain{
 			TrackGain: t.ReplayGainTrackGain,
@@ -139,20 +146,24 @@ func NewTCTrackByFolder(t *db.Track, parent *db.Album) *TrackChild {
 
 func NewTCPodcastEpisode(pe *db.PodcastEpisode) *TrackChild {
 	trCh := &TrackChild{
-		ID:          pe.SID(),
-		ContentType: pe.MIME(),
-		Suffix:      pe.Ext(),
-		Size:        pe.Size,
-		Title:       pe.Title,
-		ParentID:    pe.SID(),
-		Duration:    pe.Length,
-		Bitrate:     pe.Bitrate,
-		IsDir:       false,
-		Type:        "podcastepisode",
-		CreatedAt:   pe.CreatedAt,
-		Album:       pe.Album,
-		Artist:      pe.Artist,
-		CoverID:     pe.SID(),
+		ID:            pe.SID(),
+		ContentType:   pe.MIME(),
+		Suffix:        pe.Ext(),
+		Size:          pe.Size,
+		Title:         pe.Title,
+		ParentID:      pe.SID(),
+		Duration:      pe.Length,
+		Bitrate:       pe.Bitrate,
+		IsDir:         false,
+		Type:          "podcastepisode",
+		CreatedAt:     pe.CreatedAt,
+		Album:         pe.Album,
+		Artist:        pe.Artist,
+		Artists:       []*ArtistRef{},
+		DisplayArtist: pe.Artist,
+		AlbumArtists:  []*ArtistRef{},
+		Genres:        []*GenreRef{},
+		CoverID:       pe.SID(),
 	}
 	if pe.Podcast != nil {
 		trCh.ParentID = pe.Podcast.SID()
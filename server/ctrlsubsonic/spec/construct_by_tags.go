@@ -4,6 +4,7 @@ import (
 	"cmp"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"go.senan.xyz/gonic/db"
 )
@@ -12,14 +13,13 @@ func NewAlbumByTags(a *db.Album, artists []*db.Artist) *Album {
 	ret := &Album{
 		ID:            a.SID(),
 		Created:       a.CreatedAt,
-		Artists:       []*ArtistRef{},
-		DisplayArtist: a.TagAlbumArtist,
+		Artists:       newArtistRefs(artists),
 		Title:         a.TagTitle,
 		Album:         a.TagTitle,
 		Name:          a.TagTitle,
 		TrackCount:    a.ChildCount,
 		Duration:      a.Duration,
-		Genres:        []*GenreRef{},
+		Genres:        newGenreRefs(a.Genres),
 		Year:          a.TagYear,
 		Tracks:        []*TrackChild{},
 		AverageRating: formatRating(a.AverageRating),
@@ -38,25 +38,14 @@ func NewAlbumByTags(a *db.Album, artists []*db.Artist) *Album {
 	if a.AlbumRating != nil {
 		ret.UserRating = a.AlbumRating.Rating
 	}
-	sort.Slice(artists, func(i, j int) bool {
-		return artists[i].ID < artists[j].ID
-	})
+	ret.DisplayArtist = formatDisplayArtist(a.TagAlbumArtist, ret.Artists)
 	if len(artists) > 0 {
 		ret.Artist = artists[0].Name
 		ret.ArtistID = artists[0].SID()
 	}
-	for _, a := range artists {
-		ret.Artists = append(ret.Artists, &ArtistRef{
-			ID:   a.SID(),
-			Name: a.Name,
-		})
-	}
 	if len(a.Genres) > 0 {
 		ret.Genre = a.Genres[0].Name
 	}
-	for _, g := range a.Genres {
-		ret.Genres = append(ret.Genres, &GenreRef{Name: g.Name})
-	}
 	if a.Play != nil {
 		ret.PlayCount = a.Play.Count
 	}
@@ -76,30 +65,28 @@ func NewAlbumByTags(a *db.Album, artists []*db.Artist) *Album {
 
 func NewTrackByTags(t *db.Track, album *db.Album) *TrackChild {
 	ret := &TrackChild{
-		ID:                 t.SID(),
-		Album:              album.TagTitle,
-		AlbumID:            album.SID(),
-		Artists:            []*ArtistRef{},
-		DisplayArtist:      t.TagTrackArtist,
-		AlbumArtists:       []*ArtistRef{},
-		AlbumDisplayArtist: album.TagAlbumArtist,
-		Bitrate:            t.Bitrate,
-		ContentType:        t.MIME(),
-		CreatedAt:          t.CreatedAt,
-		Duration:           t.Length,
-		Genres:             []*GenreRef{},
-		ParentID:           t.AlbumSID(),
-		Path:               filepath.Join(album.LeftPath, album.RightPath, t.Filename),
-		Size:               t.Size,
-		Suffix:             formatExt(t.Ext()),
-		Title:              cmp.Or(t.TagTitle, t.Filename),
-		TrackNumber:        t.TagTrackNumber,
-		DiscNumber:         t.TagDiscNumber,
-		Type:               "music",
-		MusicBrainzID:      t.TagBrainzID,
-		Year:               album.TagYear,
-		AverageRating:      formatRating(t.AverageRating),
-		TranscodeMeta:      TranscodeMeta{},
+		ID:            t.SID(),
+		Album:         album.TagTitle,
+		AlbumID:       album.SID(),
+		Artists:       newArtistRefs(t.Artists),
+		AlbumArtists:  newArtistRefs(album.Artists),
+		Bitrate:       t.Bitrate,
+		ContentType:   t.MIME(),
+		CreatedAt:     t.CreatedAt,
+		Duration:      t.Length,
+		Genres:        newGenreRefs(t.Genres),
+		ParentID:      t.AlbumSID(),
+		Path:          filepath.Join(album.LeftPath, album.RightPath, t.Filename),
+		Size:          t.Size,
+		Suffix:        formatExt(t.Ext()),
+		Title:         cmp.Or(t.TagTitle, t.Filename),
+		TrackNumber:   t.TagTrackNumber,
+		DiscNumber:    t.TagDiscNumber,
+		Type:          "music",
+		MusicBrainzID: t.TagBrainzID,
+		Year:          album.TagYear,
+		AverageRating: formatRating(t.AverageRating),
+		TranscodeMeta: TranscodeMeta{},
 	}
 
 	switch {
@@ -117,13 +104,13 @@ func NewTrackByTags(t *db.Track, album *db.Album) *TrackChild {
 	if t.TrackRating != nil {
 		ret.UserRating = t.TrackRating.Rating
 	}
+	if t.TrackPlay != nil {
+		ret.PlayCount = t.TrackPlay.Count
+		ret.Played = &t.TrackPlay.Time
+	}
 
-	sort.Slice(t.Artists, func(i, j int) bool {
-		return t.Artists[i].ID < t.Artists[j].ID
-	})
-	sort.Slice(album.Artists, func(i, j int) bool {
-		return album.Artists[i].ID < album.Artists[j].ID
-	})
+	ret.DisplayArtist = formatDisplayArtist(t.TagTrackArtist, ret.Artists)
+	ret.AlbumDisplayArtist = formatDisplayArtist(album.TagAlbumArtist, ret.AlbumArtists)
 
 	switch {
 	case len(t.Artists) > 0:
@@ -133,18 +120,9 @@ func NewTrackByTags(t *db.Track, album *db.Album) *TrackChild {
 		ret.Artist = album.Artists[0].Name
 		ret.ArtistID = album.Artists[0].SID()
 	}
-	for _, a := range t.Artists {
-		ret.Artists = append(ret.Artists, &ArtistRef{ID: a.SID(), Name: a.Name})
-	}
 	if len(t.Genres) > 0 {
 		ret.Genre = t.Genres[0].Name
 	}
-	for _, g := range t.Genres {
-		ret.Genres = append(ret.Genres, &GenreRef{Name: g.Name})
-	}
-	for _, a := range album.Artists {
-		ret.AlbumArtists = append(ret.AlbumArtists, &ArtistRef{ID: a.SID(), Name: a.Name})
-	}
 	if t.ReplayGainTrackGain != 0 || t.ReplayGainAlbumGain != 0 {
 		ret.ReplayGain = &ReplayGain{
 			TrackGain: t.ReplayGainTrackGain,
@@ -183,3 +161,36 @@ func NewGenre(g *db.Genre) *Genre {
 		SongCount:  g.TrackCount,
 	}
 }
+
+// newArtistRefs sorts the artists by ID so that the first is stable, and never returns nil
+func newArtistRefs(artists []*db.Artist) []*ArtistRef {
+	sort.Slice(artists, func(i, j int) bool {
+		return artists[i].ID < artists[j].ID
+	})
+	refs := make([]*ArtistRef, 0, len(artists))
+	for _, a := range artists {
+		refs = append(refs, &ArtistRef{ID: a.SID(), Name: a.Name})
+	}
+	return refs
+}
+
+func newGenreRefs(genres []*db.Genre) []*GenreRef {
+	refs := make([]*GenreRef, 0, len(genres))
+	for _, g := range genres {
+		refs = append(refs, &GenreRef{Name: g.Name})
+	}
+	return refs
+}
+
+// formatDisplayArtist prefers the artist tag as it was written, which may have
+// its own joining words like "feat.", but falls back to the artists we know of
+func formatDisplayArtist(tag string, artists []*ArtistRef) string {
+	if tag != "" {
+		return tag
+	}
+	names := make([]string, 0, len(artists))
+	for _, a := range artists {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,14 @@
+package spec
+
+import "go.senan.xyz/gonic/db"
+
+func NewChatMessage(m *db.ChatMessage) *ChatMessage {
+	ret := &ChatMessage{
+		Time:    m.CreatedAt.UnixMilli(),
+		Message: m.Message,
+	}
+	if m.User != nil {
+		ret.Username = m.User.Name
+	}
+	return ret
+}
@@ -46,9 +46,11 @@ type Response struct {
 	Directory             *Directory             `xml:"directory"             json:"directory,omitempty"`
 	RandomTracks          *RandomTracks          `xml:"randomSongs"           json:"randomSongs,omitempty"`
 	TracksByGenre         *TracksByGenre         `xml:"songsByGenre"          json:"songsByGenre,omitempty"`
+	TrackList             *TrackList             `xml:"songList"              json:"songList,omitempty"`
 	MusicFolders          *MusicFolders          `xml:"musicFolders"          json:"musicFolders,omitempty"`
 	ScanStatus            *ScanStatus            `xml:"scanStatus"            json:"scanStatus,omitempty"`
 	Licence               *Licence               `xml:"license"               json:"license,omitempty"`
+	SearchResult          *SearchResult          `xml:"searchResult"          json:"searchResult,omitempty"`
 	SearchResultTwo       *SearchResultTwo       `xml:"searchResult2"         json:"searchResult2,omitempty"`
 	SearchResultThree     *SearchResultThree     `xml:"searchResult3"         json:"searchResult3,omitempty"`
 	User                  *User                  `xml:"user"                  json:"user,omitempty"`
@@ -59,6 +61,8 @@ type Response struct {
 	AlbumInfo             *AlbumInfo             `xml:"albumInfo"             json:"albumInfo,omitempty"`
 	Genres                *Genres                `xml:"genres"                json:"genres,omitempty"`
 	PlayQueue             *PlayQueue             `xml:"playQueue"             json:"playQueue,omitempty"`
+	PlayQueueByIndex      *PlayQueueByIndex      `xml:"playQueueByIndex"      json:"playQueueByIndex,omitempty"`
+	PlayQueues            *PlayQueues            `xml:"playQueues"            json:"playQueues,omitempty"`
 	JukeboxStatus         *JukeboxStatus         `xml:"jukeboxStatus"         json:"jukeboxStatus,omitempty"`
 	JukeboxPlaylist       *JukeboxPlaylist       `xml:"jukeboxPlaylist"       json:"jukeboxPlaylist,omitempty"`
 	Podcasts              *Podcasts              `xml:"podcasts"              json:"podcasts,omitempty"`
@@ -72,6 +76,10 @@ type Response struct {
 	InternetRadioStations *InternetRadioStations `xml:"internetRadioStations" json:"internetRadioStations,omitempty"`
 	Lyrics                *Lyrics                `xml:"lyrics"                json:"lyrics,omitempty"`
 	LyricsList            *LyricsList            `xml:"lyricsList"            json:"lyricsList,omitempty"`
+	Videos                *Videos                `xml:"videos"                json:"videos,omitempty"`
+	ChatMessages          *ChatMessages          `xml:"chatMessages"          json:"chatMessages,omitempty"`
+	TranscodeDecision     *TranscodeDecision     `xml:"transcodeDecision"     json:"transcodeDecision,omitempty"`
+	SignedURL             *SignedURL             `xml:"signedUrl"             json:"signedUrl,omitempty"`
 }
 
 func NewResponse() *Response {
@@ -176,6 +184,10 @@ type TracksByGenre struct {
 	List []*TrackChild `xml:"song" json:"song"`
 }
 
+type TrackList struct {
+	List []*TrackChild `xml:"song" json:"song"`
+}
+
 type TranscodeMeta struct {
 	TranscodedContentType string `xml:"transcodedContentType,attr,omitempty" json:"transcodedContentType,omitempty"`
 	TranscodedSuffix      string `xml:"transcodedSuffix,attr,omitempty"      json:"transcodedSuffix,omitempty"`
@@ -230,6 +242,10 @@ type TrackChild struct {
 	UserRating    int        `xml:"userRating,attr,omitempty"      json:"userRating,omitempty"`
 	AverageRating string     `xml:"averageRating,attr,omitempty"   json:"averageRating,omitempty"`
 
+	// plays
+	PlayCount int        `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	Played    *time.Time `xml:"played,attr,omitempty"    json:"played,omitempty"`
+
 	ReplayGain *ReplayGain `xml:"replayGain" json:"replayGain"`
 
 	TranscodeMeta
@@ -291,6 +307,13 @@ type ScanStatus struct {
 	Count    int  `xml:"count,attr,omitempty" json:"count,omitempty"`
 }
 
+// SearchResult is the result of the subsonic v1 `search` endpoint
+type SearchResult struct {
+	Offset    int           `xml:"offset,attr"     json:"offset"`
+	TotalHits int           `xml:"totalHits,attr"  json:"totalHits"`
+	Matches   []*TrackChild `xml:"match,omitempty" json:"match,omitempty"`
+}
+
 type SearchResultTwo struct {
 	Artists []*Directory  `xml:"artist,omitempty" json:"artist,omitempty"`
 	Albums  []*TrackChild `xml:"album,omitempty"  json:"album,omitempty"`
@@ -366,12 +389,28 @@ type Genre struct {
 }
 
 type PlayQueue struct {
-	Current   *specid.ID    `xml:"current,attr,omitempty"  json:"current,omitempty"`
-	Position  int           `xml:"position,attr,omitempty" json:"position,omitempty"`
-	Username  string        `xml:"username,attr"           json:"username"`
-	Changed   time.Time     `xml:"changed,attr"            json:"changed"`
-	ChangedBy string        `xml:"changedBy,attr"          json:"changedBy"`
-	List      []*TrackChild `xml:"entry,omitempty"         json:"entry,omitempty"`
+	Name       string        `xml:"name,attr,omitempty"       json:"name,omitempty"`
+	Current    *specid.ID    `xml:"current,attr,omitempty"    json:"current,omitempty"`
+	Position   int           `xml:"position,attr,omitempty"   json:"position,omitempty"`
+	Username   string        `xml:"username,attr"             json:"username"`
+	Changed    time.Time     `xml:"changed,attr"              json:"changed"`
+	ChangedBy  string        `xml:"changedBy,attr"            json:"changedBy"`
+	EntryCount int           `xml:"entryCount,attr,omitempty" json:"entryCount,omitempty"`
+	List       []*TrackChild `xml:"entry,omitempty"           json:"entry,omitempty"`
+}
+
+type PlayQueues struct {
+	List []*PlayQueue `xml:"playQueue" json:"playQueue"`
+}
+
+type PlayQueueByIndex struct {
+	Name         string        `xml:"name,attr,omitempty"         json:"name,omitempty"`
+	CurrentIndex *int          `xml:"currentIndex,attr,omitempty" json:"currentIndex,omitempty"`
+	Position     int           `xml:"position,attr,omitempty"     json:"position,omitempty"`
+	Username     string        `xml:"username,attr"               json:"username"`
+	Changed      time.Time     `xml:"changed,attr"                json:"changed"`
+	ChangedBy    string        `xml:"changedBy,attr"              json:"changedBy"`
+	List         []*TrackChild `xml:"entry,omitempty"             json:"entry,omitempty"`
 }
 
 type JukeboxStatus struct {
@@ -476,6 +515,43 @@ type InternetRadioStation struct {
 	HomepageURL string     `xml:"homepageUrl,attr" json:"homepageUrl"`
 }
 
+type Videos struct {
+	List []*TrackChild `xml:"video" json:"video"`
+}
+
+type ChatMessages struct {
+	List []*ChatMessage `xml:"chatMessage" json:"chatMessage"`
+}
+
+type ChatMessage struct {
+	Username string `xml:"username,attr" json:"username"`
+	Time     int64  `xml:"time,attr"     json:"time"`
+	Message  string `xml:"message,attr"  json:"message"`
+}
+
+type TranscodeDecision struct {
+	CanDirectPlay   bool           `xml:"canDirectPlay,attr"             json:"canDirectPlay"`
+	CanTranscode    bool           `xml:"canTranscode,attr"              json:"canTranscode"`
+	TranscodeReason []string       `xml:"transcodeReason,omitempty"      json:"transcodeReason,omitempty"`
+	ErrorReason     string         `xml:"errorReason,attr,omitempty"     json:"errorReason,omitempty"`
+	TranscodeParams string         `xml:"transcodeParams,attr,omitempty" json:"transcodeParams,omitempty"`
+	StreamURL       string         `xml:"streamUrl,attr,omitempty"       json:"streamUrl,omitempty"`
+	SourceStream    *StreamDetails `xml:"sourceStream,omitempty"         json:"sourceStream,omitempty"`
+	TranscodeStream *StreamDetails `xml:"transcodeStream,omitempty"      json:"transcodeStream,omitempty"`
+}
+
+type SignedURL struct {
+	URL     string    `xml:"url,attr"     json:"url"`
+	Expires time.Time `xml:"expires,attr" json:"expires"`
+}
+
+type StreamDetails struct {
+	Protocol     string `xml:"protocol,attr"               json:"protocol"`
+	Container    string `xml:"container,attr"              json:"container"`
+	Codec        string `xml:"codec,attr"                  json:"codec"`
+	AudioBitrate int    `xml:"audioBitrate,attr,omitempty" json:"audioBitrate,omitempty"` // bits per second
+}
+
 type Lyrics struct {
 	Value  string `xml:",chardata"             json:"value,omitempty"`
 	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
@@ -519,11 +595,8 @@ func formatExt(ext string) string {
 }
 
 func formatReleaseTypes(types string) []string {
-	parts := strings.Split(types, ",")
-	if len(parts) == 0 {
-		return []string{}
-	}
-	for i, part := range parts {
+	parts := []string{}
+	for part := range strings.SplitSeq(types, ",") {
 		part = strings.TrimSpace(part)
 		if len(part) == 0 {
 			continue
@@ -532,7 +605,7 @@ func formatReleaseTypes(types string) []string {
 		if part == "Ep" {
 			part = "EP"
 		}
-		parts[i] = part
+		parts = append(parts, part)
 	}
 	return parts
 }
@@ -0,0 +1,134 @@
+package transcode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const cacheIndexName = "index.json"
+
+type cacheEntry struct {
+	Key           string    `json:"key"`
+	Source        string    `json:"source,omitempty"` // empty if cached before there was an index
+	SourceModTime time.Time `json:"source_mod_time"`
+	SourceSize    int64     `json:"source_size"`
+	Size          int64     `json:"size"`
+	Accessed      time.Time `json:"accessed"`
+}
+
+// stale is true if the source file has been changed or deleted since it was transcoded
+func (e *cacheEntry) stale() bool {
+	if e.Source == "" {
+		return false
+	}
+	info, err := os.Stat(e.Source)
+	return err != nil || info.Size() != e.SourceSize || !info.ModTime().Equal(e.SourceModTime)
+}
+
+// cacheIndex is the finished transcodes in the cache, with their sizes and when they were last used. it's kept in
+// memory so the cache can be kept to size as transcodes are added, and saved to the cache dir to survive restarts
+type cacheIndex struct {
+	entries map[string]*cacheEntry // by cache key
+	size    int64
+	dirty   bool // changed since it was saved
+}
+
+func (ci *cacheIndex) add(e *cacheEntry) {
+	ci.remove(e.Key)
+	ci.entries[e.Key] = e
+	ci.size += e.Size
+	ci.dirty = true
+}
+
+func (ci *cacheIndex) remove(key string) {
+	if e, ok := ci.entries[key]; ok {
+		delete(ci.entries, key)
+		ci.size -= e.Size
+		ci.dirty = true
+	}
+}
+
+// lru is the entries, least recently used first
+func (ci *cacheIndex) lru() []*cacheEntry {
+	entries := make([]*cacheEntry, 0, len(ci.entries))
+	for _, e := range ci.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Accessed.Before(entries[j].Accessed)
+	})
+	return entries
+}
+
+// loadCacheIndex reads the saved index and makes it agree with what's in the cache dir. files which aren't in the
+// index are kept, with no source to check. they're from before there was an index, or from before a crash. an error
+// reading the saved index is returned along with an index of what's there
+func loadCacheIndex(cachePath string) (*cacheIndex, error) {
+	ci := &cacheIndex{entries: map[string]*cacheEntry{}}
+
+	saved := map[string]*cacheEntry{}
+	var indexErr error
+	switch data, err := os.ReadFile(filepath.Join(cachePath, cacheIndexName)); {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		indexErr = fmt.Errorf("read index: %w", err)
+	default:
+		var entries []*cacheEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			indexErr = fmt.Errorf("unmarshal index: %w", err)
+		}
+		for _, e := range entries {
+			saved[e.Key] = e
+		}
+	}
+
+	des, err := os.ReadDir(cachePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return ci, errors.Join(indexErr, fmt.Errorf("read cache dir: %w", err))
+	}
+	for _, de := range des {
+		name := de.Name()
+		if de.IsDir() || strings.HasPrefix(name, cacheIndexName) {
+			continue
+		}
+		if strings.HasSuffix(name, ".part") {
+			_ = os.Remove(filepath.Join(cachePath, name)) // a transcode that never finished
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		e, ok := saved[name]
+		if !ok {
+			e = &cacheEntry{Key: name, Accessed: info.ModTime()}
+		}
+		e.Size = info.Size()
+		ci.add(e)
+	}
+	ci.dirty = len(ci.entries) != len(saved)
+	return ci, indexErr
+}
+
+// saveCacheIndex writes the index to the cache dir, through a temporary file so that a crash doesn't leave half of it
+func saveCacheIndex(cachePath string, entries []cacheEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("marshal index: %w", err)
+	}
+	path := filepath.Join(cachePath, cacheIndexName)
+	if err := os.WriteFile(path+".tmp", data, perm); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("move index into place: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package transcode
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Format is an audio codec in a container, in the terms clients use to say what they can play
+type Format struct {
+	Container string
+	Codec     string
+}
+
+func (f Format) String() string { return f.Container + "/" + f.Codec }
+
+// we only store a file's extension, so the format is a best guess from that
+var fileFormats = map[string]Format{
+	"mp3":  {"mp3", "mp3"},
+	"flac": {"flac", "flac"},
+	"ogg":  {"ogg", "vorbis"},
+	"oga":  {"ogg", "vorbis"},
+	"opus": {"opus", "opus"},
+	"m4a":  {"mp4", "aac"},
+	"aac":  {"aac", "aac"},
+	"wav":  {"wav", "pcm"},
+	"wma":  {"asf", "wma"},
+	"ape":  {"ape", "ape"},
+	"wv":   {"wv", "wavpack"},
+}
+
+// FileFormat guesses the format of a file from its extension, like ".flac"
+func FileFormat(ext string) (Format, bool) {
+	f, ok := fileFormats[strings.ToLower(strings.TrimPrefix(ext, "."))]
+	return f, ok
+}
+
+type container struct {
+	mime   string
+	suffix string
+	args   string // the ffmpeg muxer and its options
+	codecs []string
+}
+
+var containers = map[string]container{
+	"mp3":    {"audio/mpeg", "mp3", "-f mp3", []string{"mp3"}},
+	"ogg":    {"audio/ogg", "ogg", "-f ogg", []string{"vorbis", "opus", "flac"}},
+	"opus":   {"audio/ogg", "opus", "-f opus", []string{"opus"}},
+	"aac":    {"audio/aac", "aac", "-f adts", []string{"aac"}},
+	"flac":   {"audio/flac", "flac", "-f flac", []string{"flac"}},
+	"wav":    {"audio/wav", "wav", "-f wav", []string{"pcm"}},
+	"mp4":    {"audio/mp4", "m4a", "-movflags frag_keyframe+empty_moov -f mp4", []string{"aac", "mp3", "flac", "opus"}},
+	"mpegts": {"video/mp2t", "ts", "-f mpegts", []string{"aac", "mp3", "opus"}},
+}
+
+// encoders are ffmpeg's encoder for each codec, and whether it's lossless and so has no bit rate
+var encoders = map[string]struct {
+	name     string
+	lossless bool
+}{
+	"mp3":    {"libmp3lame", false},
+	"opus":   {"libopus", false},
+	"vorbis": {"libvorbis", false},
+	"aac":    {"aac", false},
+	"flac":   {"flac", true},
+	"pcm":    {"pcm_s16le", true},
+}
+
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// CanWrite is true if we can produce the format with NewFormatProfile
+func CanWrite(f Format) bool {
+	c, ok := containers[f.Container]
+	if !ok || !slices.Contains(c.codecs, f.Codec) {
+		return false
+	}
+	_, ok = encoders[f.Codec]
+	return ok
+}
+
+// Lossless is true for codecs which don't take a bit rate
+func Lossless(codec string) bool {
+	return encoders[codec].lossless
+}
+
+// NewFormatProfile makes a profile which writes the format. With remux, the audio is copied
+// as it is into the new container, so it must already be in the right codec
+func NewFormatProfile(f Format, bitrate BitRate, remux bool) (Profile, error) {
+	c, ok := containers[f.Container]
+	if !ok || !slices.Contains(c.codecs, f.Codec) {
+		return Profile{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, f)
+	}
+	var codecArgs string
+	switch enc, ok := encoders[f.Codec]; {
+	case remux:
+		codecArgs = "-c:a copy"
+		bitrate = 0
+	case !ok:
+		return Profile{}, fmt.Errorf("%w: can't encode %s", ErrUnsupportedFormat, f.Codec)
+	case enc.lossless:
+		codecArgs = "-c:a " + enc.name
+		bitrate = 0
+	default:
+		codecArgs = "-b:a <bitrate> -c:a " + enc.name
+	}
+	exec := fmt.Sprintf(`ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn %s %s -`, codecArgs, c.args)
+	return NewProfile(c.mime, c.suffix, bitrate, exec), nil
+}
@@ -0,0 +1,279 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrNoSegment = errors.New("no such segment")
+
+// Segmenter cuts transcodes into the numbered segments of an HLS stream. each track is transcoded to mpegts once from
+// the start with the CachingTranscoder, so it's shared with streams of the same profile and kept in the cache under
+// its size limit. a segment is the part of that between the packets where its time range starts, so the segments
+// follow on from each other exactly, with none of the gaps or clicks of encoding each one on its own
+type Segmenter struct {
+	transcoder    *CachingTranscoder
+	segmentLength time.Duration
+	idleTimeout   time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*segmentJob // by cache key
+}
+
+// NewSegmenter makes a Segmenter which stops following a transcode once nobody has asked for its segments in
+// idleTimeout. if nothing else is reading it, like a stream of the same track, the transcode is cancelled too
+func NewSegmenter(t *CachingTranscoder, segmentLength, idleTimeout time.Duration) *Segmenter {
+	return &Segmenter{
+		transcoder:    t,
+		segmentLength: segmentLength,
+		idleTimeout:   idleTimeout,
+		jobs:          map[string]*segmentJob{},
+	}
+}
+
+// Segment writes segment n of the transcode of in, waiting until the transcode has got that far. it returns
+// ErrNoSegment if the transcode ends before then
+func (s *Segmenter) Segment(ctx context.Context, profile Profile, in string, n int, out io.Writer) error {
+	name, args, err := parseProfile(profile, in)
+	if err != nil {
+		return fmt.Errorf("split command: %w", err)
+	}
+	key := cacheKey(name, args)
+
+	s.mu.Lock()
+	job, ok := s.jobs[key]
+	if ok && job.failed() {
+		s.removeLocked(key, job) // try again
+		ok = false
+	}
+	if !ok {
+		job = s.start(ctx, key, profile, in)
+	}
+	job.waiters++
+	if job.idle != nil {
+		job.idle.Stop()
+	}
+	s.mu.Unlock()
+
+	defer s.leave(key, job)
+
+	start, end, err := job.wait(ctx, n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		// the first segment starts with the tables describing the stream, the rest need a copy of them
+		_, _ = out.Write(job.header)
+	}
+	_, _ = io.Copy(out, io.NewSectionReader(job.tr, start, end-start))
+	return nil
+}
+
+// start opens the transcode and finds its segments in the background. like the CachingTranscoder, it keeps the values
+// of the first request's context but not its cancellation, since the rest of the segments will be asked for soon.
+// must be called with s.mu held
+func (s *Segmenter) start(reqCtx context.Context, key string, profile Profile, in string) *segmentJob {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(reqCtx))
+	job := &segmentJob{
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+	s.jobs[key] = job
+
+	go func() {
+		defer cancel()
+		tr, err := s.transcoder.Open(ctx, profile, in)
+		if err != nil {
+			job.finish(0, fmt.Errorf("open transcode: %w", err))
+			return
+		}
+		job.tr = tr
+		job.finish(s.scan(ctx, job, tr))
+
+		// segments are read from the transcode until the job is removed
+		<-ctx.Done()
+		_ = tr.Close()
+	}()
+	return job
+}
+
+// scan reads the transcode's packets as they're written, and notes where each segment starts
+func (s *Segmenter) scan(ctx context.Context, job *segmentJob, tr *Transcoding) (int64, error) {
+	segmentTicks := int64(s.segmentLength) * ptsHz / int64(time.Second)
+
+	buf := make([]byte, 256*packetSize)
+	var header []byte
+	var offset int64
+	var streamPID int
+	var firstPTS, segments int64 = -1, 0
+	for {
+		size, _, err := tr.Wait(ctx, offset+packetSize)
+		if err != nil {
+			return offset, err
+		}
+		if size < offset+packetSize {
+			return size, nil // anything left over isn't a whole packet
+		}
+		n, err := tr.ReadAt(buf[:min(int64(len(buf)), size-offset)/packetSize*packetSize], offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return offset, fmt.Errorf("read transcode: %w", err)
+		}
+
+		for i := 0; i+packetSize <= n; i, offset = i+packetSize, offset+packetSize {
+			packet := buf[i : i+packetSize]
+			pid, pts, ok := pesTimestamp(packet)
+			switch {
+			case !ok:
+				if firstPTS < 0 {
+					header = append(header, packet...)
+				}
+			case firstPTS < 0:
+				streamPID, firstPTS = pid, pts
+				job.setHeader(header)
+				job.addStart(0)
+				segments = 1
+			case pid == streamPID:
+				// the timestamps are 33 bits and wrap around
+				for (pts-firstPTS)&(1<<33-1) >= segments*segmentTicks {
+					job.addStart(offset)
+					segments++
+				}
+			}
+		}
+	}
+}
+
+func (s *Segmenter) leave(key string, job *segmentJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.waiters--
+	if job.waiters > 0 {
+		return
+	}
+	if s.jobs[key] != job {
+		job.cancel() // removed while we were reading it
+		return
+	}
+	job.idle = time.AfterFunc(s.idleTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.jobs[key] == job && job.waiters == 0 {
+			s.removeLocked(key, job)
+		}
+	})
+}
+
+// removeLocked forgets a job, and stops it now if nobody is reading its segments, otherwise once they're done. must be
+// called with s.mu held
+func (s *Segmenter) removeLocked(key string, job *segmentJob) {
+	delete(s.jobs, key)
+	if job.waiters == 0 {
+		job.cancel()
+	}
+}
+
+// segmentJob follows a transcode, finding where its segments start. a segment is ready once the next one has started
+type segmentJob struct {
+	tr      *Transcoding // set before the first segment is ready
+	header  []byte       // set before the second segment is ready
+	cancel  context.CancelFunc
+	waiters int         // guarded by the Segmenter's mu
+	idle    *time.Timer // guarded by the Segmenter's mu
+
+	mu      sync.Mutex
+	starts  []int64 // offsets of the segments
+	end     int64   // size of the transcode, once done
+	done    bool
+	err     error
+	changed chan struct{} // closed and replaced when a segment starts, and when done
+}
+
+func (j *segmentJob) setHeader(header []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.header = header
+}
+
+func (j *segmentJob) addStart(offset int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.starts = append(j.starts, offset)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *segmentJob) finish(end int64, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done = true
+	j.end = end
+	j.err = err
+	close(j.changed)
+}
+
+func (j *segmentJob) failed() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done && j.err != nil
+}
+
+// wait returns the offsets of segment n in the transcode once it's finished
+func (j *segmentJob) wait(ctx context.Context, n int) (int64, int64, error) {
+	for {
+		j.mu.Lock()
+		starts, end, done, err, changed := j.starts, j.end, j.done, j.err, j.changed
+		j.mu.Unlock()
+
+		switch {
+		case n+1 < len(starts):
+			return starts[n], starts[n+1], nil
+		case done && err != nil:
+			return 0, 0, err
+		case done && n < len(starts):
+			return starts[n], end, nil
+		case done:
+			return 0, 0, ErrNoSegment
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		}
+	}
+}
+
+const (
+	packetSize = 188    // of mpegts
+	ptsHz      = 90_000 // mpegts timestamps are in 90kHz ticks
+)
+
+// pesTimestamp returns the stream and presentation timestamp of an mpegts packet which starts a PES packet with one
+func pesTimestamp(packet []byte) (pid int, pts int64, ok bool) {
+	if len(packet) < packetSize || packet[0] != 0x47 || packet[1]&0x40 == 0 {
+		return 0, 0, false
+	}
+	pid = int(packet[1]&0x1f)<<8 | int(packet[2])
+	var payload []byte
+	switch packet[3] >> 4 & 0x3 {
+	case 0x1: // payload only
+		payload = packet[4:]
+	case 0x3: // adaptation field then payload
+		if 5+int(packet[4]) > packetSize {
+			return 0, 0, false
+		}
+		payload = packet[5+int(packet[4]):]
+	default:
+		return 0, 0, false
+	}
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[7]&0x80 == 0 {
+		return 0, 0, false
+	}
+	pts = int64(payload[9]>>1&0x07)<<30 | int64(payload[10])<<22 | int64(payload[11]>>1)<<15 | int64(payload[12])<<7 | int64(payload[13]>>1)
+	return pid, pts, true
+}
@@ -8,7 +8,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
+	"os"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/shlex"
@@ -18,6 +24,15 @@ type Transcoder interface {
 	Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error
 }
 
+// CacheOpener is a Transcoder which keeps finished transcodes, and can open them and those in progress to be served
+// with ranges
+type CacheOpener interface {
+	OpenCached(profile Profile, in string) (*os.File, error)
+	OpenRunning(ctx context.Context, profile Profile, in string) (*Transcoding, error)
+}
+
+// UserProfiles are the profiles users can pick, the built in ones and any from the config. it's only changed at
+// startup. profiles from the database can change while running, so they're kept apart. see LookupProfile
 var UserProfiles = map[string]Profile{
 	"mp3":          MP3,
 	"mp3_320":      MP3320,
@@ -31,7 +46,7 @@ var UserProfiles = map[string]Profile{
 	"opus_192":     Opus192,
 }
 
-// Store as simple strings, since we may let the user provide their own profiles soon
+// Store as simple strings, so that users can provide their own profiles too. see ParseUserProfile
 var (
 	MP3    = NewProfile("audio/mpeg", "mp3", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libmp3lame -f mp3 -`)
 	MP3320 = NewProfile("audio/mpeg", "mp3", 320, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libmp3lame -f mp3 -`)
@@ -50,6 +65,15 @@ var (
 	PCM16le = NewProfile("audio/wav", "wav", 0, `ffmpeg -v 0 -i <file> -ss <seek> -c:a pcm_s16le -ac 2 -ar 48000 -f s16le -`)
 )
 
+// HLS transcodes a whole track to mpegts, for a Segmenter to cut into the segments of an HLS stream
+var HLS = NewProfile("video/mp2t", "ts", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a aac -f mpegts -`)
+
+// HLSBitRates are the variants offered for adaptive streaming when the client doesn't ask for any
+var HLSBitRates = []BitRate{64, 128, 256}
+
+// HLSSegmentLength is the length of each segment of an HLS stream, apart from the last
+var HLSSegmentLength = 10 * time.Second
+
 type BitRate uint // kilobits/s
 
 type Profile struct {
@@ -65,6 +89,9 @@ func (p *Profile) Seek() time.Duration { return p.seek }
 func (p *Profile) Suffix() string      { return p.suffix }
 func (p *Profile) MIME() string        { return p.mime }
 
+// Segmentable is true if the profile makes mpegts, which a Segmenter can cut into HLS segments
+func (p *Profile) Segmentable() bool { return p.mime == HLS.mime }
+
 func NewProfile(mime string, suffix string, bitrate BitRate, exec string) Profile {
 	return Profile{mime: mime, suffix: suffix, bitrate: bitrate, exec: exec}
 }
@@ -79,8 +106,122 @@ func WithSeek(p Profile, seek time.Duration) Profile {
 	return p
 }
 
+var dbProfiles atomic.Pointer[map[string]Profile]
+
+// SetDBProfiles replaces the user profiles from the database
+func SetDBProfiles(profiles map[string]Profile) {
+	dbProfiles.Store(&profiles)
+}
+
+// LookupProfile finds a user profile by name, from UserProfiles or the database
+func LookupProfile(name string) (Profile, bool) {
+	if profile, ok := UserProfiles[name]; ok {
+		return profile, true
+	}
+	if profiles := dbProfiles.Load(); profiles != nil {
+		profile, ok := (*profiles)[name]
+		return profile, ok
+	}
+	return Profile{}, false
+}
+
+// ProfileNames is the names of every user profile, sorted
+func ProfileNames() []string {
+	names := slices.Collect(maps.Keys(UserProfiles))
+	if profiles := dbProfiles.Load(); profiles != nil {
+		for name := range *profiles {
+			if _, ok := UserProfiles[name]; !ok {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
 var ErrNoProfileParts = fmt.Errorf("not enough profile parts")
 
+// ParseUserProfile parses a profile from the config, in the form "<name> <mime> <suffix> <bitrate> <exec>". For example
+//
+//	flac_16 audio/flac flac 0 ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -c:a flac -sample_fmt s16 -f flac -
+//
+// Profiles which make mpegts, with the mime type video/mp2t, are also used for HLS, see Segmenter
+func ParseUserProfile(in string) (string, Profile, error) {
+	name, mime, suffix, bitrate, exec, err := splitProfile(in, "exec")
+	if err != nil {
+		return "", Profile{}, err
+	}
+	profile, err := NewUserProfile(name, mime, suffix, bitrate, exec)
+	if err != nil {
+		return "", Profile{}, err
+	}
+	return name, profile, nil
+}
+
+// ParseFFmpegProfile parses a profile added on the web, in the form "<name> <mime> <suffix> <bitrate> <args>", where
+// args are only the arguments to ffmpeg. see NewFFmpegProfile
+func ParseFFmpegProfile(in string) (string, string, Profile, error) {
+	name, mime, suffix, bitrate, args, err := splitProfile(in, "args")
+	if err != nil {
+		return "", "", Profile{}, err
+	}
+	profile, err := NewFFmpegProfile(name, mime, suffix, bitrate, args)
+	if err != nil {
+		return "", "", Profile{}, err
+	}
+	return name, args, profile, nil
+}
+
+func splitProfile(in string, last string) (name, mime, suffix string, bitrate BitRate, rest string, err error) {
+	var parts []string
+	rest = strings.TrimSpace(in)
+	for range 4 {
+		part, r, _ := strings.Cut(rest, " ")
+		parts, rest = append(parts, part), strings.TrimSpace(r)
+	}
+	name, mime, suffix, bitrateStr := parts[0], parts[1], parts[2], parts[3]
+	if name == "" || rest == "" {
+		return "", "", "", 0, "", fmt.Errorf("expected \"<name> <mime> <suffix> <bitrate> <%s>\": %w", last, ErrNoProfileParts)
+	}
+	b, err := strconv.ParseUint(bitrateStr, 10, 32)
+	if err != nil {
+		return "", "", "", 0, "", fmt.Errorf("invalid bitrate %q: %w", bitrateStr, err)
+	}
+	return name, mime, suffix, BitRate(b), rest, nil
+}
+
+// NewUserProfile makes a profile from its parts, checking that the exec can be run
+func NewUserProfile(name, mime, suffix string, bitrate BitRate, exec string) (Profile, error) {
+	if name == "" || exec == "" {
+		return Profile{}, ErrNoProfileParts
+	}
+	if !strings.Contains(mime, "/") {
+		return Profile{}, fmt.Errorf("invalid mime type %q", mime)
+	}
+	profile := NewProfile(mime, suffix, bitrate, exec)
+	if !strings.Contains(exec, "<file>") {
+		return Profile{}, fmt.Errorf("exec for %q doesn't read a <file>", name)
+	}
+	if _, _, err := parseProfile(profile, ""); err != nil {
+		return Profile{}, fmt.Errorf("parse exec for %q: %w", name, err)
+	}
+	return profile, nil
+}
+
+// NewFFmpegProfile makes a profile which runs ffmpeg with args. unlike with NewUserProfile, the command can't be
+// picked, and ffmpeg must write to stdout. it's for profiles added on the web, so that admins there can't run anything
+// they like on the host
+func NewFFmpegProfile(name, mime, suffix string, bitrate BitRate, args string) (Profile, error) {
+	parts, err := shlex.Split(args)
+	if err != nil {
+		return Profile{}, fmt.Errorf("split args for %q: %w", name, err)
+	}
+	if len(parts) == 0 || parts[len(parts)-1] != "-" {
+		return Profile{}, fmt.Errorf("args for %q don't write to stdout, they should end with -", name)
+	}
+	return NewUserProfile(name, mime, suffix, bitrate, "ffmpeg "+args)
+}
+
 func parseProfile(profile Profile, in string) (string, []string, error) {
 	parts, err := shlex.Split(profile.exec)
 	if err != nil {
@@ -8,6 +8,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -104,6 +106,88 @@ func TestTranscodeWithSeek(t *testing.T) {
 	require.Equal(t, (testFileLen-seekSecs)*bytesPerSec, buf.Len())
 }
 
+func TestParseUserProfile(t *testing.T) {
+	t.Parallel()
+
+	name, profile, err := transcode.ParseUserProfile("flac_16  audio/flac flac 0 ffmpeg -v 0 -i <file> -ss <seek> -c:a flac -sample_fmt s16 -f flac -")
+	require.NoError(t, err)
+	require.Equal(t, "flac_16", name)
+	require.Equal(t, "audio/flac", profile.MIME())
+	require.Equal(t, "flac", profile.Suffix())
+	require.Equal(t, transcode.BitRate(0), profile.BitRate())
+	require.False(t, profile.Segmentable())
+
+	_, profile, err = transcode.ParseUserProfile("hls_aac video/mp2t ts 96 ffmpeg -v 0 -i <file> -ss <seek> -c:a aac -b:a <bitrate> -f mpegts -")
+	require.NoError(t, err)
+	require.True(t, profile.Segmentable())
+
+	for _, in := range []string{
+		"",
+		"flac_16 audio/flac flac 0",
+		"flac_16 flac flac 0 ffmpeg -i <file> -",
+		"flac_16 audio/flac flac lossless ffmpeg -i <file> -",
+		"flac_16 audio/flac flac 0 ffmpeg -i input.flac -",
+		"flac_16 audio/flac flac 0 not-a-real-transcoder -i <file> -",
+		`flac_16 audio/flac flac 0 ffmpeg -i <file> -metadata "unclosed -`,
+	} {
+		_, _, err := transcode.ParseUserProfile(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestParseFFmpegProfile(t *testing.T) {
+	t.Parallel()
+
+	name, args, profile, err := transcode.ParseFFmpegProfile("flac_16 audio/flac flac 0 -v 0 -i <file> -ss <seek> -c:a flac -f flac -")
+	require.NoError(t, err)
+	require.Equal(t, "flac_16", name)
+	require.Equal(t, "-v 0 -i <file> -ss <seek> -c:a flac -f flac -", args)
+	require.Equal(t, "audio/flac", profile.MIME())
+
+	for _, in := range []string{
+		"",
+		"flac_16 audio/flac flac 0",
+		"flac_16 audio/flac flac 0 -i input.flac -",
+		"flac_16 audio/flac flac 0 -i <file> -f flac out.flac",
+		`flac_16 audio/flac flac 0 -i <file> -metadata "unclosed -`,
+	} {
+		_, _, _, err := transcode.ParseFFmpegProfile(in)
+		require.Error(t, err, in)
+	}
+}
+
+func TestLookupProfile(t *testing.T) {
+	// not parallel, the database profiles are global
+	t.Cleanup(func() { transcode.SetDBProfiles(nil) })
+
+	_, ok := transcode.LookupProfile("flac_16")
+	require.False(t, ok)
+
+	flac, err := transcode.NewUserProfile("flac_16", "audio/flac", "flac", 0, "ffmpeg -v 0 -i <file> -c:a flac -f flac -")
+	require.NoError(t, err)
+	other, err := transcode.NewUserProfile("opus", "audio/ogg", "opus", 64, "ffmpeg -v 0 -i <file> -b:a <bitrate> -f opus -")
+	require.NoError(t, err)
+	transcode.SetDBProfiles(map[string]transcode.Profile{"flac_16": flac, "opus": other})
+
+	profile, ok := transcode.LookupProfile("flac_16")
+	require.True(t, ok)
+	require.Equal(t, "flac", profile.Suffix())
+
+	// the built in profiles win
+	profile, ok = transcode.LookupProfile("opus")
+	require.True(t, ok)
+	require.Equal(t, transcode.Opus, profile)
+
+	names := transcode.ProfileNames()
+	require.True(t, slices.IsSorted(names))
+	require.Len(t, names, len(transcode.UserProfiles)+1)
+	require.Contains(t, names, "flac_16")
+
+	transcode.SetDBProfiles(nil)
+	_, ok = transcode.LookupProfile("flac_16")
+	require.False(t, ok)
+}
+
 func TestCachingParallelism(t *testing.T) {
 	t.Parallel()
 
@@ -129,6 +213,441 @@ func TestCachingParallelism(t *testing.T) {
 	require.Equal(t, 1, int(realTranscodeCount.Load()))
 }
 
+func TestSegmenter(t *testing.T) {
+	t.Parallel()
+
+	var realTranscodeCount atomic.Uint64
+	transcoder := callbackTranscoder{
+		transcoder: transcode.NewFFmpegTranscoder(),
+		callback:   func() { realTranscodeCount.Add(1) },
+	}
+
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, t.TempDir(), 1024)
+	segmenter := transcode.NewSegmenter(cacheTranscoder, 2*time.Second, time.Minute)
+
+	// the segments all come from one transcode, however they're asked for
+	order := []int{2, 0, 1, 0}
+	segments := make([][]byte, len(order))
+	var wg sync.WaitGroup
+	for i, n := range order {
+		wg.Go(func() {
+			var buf bytes.Buffer
+			require.NoError(t, segmenter.Segment(context.Background(), transcode.HLS, "testdata/5s.flac", n, &buf))
+			segments[i] = buf.Bytes()
+		})
+	}
+	wg.Wait()
+
+	for _, segment := range segments {
+		require.NotEmpty(t, segment)
+		require.Equal(t, byte(0x47), segment[0]) // mpegts sync byte
+	}
+	require.Equal(t, segments[1], segments[3])
+	require.NotEqual(t, segments[0], segments[1])
+
+	err := segmenter.Segment(context.Background(), transcode.HLS, "testdata/5s.flac", 3, io.Discard)
+	require.ErrorIs(t, err, transcode.ErrNoSegment)
+
+	// and a stream of the same transcode comes from the cache
+	require.NoError(t, cacheTranscoder.Transcode(context.Background(), transcode.HLS, "testdata/5s.flac", io.Discard))
+	require.Equal(t, 1, int(realTranscodeCount.Load()))
+}
+
+func TestSegmenterCuts(t *testing.T) {
+	t.Parallel()
+
+	in := sourceFile(t)
+	transcoder := &tsTranscoder{}
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, t.TempDir(), 1024)
+	segmenter := transcode.NewSegmenter(cacheTranscoder, 2*time.Second, time.Minute)
+
+	segment := func(n int) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, segmenter.Segment(context.Background(), transcode.HLS, in, n, &buf))
+		return buf.Bytes()
+	}
+	packets := func(from, to int) []byte { return tsStream[from*tsPacketSize : to*tsPacketSize] }
+
+	// two packets of tables, then two packets every half second. segments after the first start with the tables too
+	require.Equal(t, packets(0, 10), segment(0))
+	require.Equal(t, slices.Concat(packets(0, 2), packets(10, 18)), segment(1))
+	require.Equal(t, slices.Concat(packets(0, 2), packets(18, 22)), segment(2))
+
+	err := segmenter.Segment(context.Background(), transcode.HLS, in, 3, io.Discard)
+	require.ErrorIs(t, err, transcode.ErrNoSegment)
+
+	var buf bytes.Buffer
+	require.NoError(t, cacheTranscoder.Transcode(context.Background(), transcode.HLS, in, &buf))
+	require.Equal(t, tsStream, buf.Bytes())
+	require.Equal(t, 1, int(transcoder.count.Load()))
+}
+
+func TestSegmenterIdle(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	transcoder := &tsTranscoder{hold: true}
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, cacheDir, 1024)
+	segmenter := transcode.NewSegmenter(cacheTranscoder, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, segmenter.Segment(context.Background(), transcode.HLS, "in", 0, io.Discard))
+
+	// once nobody asks for more segments, the transcode is cancelled and nothing is cached
+	require.Eventually(t, transcoder.cancelled.Load, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(cacheDir)
+		return len(entries) == 0
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, segmenter.Segment(context.Background(), transcode.HLS, "in", 1, io.Discard))
+	require.Equal(t, 2, int(transcoder.count.Load()))
+}
+
+func TestCachingSharedInProgress(t *testing.T) {
+	t.Parallel()
+
+	in := sourceFile(t)
+	transcoder := newGateTranscoder()
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, t.TempDir(), 1024)
+
+	first, firstCancel := context.WithCancel(context.Background())
+	defer firstCancel()
+
+	var wg sync.WaitGroup
+	var firstOut, secondOut syncBuffer
+	wg.Go(func() {
+		_ = cacheTranscoder.Transcode(first, testProfile, in, &firstOut)
+	})
+	transcoder.write("abc")
+	require.Eventually(t, func() bool { return firstOut.String() == "abc" }, time.Second, time.Millisecond)
+
+	// the second reader starts straight away with what's been written so far
+	wg.Go(func() {
+		require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, in, &secondOut))
+	})
+	require.Eventually(t, func() bool { return secondOut.String() == "abc" }, time.Second, time.Millisecond)
+
+	// and the first going away doesn't stop it for the second
+	firstCancel()
+	transcoder.write("def")
+	transcoder.finish(nil)
+	wg.Wait()
+
+	require.Equal(t, "abcdef", secondOut.String())
+	require.Equal(t, 1, int(transcoder.count.Load()))
+
+	// then it's from the cache
+	var buf bytes.Buffer
+	require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, in, &buf))
+	require.Equal(t, "abcdef", buf.String())
+	require.Equal(t, 1, int(transcoder.count.Load()))
+
+	// which can be opened to serve ranges
+	cf, err := cacheTranscoder.OpenCached(testProfile, in)
+	require.NoError(t, err)
+	defer cf.Close()
+	cached, err := io.ReadAll(cf)
+	require.NoError(t, err)
+	require.Equal(t, "abcdef", string(cached))
+
+	_, err = cacheTranscoder.OpenCached(testProfile, "other")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCachingAbandoned(t *testing.T) {
+	t.Parallel()
+
+	transcoder := newGateTranscoder()
+	cacheDir := t.TempDir()
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, cacheDir, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cacheTranscoder.Transcode(ctx, testProfile, "in", io.Discard)
+	}()
+	transcoder.write("abc")
+
+	// with nobody left reading, the transcode is cancelled and nothing is cached
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(cacheDir)
+		return len(entries) == 0
+	}, time.Second, time.Millisecond)
+
+	transcoder.finish(nil)
+	require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, "in", io.Discard))
+	require.Equal(t, 2, int(transcoder.count.Load()))
+}
+
+func TestLimitedFairQueue(t *testing.T) {
+	t.Parallel()
+
+	transcoder := newHoldTranscoder()
+	limited := transcode.NewLimitedTranscoder(transcoder, 1)
+
+	errs := map[string]chan error{}
+	start := func(user, in string, expQueued int) {
+		t.Helper()
+		errc := make(chan error, 1)
+		errs[in] = errc
+		go func() {
+			errc <- limited.Transcode(transcode.WithUser(context.Background(), user), testProfile, in, io.Discard)
+		}()
+		require.Eventually(t, func() bool {
+			return limited.Stats().Running+limited.Stats().Queued == len(errs) && limited.Stats().Queued == expQueued
+		}, time.Second, time.Millisecond)
+	}
+	tracks := func() []string {
+		var tracks []string
+		for _, job := range limited.Jobs() {
+			tracks = append(tracks, job.Track)
+		}
+		return tracks
+	}
+
+	start("alice", "a1", 0)
+	start("alice", "a2", 1)
+	start("alice", "a3", 2)
+	start("bob", "b1", 3)
+
+	// alice has more queued, but bob gets the next turn after her
+	require.Equal(t, []string{"a1", "a2", "b1", "a3"}, tracks())
+	jobs := limited.Jobs()
+	require.True(t, jobs[0].Running)
+	require.Equal(t, "alice", jobs[0].User)
+	for i, job := range jobs[1:] {
+		require.False(t, job.Running)
+		require.Equal(t, i+1, job.Position)
+	}
+	require.Equal(t, transcode.Stats{Limit: 1, Running: 1, Queued: 3}, limited.Stats())
+
+	transcoder.release("a1")
+	require.NoError(t, <-errs["a1"])
+	require.Eventually(t, func() bool { return transcoder.started("a2") }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"a2", "b1", "a3"}, tracks())
+
+	// a queued job can be cancelled without it ever running
+	require.True(t, limited.Cancel(jobs[3].ID))
+	require.ErrorIs(t, <-errs["a3"], transcode.ErrJobCancelled)
+	require.False(t, transcoder.started("a3"))
+
+	transcoder.release("a2")
+	require.NoError(t, <-errs["a2"])
+	require.Eventually(t, func() bool { return transcoder.started("b1") }, time.Second, time.Millisecond)
+
+	// and so can a running one
+	require.True(t, limited.Cancel(jobs[2].ID))
+	require.ErrorIs(t, <-errs["b1"], transcode.ErrJobCancelled)
+	require.False(t, limited.Cancel(jobs[2].ID))
+
+	require.Empty(t, limited.Jobs())
+	require.Equal(t, transcode.Stats{Limit: 1}, limited.Stats())
+}
+
+func TestLimitedLowPriority(t *testing.T) {
+	t.Parallel()
+
+	transcoder := newHoldTranscoder()
+	limited := transcode.NewLimitedTranscoder(transcoder, 1)
+
+	var wg sync.WaitGroup
+	start := func(ctx context.Context, in string, expQueued int) {
+		t.Helper()
+		wg.Go(func() {
+			require.NoError(t, limited.Transcode(ctx, testProfile, in, io.Discard))
+		})
+		require.Eventually(t, func() bool { return limited.Stats().Queued == expQueued }, time.Second, time.Millisecond)
+	}
+
+	start(transcode.WithUser(context.Background(), "alice"), "live-1", 0)
+	require.Eventually(t, func() bool { return transcoder.started("live-1") }, time.Second, time.Millisecond)
+	start(transcode.WithLowPriority(context.Background()), "warm", 1)
+	start(transcode.WithUser(context.Background(), "bob"), "live-2", 2)
+
+	// the low priority job came first, but waits for the live one
+	jobs := limited.Jobs()
+	require.Equal(t, "live-2", jobs[1].Track)
+	require.Equal(t, "warm", jobs[2].Track)
+	require.True(t, jobs[2].LowPriority)
+	require.Equal(t, 2, jobs[2].Position)
+
+	transcoder.release("live-1")
+	require.Eventually(t, func() bool { return transcoder.started("live-2") }, time.Second, time.Millisecond)
+	require.False(t, transcoder.started("warm"))
+
+	transcoder.release("live-2")
+	require.Eventually(t, func() bool { return transcoder.started("warm") }, time.Second, time.Millisecond)
+	transcoder.release("warm")
+	wg.Wait()
+}
+
+func TestLimitedLowPriorityKeepsSlotFree(t *testing.T) {
+	t.Parallel()
+
+	transcoder := newHoldTranscoder()
+	limited := transcode.NewLimitedTranscoder(transcoder, 2)
+
+	var wg sync.WaitGroup
+	start := func(ctx context.Context, in string, expRunning, expQueued int) {
+		t.Helper()
+		wg.Go(func() {
+			require.NoError(t, limited.Transcode(ctx, testProfile, in, io.Discard))
+		})
+		require.Eventually(t, func() bool {
+			stats := limited.Stats()
+			return stats.Running == expRunning && stats.Queued == expQueued
+		}, time.Second, time.Millisecond)
+	}
+
+	// a slot is free, but the warm jobs only get one of the two
+	start(transcode.WithLowPriority(context.Background()), "warm-1", 1, 0)
+	start(transcode.WithLowPriority(context.Background()), "warm-2", 1, 1)
+	require.Eventually(t, func() bool { return transcoder.started("warm-1") }, time.Second, time.Millisecond)
+	require.False(t, transcoder.started("warm-2"))
+
+	// so a live one starts straight away
+	start(transcode.WithUser(context.Background(), "alice"), "live", 2, 1)
+	require.Eventually(t, func() bool { return transcoder.started("live") }, time.Second, time.Millisecond)
+
+	// when the live one is done, its slot stays free
+	transcoder.release("live")
+	require.Eventually(t, func() bool { return limited.Stats().Running == 1 }, time.Second, time.Millisecond)
+	require.False(t, transcoder.started("warm-2"))
+
+	transcoder.release("warm-1")
+	require.Eventually(t, func() bool { return transcoder.started("warm-2") }, time.Second, time.Millisecond)
+	transcoder.release("warm-2")
+	wg.Wait()
+}
+
+func TestCachingPromotesLowPriority(t *testing.T) {
+	t.Parallel()
+
+	transcoder := newHoldTranscoder()
+	limited := transcode.NewLimitedTranscoder(transcoder, 1)
+	cacheTranscoder := transcode.NewCachingTranscoder(limited, t.TempDir(), 0)
+
+	var wg sync.WaitGroup
+	start := func(ctx context.Context, in string, expQueued int) {
+		t.Helper()
+		wg.Go(func() {
+			require.NoError(t, cacheTranscoder.Transcode(ctx, testProfile, in, io.Discard))
+		})
+		require.Eventually(t, func() bool { return limited.Stats().Queued == expQueued }, time.Second, time.Millisecond)
+	}
+	tracks := func() []string {
+		var tracks []string
+		for _, j := range limited.Jobs() {
+			tracks = append(tracks, j.Track)
+		}
+		return tracks
+	}
+
+	start(transcode.WithUser(context.Background(), "alice"), "live-1", 0)
+	require.Eventually(t, func() bool { return transcoder.started("live-1") }, time.Second, time.Millisecond)
+	start(transcode.WithLowPriority(transcode.WithUser(context.Background(), "alice")), "warm", 1)
+	start(transcode.WithUser(context.Background(), "bob"), "live-2", 2)
+	start(transcode.WithUser(context.Background(), "bob"), "live-3", 3)
+	require.Equal(t, []string{"live-1", "live-2", "live-3", "warm"}, tracks())
+
+	// someone streams the track being warmed, so it takes its user's turn instead of waiting for everyone
+	wg.Go(func() {
+		require.NoError(t, cacheTranscoder.Transcode(transcode.WithUser(context.Background(), "alice"), testProfile, "warm", io.Discard))
+	})
+	require.Eventually(t, func() bool { return slices.Equal(tracks(), []string{"live-1", "live-2", "warm", "live-3"}) }, time.Second, time.Millisecond)
+	require.False(t, limited.Jobs()[2].LowPriority)
+
+	transcoder.release("live-1")
+	require.Eventually(t, func() bool { return transcoder.started("live-2") }, time.Second, time.Millisecond)
+	transcoder.release("live-2")
+	require.Eventually(t, func() bool { return transcoder.started("warm") }, time.Second, time.Millisecond)
+	require.False(t, transcoder.started("live-3"))
+
+	transcoder.release("warm")
+	transcoder.release("live-3")
+	wg.Wait()
+}
+
+func TestLimitedNoLimit(t *testing.T) {
+	t.Parallel()
+
+	transcoder := newHoldTranscoder()
+	limited := transcode.NewLimitedTranscoder(transcoder, 0)
+
+	var wg sync.WaitGroup
+	for _, in := range []string{"a", "b", "c"} {
+		wg.Go(func() {
+			require.NoError(t, limited.Transcode(context.Background(), testProfile, in, io.Discard))
+		})
+	}
+	require.Eventually(t, func() bool { return limited.Stats().Running == 3 }, time.Second, time.Millisecond)
+	require.Zero(t, limited.Stats().Queued)
+
+	for _, in := range []string{"a", "b", "c"} {
+		transcoder.release(in)
+	}
+	wg.Wait()
+}
+
+func TestCachingEvictOnInsert(t *testing.T) {
+	t.Parallel()
+
+	const mb = 1024 * 1024
+	transcoder := &sizeTranscoder{size: mb / 2}
+	cacheDir := t.TempDir()
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, cacheDir, 1)
+
+	a, b, c := sourceFile(t), sourceFile(t), sourceFile(t)
+	for _, in := range []string{a, b, a, c} {
+		require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, in, io.Discard))
+	}
+
+	// c went over the limit, and b was used least recently
+	require.Equal(t, transcode.CacheStats{Hits: 1, Misses: 3, Entries: 2, Size: mb, Limit: mb}, cacheTranscoder.CacheStats())
+	_, err := cacheTranscoder.OpenCached(testProfile, b)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	for _, in := range []string{a, c} {
+		cf, err := cacheTranscoder.OpenCached(testProfile, in)
+		require.NoError(t, err)
+		require.NoError(t, cf.Close())
+	}
+
+	// the index is saved now and then rather than on every insert, so the cache is still there after a restart
+	require.NoFileExists(t, filepath.Join(cacheDir, "index.json"))
+	require.NoError(t, cacheTranscoder.SaveIndex())
+	require.FileExists(t, filepath.Join(cacheDir, "index.json"))
+	cacheTranscoder = transcode.NewCachingTranscoder(transcoder, cacheDir, 0)
+	require.Equal(t, 2, cacheTranscoder.CacheStats().Entries)
+	require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, c, io.Discard))
+	require.Equal(t, 3, int(transcoder.count.Load()))
+}
+
+func TestCachingInvalidate(t *testing.T) {
+	t.Parallel()
+
+	transcoder := &sizeTranscoder{size: 8}
+	cacheTranscoder := transcode.NewCachingTranscoder(transcoder, t.TempDir(), 0)
+
+	changed, deleted := sourceFile(t), sourceFile(t)
+	for _, in := range []string{changed, deleted, changed, deleted} {
+		require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, in, io.Discard))
+	}
+	require.Equal(t, 2, int(transcoder.count.Load()))
+
+	// a changed source is transcoded again
+	require.NoError(t, os.Chtimes(changed, time.Time{}, time.Now().Add(time.Hour)))
+	require.NoError(t, cacheTranscoder.Transcode(context.Background(), testProfile, changed, io.Discard))
+	require.Equal(t, 3, int(transcoder.count.Load()))
+
+	// and a deleted one is dropped from the cache
+	require.NoError(t, os.Remove(deleted))
+	require.NoError(t, cacheTranscoder.CacheEject())
+	require.Equal(t, 1, cacheTranscoder.CacheStats().Entries)
+	require.Equal(t, int64(8), cacheTranscoder.CacheStats().Size)
+}
+
 type callbackTranscoder struct {
 	transcoder transcode.Transcoder
 	callback   func()
@@ -138,3 +657,158 @@ func (ct callbackTranscoder) Transcode(ctx context.Context, profile transcode.Pr
 	ct.callback()
 	return ct.transcoder.Transcode(ctx, profile, in, out)
 }
+
+// gateTranscoder writes what it's told, then waits for finish or for its context to be cancelled
+type gateTranscoder struct {
+	count  atomic.Uint64
+	writes chan string
+	done   chan error
+}
+
+func newGateTranscoder() *gateTranscoder {
+	return &gateTranscoder{writes: make(chan string), done: make(chan error, 1)}
+}
+
+func (gt *gateTranscoder) write(s string)   { gt.writes <- s }
+func (gt *gateTranscoder) finish(err error) { gt.done <- err }
+
+func (gt *gateTranscoder) Transcode(ctx context.Context, _ transcode.Profile, _ string, out io.Writer) error {
+	gt.count.Add(1)
+	for {
+		select {
+		case s := <-gt.writes:
+			if _, err := io.WriteString(out, s); err != nil {
+				return err
+			}
+		case err := <-gt.done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+// holdTranscoder runs until each input is released, or its context is cancelled
+type holdTranscoder struct {
+	mu       sync.Mutex
+	releases map[string]chan struct{}
+	starts   map[string]bool
+}
+
+func newHoldTranscoder() *holdTranscoder {
+	return &holdTranscoder{releases: map[string]chan struct{}{}, starts: map[string]bool{}}
+}
+
+func (ht *holdTranscoder) ch(in string) chan struct{} {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if _, ok := ht.releases[in]; !ok {
+		ht.releases[in] = make(chan struct{})
+	}
+	return ht.releases[in]
+}
+
+func (ht *holdTranscoder) release(in string) { close(ht.ch(in)) }
+
+func (ht *holdTranscoder) started(in string) bool {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	return ht.starts[in]
+}
+
+func (ht *holdTranscoder) Transcode(ctx context.Context, _ transcode.Profile, in string, _ io.Writer) error {
+	ht.mu.Lock()
+	ht.starts[in] = true
+	ht.mu.Unlock()
+	select {
+	case <-ht.ch(in):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sizeTranscoder writes size bytes for every transcode
+type sizeTranscoder struct {
+	count atomic.Uint64
+	size  int
+}
+
+func (st *sizeTranscoder) Transcode(_ context.Context, _ transcode.Profile, _ string, out io.Writer) error {
+	st.count.Add(1)
+	_, err := out.Write(make([]byte, st.size))
+	return err
+}
+
+const tsPacketSize = 188
+
+// tsStream is 5s of made up mpegts. it has two packets of tables, then a packet starting a PES packet and one carrying
+// on with it for every half second
+var tsStream = func() []byte {
+	packet := func(pid int, pts int64) []byte {
+		p := make([]byte, tsPacketSize)
+		p[0], p[1], p[2], p[3] = 0x47, byte(pid>>8), byte(pid), 0x10
+		if pts >= 0 {
+			p[1] |= 0x40 // payload unit start
+			copy(p[4:], []byte{0, 0, 1, 0xc0, 0, 0, 0x80, 0x80, 5})
+			p[13] = byte(0x21 | pts>>29&0x0e)
+			p[14] = byte(pts >> 22)
+			p[15] = byte(0x01 | pts>>14&0xfe)
+			p[16] = byte(pts >> 7)
+			p[17] = byte(0x01 | pts<<1&0xfe)
+		}
+		return p
+	}
+	const firstPTS = 126_000
+	stream := slices.Concat(packet(0, -1), packet(0x1000, -1))
+	for i := range int64(10) {
+		stream = slices.Concat(stream, packet(0x100, firstPTS+i*45_000), packet(0x100, -1))
+	}
+	return stream
+}()
+
+// tsTranscoder writes tsStream. if hold is set, it then waits to be cancelled
+type tsTranscoder struct {
+	hold      bool
+	count     atomic.Uint64
+	cancelled atomic.Bool
+}
+
+func (tt *tsTranscoder) Transcode(ctx context.Context, _ transcode.Profile, _ string, out io.Writer) error {
+	tt.count.Add(1)
+	if _, err := out.Write(tsStream); err != nil {
+		return err
+	}
+	if !tt.hold {
+		return nil
+	}
+	<-ctx.Done()
+	tt.cancelled.Store(true)
+	return ctx.Err()
+}
+
+// sourceFile makes a file to transcode, since the cache checks if its source has changed
+func sourceFile(t *testing.T) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "*.flac")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
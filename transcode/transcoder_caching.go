@@ -3,12 +3,13 @@ package transcode
 import (
 	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
 	"time"
 )
@@ -18,110 +19,494 @@ const perm = 0o644
 type CachingTranscoder struct {
 	cachePath  string
 	transcoder Transcoder
-	limitMB    int
-	locks      keyedMutex
-	cleanLock  sync.RWMutex
+	limit      int64 // in bytes, 0 for no limit
+
+	mu      sync.Mutex
+	running map[string]*sharedTranscode // by cache key
+	index   *cacheIndex
+	hits    int
+	misses  int
+
+	saveMu sync.Mutex
 }
 
 var _ Transcoder = (*CachingTranscoder)(nil)
+var _ CacheOpener = (*CachingTranscoder)(nil)
 
 func NewCachingTranscoder(t Transcoder, cachePath string, limitMB int) *CachingTranscoder {
-	return &CachingTranscoder{transcoder: t, cachePath: cachePath, limitMB: limitMB}
+	index, err := loadCacheIndex(cachePath)
+	if err != nil {
+		log.Printf("error loading transcode cache index, indexing what's there: %v", err)
+	}
+	ct := &CachingTranscoder{
+		transcoder: t,
+		cachePath:  cachePath,
+		limit:      int64(limitMB) * 1024 * 1024,
+		running:    map[string]*sharedTranscode{},
+		index:      index,
+	}
+	ct.evictLocked("") // in case the limit is lower than last time
+	return ct
 }
 
+// Transcode serves from the cache if the transcode is done. if it's in progress, it follows the partial file as
+// it's written, so concurrent requests for the same transcode share the one ffmpeg. the transcode carries on while
+// anyone is reading, and is cancelled once they all go away
 func (t *CachingTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
-	t.cleanLock.RLock()
-	defer t.cleanLock.RUnlock()
-
 	// don't try cache partial transcodes
 	if profile.Seek() > 0 {
 		return t.transcoder.Transcode(ctx, profile, in, out)
 	}
 
+	tr, err := t.Open(ctx, profile, in)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	if _, err := io.Copy(out, tr.NewReader(ctx, 0)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Open opens a transcode to read from any offset, from the cache if it's done, otherwise joining the transcode in
+// progress or starting it. like with Transcode, the transcode carries on while anyone has it open
+func (t *CachingTranscoder) Open(ctx context.Context, profile Profile, in string) (*Transcoding, error) {
+	if profile.Seek() > 0 {
+		return nil, errors.New("partial transcodes aren't cached")
+	}
+
 	if err := os.MkdirAll(t.cachePath, perm^0o111); err != nil {
-		return fmt.Errorf("make cache path: %w", err)
+		return nil, fmt.Errorf("make cache path: %w", err)
 	}
 
 	name, args, err := parseProfile(profile, in)
 	if err != nil {
-		return fmt.Errorf("split command: %w", err)
+		return nil, fmt.Errorf("split command: %w", err)
 	}
 
 	key := cacheKey(name, args)
-	unlock := t.locks.Lock(key)
-	defer unlock()
 
-	path := filepath.Join(t.cachePath, key)
-	cf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if cf := t.openCached(key); cf != nil {
+		info, err := cf.Stat()
+		if err != nil {
+			_ = cf.Close()
+			return nil, fmt.Errorf("stat cached transcode: %w", err)
+		}
+		t.mu.Lock()
+		t.hits++
+		t.mu.Unlock()
+		return &Transcoding{file: cf, size: info.Size()}, nil
+	}
+
+	t.mu.Lock()
+	st, ok := t.running[key]
+	switch {
+	case ok:
+		t.hits++
+	default:
+		// if a transcode finished since openCached looked, it's done again. that's rare, and only costs the work
+		t.misses++
+		st, err = t.start(ctx, key, profile, in)
+		if err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+	}
+	st.readers++
+	t.mu.Unlock()
+
+	if ok && !isLowPriority(ctx) {
+		// someone is waiting for it now, so a queued low priority transcode shouldn't wait behind live ones
+		Promote(st.ctx)
+	}
+
+	return &Transcoding{t: t, key: key, st: st, file: st.file}, nil
+}
+
+// OpenRunning joins a transcode in progress without starting one, or returns an error satisfying os.ErrNotExist if
+// there isn't one
+func (t *CachingTranscoder) OpenRunning(ctx context.Context, profile Profile, in string) (*Transcoding, error) {
+	if profile.Seek() > 0 {
+		return nil, os.ErrNotExist
+	}
+	name, args, err := parseProfile(profile, in)
+	if err != nil {
+		return nil, fmt.Errorf("split command: %w", err)
+	}
+	key := cacheKey(name, args)
+
+	t.mu.Lock()
+	st, ok := t.running[key]
+	if !ok {
+		t.mu.Unlock()
+		return nil, os.ErrNotExist
+	}
+	t.hits++
+	st.readers++
+	t.mu.Unlock()
+
+	if !isLowPriority(ctx) {
+		Promote(st.ctx)
+	}
+	return &Transcoding{t: t, key: key, st: st, file: st.file}, nil
+}
+
+// OpenCached opens a finished transcode, or returns an error satisfying os.ErrNotExist if there isn't one
+func (t *CachingTranscoder) OpenCached(profile Profile, in string) (*os.File, error) {
+	if profile.Seek() > 0 {
+		return nil, os.ErrNotExist
+	}
+	name, args, err := parseProfile(profile, in)
 	if err != nil {
-		return fmt.Errorf("open cache file: %w", err)
+		return nil, fmt.Errorf("split command: %w", err)
+	}
+
+	cf := t.openCached(cacheKey(name, args))
+	if cf == nil {
+		return nil, os.ErrNotExist
 	}
-	defer cf.Close()
+	t.mu.Lock()
+	t.hits++
+	t.mu.Unlock()
+	return cf, nil
+}
 
-	if i, err := cf.Stat(); err == nil && i.Size() > 0 {
-		_, _ = io.Copy(out, cf)
-		_ = os.Chtimes(path, time.Now(), time.Now()) // Touch for LRU cache purposes
+// openCached opens a finished transcode if it's in the index and its source hasn't changed since. otherwise it
+// returns nil, dropping the transcode if it's out of date. the source is checked without holding t.mu, so that a
+// slow disk doesn't hold up every other request
+func (t *CachingTranscoder) openCached(key string) *os.File {
+	t.mu.Lock()
+	e, ok := t.index.entries[key]
+	t.mu.Unlock()
+	if !ok {
 		return nil
 	}
 
-	dest := io.MultiWriter(out, cf)
-	if err := t.transcoder.Transcode(ctx, profile, in, dest); err != nil {
-		os.Remove(path)
-		return fmt.Errorf("internal transcode: %w", err)
+	stale := e.stale()
+	var cf *os.File
+	if !stale {
+		cf, _ = os.Open(filepath.Join(t.cachePath, key))
 	}
 
-	return nil
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.index.entries[key] != e:
+		// replaced or removed meanwhile
+		if cf != nil {
+			_ = cf.Close()
+		}
+		return nil
+	case stale:
+		t.removeLocked(key)
+		return nil
+	case cf == nil:
+		t.index.remove(key) // deleted from under us
+		return nil
+	}
+	e.Accessed = time.Now()
+	t.index.dirty = true
+	return cf
 }
 
-func (t *CachingTranscoder) CacheEject() error {
-	t.cleanLock.Lock()
-	defer t.cleanLock.Unlock()
+// start runs the transcode in the background, writing to a partial file which is renamed into place when it's
+// done. it keeps the values of the first request's context, but not its cancellation. must be called with t.mu held
+func (t *CachingTranscoder) start(reqCtx context.Context, key string, profile Profile, in string) (*sharedTranscode, error) {
+	entry := &cacheEntry{Key: key, Source: in}
+	if info, err := os.Stat(in); err == nil {
+		entry.SourceModTime, entry.SourceSize = info.ModTime(), info.Size()
+	}
 
-	// Delete LRU cache files that exceed size limit. Use last modified time.
-	type file struct {
-		path string
-		info os.FileInfo
+	partial, err := os.CreateTemp(t.cachePath, key+".*.part")
+	if err != nil {
+		return nil, fmt.Errorf("create partial cache file: %w", err)
 	}
 
-	var files []file
-	var total int64 = 0
+	ctx, cancel := context.WithCancel(context.WithoutCancel(reqCtx))
+	st := &sharedTranscode{
+		ctx:     ctx,
+		file:    partial,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+	t.running[key] = st
 
-	err := filepath.WalkDir(t.cachePath, func(path string, de fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !de.IsDir() {
-			info, err := de.Info()
-			if err != nil {
-				return fmt.Errorf("walk cache path for eject: %w", err)
+	go func() {
+		defer cancel()
+		err := t.transcoder.Transcode(ctx, profile, in, st)
+
+		t.mu.Lock()
+		if err == nil {
+			if err := os.Rename(partial.Name(), filepath.Join(t.cachePath, key)); err != nil {
+				log.Printf("error moving transcode into cache: %v", err)
+			} else {
+				entry.Size, entry.Accessed = st.size(), time.Now()
+				t.index.add(entry)
+				t.evictLocked(key)
 			}
-			files = append(files, file{path, info})
-			total += info.Size()
+		} else {
+			_ = os.Remove(partial.Name())
 		}
-		return nil
-	})
+		if t.running[key] == st {
+			delete(t.running, key)
+		}
+		st.finish(err)
+		if st.readers == 0 {
+			_ = st.file.Close()
+		}
+		t.mu.Unlock()
+	}()
+
+	return st, nil
+}
+
+func (t *CachingTranscoder) leave(key string, st *sharedTranscode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st.readers--
+	if st.readers > 0 {
+		return
+	}
+	if st.isDone() {
+		_ = st.file.Close()
+		return
+	}
+	// nobody wants it any more. forget it now so that new requests start again instead of joining a cancelled one
+	if t.running[key] == st {
+		delete(t.running, key)
+	}
+	st.cancel()
+}
 
+// sharedTranscode is a transcode in progress. it's written to by the transcoder, and followed by each reader at its
+// own offset with ReadAt, waiting for more with wait
+type sharedTranscode struct {
+	ctx     context.Context
+	file    *os.File
+	cancel  context.CancelFunc
+	readers int // guarded by the CachingTranscoder's mu
+
+	mu      sync.Mutex
+	written int64
+	done    bool
+	err     error
+	changed chan struct{} // closed and replaced on every write, and when done
+}
+
+func (st *sharedTranscode) Write(p []byte) (int, error) {
+	n, err := st.file.Write(p)
+
+	st.mu.Lock()
+	st.written += int64(n)
+	close(st.changed)
+	st.changed = make(chan struct{})
+	st.mu.Unlock()
+
+	return n, err
+}
+
+func (st *sharedTranscode) finish(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.done = true
+	st.err = err
+	close(st.changed)
+}
+
+func (st *sharedTranscode) size() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.written
+}
+
+func (st *sharedTranscode) isDone() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.done
+}
+
+// wait waits until at least n bytes have been written or the transcode is done, and returns how much has been
+// written. it returns the transcode's error if it failed before writing n bytes
+func (st *sharedTranscode) wait(ctx context.Context, n int64) (int64, bool, error) {
+	for {
+		st.mu.Lock()
+		written, done, err, changed := st.written, st.done, st.err, st.changed
+		st.mu.Unlock()
+
+		switch {
+		case written >= n:
+			return written, done, nil
+		case done && err != nil:
+			return written, done, fmt.Errorf("internal transcode: %w", err)
+		case done:
+			return written, done, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return written, done, ctx.Err()
+		}
+	}
+}
+
+// Transcoding is a transcode opened with Open, which may still be in progress. it must be closed
+type Transcoding struct {
+	t    *CachingTranscoder
+	key  string
+	st   *sharedTranscode // nil if it was already cached
+	file *os.File
+	size int64 // if it was already cached
+}
+
+// Wait waits until at least n bytes are there to read or the transcode is done, and returns how much there is. it
+// returns an error if the transcode failed before getting to n bytes
+func (tr *Transcoding) Wait(ctx context.Context, n int64) (size int64, done bool, err error) {
+	if tr.st == nil {
+		return tr.size, true, nil
+	}
+	return tr.st.wait(ctx, n)
+}
+
+// ReadAt reads what's already there, use Wait first for what isn't
+func (tr *Transcoding) ReadAt(p []byte, off int64) (int, error) {
+	return tr.file.ReadAt(p, off)
+}
+
+// NewReader reads the transcode from offset to the end, waiting for more to be written as it goes
+func (tr *Transcoding) NewReader(ctx context.Context, offset int64) io.Reader {
+	return &transcodingReader{ctx: ctx, tr: tr, offset: offset}
+}
+
+func (tr *Transcoding) Close() error {
+	if tr.st == nil {
+		return tr.file.Close()
+	}
+	tr.t.leave(tr.key, tr.st)
+	return nil
+}
+
+type transcodingReader struct {
+	ctx    context.Context
+	tr     *Transcoding
+	offset int64
+}
+
+func (r *transcodingReader) Read(p []byte) (int, error) {
+	size, _, err := r.tr.Wait(r.ctx, r.offset+1)
 	if err != nil {
-		return fmt.Errorf("walk cache path for eject: %w", err)
+		return 0, err
 	}
+	if r.offset >= size {
+		return 0, io.EOF
+	}
+	n, err := r.tr.ReadAt(p[:min(int64(len(p)), size-r.offset)], r.offset)
+	r.offset += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("read partial cache file: %w", err)
+	}
+	return n, nil
+}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].info.ModTime().Before(files[j].info.ModTime())
-	})
+// evictLocked removes the least recently used transcodes until the cache is under its limit, apart from keep which
+// was just added. must be called with t.mu held
+func (t *CachingTranscoder) evictLocked(keep string) {
+	if t.limit == 0 || t.index.size <= t.limit {
+		return
+	}
+	for _, e := range t.index.lru() {
+		if t.index.size <= t.limit {
+			break
+		}
+		if e.Key != keep {
+			t.removeLocked(e.Key)
+		}
+	}
+}
 
-	for total > int64(t.limitMB)*1024*1024 {
-		curFile := files[0]
-		files = files[1:]
-		total -= curFile.info.Size()
-		err = os.Remove(curFile.path)
-		if err != nil {
-			return fmt.Errorf("remove cache file: %w", err)
+// removeLocked removes a transcode from the index and the cache dir. readers which already have it open can carry
+// on. must be called with t.mu held
+func (t *CachingTranscoder) removeLocked(key string) {
+	t.index.remove(key)
+	if err := os.Remove(filepath.Join(t.cachePath, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("error removing transcode from cache: %v", err)
+	}
+}
+
+// CacheEject removes transcodes of source files which have since been changed or deleted, then saves the index.
+// the sources are checked without holding the lock, so transcodes carry on meanwhile
+func (t *CachingTranscoder) CacheEject() error {
+	t.mu.Lock()
+	entries := make([]*cacheEntry, 0, len(t.index.entries))
+	for _, e := range t.index.entries {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	var stale []*cacheEntry
+	for _, e := range entries {
+		if e.stale() {
+			stale = append(stale, e)
+		}
+	}
+
+	t.mu.Lock()
+	for _, e := range stale {
+		if t.index.entries[e.Key] == e {
+			t.removeLocked(e.Key)
 		}
 	}
+	t.mu.Unlock()
+
+	return t.SaveIndex()
+}
 
+// SaveIndex saves the index of the cache if it has changed, so that it's kept with access times across restarts.
+// it's called now and then rather than after every change. transcodes added since the last save are still found
+// after a crash, just without their sources to check
+func (t *CachingTranscoder) SaveIndex() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	if !t.index.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	entries := make([]cacheEntry, 0, len(t.index.entries))
+	for _, e := range t.index.lru() {
+		entries = append(entries, *e)
+	}
+	t.index.dirty = false
+	t.mu.Unlock()
+
+	if err := saveCacheIndex(t.cachePath, entries); err != nil {
+		t.mu.Lock()
+		t.index.dirty = true
+		t.mu.Unlock()
+		return err
+	}
 	return nil
 }
 
+// CacheStats are counts for the cache, for metrics. joining a transcode that's already running counts as a hit
+type CacheStats struct {
+	Hits    int   `json:"hits"`
+	Misses  int   `json:"misses"`
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	Limit   int64 `json:"limit"`
+}
+
+func (t *CachingTranscoder) CacheStats() CacheStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return CacheStats{Hits: t.hits, Misses: t.misses, Entries: len(t.index.entries), Size: t.index.size, Limit: t.limit}
+}
+
 func cacheKey(cmd string, args []string) string {
 	// the cache is invalid whenever transcode command (which includes the
 	// absolute filepath, bit rate args, replay gain args, etc.) changes
@@ -132,15 +517,3 @@ func cacheKey(cmd string, args []string) string {
 	}
 	return fmt.Sprintf("%x", sum.Sum(nil))
 }
-
-type keyedMutex struct {
-	sync.Map
-}
-
-func (km *keyedMutex) Lock(key string) func() {
-	value, _ := km.LoadOrStore(key, &sync.Mutex{})
-	mu := value.(*sync.Mutex)
-	mu.Lock()
-	// TODO: remove key entry from map to save some space?
-	return mu.Unlock
-}
@@ -0,0 +1,349 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	ctxUser ctxKey = iota
+	ctxLowPriority
+)
+
+// WithUser says who a transcode is for, so that the LimitedTranscoder can queue fairly between users
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, ctxUser, user)
+}
+
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(ctxUser).(string)
+	return user
+}
+
+// WithLowPriority marks a transcode which nobody is waiting for, like warming the cache. the LimitedTranscoder only
+// starts it when no other transcodes are queued, and keeps a slot free of them for live transcodes. without a limit
+// nothing is queued, so it has no effect
+func WithLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxLowPriority, &lowPriority{})
+}
+
+// Promote raises a transcode started with a WithLowPriority context to normal priority, for when someone ends up
+// waiting for it after all. if it's queued in a LimitedTranscoder, it moves to its user's queue
+func Promote(ctx context.Context) {
+	low, _ := ctx.Value(ctxLowPriority).(*lowPriority)
+	if low == nil {
+		return
+	}
+	low.mu.Lock()
+	low.promoted = true
+	onPromote := low.onPromote
+	low.onPromote = nil
+	low.mu.Unlock()
+
+	if onPromote != nil {
+		onPromote()
+	}
+}
+
+func isLowPriority(ctx context.Context) bool {
+	low, _ := ctx.Value(ctxLowPriority).(*lowPriority)
+	if low == nil {
+		return false
+	}
+	low.mu.Lock()
+	defer low.mu.Unlock()
+	return !low.promoted
+}
+
+// lowPriority is what WithLowPriority puts in the context
+type lowPriority struct {
+	mu        sync.Mutex
+	promoted  bool
+	onPromote func() // set while the transcode is queued as low priority
+}
+
+// watch sets the func to call if the transcode is promoted, and returns false if it already has been
+func (l *lowPriority) watch(onPromote func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.promoted {
+		return false
+	}
+	l.onPromote = onPromote
+	return true
+}
+
+var ErrJobCancelled = errors.New("transcode job cancelled")
+
+// LimitedTranscoder runs at most limit transcodes at once. the rest wait in a queue per user, and when a transcode
+// finishes the next one comes from the next user in turn, so one user with a lot of downloads can't hold up the others.
+// low priority transcodes wait in their own queue, behind everyone else's. if the limit is more than one, they can
+// only take limit-1 of the slots, so that a live transcode can always start without waiting for one to finish
+type LimitedTranscoder struct {
+	transcoder Transcoder
+	limit      int // 0 for no limit
+
+	mu         sync.Mutex
+	nextID     int
+	running    int
+	runningLow int               // of running, the low priority ones
+	jobs       []*job            // running and queued, in order of arrival
+	queues     map[string][]*job // waiting jobs by user
+	turns      []string          // users with waiting jobs, whose turn is next first
+	low        []*job            // waiting low priority jobs, in order of arrival
+}
+
+var _ Transcoder = (*LimitedTranscoder)(nil)
+
+func NewLimitedTranscoder(t Transcoder, limit int) *LimitedTranscoder {
+	return &LimitedTranscoder{transcoder: t, limit: max(limit, 0), queues: map[string][]*job{}}
+}
+
+type job struct {
+	Job
+	cancel context.CancelCauseFunc
+	start  chan struct{}
+}
+
+// Job is a snapshot of a transcode which is running or waiting to run
+type Job struct {
+	ID          int       `json:"id"`
+	User        string    `json:"user"`
+	Track       string    `json:"track"`
+	Profile     string    `json:"profile"`
+	LowPriority bool      `json:"low_priority"`
+	Running     bool      `json:"running"`
+	Queued      time.Time `json:"queued"`
+	Started     time.Time `json:"started"`  // zero if it's still waiting
+	Position    int       `json:"position"` // place in the queue, if waiting
+}
+
+func (t *LimitedTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	j := &job{
+		Job: Job{
+			User:    userFrom(ctx),
+			Track:   filepath.Base(in),
+			Profile: profileName(profile),
+			Queued:  time.Now(),
+		},
+		cancel: cancel,
+		start:  make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.nextID++
+	j.ID = t.nextID
+	t.jobs = append(t.jobs, j)
+	if low, _ := ctx.Value(ctxLowPriority).(*lowPriority); low != nil {
+		j.LowPriority = low.watch(func() { t.promote(j) })
+		defer low.watch(nil)
+	}
+	if t.roomLocked(j) && len(t.turns) == 0 && (!j.LowPriority || len(t.low) == 0) {
+		t.startLocked(j)
+	} else {
+		t.enqueueLocked(j)
+	}
+	t.mu.Unlock()
+
+	defer t.finish(j)
+
+	select {
+	case <-j.start:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for transcode: %w", context.Cause(ctx))
+	}
+	if err := t.transcoder.Transcode(ctx, profile, in, out); err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, ErrJobCancelled) {
+			return fmt.Errorf("%w: %w", cause, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Cancel stops a running or queued job, returning false if there's no such job
+func (t *LimitedTranscoder) Cancel(id int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		if j.ID == id {
+			j.cancel(ErrJobCancelled)
+			return true
+		}
+	}
+	return false
+}
+
+// Jobs lists the running jobs, then the queued ones in the order they will run
+func (t *LimitedTranscoder) Jobs() []Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var running []Job
+	for _, j := range t.jobs {
+		if j.Running {
+			running = append(running, j.Job)
+		}
+	}
+	var queued []Job
+	for round := 0; ; round++ {
+		var found bool
+		for _, user := range t.turns {
+			if queue := t.queues[user]; round < len(queue) {
+				queued = append(queued, queue[round].Job)
+				queued[len(queued)-1].Position = len(queued)
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	for _, j := range t.low {
+		queued = append(queued, j.Job)
+		queued[len(queued)-1].Position = len(queued)
+	}
+	return append(running, queued...)
+}
+
+// Stats are counts of jobs, for metrics
+type Stats struct {
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+func (t *LimitedTranscoder) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Stats{Limit: t.limit, Running: t.running, Queued: len(t.jobs) - t.running}
+}
+
+func (t *LimitedTranscoder) finish(j *job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.jobs = slices.DeleteFunc(t.jobs, func(o *job) bool { return o == j })
+	if !j.Running && j.LowPriority {
+		t.low = slices.DeleteFunc(t.low, func(o *job) bool { return o == j })
+		return
+	}
+	if !j.Running {
+		// cancelled while waiting, the user keeps their turn if they have more
+		t.queues[j.User] = slices.DeleteFunc(t.queues[j.User], func(o *job) bool { return o == j })
+		if len(t.queues[j.User]) == 0 {
+			delete(t.queues, j.User)
+			t.turns = slices.DeleteFunc(t.turns, func(user string) bool { return user == j.User })
+		}
+		return
+	}
+
+	t.running--
+	if j.LowPriority {
+		t.runningLow--
+	}
+	t.startQueuedLocked()
+}
+
+// promote moves a low priority job to its user's queue, if it's still waiting
+func (t *LimitedTranscoder) promote(j *job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if j.Running || !j.LowPriority || !slices.Contains(t.low, j) {
+		return
+	}
+	t.low = slices.DeleteFunc(t.low, func(o *job) bool { return o == j })
+	j.LowPriority = false
+	t.enqueueLocked(j)
+	t.startQueuedLocked()
+}
+
+// startQueuedLocked starts waiting jobs while there's room, taking turns between users before low priority jobs
+func (t *LimitedTranscoder) startQueuedLocked() {
+	for len(t.turns) > 0 && t.roomLocked(t.queues[t.turns[0]][0]) {
+		user := t.turns[0]
+		t.turns = t.turns[1:]
+		next := t.queues[user][0]
+		t.queues[user] = t.queues[user][1:]
+		if len(t.queues[user]) > 0 {
+			t.turns = append(t.turns, user) // back of the line
+		} else {
+			delete(t.queues, user)
+		}
+		t.startLocked(next)
+	}
+	for len(t.low) > 0 && t.roomLocked(t.low[0]) {
+		next := t.low[0]
+		t.low = t.low[1:]
+		t.startLocked(next)
+	}
+}
+
+// roomLocked returns if there's a free slot for j
+func (t *LimitedTranscoder) roomLocked(j *job) bool {
+	switch {
+	case t.limit == 0:
+		return true
+	case t.running >= t.limit:
+		return false
+	case j.LowPriority && t.limit > 1:
+		return t.runningLow < t.limit-1
+	default:
+		return true
+	}
+}
+
+func (t *LimitedTranscoder) startLocked(j *job) {
+	t.running++
+	if j.LowPriority {
+		t.runningLow++
+	}
+	j.Running = true
+	j.Started = time.Now()
+	close(j.start)
+}
+
+func (t *LimitedTranscoder) enqueueLocked(j *job) {
+	if j.LowPriority {
+		t.low = append(t.low, j)
+		return
+	}
+	if len(t.queues[j.User]) == 0 {
+		t.turns = append(t.turns, j.User)
+	}
+	t.queues[j.User] = append(t.queues[j.User], j)
+}
+
+// profileName is the name of a user profile if it's one of them, for showing jobs
+func profileName(profile Profile) string {
+	name := profile.Suffix()
+	var names []string
+	profiles := map[string]Profile{}
+	for _, n := range ProfileNames() {
+		if p, _ := LookupProfile(n); p.exec == profile.exec && p.mime == profile.mime {
+			names = append(names, n)
+			profiles[n] = p
+		}
+	}
+	if i := slices.IndexFunc(names, func(n string) bool { return profiles[n].bitrate == profile.bitrate }); i >= 0 {
+		name = names[i]
+	} else if len(names) > 0 {
+		name = names[0]
+	}
+	if profile.BitRate() > 0 {
+		return fmt.Sprintf("%s %dk", name, profile.BitRate())
+	}
+	return name
+}
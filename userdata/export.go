@@ -0,0 +1,296 @@
+package userdata
+
+import (
+	"fmt"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+// Export returns all of the user's data. rows which refer to something that no longer exists are left out
+func Export(dbc *db.DB, user *db.User) (*Data, error) {
+	data := &Data{
+		Version:    Version,
+		ExportedAt: time.Now().UTC(),
+		User: User{
+			Name:              user.Name,
+			LastFMSession:     user.LastFMSession,
+			ListenBrainzURL:   user.ListenBrainzURL,
+			ListenBrainzToken: user.ListenBrainzToken,
+		},
+	}
+
+	var (
+		artistStars    []*db.ArtistStar
+		artistRatings  []*db.ArtistRating
+		albumStars     []*db.AlbumStar
+		albumRatings   []*db.AlbumRating
+		albumPlays     []*db.Play
+		trackStars     []*db.TrackStar
+		trackRatings   []*db.TrackRating
+		trackPlays     []*db.TrackPlay
+		listens        []*db.Listen
+		bookmarks      []*db.Bookmark
+		playQueues     []*db.PlayQueue
+		transcodePrefs []*db.TranscodePreference
+	)
+	for _, q := range []struct {
+		name  string
+		dest  any
+		order string
+	}{
+		{"artist stars", &artistStars, "artist_id"},
+		{"artist ratings", &artistRatings, "artist_id"},
+		{"album stars", &albumStars, "album_id"},
+		{"album ratings", &albumRatings, "album_id"},
+		{"album plays", &albumPlays, "id"},
+		{"track stars", &trackStars, "track_id"},
+		{"track ratings", &trackRatings, "track_id"},
+		{"track plays", &trackPlays, "track_id"},
+		{"listens", &listens, "id"},
+		{"bookmarks", &bookmarks, "id"},
+		{"play queues", &playQueues, "name"},
+		{"transcode preferences", &transcodePrefs, "client"},
+	} {
+		if err := dbc.Where("user_id=?", user.ID).Order(q.order).Find(q.dest).Error; err != nil {
+			return nil, fmt.Errorf("find %s: %w", q.name, err)
+		}
+	}
+
+	// collect everything referred to so that it can be looked up in batches
+	var artistIDs, albumIDs, trackIDs, episodeIDs []int
+	for _, s := range artistStars {
+		artistIDs = append(artistIDs, s.ArtistID)
+	}
+	for _, r := range artistRatings {
+		artistIDs = append(artistIDs, r.ArtistID)
+	}
+	for _, s := range albumStars {
+		albumIDs = append(albumIDs, s.AlbumID)
+	}
+	for _, r := range albumRatings {
+		albumIDs = append(albumIDs, r.AlbumID)
+	}
+	for _, p := range albumPlays {
+		albumIDs = append(albumIDs, p.AlbumID)
+	}
+	for _, s := range trackStars {
+		trackIDs = append(trackIDs, s.TrackID)
+	}
+	for _, r := range trackRatings {
+		trackIDs = append(trackIDs, r.TrackID)
+	}
+	for _, p := range trackPlays {
+		trackIDs = append(trackIDs, p.TrackID)
+	}
+	for _, l := range listens {
+		if l.TrackID != nil {
+			trackIDs = append(trackIDs, *l.TrackID)
+		}
+	}
+	itemIDs := func(id specid.ID) {
+		switch id.Type {
+		case specid.Track:
+			trackIDs = append(trackIDs, id.Value)
+		case specid.PodcastEpisode:
+			episodeIDs = append(episodeIDs, id.Value)
+		}
+	}
+	for _, b := range bookmarks {
+		itemIDs(specid.ID{Type: specid.IDT(b.EntryIDType), Value: b.EntryID})
+	}
+	for _, q := range playQueues {
+		for _, id := range q.GetItems() {
+			itemIDs(id)
+		}
+	}
+
+	artists, err := artistRefs(dbc, artistIDs)
+	if err != nil {
+		return nil, fmt.Errorf("find artists: %w", err)
+	}
+	albums, err := albumRefs(dbc, albumIDs)
+	if err != nil {
+		return nil, fmt.Errorf("find albums: %w", err)
+	}
+	tracks, err := trackRefs(dbc, trackIDs)
+	if err != nil {
+		return nil, fmt.Errorf("find tracks: %w", err)
+	}
+	episodes, err := episodeRefs(dbc, episodeIDs)
+	if err != nil {
+		return nil, fmt.Errorf("find podcast episodes: %w", err)
+	}
+	itemRef := func(id specid.ID) *ItemRef {
+		switch id.Type {
+		case specid.Track:
+			if ref, ok := tracks[id.Value]; ok {
+				return &ItemRef{Track: ref}
+			}
+		case specid.PodcastEpisode:
+			if ref, ok := episodes[id.Value]; ok {
+				return &ItemRef{Episode: ref}
+			}
+		}
+		return nil
+	}
+
+	for _, s := range artistStars {
+		if ref, ok := artists[s.ArtistID]; ok {
+			data.ArtistStars = append(data.ArtistStars, &ArtistStar{Artist: *ref, StarDate: s.StarDate})
+		}
+	}
+	for _, r := range artistRatings {
+		if ref, ok := artists[r.ArtistID]; ok {
+			data.ArtistRatings = append(data.ArtistRatings, &ArtistRating{Artist: *ref, Rating: r.Rating})
+		}
+	}
+	for _, s := range albumStars {
+		if ref, ok := albums[s.AlbumID]; ok {
+			data.AlbumStars = append(data.AlbumStars, &AlbumStar{Album: *ref, StarDate: s.StarDate})
+		}
+	}
+	for _, r := range albumRatings {
+		if ref, ok := albums[r.AlbumID]; ok {
+			data.AlbumRatings = append(data.AlbumRatings, &AlbumRating{Album: *ref, Rating: r.Rating})
+		}
+	}
+	for _, p := range albumPlays {
+		if ref, ok := albums[p.AlbumID]; ok {
+			data.AlbumPlays = append(data.AlbumPlays, &AlbumPlay{Album: *ref, Time: p.Time, Count: p.Count, Length: p.Length})
+		}
+	}
+	for _, s := range trackStars {
+		if ref, ok := tracks[s.TrackID]; ok {
+			data.TrackStars = append(data.TrackStars, &TrackStar{Track: *ref, StarDate: s.StarDate})
+		}
+	}
+	for _, r := range trackRatings {
+		if ref, ok := tracks[r.TrackID]; ok {
+			data.TrackRatings = append(data.TrackRatings, &TrackRating{Track: *ref, Rating: r.Rating})
+		}
+	}
+	for _, p := range trackPlays {
+		if ref, ok := tracks[p.TrackID]; ok {
+			data.TrackPlays = append(data.TrackPlays, &TrackPlay{Track: *ref, Time: p.Time, Count: p.Count})
+		}
+	}
+	for _, l := range listens {
+		listen := &Listen{
+			Time:       l.Time,
+			Client:     l.Client,
+			Submission: l.Submission,
+			Skipped:    l.Skipped,
+			TrackTitle: l.TrackTitle,
+			ArtistName: l.ArtistName,
+			AlbumTitle: l.AlbumTitle,
+			Length:     l.Length,
+		}
+		if l.TrackID != nil {
+			listen.Track = tracks[*l.TrackID]
+		}
+		data.Listens = append(data.Listens, listen)
+	}
+	for _, b := range bookmarks {
+		if ref := itemRef(specid.ID{Type: specid.IDT(b.EntryIDType), Value: b.EntryID}); ref != nil {
+			data.Bookmarks = append(data.Bookmarks, &Bookmark{Item: *ref, Position: b.Position, Comment: b.Comment, CreatedAt: b.CreatedAt, UpdatedAt: b.UpdatedAt})
+		}
+	}
+	for _, q := range playQueues {
+		queue := &PlayQueue{Name: q.Name, Position: q.Position, ChangedBy: q.ChangedBy, UpdatedAt: q.UpdatedAt}
+		for i, id := range q.GetItems() {
+			ref := itemRef(id)
+			if ref == nil {
+				continue
+			}
+			if i == q.CurrentIndex {
+				queue.Current = len(queue.Items)
+			}
+			queue.Items = append(queue.Items, ref)
+		}
+		data.PlayQueues = append(data.PlayQueues, queue)
+	}
+	for _, p := range transcodePrefs {
+		data.TranscodePreferences = append(data.TranscodePreferences, &TranscodePreference{Client: p.Client, Profile: p.Profile})
+	}
+
+	return data, nil
+}
+
+// lookups are chunked to stay under the database's limit of query parameters
+const lookupChunkSize = 500
+
+func lookup(ids []int, f func(chunk []int) error) error {
+	for i := 0; i < len(ids); i += lookupChunkSize {
+		if err := f(ids[i:min(i+lookupChunkSize, len(ids))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func artistRefs(dbc *db.DB, ids []int) (map[int]*ArtistRef, error) {
+	refs := map[int]*ArtistRef{}
+	return refs, lookup(ids, func(chunk []int) error {
+		var artists []*db.Artist
+		if err := dbc.Preload("Info").Where("id IN (?)", chunk).Find(&artists).Error; err != nil {
+			return err
+		}
+		for _, a := range artists {
+			ref := &ArtistRef{Name: a.Name}
+			if a.Info != nil {
+				ref.MBID = a.Info.MusicBrainzID
+			}
+			refs[a.ID] = ref
+		}
+		return nil
+	})
+}
+
+func albumRefs(dbc *db.DB, ids []int) (map[int]*AlbumRef, error) {
+	refs := map[int]*AlbumRef{}
+	return refs, lookup(ids, func(chunk []int) error {
+		var albums []*db.Album
+		if err := dbc.Where("id IN (?)", chunk).Find(&albums).Error; err != nil {
+			return err
+		}
+		for _, a := range albums {
+			refs[a.ID] = &AlbumRef{Path: albumPath(a), MusicFolder: a.RootDir, MBID: a.TagBrainzID}
+		}
+		return nil
+	})
+}
+
+func trackRefs(dbc *db.DB, ids []int) (map[int]*TrackRef, error) {
+	refs := map[int]*TrackRef{}
+	return refs, lookup(ids, func(chunk []int) error {
+		var tracks []*db.Track
+		if err := dbc.Preload("Album").Where("id IN (?)", chunk).Find(&tracks).Error; err != nil {
+			return err
+		}
+		for _, t := range tracks {
+			refs[t.ID] = &TrackRef{Path: albumPath(t.Album) + "/" + t.Filename, MusicFolder: t.Album.RootDir, MBID: t.TagBrainzID}
+		}
+		return nil
+	})
+}
+
+func episodeRefs(dbc *db.DB, ids []int) (map[int]*EpisodeRef, error) {
+	refs := map[int]*EpisodeRef{}
+	return refs, lookup(ids, func(chunk []int) error {
+		var episodes []*db.PodcastEpisode
+		if err := dbc.Preload("Podcast").Where("id IN (?)", chunk).Find(&episodes).Error; err != nil {
+			return err
+		}
+		for _, e := range episodes {
+			refs[e.ID] = &EpisodeRef{PodcastURL: e.Podcast.URL, AudioURL: e.AudioURL}
+		}
+		return nil
+	})
+}
+
+// albumPath is the album's path relative to its music path. see splitAlbumPath
+func albumPath(album *db.Album) string {
+	return album.LeftPath + album.RightPath
+}
@@ -0,0 +1,439 @@
+package userdata
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+// Report describes the result of an import
+type Report struct {
+	Imported  int
+	Unmatched []string // descriptions of the rows which couldn't be matched with the library, and were skipped
+}
+
+func (r *Report) unmatched(kind string, ref fmt.Stringer) {
+	r.Unmatched = append(r.Unmatched, fmt.Sprintf("%s: %s", kind, ref))
+}
+
+// Import adds data to the user's data, matching its references against the current library. stars, ratings, and
+// plays which the user already has are replaced. listens are kept even if their track can't be found, since they
+// have the track's details
+func Import(dbc *db.DB, user *db.User, data *Data) (*Report, error) {
+	return importData(dbc, user, data, false)
+}
+
+// Add is like Import, but adds the play counts to the user's instead of replacing them. it's for plays which were
+// counted somewhere else, like another server
+func Add(dbc *db.DB, user *db.User, data *Data) (*Report, error) {
+	return importData(dbc, user, data, true)
+}
+
+func importData(dbc *db.DB, user *db.User, data *Data, addPlays bool) (*Report, error) {
+	if data.Version != Version {
+		return nil, fmt.Errorf("%d: %w", data.Version, ErrUnsupportedVersion)
+	}
+
+	report := &Report{}
+	err := dbc.Transaction(func(tx *db.DB) error {
+		r := &resolver{tx: tx}
+		if err := importUser(tx, user, &data.User); err != nil {
+			return fmt.Errorf("user: %w", err)
+		}
+		for _, s := range data.ArtistStars {
+			id, err := r.artist(&s.Artist)
+			if err != nil {
+				return fmt.Errorf("artist star: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("artist star", &s.Artist)
+				continue
+			}
+			if err := tx.Save(&db.ArtistStar{UserID: user.ID, ArtistID: id, StarDate: s.StarDate}).Error; err != nil {
+				return fmt.Errorf("save artist star: %w", err)
+			}
+			report.Imported++
+		}
+		for _, s := range data.ArtistRatings {
+			id, err := r.artist(&s.Artist)
+			if err != nil {
+				return fmt.Errorf("artist rating: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("artist rating", &s.Artist)
+				continue
+			}
+			if err := tx.Save(&db.ArtistRating{UserID: user.ID, ArtistID: id, Rating: s.Rating}).Error; err != nil {
+				return fmt.Errorf("save artist rating: %w", err)
+			}
+			if err := tx.UpdateArtistAverageRating(id); err != nil {
+				return fmt.Errorf("artist rating: %w", err)
+			}
+			report.Imported++
+		}
+		for _, s := range data.AlbumStars {
+			id, err := r.album(&s.Album)
+			if err != nil {
+				return fmt.Errorf("album star: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("album star", &s.Album)
+				continue
+			}
+			if err := tx.Save(&db.AlbumStar{UserID: user.ID, AlbumID: id, StarDate: s.StarDate}).Error; err != nil {
+				return fmt.Errorf("save album star: %w", err)
+			}
+			report.Imported++
+		}
+		for _, s := range data.AlbumRatings {
+			id, err := r.album(&s.Album)
+			if err != nil {
+				return fmt.Errorf("album rating: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("album rating", &s.Album)
+				continue
+			}
+			if err := tx.Save(&db.AlbumRating{UserID: user.ID, AlbumID: id, Rating: s.Rating}).Error; err != nil {
+				return fmt.Errorf("save album rating: %w", err)
+			}
+			if err := tx.UpdateAlbumAverageRating(id); err != nil {
+				return fmt.Errorf("album rating: %w", err)
+			}
+			report.Imported++
+		}
+		for _, p := range data.AlbumPlays {
+			id, err := r.album(&p.Album)
+			if err != nil {
+				return fmt.Errorf("album play: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("album play", &p.Album)
+				continue
+			}
+			var play db.Play
+			if err := tx.Where("user_id=? AND album_id=?", user.ID, id).First(&play).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("find album play: %w", err)
+			}
+			if !addPlays {
+				play.Count, play.Length, play.Time = 0, 0, time.Time{}
+			}
+			play.UserID = user.ID
+			play.AlbumID = id
+			play.Count += p.Count
+			play.Length += p.Length
+			if p.Time.After(play.Time) {
+				play.Time = p.Time
+			}
+			if err := tx.Save(&play).Error; err != nil {
+				return fmt.Errorf("save album play: %w", err)
+			}
+			report.Imported++
+		}
+		for _, s := range data.TrackStars {
+			id, err := r.track(&s.Track)
+			if err != nil {
+				return fmt.Errorf("track star: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("track star", &s.Track)
+				continue
+			}
+			if err := tx.Save(&db.TrackStar{UserID: user.ID, TrackID: id, StarDate: s.StarDate}).Error; err != nil {
+				return fmt.Errorf("save track star: %w", err)
+			}
+			report.Imported++
+		}
+		for _, s := range data.TrackRatings {
+			id, err := r.track(&s.Track)
+			if err != nil {
+				return fmt.Errorf("track rating: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("track rating", &s.Track)
+				continue
+			}
+			if err := tx.Save(&db.TrackRating{UserID: user.ID, TrackID: id, Rating: s.Rating}).Error; err != nil {
+				return fmt.Errorf("save track rating: %w", err)
+			}
+			if err := tx.UpdateTrackAverageRating(id); err != nil {
+				return fmt.Errorf("track rating: %w", err)
+			}
+			report.Imported++
+		}
+		for _, p := range data.TrackPlays {
+			id, err := r.track(&p.Track)
+			if err != nil {
+				return fmt.Errorf("track play: %w", err)
+			}
+			if id == 0 {
+				report.unmatched("track play", &p.Track)
+				continue
+			}
+			play := db.TrackPlay{UserID: user.ID, TrackID: id, Count: p.Count, Time: p.Time}
+			if addPlays {
+				var existing db.TrackPlay
+				if err := tx.Where("user_id=? AND track_id=?", user.ID, id).First(&existing).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+					return fmt.Errorf("find track play: %w", err)
+				}
+				play.Count += existing.Count
+				if existing.Time.After(play.Time) {
+					play.Time = existing.Time
+				}
+			}
+			if err := tx.Save(&play).Error; err != nil {
+				return fmt.Errorf("save track play: %w", err)
+			}
+			report.Imported++
+		}
+		for _, l := range data.Listens {
+			listen := db.Listen{
+				UserID:     user.ID,
+				Time:       db.ListenTime(l.Time),
+				Client:     l.Client,
+				Submission: l.Submission,
+				Skipped:    l.Skipped,
+				TrackTitle: l.TrackTitle,
+				ArtistName: l.ArtistName,
+				AlbumTitle: l.AlbumTitle,
+				Length:     l.Length,
+			}
+			// importing the same data twice shouldn't duplicate listens
+			var count int
+			if err := tx.Model(db.Listen{}).Where("user_id=? AND time=? AND track_title=?", user.ID, listen.Time, listen.TrackTitle).Count(&count).Error; err != nil {
+				return fmt.Errorf("find listen: %w", err)
+			}
+			if count > 0 {
+				continue
+			}
+			if l.Track != nil {
+				id, err := r.track(l.Track)
+				if err != nil {
+					return fmt.Errorf("listen: %w", err)
+				}
+				if id != 0 {
+					listen.TrackID = &id
+				}
+			}
+			if err := tx.Create(&listen).Error; err != nil {
+				return fmt.Errorf("create listen: %w", err)
+			}
+			report.Imported++
+		}
+		for _, b := range data.Bookmarks {
+			id, err := r.item(&b.Item)
+			if err != nil {
+				return fmt.Errorf("bookmark: %w", err)
+			}
+			if id.Value == 0 {
+				report.unmatched("bookmark", &b.Item)
+				continue
+			}
+			var bookmark db.Bookmark
+			if err := tx.Where("user_id=? AND entry_id_type=? AND entry_id=?", user.ID, id.Type, id.Value).First(&bookmark).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("find bookmark: %w", err)
+			}
+			bookmark.UserID = user.ID
+			bookmark.EntryIDType = string(id.Type)
+			bookmark.EntryID = id.Value
+			bookmark.Position = b.Position
+			bookmark.Comment = b.Comment
+			bookmark.CreatedAt = b.CreatedAt
+			if err := tx.Save(&bookmark).Error; err != nil {
+				return fmt.Errorf("save bookmark: %w", err)
+			}
+			report.Imported++
+		}
+		for _, q := range data.PlayQueues {
+			if err := importPlayQueue(tx, r, user, q, report); err != nil {
+				return fmt.Errorf("play queue: %w", err)
+			}
+		}
+		for _, p := range data.TranscodePreferences {
+			if err := tx.Where("user_id=? AND client=?", user.ID, p.Client).Delete(db.TranscodePreference{}).Error; err != nil {
+				return fmt.Errorf("delete transcode preference: %w", err)
+			}
+			if err := tx.Create(&db.TranscodePreference{UserID: user.ID, Client: p.Client, Profile: p.Profile}).Error; err != nil {
+				return fmt.Errorf("create transcode preference: %w", err)
+			}
+			report.Imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func importUser(tx *db.DB, user *db.User, data *User) error {
+	if data.LastFMSession != "" {
+		user.LastFMSession = data.LastFMSession
+	}
+	if data.ListenBrainzURL != "" || data.ListenBrainzToken != "" {
+		user.ListenBrainzURL = data.ListenBrainzURL
+		user.ListenBrainzToken = data.ListenBrainzToken
+	}
+	return tx.Save(user).Error
+}
+
+func importPlayQueue(tx *db.DB, r *resolver, user *db.User, data *PlayQueue, report *Report) error {
+	var items []specid.ID
+	current := -1
+	for i, ref := range data.Items {
+		id, err := r.item(ref)
+		if err != nil {
+			return err
+		}
+		if id.Value == 0 {
+			report.unmatched("play queue item", ref)
+			continue
+		}
+		if i == data.Current {
+			current = len(items)
+		}
+		items = append(items, id)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	position := data.Position
+	if current < 0 {
+		// the current item is gone, start from the top
+		current, position = 0, 0
+	}
+
+	var queue db.PlayQueue
+	if err := tx.Where("user_id=? AND name=?", user.ID, data.Name).First(&queue).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find: %w", err)
+	}
+	queue.UserID = user.ID
+	queue.Name = data.Name
+	queue.SetItems(items)
+	queue.SetCurrentIndex(current)
+	queue.Position = position
+	queue.ChangedBy = data.ChangedBy
+	if err := tx.Save(&queue).Error; err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+	report.Imported++
+	return nil
+}
+
+// resolver finds the IDs of references in the current library. the ID is 0 if nothing matches. references are
+// matched by path or name first, then MusicBrainz ID in case the files have moved
+type resolver struct {
+	tx *db.DB
+}
+
+func (r *resolver) artist(ref *ArtistRef) (int, error) {
+	var artist db.Artist
+	if err := first(r.tx.Where("name=?", ref.Name), &artist); err != nil || artist.ID != 0 || ref.MBID == "" {
+		return artist.ID, err
+	}
+	err := first(r.tx.Joins("JOIN artist_infos ON artist_infos.id=artists.id").Where("artist_infos.music_brainz_id=?", ref.MBID), &artist)
+	return artist.ID, err
+}
+
+func (r *resolver) album(ref *AlbumRef) (int, error) {
+	left, right := splitAlbumPath(ref.Path)
+	var matches []*pathMatch
+	q := r.tx.
+		Table("albums").
+		Select("id, root_dir").
+		Where("left_path=? AND right_path=?", left, right)
+	if err := q.Scan(&matches).Error; err != nil {
+		return 0, err
+	}
+	if id := pickMatch(matches, ref.MusicFolder); id != 0 || ref.MBID == "" {
+		return id, nil
+	}
+	var album db.Album
+	err := first(r.tx.Where("tag_brainz_id=?", ref.MBID), &album)
+	return album.ID, err
+}
+
+func (r *resolver) track(ref *TrackRef) (int, error) {
+	albumPath, filename := path.Split(ref.Path)
+	left, right := splitAlbumPath(strings.TrimSuffix(albumPath, "/"))
+	var matches []*pathMatch
+	q := r.tx.
+		Table("tracks").
+		Select("tracks.id, albums.root_dir").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.left_path=? AND albums.right_path=? AND tracks.filename=?", left, right, filename)
+	if err := q.Scan(&matches).Error; err != nil {
+		return 0, err
+	}
+	if id := pickMatch(matches, ref.MusicFolder); id != 0 || ref.MBID == "" {
+		return id, nil
+	}
+	var track db.Track
+	err := first(r.tx.Where("tag_brainz_id=?", ref.MBID), &track)
+	return track.ID, err
+}
+
+func (r *resolver) episode(ref *EpisodeRef) (int, error) {
+	var episode db.PodcastEpisode
+	q := r.tx.
+		Joins("JOIN podcasts ON podcasts.id=podcast_episodes.podcast_id").
+		Where("podcasts.url=? AND podcast_episodes.audio_url=?", ref.PodcastURL, ref.AudioURL)
+	err := first(q, &episode)
+	return episode.ID, err
+}
+
+func (r *resolver) item(ref *ItemRef) (specid.ID, error) {
+	switch {
+	case ref.Track != nil:
+		id, err := r.track(ref.Track)
+		return specid.ID{Type: specid.Track, Value: id}, err
+	case ref.Episode != nil:
+		id, err := r.episode(ref.Episode)
+		return specid.ID{Type: specid.PodcastEpisode, Value: id}, err
+	default:
+		return specid.ID{}, nil
+	}
+}
+
+// pathMatch is an album or track with the path a reference is looking for, and the music path it's in
+type pathMatch struct {
+	ID      int
+	RootDir string
+}
+
+// pickMatch chooses between albums or tracks with the same relative path, which can happen with more than one music
+// path. the one in the reference's music folder wins. otherwise it's only a match if there's no other candidate, say
+// if the music path has moved
+func pickMatch(matches []*pathMatch, musicFolder string) int {
+	for _, m := range matches {
+		if musicFolder != "" && m.RootDir == musicFolder {
+			return m.ID
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0].ID
+	}
+	return 0
+}
+
+// first is like gorm's First, but not finding anything isn't an error
+func first(q *gorm.DB, dest any) error {
+	if err := q.First(dest).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return nil
+}
+
+// splitAlbumPath splits the relative path of an album into its left and right paths, like the scanner does.
+// see albumPath
+func splitAlbumPath(p string) (left, right string) {
+	return path.Split(p)
+}
@@ -0,0 +1,177 @@
+// Package userdata exports and imports everything gonic stores for a user, other than their account,
+// so that it can be moved to another instance or survive a rebuilt database.
+//
+// library items are not referred to by database IDs, which change after a rescan. instead tracks and
+// albums are referred to by their path relative to the music path, the music path itself, and their
+// MusicBrainz ID, artists by name and MusicBrainz ID, and podcast episodes by their feed and audio URLs
+package userdata
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version is the version of the export format
+const Version = 1
+
+var ErrUnsupportedVersion = errors.New("unsupported export version")
+
+type Data struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+	User       User      `json:"user"`
+
+	ArtistStars   []*ArtistStar   `json:"artistStars,omitempty"`
+	ArtistRatings []*ArtistRating `json:"artistRatings,omitempty"`
+	AlbumStars    []*AlbumStar    `json:"albumStars,omitempty"`
+	AlbumRatings  []*AlbumRating  `json:"albumRatings,omitempty"`
+	AlbumPlays    []*AlbumPlay    `json:"albumPlays,omitempty"`
+	TrackStars    []*TrackStar    `json:"trackStars,omitempty"`
+	TrackRatings  []*TrackRating  `json:"trackRatings,omitempty"`
+	TrackPlays    []*TrackPlay    `json:"trackPlays,omitempty"`
+	Listens       []*Listen       `json:"listens,omitempty"`
+	Bookmarks     []*Bookmark     `json:"bookmarks,omitempty"`
+	PlayQueues    []*PlayQueue    `json:"playQueues,omitempty"`
+
+	TranscodePreferences []*TranscodePreference `json:"transcodePreferences,omitempty"`
+}
+
+type User struct {
+	Name              string `json:"name"`
+	LastFMSession     string `json:"lastFMSession,omitempty"`
+	ListenBrainzURL   string `json:"listenBrainzURL,omitempty"`
+	ListenBrainzToken string `json:"listenBrainzToken,omitempty"`
+}
+
+type ArtistRef struct {
+	Name string `json:"name"`
+	MBID string `json:"mbid,omitempty"`
+}
+
+func (r *ArtistRef) String() string { return refString(r.Name, r.MBID) }
+
+type AlbumRef struct {
+	Path        string `json:"path"`
+	MusicFolder string `json:"musicFolder,omitempty"` // the music path Path is relative to, in case the same path is in more than one
+	MBID        string `json:"mbid,omitempty"`
+}
+
+func (r *AlbumRef) String() string { return refString(r.Path, r.MBID) }
+
+type TrackRef struct {
+	Path        string `json:"path"`
+	MusicFolder string `json:"musicFolder,omitempty"` // the music path Path is relative to, in case the same path is in more than one
+	MBID        string `json:"mbid,omitempty"`
+}
+
+func (r *TrackRef) String() string { return refString(r.Path, r.MBID) }
+
+type EpisodeRef struct {
+	PodcastURL string `json:"podcastURL"`
+	AudioURL   string `json:"audioURL"`
+}
+
+func (r *EpisodeRef) String() string { return fmt.Sprintf("%s (%s)", r.AudioURL, r.PodcastURL) }
+
+// ItemRef refers to something that can be played, either a track or a podcast episode
+type ItemRef struct {
+	Track   *TrackRef   `json:"track,omitempty"`
+	Episode *EpisodeRef `json:"episode,omitempty"`
+}
+
+func (r *ItemRef) String() string {
+	switch {
+	case r.Track != nil:
+		return r.Track.String()
+	case r.Episode != nil:
+		return r.Episode.String()
+	default:
+		return "unknown item"
+	}
+}
+
+type ArtistStar struct {
+	Artist   ArtistRef `json:"artist"`
+	StarDate time.Time `json:"starDate"`
+}
+
+type ArtistRating struct {
+	Artist ArtistRef `json:"artist"`
+	Rating int       `json:"rating"`
+}
+
+type AlbumStar struct {
+	Album    AlbumRef  `json:"album"`
+	StarDate time.Time `json:"starDate"`
+}
+
+type AlbumRating struct {
+	Album  AlbumRef `json:"album"`
+	Rating int      `json:"rating"`
+}
+
+type AlbumPlay struct {
+	Album  AlbumRef  `json:"album"`
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+	Length int       `json:"length"`
+}
+
+type TrackStar struct {
+	Track    TrackRef  `json:"track"`
+	StarDate time.Time `json:"starDate"`
+}
+
+type TrackRating struct {
+	Track  TrackRef `json:"track"`
+	Rating int      `json:"rating"`
+}
+
+type TrackPlay struct {
+	Track TrackRef  `json:"track"`
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+// Listen keeps the track's details even if the track can't be found, like db.Listen
+type Listen struct {
+	Track      *TrackRef `json:"track,omitempty"`
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client,omitempty"`
+	Submission bool      `json:"submission"`
+	Skipped    bool      `json:"skipped,omitempty"`
+	TrackTitle string    `json:"trackTitle"`
+	ArtistName string    `json:"artistName"`
+	AlbumTitle string    `json:"albumTitle"`
+	Length     int       `json:"length"`
+}
+
+type Bookmark struct {
+	Item      ItemRef   `json:"item"`
+	Position  int       `json:"position"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type PlayQueue struct {
+	Name      string     `json:"name"`
+	Items     []*ItemRef `json:"items"`
+	Current   int        `json:"current"` // index in Items
+	Position  int        `json:"position"`
+	ChangedBy string     `json:"changedBy,omitempty"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+type TranscodePreference struct {
+	Client  string `json:"client"`
+	Profile string `json:"profile"`
+}
+
+func refString(name, mbid string) string {
+	if mbid == "" {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, mbid)
+}
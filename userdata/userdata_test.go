@@ -0,0 +1,233 @@
+package userdata_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.senan.xyz/wrtag/tags/normtag"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/userdata"
+)
+
+func TestExportImport(t *testing.T) {
+	t.Parallel()
+
+	setMBID := func(info *mockfs.TagInfo) {
+		normtag.Set(info.Tags, normtag.MusicBrainzRecordingID, "mbid-track")
+	}
+
+	src := mockfs.New(t)
+	src.AddItems()
+	src.SetTags("artist-0/album-0/track-0.flac", setMBID)
+	src.ScanAndClean()
+
+	srcUser := createUser(t, src.DB())
+	srcUser.ListenBrainzURL = "https://lb.example.com"
+	srcUser.ListenBrainzToken = "token"
+	require.NoError(t, src.DB().Save(srcUser).Error)
+
+	movedTrack := findTrack(t, src.DB(), "artist-0/", "album-0", "track-0.flac")
+	goneTrack := findTrack(t, src.DB(), "artist-2/", "album-0", "track-0.flac")
+	playedTrack := findTrack(t, src.DB(), "artist-0/", "album-1", "track-1.flac")
+	var artist db.Artist
+	require.NoError(t, src.DB().Where("name=?", "artist-1").First(&artist).Error)
+
+	starDate := time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+	listenTime := time.Date(2025, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for _, row := range []any{
+		&db.ArtistStar{UserID: srcUser.ID, ArtistID: artist.ID, StarDate: starDate},
+		&db.AlbumRating{UserID: srcUser.ID, AlbumID: playedTrack.AlbumID, Rating: 4},
+		&db.TrackStar{UserID: srcUser.ID, TrackID: movedTrack.ID, StarDate: starDate},
+		&db.TrackStar{UserID: srcUser.ID, TrackID: goneTrack.ID, StarDate: starDate},
+		&db.TrackPlay{UserID: srcUser.ID, TrackID: playedTrack.ID, Count: 3, Time: listenTime},
+		&db.Listen{UserID: srcUser.ID, TrackID: &playedTrack.ID, Time: listenTime, Submission: true, TrackTitle: "title-1", Length: 100},
+		&db.Listen{UserID: srcUser.ID, TrackID: &goneTrack.ID, Time: listenTime.Add(time.Hour), Submission: true, TrackTitle: "title-0", Length: 100},
+		&db.Bookmark{UserID: srcUser.ID, EntryIDType: string(specid.Track), EntryID: movedTrack.ID, Position: 42},
+		&db.TranscodePreference{UserID: srcUser.ID, Client: "DSub", Profile: "opus"},
+	} {
+		require.NoError(t, src.DB().Create(row).Error)
+	}
+	queue := db.PlayQueue{UserID: srcUser.ID, Name: "phone", Position: 10}
+	queue.SetItems([]specid.ID{*goneTrack.SID(), *movedTrack.SID(), *playedTrack.SID()})
+	require.True(t, queue.SetCurrentIndex(2))
+	require.NoError(t, src.DB().Create(&queue).Error)
+
+	exported, err := userdata.Export(src.DB(), srcUser)
+	require.NoError(t, err)
+	exportedJSON, err := json.Marshal(exported)
+	require.NoError(t, err)
+
+	// a new library, where one track has moved and one artist is gone
+	dst := mockfs.New(t)
+	dst.AddItems()
+	dst.RemoveAll("artist-2")
+	dst.Move("artist-0/album-0/track-0.flac", "artist-0/album-0/track-0-moved.flac")
+	dst.SetTags("artist-0/album-0/track-0-moved.flac", setMBID)
+	dst.ScanAndClean()
+
+	dstUser := createUser(t, dst.DB())
+
+	var data userdata.Data
+	require.NoError(t, json.Unmarshal(exportedJSON, &data))
+	report, err := userdata.Import(dst.DB(), dstUser, &data)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"track star: artist-2/album-0/track-0.flac",
+		"play queue item: artist-2/album-0/track-0.flac",
+	}, report.Unmatched)
+	require.Equal(t, 9, report.Imported)
+
+	movedTrack = findTrack(t, dst.DB(), "artist-0/", "album-0", "track-0-moved.flac")
+	playedTrack = findTrack(t, dst.DB(), "artist-0/", "album-1", "track-1.flac")
+	require.NoError(t, dst.DB().Where("name=?", "artist-1").First(&artist).Error)
+
+	user := dst.DB().GetUserByID(dstUser.ID)
+	require.Equal(t, "https://lb.example.com", user.ListenBrainzURL)
+	require.Equal(t, "token", user.ListenBrainzToken)
+
+	var artistStar db.ArtistStar
+	require.NoError(t, dst.DB().Where("user_id=? AND artist_id=?", user.ID, artist.ID).First(&artistStar).Error)
+	require.True(t, starDate.Equal(artistStar.StarDate))
+
+	var albumRating db.AlbumRating
+	require.NoError(t, dst.DB().Where("user_id=? AND album_id=?", user.ID, playedTrack.AlbumID).First(&albumRating).Error)
+	require.Equal(t, 4, albumRating.Rating)
+
+	var album db.Album
+	require.NoError(t, dst.DB().Where("id=?", playedTrack.AlbumID).First(&album).Error)
+	require.Equal(t, 4.0, album.AverageRating)
+
+	var trackStars []*db.TrackStar
+	require.NoError(t, dst.DB().Where("user_id=?", user.ID).Find(&trackStars).Error)
+	require.Len(t, trackStars, 1)
+	require.Equal(t, movedTrack.ID, trackStars[0].TrackID)
+
+	var trackPlay db.TrackPlay
+	require.NoError(t, dst.DB().Where("user_id=? AND track_id=?", user.ID, playedTrack.ID).First(&trackPlay).Error)
+	require.Equal(t, 3, trackPlay.Count)
+
+	var listens []*db.Listen
+	require.NoError(t, dst.DB().Where("user_id=?", user.ID).Order("time").Find(&listens).Error)
+	require.Len(t, listens, 2)
+	require.Equal(t, playedTrack.ID, *listens[0].TrackID)
+	require.Nil(t, listens[1].TrackID)
+	require.Equal(t, "title-0", listens[1].TrackTitle)
+
+	var bookmark db.Bookmark
+	require.NoError(t, dst.DB().Where("user_id=?", user.ID).First(&bookmark).Error)
+	require.Equal(t, movedTrack.ID, bookmark.EntryID)
+	require.Equal(t, 42, bookmark.Position)
+
+	var dstQueue db.PlayQueue
+	require.NoError(t, dst.DB().Where("user_id=? AND name=?", user.ID, "phone").First(&dstQueue).Error)
+	require.Equal(t, []specid.ID{*movedTrack.SID(), *playedTrack.SID()}, dstQueue.GetItems())
+	require.Equal(t, playedTrack.SID().String(), dstQueue.Current)
+	require.Equal(t, 1, dstQueue.CurrentIndex)
+	require.Equal(t, 10, dstQueue.Position)
+
+	var pref db.TranscodePreference
+	require.NoError(t, dst.DB().Where("user_id=?", user.ID).First(&pref).Error)
+	require.Equal(t, "opus", pref.Profile)
+
+	// importing again doesn't duplicate anything
+	report, err = userdata.Import(dst.DB(), dstUser, &data)
+	require.NoError(t, err)
+	require.Equal(t, 7, report.Imported)
+
+	var count int
+	require.NoError(t, dst.DB().Model(db.Listen{}).Where("user_id=?", user.ID).Count(&count).Error)
+	require.Equal(t, 2, count)
+	require.NoError(t, dst.DB().Model(db.Bookmark{}).Where("user_id=?", user.ID).Count(&count).Error)
+	require.Equal(t, 1, count)
+}
+
+func TestImportMusicFolders(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.NewWithDirs(t, []string{"m-0", "m-1"})
+	m.AddItemsPrefix("m-0")
+	m.AddItemsPrefix("m-1")
+	m.ScanAndClean()
+
+	// the same relative paths are in both music folders
+	var tracks []*db.Track
+	err := m.DB().
+		Preload("Album").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.left_path=? AND albums.right_path=? AND tracks.filename=?", "artist-0/", "album-0", "track-0.flac").
+		Order("albums.root_dir").
+		Find(&tracks).
+		Error
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	track := tracks[1]
+	require.Equal(t, filepath.Join(m.TmpDir(), "m-1"), track.Album.RootDir)
+
+	srcUser := createUser(t, m.DB())
+	require.NoError(t, m.DB().Create(&db.TrackStar{UserID: srcUser.ID, TrackID: track.ID}).Error)
+	require.NoError(t, m.DB().Create(&db.AlbumRating{UserID: srcUser.ID, AlbumID: track.AlbumID, Rating: 5}).Error)
+
+	data, err := userdata.Export(m.DB(), srcUser)
+	require.NoError(t, err)
+	require.Equal(t, track.Album.RootDir, data.TrackStars[0].Track.MusicFolder)
+
+	dstUser := db.User{Name: "other", Password: "password"}
+	require.NoError(t, m.DB().Create(&dstUser).Error)
+	report, err := userdata.Import(m.DB(), &dstUser, data)
+	require.NoError(t, err)
+	require.Empty(t, report.Unmatched)
+
+	var trackStar db.TrackStar
+	require.NoError(t, m.DB().Where("user_id=?", dstUser.ID).First(&trackStar).Error)
+	require.Equal(t, track.ID, trackStar.TrackID)
+	var albumRating db.AlbumRating
+	require.NoError(t, m.DB().Where("user_id=?", dstUser.ID).First(&albumRating).Error)
+	require.Equal(t, track.AlbumID, albumRating.AlbumID)
+
+	// without a music folder which matches, there's no telling which one was meant
+	data.TrackStars[0].Track.MusicFolder = ""
+	data.AlbumRatings[0].Album.MusicFolder = "/elsewhere"
+	report, err = userdata.Import(m.DB(), &dstUser, data)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"album rating: artist-0/album-0",
+		"track star: artist-0/album-0/track-0.flac",
+	}, report.Unmatched)
+}
+
+func TestImportUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+
+	m := mockfs.New(t)
+	user := createUser(t, m.DB())
+
+	_, err := userdata.Import(m.DB(), user, &userdata.Data{Version: userdata.Version + 1})
+	require.ErrorIs(t, err, userdata.ErrUnsupportedVersion)
+}
+
+func createUser(t *testing.T, dbc *db.DB) *db.User {
+	t.Helper()
+
+	user := db.User{Name: "listener", Password: "password"}
+	require.NoError(t, dbc.Create(&user).Error)
+	return &user
+}
+
+func findTrack(t *testing.T, dbc *db.DB, leftPath, rightPath, filename string) *db.Track {
+	t.Helper()
+
+	var track db.Track
+	err := dbc.
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.left_path=? AND albums.right_path=? AND tracks.filename=?", leftPath, rightPath, filename).
+		First(&track).
+		Error
+	require.NoError(t, err)
+	return &track
+}